@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bodgit/sevenzip"
+)
+
+// archiveEntry is a DAT file inside an archive.
+type archiveEntry struct {
+	archive string
+	// name is the slash separated path of the file inside the archive.
+	name string
+	size int64
+}
+
+// archiveKind returns the format of an archive by its extension, or an empty
+// string for other files.
+func archiveKind(fileName string) string {
+	name := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".7z"):
+		return "7z"
+	}
+	return ""
+}
+
+func isDatFile(name string) bool {
+	return strings.HasSuffix(name, " (Float).DAT") || strings.HasSuffix(name, " (Tagname).DAT")
+}
+
+// validEntryName rejects names that would be staged outside the archive's
+// staging folder.
+func validEntryName(name string) bool {
+	clean := path.Clean(name)
+	return clean != "." && !path.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../") && !strings.Contains(name, "\\")
+}
+
+// archiveEntryName returns the slash separated name of an archive entry,
+// archives written on Windows may separate folders with backslashes. ok is
+// false for names that would be staged outside the archive's staging folder.
+func archiveEntryName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return path.Clean(name), validEntryName(name) && !strings.Contains(name, ":")
+}
+
+// listArchive returns the DAT files in an archive.
+func listArchive(archive string) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	add := func(name string, size int64) {
+		if !isDatFile(name) {
+			return
+		}
+		clean, ok := archiveEntryName(name)
+		if !ok {
+			slog.Warn(fmt.Sprintf("Skipping %s in %s, its path leads out of the archive", name, archive))
+			return
+		}
+		entries = append(entries, archiveEntry{archive: archive, name: clean, size: size})
+	}
+
+	switch archiveKind(archive) {
+	case "zip":
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if !f.FileInfo().IsDir() {
+				add(f.Name, int64(f.UncompressedSize64))
+			}
+		}
+	case "7z":
+		r, err := sevenzip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if !f.FileInfo().IsDir() {
+				add(f.Name, int64(f.UncompressedSize))
+			}
+		}
+	case "tar.gz":
+		err := readTarGz(archive, func(header *tar.Header, _ io.Reader) error {
+			add(header.Name, header.Size)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a supported archive", archive)
+	}
+	return entries, nil
+}
+
+// readTarGz calls fn with every regular file of a tar.gz archive.
+func readTarGz(archive string, fn func(header *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", archive, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", archive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveStaging extracts DAT files from archives the first time they are
+// read, LibDAT only reads files from disk. The files are found by their
+// virtual path, the archive path joined with the name inside the archive.
+// Past the limit the files read longest ago are removed, they are extracted
+// again when they are read again.
+type archiveStaging struct {
+	mu      sync.Mutex
+	dir     string
+	limit   int64
+	entries map[string]archiveEntry
+	staged  map[string]string
+	// archives serialises the extraction of each archive.
+	archives map[string]*sync.Mutex
+	// used holds the staged files by virtual path, read longest ago first.
+	used  []string
+	sizes map[string]int64
+	total int64
+	// folders are the archive folders extracted to by this run.
+	folders map[string]bool
+}
+
+// staging holds the archive entries found by the last discovery.
+var staging = newArchiveStaging()
+
+func newArchiveStaging() *archiveStaging {
+	return &archiveStaging{
+		entries:  make(map[string]archiveEntry),
+		staged:   make(map[string]string),
+		archives: make(map[string]*sync.Mutex),
+		sizes:    make(map[string]int64),
+		folders:  make(map[string]bool),
+	}
+}
+
+func defaultStagingDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "goDataLogConvertTUI", "staging")
+}
+
+// register adds the entries of an archive under their virtual paths, limit
+// is the number of bytes kept staged, 0 for no limit.
+func (s *archiveStaging) register(dir string, limit int64, entries []archiveEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dir = dir
+	s.limit = limit
+	for _, entry := range entries {
+		s.entries[virtualPath(entry)] = entry
+	}
+}
+
+func virtualPath(entry archiveEntry) string {
+	return filepath.Join(entry.archive, filepath.FromSlash(entry.name))
+}
+
+// stagedPath returns the path a DAT file is read from. Files inside an
+// archive are extracted to the staging folder first, together with the tag
+// file of a float file. Float files read with the tag file of another day
+// are paired with it in the staging folder, as pairing has them. Other files
+// are read where they are.
+func stagedPath(pairing *datPairing, fileName string) (string, error) {
+	staged, err := staging.stage(fileName)
+	if err != nil {
+		return "", err
+	}
+	if tag, ok := pairing.Fallback(fileName); ok {
+		return pairing.stage(fileName, staged, tag)
+	}
+	return staged, nil
+}
+
+func (s *archiveStaging) stage(fileName string) (string, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[fileName]
+	if !ok {
+		s.mu.Unlock()
+		return fileName, nil
+	}
+	if staged, ok := s.staged[fileName]; ok {
+		s.touch(fileName)
+		s.mu.Unlock()
+		return staged, nil
+	}
+	lock, ok := s.archives[entry.archive]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.archives[entry.archive] = lock
+	}
+	dir := s.dir
+	room := int64(0)
+	if s.limit > 0 {
+		room = max(s.limit-s.total, 1)
+	}
+	s.mu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+	// Another read may have extracted it while waiting for the archive.
+	s.mu.Lock()
+	staged, ok := s.staged[fileName]
+	s.mu.Unlock()
+	if ok {
+		return staged, nil
+	}
+
+	archiveDir, err := stagingFolder(dir, entry.archive)
+	if err != nil {
+		return "", err
+	}
+	names := map[string]bool{entry.name: true}
+	if strings.HasSuffix(entry.name, " (Float).DAT") {
+		names[strings.TrimSuffix(entry.name, " (Float).DAT")+" (Tagname).DAT"] = true
+	}
+	extracted, err := extractArchive(entry.archive, archiveDir, names, room)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract %s from %s: %v", entry.name, entry.archive, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.folders[archiveDir] = true
+	keep := make(map[string]bool)
+	for name, target := range extracted {
+		virtual := filepath.Join(entry.archive, filepath.FromSlash(name))
+		if names[name] {
+			keep[virtual] = true
+		}
+		if _, ok := s.staged[virtual]; ok {
+			continue
+		}
+		s.staged[virtual] = target
+		if info, err := os.Stat(target); err == nil {
+			s.sizes[virtual] = info.Size()
+			s.total += info.Size()
+		}
+		s.used = append(s.used, virtual)
+	}
+	// The files asked for are the ones read last.
+	for virtual := range keep {
+		s.touch(virtual)
+	}
+	s.evict(keep)
+	staged, ok = s.staged[fileName]
+	if !ok {
+		return "", fmt.Errorf("%s not found in %s", entry.name, entry.archive)
+	}
+	return staged, nil
+}
+
+// touch moves a staged file to the end of the used list.
+func (s *archiveStaging) touch(virtual string) {
+	for i, used := range s.used {
+		if used == virtual {
+			s.used = append(append(s.used[:i:i], s.used[i+1:]...), virtual)
+			return
+		}
+	}
+}
+
+// evict removes the files read longest ago until the staged files fit the
+// limit, except the files in keep. A file that cannot be removed, such as
+// one still open on Windows, stays staged.
+func (s *archiveStaging) evict(keep map[string]bool) {
+	if s.limit <= 0 {
+		return
+	}
+	used := s.used[:0:0]
+	for _, virtual := range s.used {
+		if s.total <= s.limit || keep[virtual] {
+			used = append(used, virtual)
+			continue
+		}
+		if err := os.Remove(s.staged[virtual]); err != nil && !os.IsNotExist(err) {
+			used = append(used, virtual)
+			continue
+		}
+		s.total -= s.sizes[virtual]
+		delete(s.sizes, virtual)
+		delete(s.staged, virtual)
+	}
+	s.used = used
+}
+
+// cleanup removes the archive folders extracted to by this run.
+func (s *archiveStaging) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for folder := range s.folders {
+		if err := os.RemoveAll(folder); err != nil {
+			slog.Warn(fmt.Sprintf("Removing staged files in %s failed: %v", folder, err))
+		}
+	}
+	s.folders = make(map[string]bool)
+	s.staged = make(map[string]string)
+	s.sizes = make(map[string]int64)
+	s.used = nil
+	s.total = 0
+}
+
+// stagingFolder returns the folder the files of an archive are extracted to.
+// It changes with the archive's size and time so a replaced archive is
+// extracted again.
+func stagingFolder(dir, archive string) (string, error) {
+	info, err := os.Stat(archive)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(archive)
+	if err != nil {
+		abs = archive
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d", abs, info.Size(), info.ModTime().UnixNano())))
+	return filepath.Join(dir, fmt.Sprintf("%s-%s", filepath.Base(archive), hex.EncodeToString(sum[:6]))), nil
+}
+
+// extractArchive writes the named files of an archive to dir and returns
+// their paths by name. A tar.gz archive can only be read front to back, so
+// its other DAT files are extracted in the same pass while they fit in room
+// bytes, 0 for no limit.
+func extractArchive(archive, dir string, names map[string]bool, room int64) (map[string]string, error) {
+	extracted := make(map[string]string)
+	extract := func(name string, size int64, open func() (io.ReadCloser, error)) error {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if info, err := os.Stat(target); err == nil && info.Size() == size {
+			extracted[name] = target
+			return nil
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if err := writeStagedFile(target, r); err != nil {
+			return err
+		}
+		extracted[name] = target
+		return nil
+	}
+
+	switch archiveKind(archive) {
+	case "zip":
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			name, ok := archiveEntryName(f.Name)
+			if ok && names[name] {
+				if err := extract(name, int64(f.UncompressedSize64), f.Open); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case "7z":
+		r, err := sevenzip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			name, ok := archiveEntryName(f.Name)
+			if ok && names[name] {
+				if err := extract(name, int64(f.UncompressedSize), f.Open); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case "tar.gz":
+		err := readTarGz(archive, func(header *tar.Header, r io.Reader) error {
+			name, ok := archiveEntryName(header.Name)
+			if !isDatFile(header.Name) || !ok {
+				return nil
+			}
+			if !names[name] && room > 0 {
+				if header.Size >= room {
+					return nil
+				}
+				room -= header.Size
+			}
+			return extract(name, header.Size, func() (io.ReadCloser, error) {
+				return io.NopCloser(r), nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a supported archive", archive)
+	}
+	return extracted, nil
+}
+
+// writeStagedFile copies r to target through a temporary file, so an
+// interrupted extraction is not mistaken for a staged file.
+func writeStagedFile(target string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".staging-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
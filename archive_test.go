@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeArchive packs the files of dir into a zip or tar.gz archive under
+// folder, joined with sep as archivers on Windows may do.
+func writeArchive(t *testing.T, dir, archive, folder, sep string, extra ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	names := extra
+	contents := make(map[string][]byte)
+	for _, entry := range entries {
+		name := folder + sep + entry.Name()
+		if contents[name], err = os.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	if archiveKind(archive) == "zip" {
+		zw := zip.NewWriter(file)
+		for _, name := range names {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(contents[name])
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(contents[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListArchiveBackslashNames(t *testing.T) {
+	dir := genSet(t, "-tags", "5", "-rate", "1h", "-duration", "24h")
+	for _, kind := range []string{"zip", "tar.gz"} {
+		t.Run(kind, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "pc1."+kind)
+			writeArchive(t, dir, archive, `line1\2024`, `\`, `..\evil (Float).DAT`, `C:\evil (Float).DAT`)
+			entries, err := listArchive(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("%d entries listed, the float and tag file expected: %v", len(entries), entries)
+			}
+			for _, entry := range entries {
+				if !strings.HasPrefix(entry.name, "line1/2024/2024 01 01 0000 (") {
+					t.Errorf("entry %s is not slash separated", entry.name)
+				}
+			}
+
+			s := newArchiveStaging()
+			s.register(t.TempDir(), 0, entries)
+			staged, err := s.stage(virtualPath(entries[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, records := readDatSet(t, staged); len(records) != 5*24 {
+				t.Errorf("%d records read from the staged file", len(records))
+			}
+		})
+	}
+}
+
+func TestArchiveStagingLimit(t *testing.T) {
+	dir := genSet(t, "-tags", "10", "-rate", "1h", "-duration", "72h")
+	for _, kind := range []string{"zip", "tar.gz"} {
+		t.Run(kind, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "pc1."+kind)
+			writeArchive(t, dir, archive, "line1", "/")
+			entries, err := listArchive(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var floats []string
+			setSize := int64(0)
+			for _, entry := range entries {
+				if strings.HasSuffix(entry.name, " (Float).DAT") {
+					floats = append(floats, virtualPath(entry))
+				}
+				if strings.HasPrefix(entry.name, "line1/2024 01 01") {
+					setSize += entry.size
+				}
+			}
+
+			// One and a half sets fit.
+			s := newArchiveStaging()
+			s.register(t.TempDir(), setSize*3/2, entries)
+			var paths []string
+			for _, floatFileName := range floats {
+				staged, err := s.stage(floatFileName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, staged)
+				if s.total > setSize*3/2 {
+					t.Errorf("%d bytes staged after %s, the limit is %d", s.total, filepath.Base(floatFileName), setSize*3/2)
+				}
+			}
+			if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+				t.Errorf("the set read first is still staged")
+			}
+			if _, _, records := readDatSet(t, paths[2]); len(records) != 240 {
+				t.Errorf("%d records read from the set read last", len(records))
+			}
+
+			// A removed file is extracted again.
+			staged, err := s.stage(floats[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, records := readDatSet(t, staged); len(records) != 240 {
+				t.Errorf("%d records read from the set extracted again", len(records))
+			}
+
+			s.cleanup()
+			if _, err := os.Stat(filepath.Dir(staged)); !os.IsNotExist(err) {
+				t.Errorf("the staging folder of the archive is left after cleanup")
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// avroRecordSchema is the Avro schema of the records produced by the kafka
+// sink with -kafkaEncoding avro. Timestamps are microseconds since the epoch,
+// values that are not finite are null as in the JSON payload.
+const avroRecordSchema = `{
+  "type": "record",
+  "name": "DatalogRecord",
+  "namespace": "goDataLogConvertTUI",
+  "fields": [
+    {"name": "tag", "type": "string"},
+    {"name": "datalogTag", "type": "string"},
+    {"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+    {"name": "value", "type": ["null", "double"]},
+    {"name": "status", "type": "string"}
+  ]
+}`
+
+// encodeAvroRecord encodes a record with the Avro binary encoding of
+// avroRecordSchema. When schemaID is positive the payload is prefixed with the
+// Confluent schema registry wire format header.
+func encodeAvroRecord(rec jsonRecord, timestampMicros int64, schemaID int) []byte {
+	var b []byte
+	if schemaID > 0 {
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint32(b, uint32(schemaID))
+	}
+	b = appendAvroString(b, rec.Tag)
+	b = appendAvroString(b, rec.DatalogTag)
+	b = appendAvroLong(b, timestampMicros)
+	// A union is written as the index of its branch and the value.
+	if rec.Value == nil {
+		b = appendAvroLong(b, 0)
+	} else {
+		b = appendAvroLong(b, 1)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(*rec.Value))
+	}
+	b = appendAvroString(b, rec.Status)
+	return b
+}
+
+func appendAvroLong(b []byte, v int64) []byte {
+	// Avro longs are zig-zag encoded variable length integers.
+	return binary.AppendUvarint(b, uint64((v<<1)^(v>>63)))
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = appendAvroLong(b, int64(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestAppendAvroLong(t *testing.T) {
+	// Zig-zag encoding maps 0, -1, 1, -2, 2 ... to 0, 1, 2, 3, 4 ... before
+	// they are written seven bits at a time.
+	tests := []struct {
+		value int64
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{-1, []byte{0x01}},
+		{1, []byte{0x02}},
+		{-64, []byte{0x7f}},
+		{64, []byte{0x80, 0x01}},
+		{1704067200000000, []byte{0x80, 0x80, 0x89, 0x82, 0xe2, 0xf5, 0x86, 0x06}},
+		{math.MinInt64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+	for _, test := range tests {
+		if got := appendAvroLong(nil, test.value); !bytes.Equal(got, test.want) {
+			t.Errorf("%d is encoded as % x, % x expected", test.value, got, test.want)
+		}
+	}
+}
+
+func TestEncodeAvroRecord(t *testing.T) {
+	value := 1.5
+	rec := jsonRecord{Tag: "T1", DatalogTag: "a", Value: &value, Status: "U"}
+	body := []byte{
+		0x04, 'T', '1', // tag
+		0x02, 'a', // datalogTag
+		0x06,                               // timestamp 3
+		0x02, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, // value, the double branch
+		0x02, 'U', // status
+	}
+	if got := encodeAvroRecord(rec, 3, 0); !bytes.Equal(got, body) {
+		t.Errorf("plain avro is % x, % x expected", got, body)
+	}
+
+	// The schema registry header is the magic byte and the big endian id.
+	header := []byte{0x00, 0x00, 0x01, 0x02, 0x03}
+	if got := encodeAvroRecord(rec, 3, 0x010203); !bytes.Equal(got, append(header, body...)) {
+		t.Errorf("avro with a schema id is % x", got)
+	}
+
+	rec.Value = nil
+	rec.Status = ""
+	null := []byte{0x04, 'T', '1', 0x02, 'a', 0x06, 0x00, 0x00}
+	if got := encodeAvroRecord(rec, 3, 0); !bytes.Equal(got, null) {
+		t.Errorf("a null value is % x, % x expected", got, null)
+	}
+}
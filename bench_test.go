@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+// benchSet is a day of 100 tags logged every 10 seconds, 864,000 points.
+var benchSet = []string{"-tags", "100", "-rate", "10s", "-duration", "24h", "-status", "0"}
+
+// benchRecords reads the float records of a generated day and resolves its
+// tags through sink.
+func benchRecords(b *testing.B, sink Sink) ([]*LibDAT.DatFloatRecord, *LibPI.PointLookup) {
+	b.Helper()
+	floatFileName := filepath.Join(genSet(b, benchSet...), "2024 01 01 0000 (Float).DAT")
+	dr := &LibDAT.DatReader{FloatFileNames: []string{floatFileName}}
+	tags, err := dr.ReadTagFile(floatFileName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	points := LibPI.NewPointLookup()
+	for _, tag := range tags {
+		point := sink.ResolvePoint(tag, tag.Name)
+		if !point.Process {
+			b.Skipf("%s cannot be resolved on %s", tag.Name, sink.Target())
+		}
+		points.AddPoint(point)
+	}
+	records, err := dr.ReadFloatFile(floatFileName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return records, points
+}
+
+// BenchmarkReadFloatFile measures reading a float file as the load step does.
+func BenchmarkReadFloatFile(b *testing.B) {
+	floatFileName := filepath.Join(genSet(b, benchSet...), "2024 01 01 0000 (Float).DAT")
+	report := checkDatFile(nil, floatFileName)
+	dr := &LibDAT.DatReader{FloatFileNames: []string{floatFileName}}
+	b.ResetTimer()
+	points := 0
+	for i := 0; i < b.N; i++ {
+		records, err := readFloatFileRecords(dr, floatFileName, report)
+		if err != nil {
+			b.Fatal(err)
+		}
+		points += len(records)
+	}
+	b.ReportMetric(float64(points)/b.Elapsed().Seconds(), "points/s")
+}
+
+// BenchmarkInsertPIAPI measures inserting a day of records through
+// piapi.dll into the historian on localhost, the path the 250,000 points per
+// second in the README are measured on. The points are created on the
+// historian beforehand, the benchmark is skipped when they do not exist.
+func BenchmarkInsertPIAPI(b *testing.B) {
+	sink := &piapiSink{hostname: "localhost", processName: "dat2fth"}
+	if err := sink.Connect(); err != nil {
+		b.Skipf("no historian on localhost: %v", err)
+	}
+	defer sink.Close()
+	records, points := benchRecords(b, sink)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sink.Insert(records, points); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(records)*b.N)/b.Elapsed().Seconds(), "points/s")
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/filepicker"
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/table"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// datCounts is the number of DAT files in a single folder.
+type datCounts struct {
+	Name   string
+	Floats int
+	Tags   int
+	// Pairs counts the float files with a matching tag file.
+	Pairs int
+}
+
+// countDatFiles counts the float and tag files directly inside dir.
+func countDatFiles(dir string) (datCounts, error) {
+	counts := datCounts{Name: filepath.Base(dir)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return counts, err
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names[entry.Name()] = true
+		}
+	}
+	for name := range names {
+		switch {
+		case strings.HasSuffix(name, " (Float).DAT"):
+			counts.Floats++
+			if names[strings.Replace(name, " (Float)", " (Tagname)", 1)] {
+				counts.Pairs++
+			}
+		case strings.HasSuffix(name, " (Tagname).DAT"):
+			counts.Tags++
+		}
+	}
+	return counts, nil
+}
+
+func (c datCounts) String() string {
+	return fmt.Sprintf("%d pairs (%d float, %d tag)", c.Pairs, c.Floats, c.Tags)
+}
+
+type dirPreviewMsg struct {
+	dir     string
+	current datCounts
+	folders []datCounts
+	err     string
+}
+
+// previewDirectory counts the DAT files in dir and in each folder directly
+// below it.
+func previewDirectory(dir string) tea.Cmd {
+	return func() tea.Msg {
+		msg := dirPreviewMsg{dir: dir}
+		current, err := countDatFiles(dir)
+		if err != nil {
+			msg.err = err.Error()
+			return msg
+		}
+		msg.current = current
+
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			counts, err := countDatFiles(filepath.Join(dir, entry.Name()))
+			if err != nil || counts.Floats+counts.Tags == 0 {
+				continue
+			}
+			msg.folders = append(msg.folders, counts)
+		}
+		sort.Slice(msg.folders, func(i, j int) bool {
+			return msg.folders[i].Name < msg.folders[j].Name
+		})
+		return msg
+	}
+}
+
+// DirBrowserModel picks the folder DAT files are loaded from.
+type DirBrowserModel struct {
+	Active  bool
+	Picker  filepicker.Model
+	Preview dirPreviewMsg
+	Err     string
+	// Loading is the folder chosen while its DAT files are discovered.
+	Loading string
+	// UseCurrent selects the folder being browsed rather than a folder in it.
+	UseCurrent key.Binding
+	Close      key.Binding
+}
+
+func initialDirBrowserModel() DirBrowserModel {
+	picker := filepicker.New()
+	picker.DirAllowed = true
+	picker.FileAllowed = false
+	picker.ShowPermissions = false
+	picker.ShowSize = false
+	picker.AutoHeight = false
+	// esc closes the browser instead of going up a folder.
+	picker.KeyMap.Back = key.NewBinding(key.WithKeys("h", "backspace", "left"), key.WithHelp("h", "back"))
+	return DirBrowserModel{
+		Picker:     picker,
+		UseCurrent: key.NewBinding(key.WithKeys("."), key.WithHelp(".", "use this folder")),
+		Close:      key.NewBinding(key.WithKeys("esc"), key.WithHelp("esc", "close")),
+	}
+}
+
+// Open starts browsing at dir, or at its closest existing parent.
+func (m DirBrowserModel) Open(dir string, height int) (DirBrowserModel, tea.Cmd) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		dir = "."
+	}
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	m.Active = true
+	m.Err = ""
+	m.Loading = ""
+	m.Picker.CurrentDirectory = dir
+	m.Picker.Path = ""
+	m.Picker.Height = max(height-8, 3)
+	return m, tea.Batch(m.Picker.Init(), previewDirectory(dir))
+}
+
+func (m DirBrowserModel) Resize(height int) DirBrowserModel {
+	m.Picker.Height = max(height-8, 3)
+	return m
+}
+
+// Update passes msg to the file picker. chosen is the folder picked by the
+// user, empty until one is.
+func (m DirBrowserModel) Update(msg tea.Msg) (browser DirBrowserModel, cmd tea.Cmd, chosen string) {
+	switch msg := msg.(type) {
+	case dirPreviewMsg:
+		if msg.dir == m.Picker.CurrentDirectory {
+			m.Preview = msg
+		}
+		return m, nil, ""
+	case tea.KeyMsg:
+		switch {
+		case key.Matches(msg, m.Close):
+			m.Active = false
+			return m, nil, ""
+		case key.Matches(msg, m.UseCurrent):
+			return m, nil, m.Picker.CurrentDirectory
+		}
+	}
+
+	dir := m.Picker.CurrentDirectory
+	m.Picker, cmd = m.Picker.Update(msg)
+	if selected, path := m.Picker.DidSelectFile(msg); selected {
+		return m, cmd, path
+	}
+	if m.Picker.CurrentDirectory != dir {
+		m.Err = ""
+		cmd = tea.Batch(cmd, previewDirectory(m.Picker.CurrentDirectory))
+	}
+	return m, cmd, ""
+}
+
+func (m DirBrowserModel) View(width, height int) string {
+	s := lipgloss.NewStyle().Bold(true).Render("Choose the DAT folder") + "\n"
+	s += m.Picker.CurrentDirectory + "\n\n"
+
+	var preview strings.Builder
+	preview.WriteString(lipgloss.NewStyle().Bold(true).Render("This folder") + "\n")
+	if m.Preview.err != "" {
+		preview.WriteString(lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render(m.Preview.err) + "\n")
+	} else {
+		preview.WriteString(m.Preview.current.String() + "\n")
+	}
+	if len(m.Preview.folders) > 0 {
+		preview.WriteString("\n" + lipgloss.NewStyle().Bold(true).Render("Folders with DAT files") + "\n")
+		for i, folder := range m.Preview.folders {
+			if i >= m.Picker.Height-3 {
+				preview.WriteString(fmt.Sprintf("and %d more\n", len(m.Preview.folders)-i))
+				break
+			}
+			preview.WriteString(fmt.Sprintf("%s: %s\n", folder.Name, folder))
+		}
+	}
+
+	pickerWidth := max(width/2, 20)
+	picker := lipgloss.NewStyle().Width(pickerWidth).Height(m.Picker.Height).MaxHeight(m.Picker.Height).Render(m.Picker.View())
+	s += lipgloss.JoinHorizontal(lipgloss.Top, picker, lipgloss.NewStyle().Width(max(width-pickerWidth-2, 10)).Render(preview.String())) + "\n"
+
+	if m.Loading != "" {
+		s += fmt.Sprintf("Reading the DAT files in %s...\n", m.Loading)
+	} else if m.Err != "" {
+		s += lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render(m.Err) + "\n"
+	} else {
+		s += "\n"
+	}
+	s += "[enter] Use folder  [.] Use this folder  [l] Open  [h] Up  [j/k] Move  [esc] Close"
+	return s
+}
+
+// dirDiscoveredMsg gives the DAT files found in a folder chosen in the
+// browser.
+type dirDiscoveredMsg struct {
+	dir     string
+	sources datSources
+	dr      *LibDAT.DatReader
+	pairing *datPairing
+	err     string
+}
+
+// discoverDirectory finds the DAT files of sources in the background, remote
+// and large folders take a while.
+func discoverDirectory(sources datSources, dir string) tea.Cmd {
+	return func() tea.Msg {
+		msg := dirDiscoveredMsg{dir: dir, sources: sources}
+		dr, pairing, err := sources.Discover()
+		if err != nil {
+			msg.err = err.Error()
+			return msg
+		}
+		msg.dr = dr
+		msg.pairing = pairing
+		return msg
+	}
+}
+
+// loadNewDirectory replaces the files table with the DAT files in dir once
+// they are discovered. The watch finds the files itself.
+func (m model) loadNewDirectory(dir string) (model, tea.Cmd) {
+	sources := m.sources.WithPath(dir)
+	if m.watch.Enabled() {
+		return m.useDirectory(dir, sources, &LibDAT.DatReader{}, nil)
+	}
+	m.browser.Err = ""
+	m.browser.Loading = dir
+	return m, discoverDirectory(sources, dir)
+}
+
+func updateWithDirDiscoveredMsg(m model, msg dirDiscoveredMsg) (model, tea.Cmd) {
+	// The browser was closed, or another folder chosen, in the meantime.
+	if !m.browser.Active || msg.dir != m.browser.Loading {
+		return m, nil
+	}
+	m.browser.Loading = ""
+	if msg.err != "" {
+		m.browser.Err = fmt.Sprintf("%s contains no valid DAT files: %s", msg.dir, msg.err)
+		return m, nil
+	}
+	return m.useDirectory(msg.dir, msg.sources, msg.dr, msg.pairing)
+}
+
+// useDirectory replaces the files table with the files of dr.
+func (m model) useDirectory(dir string, sources datSources, dr *LibDAT.DatReader, pairing *datPairing) (model, tea.Cmd) {
+	m.browser.Active = false
+	m.sources = sources
+	m.dr = dr
+	m.pairing = pairing
+	m.generation++
+	m.setRows([]table.Row{})
+	m.datFileRecords = make(map[string]DATRecordStructure)
+	m.processed = false
+	m.processingStatus = nil
+	m.firstDatReturned = false
+	m.recsLoadedCount = 0
+	m.sfmpu = initialScanningPopupModel()
+	m.novfpu.Active = false
+	m.selection.Anchor = ""
+	m.refreshTable()
+	if m.watch.Enabled() {
+		m.watch = m.watch.Start(sources)
+		return m, tea.Batch(m.watch.Run(), m.notify(statusInfo, fmt.Sprintf("Watching %s for closed DAT files", dir)))
+	}
+	return m, tea.Batch(loadDirectory(m), m.notify(statusInfo, fmt.Sprintf("Loading DAT files from %s", dir)))
+}
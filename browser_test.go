@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestLoadNewDirectoryDropsStaleLoads(t *testing.T) {
+	old := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "48h")
+	m := newTestModel(t, old, newMemorySink())
+	m = runModel(t, m, m.Init(), loaded(2))
+	fileName := m.rows[0][1]
+	check := CheckDATFile(m, fileName)
+	name := DATFileNameMsg{loadGeneration: m.load(), fileName: fileName}
+
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "24h", "-start", "2024-02-01")
+	m.browser.Active = true
+	m, cmd := m.loadNewDirectory(dir)
+	m = runModel(t, m, cmd, loaded(1))
+
+	for _, msg := range []tea.Msg{check(), name} {
+		updated, _ := m.Update(msg)
+		m = updated.(model)
+	}
+	if len(m.rows) != 1 || m.rows[0][1] == fileName {
+		t.Errorf("loads of the previous directory changed the rows: %v", m.rows)
+	}
+	if _, ok := m.datFileRecords[fileName]; ok {
+		t.Errorf("the integrity of %s is recorded after the switch", fileName)
+	}
+}
+
+func TestLoadNewDirectoryKeepsPairing(t *testing.T) {
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "48h", "-corrupt", "notag")
+	m := newTestModel(t, dir, newMemorySink())
+	m.sources.TagFallback = true
+	m.browser.Active = true
+	m, cmd := m.loadNewDirectory(dir)
+	m = runModel(t, m, cmd, loaded(2))
+	fileName := filepath.Join(dir, "2024 01 02 0000 (Float).DAT")
+	if _, ok := m.pairing.Fallback(fileName); !ok {
+		t.Fatalf("%s is not read with a fallback tag file", fileName)
+	}
+
+	// A folder without DAT files is not loaded and leaves the files and
+	// their pairing alone.
+	m.browser.Active = true
+	m, cmd = m.loadNewDirectory(t.TempDir())
+	m, _ = updateWithDirDiscoveredMsg(m, cmd().(dirDiscoveredMsg))
+	if m.browser.Err == "" || !m.browser.Active {
+		t.Error("an empty folder is loaded")
+	}
+	if _, ok := m.pairing.Fallback(fileName); !ok {
+		t.Error("the pairing of the loaded folder is lost")
+	}
+	if len(m.rows) != 2 {
+		t.Errorf("the rows are %v after the failed load", m.rows)
+	}
+}
+
+func TestLoadNewDirectoryDiscoversInBackground(t *testing.T) {
+	old := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "48h")
+	m := newTestModel(t, old, newMemorySink())
+	m = runModel(t, m, m.Init(), loaded(2))
+
+	first := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "24h", "-start", "2024-02-01")
+	second := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "24h", "-start", "2024-03-01")
+	m.browser.Active = true
+	m, firstCmd := m.loadNewDirectory(first)
+	if len(m.rows) != 2 || m.browser.Loading != first {
+		t.Fatalf("the rows changed before discovery returned: %v", m.rows)
+	}
+	// Another folder is chosen before the first one is discovered.
+	m, secondCmd := m.loadNewDirectory(second)
+	m, _ = updateWithDirDiscoveredMsg(m, firstCmd().(dirDiscoveredMsg))
+	if m.sources.Paths[0] == first {
+		t.Fatal("the folder chosen first is loaded")
+	}
+	m, cmd := updateWithDirDiscoveredMsg(m, secondCmd().(dirDiscoveredMsg))
+	m = runModel(t, m, cmd, loaded(1))
+	if m.sources.Paths[0] != second || m.browser.Active {
+		t.Errorf("the folder chosen last is not loaded, the sources are %v", m.sources)
+	}
+}
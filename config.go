@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Config is the optional JSON config file of the TUI.
+type Config struct {
+	// Keys remaps key bindings by name, e.g. "pageDown": ["pgdown", "ctrl+d"].
+	Keys map[string][]string `json:"keys,omitempty"`
+	// RecentServers lists the last historian connections, newest first.
+	RecentServers []RecentServer `json:"recentServers,omitempty"`
+	// Hosts holds the login details of remote DAT sources by host name.
+	Hosts map[string]HostCredentials `json:"hosts,omitempty"`
+}
+
+// defaultConfigPath returns the config file used when -config is not given.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "goDataLogConvertTUI", "config.json")
+}
+
+// loadConfig reads the config file at path. A missing file gives the
+// default config, it is created once there is something to save. A missing
+// file is an error when the path was given explicitly.
+func loadConfig(path string, explicit bool) (Config, error) {
+	var cfg Config
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// saveConfig writes cfg to path, creating its directory when needed.
+func saveConfig(path string, cfg Config) error {
+	if path == "" {
+		return fmt.Errorf("no config file path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
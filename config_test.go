@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.json")
+	if _, err := loadConfig(missing, false); err != nil {
+		t.Errorf("a missing default config returned %v", err)
+	}
+	if _, err := loadConfig(missing, true); err == nil {
+		t.Error("a missing -config file did not fail")
+	}
+
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(`{"keys":{"logs":["ctrl+l"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := cfg.Keys["logs"]; len(keys) != 1 || keys[0] != "ctrl+l" {
+		t.Errorf("the keys read are %v", cfg.Keys)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"keys":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path, false); err == nil {
+		t.Error("an invalid config did not fail")
+	}
+}
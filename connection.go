@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/complacentsee/goDataLogConvertTUI/helpers"
+)
+
+// Number of servers kept in the recent servers list.
+const recentServersLimit = 10
+
+// RecentServer is a historian connection that succeeded before.
+type RecentServer struct {
+	Host        string `json:"host"`
+	ProcessName string `json:"processName"`
+}
+
+const (
+	connectionFocusHost = iota
+	connectionFocusProcess
+	connectionFocusRecent
+)
+
+// ConnectionDialogModel edits the historian host and process name and
+// reconnects the sink without restarting.
+type ConnectionDialogModel struct {
+	Active       bool
+	Host         textinput.Model
+	ProcessName  textinput.Model
+	Recent       []RecentServer
+	RecentCursor int
+	Focus        int
+	// Editable is false for sinks that are not configured by host and
+	// process name, those can only be reconnected.
+	Editable bool
+	Target   string
+	Err      string
+	Keys     keyMap
+}
+
+func initialConnectionDialogModel(recent []RecentServer, keys keyMap) ConnectionDialogModel {
+	host := textinput.New()
+	host.Prompt = "Host:         "
+	host.CharLimit = 255
+
+	processName := textinput.New()
+	processName.Prompt = "Process name: "
+	processName.CharLimit = 255
+
+	return ConnectionDialogModel{Host: host, ProcessName: processName, Recent: recent, Keys: keys}
+}
+
+// Open shows the dialog filled in with the current connection of sink.
+func (m ConnectionDialogModel) Open(sink Sink, lastErr string) (ConnectionDialogModel, tea.Cmd) {
+	m.Active = true
+	m.Err = lastErr
+	m.Target = sink.Target()
+	m.RecentCursor = 0
+	piapi, editable := sink.(*piapiSink)
+	m.Editable = editable
+	if !editable {
+		return m, nil
+	}
+	m.Host.SetValue(piapi.hostname)
+	m.ProcessName.SetValue(piapi.processName)
+	return m.focus(connectionFocusHost)
+}
+
+func (m ConnectionDialogModel) Close() ConnectionDialogModel {
+	m.Active = false
+	m.Host.Blur()
+	m.ProcessName.Blur()
+	return m
+}
+
+func (m ConnectionDialogModel) focus(focus int) (ConnectionDialogModel, tea.Cmd) {
+	if focus == connectionFocusRecent && len(m.Recent) == 0 {
+		focus = connectionFocusHost
+	}
+	m.Focus = focus
+	m.Host.Blur()
+	m.ProcessName.Blur()
+	switch focus {
+	case connectionFocusHost:
+		return m, m.Host.Focus()
+	case connectionFocusProcess:
+		return m, m.ProcessName.Focus()
+	}
+	return m, nil
+}
+
+// Update handles a key in the dialog, connect is set when the user asked to
+// connect with the values shown. Characters typed into a field are text,
+// even when a binding is remapped to them.
+func (m ConnectionDialogModel) Update(msg tea.KeyMsg) (dialog ConnectionDialogModel, cmd tea.Cmd, connect bool) {
+	typing := m.Editable && m.Focus != connectionFocusRecent && msg.Type == tea.KeyRunes
+	if !typing {
+		switch {
+		case key.Matches(msg, m.Keys.Back):
+			return m.Close(), nil, false
+		case key.Matches(msg, m.Keys.Details):
+			if m.Editable && (m.Host.Value() == "" || m.ProcessName.Value() == "") {
+				m.Err = "Host and process name are required."
+				return m, nil, false
+			}
+			return m, nil, true
+		case !m.Editable:
+			return m, nil, false
+		case key.Matches(msg, m.Keys.NextField):
+			m, cmd = m.focus((m.Focus + 1) % 3)
+			return m, cmd, false
+		case key.Matches(msg, m.Keys.PrevField):
+			m, cmd = m.focus((m.Focus + 2) % 3)
+			return m, cmd, false
+		}
+	}
+
+	switch m.Focus {
+	case connectionFocusHost:
+		m.Host, cmd = m.Host.Update(msg)
+	case connectionFocusProcess:
+		m.ProcessName, cmd = m.ProcessName.Update(msg)
+	case connectionFocusRecent:
+		switch {
+		case key.Matches(msg, m.Keys.Up):
+			m.RecentCursor = max(m.RecentCursor-1, 0)
+		case key.Matches(msg, m.Keys.Down):
+			m.RecentCursor = min(m.RecentCursor+1, len(m.Recent)-1)
+		}
+		server := m.Recent[m.RecentCursor]
+		m.Host.SetValue(server.Host)
+		m.ProcessName.SetValue(server.ProcessName)
+	}
+	return m, cmd, false
+}
+
+// addRecentServer moves server to the top of recent, dropping the oldest
+// entries past the limit.
+func addRecentServer(recent []RecentServer, server RecentServer) []RecentServer {
+	result := []RecentServer{server}
+	for _, r := range recent {
+		if r != server && len(result) < recentServersLimit {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// Reconnect closes the old sink before connecting the new one, which may be
+// the same sink when it is only reconnected.
+func Reconnect(old, sink Sink, hostname string) tea.Cmd {
+	return func() tea.Msg {
+		if err := old.Close(); err != nil {
+			slog.Warn(fmt.Sprintf("Closing %s failed: %v", old.Target(), err))
+		}
+		return PiConnectToServer(sink, hostname)()
+	}
+}
+
+func (m ConnectionDialogModel) View(width, height int, connecting bool, background string) string {
+	if !m.Active {
+		return background
+	}
+
+	popupWidth := 70
+	borderStyle := lipgloss.NewStyle().
+		Border(lipgloss.NormalBorder(), true).
+		Padding(1, 2).
+		Width(popupWidth).
+		BorderForeground(lipgloss.Color("205"))
+
+	lines := []string{lipgloss.NewStyle().Bold(true).Render("Connection"), ""}
+	if m.Editable {
+		lines = append(lines, m.Host.View(), m.ProcessName.View(), "")
+		if len(m.Recent) > 0 {
+			lines = append(lines, "Recent servers:")
+			for i, server := range m.Recent {
+				line := fmt.Sprintf("  %s (%s)", server.Host, server.ProcessName)
+				if m.Focus == connectionFocusRecent && i == m.RecentCursor {
+					line = lipgloss.NewStyle().Foreground(lipgloss.Color("205")).Render("> " + line[2:])
+				}
+				lines = append(lines, line)
+			}
+			lines = append(lines, "")
+		}
+	} else {
+		lines = append(lines, m.Target, "")
+	}
+
+	switch {
+	case connecting:
+		lines = append(lines, lipgloss.NewStyle().Foreground(lipgloss.Color("3")).Render("Connecting..."))
+	case m.Err != "":
+		lines = append(lines, lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Width(popupWidth-4).Render("Error: "+m.Err))
+	}
+	lines = append(lines, "")
+
+	k := m.Keys
+	if m.Editable {
+		lines = append(lines, strings.Join([]string{keyHint(k.Details, "Connect"), keyHint(k.NextField, "Next field"), keyHint(k.Back, "Close")}, "  "))
+	} else {
+		lines = append(lines, keyHint(k.Details, "Reconnect")+"  "+keyHint(k.Back, "Close"))
+	}
+	foreground := borderStyle.Render(lipgloss.JoinVertical(lipgloss.Left, lines...))
+
+	x := int(math.Round(float64(width)/2 - float64(lipgloss.Width(foreground))*0.5))
+	y := int(math.Round(float64(height)/2 - float64(lipgloss.Height(foreground))*0.5))
+	return helpers.PlaceOverlay(max(x, 0), max(y, 0), foreground, background, false)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// datField is a dBase field descriptor of a DAT file.
+type datField struct {
+	name   string
+	kind   byte
+	length int
+}
+
+// The fields FactoryTalk View writes, the lengths LibDAT reads are in
+// floatFileLayout and tagFileLayout. Float records end with a field LibDAT
+// does not read.
+var (
+	floatFileFields = []datField{{"Date", 'D', 8}, {"Time", 'C', 8}, {"Millitm", 'N', 3}, {"TagIndex", 'N', 5}, {"Value", 'B', 8}, {"Status", 'C', 1}, {"Marker", 'C', 1}, {"Internal", 'C', 4}}
+	tagFileFields   = []datField{{"Tagname", 'C', 255}, {"TTagIndex", 'N', 5}, {"TTagType", 'N', 1}, {"TTagDataTy", 'N', 2}}
+)
+
+// Largest values the numeric fields hold.
+const (
+	maxDatTagID    = 99999
+	maxDatTagType  = 9
+	maxDatTagDtype = 99
+)
+
+// datTimeFormat is the resolution DAT files keep timestamps in, LibDAT reads
+// them as UTC.
+const datTimeFormat = "2006-01-02 15:04:05.000"
+
+// datSetName returns the float file name of a DAT file set starting at t, the
+// tag file name follows from tagFileOf.
+func datSetName(t time.Time) string {
+	return t.Format("2006 01 02 1504") + " (Float).DAT"
+}
+
+// writeDatHeader writes the dBase header and field descriptors. The date is
+// the day of the file rather than of the last update, as FactoryTalk View
+// writes it.
+func writeDatHeader(w *bufio.Writer, date time.Time, count int, layout datLayout, fields []datField) error {
+	header := make([]byte, 32)
+	header[0] = 0x03
+	header[1] = byte(date.Year() - 1900)
+	header[2] = byte(date.Month())
+	header[3] = byte(date.Day())
+	binary.LittleEndian.PutUint32(header[4:8], uint32(count))
+	binary.LittleEndian.PutUint16(header[8:10], uint16(layout.headerLength))
+	binary.LittleEndian.PutUint16(header[10:12], uint16(layout.recordLength))
+	w.Write(header)
+	for _, field := range fields {
+		descriptor := make([]byte, 32)
+		copy(descriptor[:11], field.name)
+		descriptor[11] = field.kind
+		descriptor[16] = byte(field.length)
+		w.Write(descriptor)
+	}
+	if err := w.WriteByte(0x0D); err != nil {
+		return err
+	}
+	if w.Buffered() != int(layout.headerLength) {
+		return fmt.Errorf("%s file header is %d bytes, %d are expected", layout.name, w.Buffered(), layout.headerLength)
+	}
+	return nil
+}
+
+// writeTagFile writes the tags to a tag file in the layout LibDAT reads.
+func writeTagFile(fileName string, date time.Time, tags []*LibDAT.DatTagRecord) error {
+	return writeDatFile(fileName, func(w *bufio.Writer) error {
+		if err := writeDatHeader(w, date, len(tags), tagFileLayout, tagFileFields); err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			switch {
+			case len(tag.Name) > 255:
+				return fmt.Errorf("tag name %s is longer than 255 characters", tag.Name)
+			case tag.ID < 0 || tag.ID > maxDatTagID:
+				return fmt.Errorf("tag id %d of %s does not fit the tag file", tag.ID, tag.Name)
+			case tag.Type < 0 || tag.Type > maxDatTagType || tag.Dtype < 0 || tag.Dtype > maxDatTagDtype:
+				return fmt.Errorf("tag type %d/%d of %s does not fit the tag file", tag.Type, tag.Dtype, tag.Name)
+			}
+			// The name is padded in bytes, fmt pads in runes.
+			fmt.Fprintf(w, " %s%s%5d%1d%2d", tag.Name, strings.Repeat(" ", 255-len(tag.Name)), tag.ID, tag.Type, tag.Dtype)
+		}
+		return w.WriteByte(0x1A)
+	})
+}
+
+// writeFloatFile writes the records to a float file in the layout LibDAT
+// reads. Timestamps are written in their own location to the millisecond.
+func writeFloatFile(fileName string, date time.Time, records []*LibDAT.DatFloatRecord) error {
+	return writeFloatRecords(fileName, date, len(records), func(write func(*LibDAT.DatFloatRecord) error) error {
+		for _, r := range records {
+			if err := write(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeFloatRecords writes a float file of count records passed to write one
+// at a time by each, so they need not be held in memory.
+func writeFloatRecords(fileName string, date time.Time, count int, each func(write func(*LibDAT.DatFloatRecord) error) error) error {
+	return writeDatFile(fileName, func(w *bufio.Writer) error {
+		if err := writeDatHeader(w, date, count, floatFileLayout, floatFileFields); err != nil {
+			return err
+		}
+		record := make([]byte, floatRecordLength)
+		written := 0
+		err := each(func(r *LibDAT.DatFloatRecord) error {
+			if r.TagID < 0 || r.TagID > maxDatTagID {
+				return fmt.Errorf("tag id %d does not fit the float file", r.TagID)
+			}
+			for i := range record {
+				record[i] = ' '
+			}
+			copy(record[1:17], r.TimeStamp.Format("2006010215:04:05"))
+			copy(record[17:25], fmt.Sprintf("%3d%5d", r.TimeStamp.Nanosecond()/int(time.Millisecond), r.TagID))
+			binary.LittleEndian.PutUint64(record[25:33], math.Float64bits(r.Val))
+			record[33] = datByte(r.Status)
+			record[34] = datByte(r.Marker)
+			copy(record[35:], []byte{0, 0, 0, 0})
+			written++
+			_, err := w.Write(record)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if written != count {
+			return fmt.Errorf("%d records were written, the header counts %d", written, count)
+		}
+		return w.WriteByte(0x1A)
+	})
+}
+
+// datByte writes an unset status or marker as a space, like FactoryTalk View.
+func datByte(b byte) byte {
+	if b == 0 {
+		return ' '
+	}
+	return b
+}
+
+// writeDatFile writes a DAT file through a temporary file, a file set is
+// never left half written.
+func writeDatFile(fileName string, write func(w *bufio.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), ".dat-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", fileName, err)
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// writeDatSet writes a float file and its tag file, then reads both back
+// through LibDAT and compares them with what was written.
+func writeDatSet(floatFileName string, date time.Time, tags []*LibDAT.DatTagRecord, records []*LibDAT.DatFloatRecord) error {
+	for _, fileName := range []string{floatFileName, tagFileOf(floatFileName)} {
+		if _, err := os.Stat(fileName); err == nil {
+			return fmt.Errorf("%s already exists", fileName)
+		}
+	}
+	if err := writeTagFile(tagFileOf(floatFileName), date, tags); err != nil {
+		return err
+	}
+	if err := writeFloatFile(floatFileName, date, records); err != nil {
+		os.Remove(tagFileOf(floatFileName))
+		return err
+	}
+	if err := verifyDatSet(floatFileName, date, tags, records); err != nil {
+		os.Remove(floatFileName)
+		os.Remove(tagFileOf(floatFileName))
+		return fmt.Errorf("%s does not read back as written: %v", filepath.Base(floatFileName), err)
+	}
+	return nil
+}
+
+// verifyDatSet reads a written file set through LibDAT.DatReader and compares
+// every tag and record with what was written.
+func verifyDatSet(floatFileName string, date time.Time, tags []*LibDAT.DatTagRecord, records []*LibDAT.DatFloatRecord) error {
+	dr := &LibDAT.DatReader{FloatFileNames: []string{floatFileName}}
+	_, readDate, err := dr.ReadTagFileHeader(floatFileName)
+	if err != nil {
+		return err
+	}
+	if *readDate != date.Format("2006-01-02") {
+		return fmt.Errorf("tag file date is %s, %s was written", *readDate, date.Format("2006-01-02"))
+	}
+	readTags, err := dr.ReadTagFile(floatFileName)
+	if err != nil {
+		return err
+	}
+	if len(readTags) != len(tags) {
+		return fmt.Errorf("%d tags read, %d were written", len(readTags), len(tags))
+	}
+	for i, tag := range tags {
+		if *readTags[i] != *tag {
+			return fmt.Errorf("tag %d reads as %+v, %+v was written", i, *readTags[i], *tag)
+		}
+	}
+
+	readRecords, err := dr.ReadFloatFile(floatFileName)
+	if err != nil {
+		return err
+	}
+	if len(readRecords) != len(records) {
+		return fmt.Errorf("%d records read, %d were written", len(readRecords), len(records))
+	}
+	for i, r := range records {
+		read := readRecords[i]
+		switch {
+		case read == nil || !read.IsValid:
+			return fmt.Errorf("record %d is not readable", i)
+		case read.TimeStamp.Format(datTimeFormat) != r.TimeStamp.Format(datTimeFormat):
+			return fmt.Errorf("record %d reads at %s, %s was written", i, read.TimeStamp, r.TimeStamp)
+		case read.TagID != r.TagID:
+			return fmt.Errorf("record %d reads with tag id %d, %d was written", i, read.TagID, r.TagID)
+		case math.Float64bits(read.Val) != math.Float64bits(r.Val):
+			return fmt.Errorf("record %d reads as %v, %v was written", i, read.Val, r.Val)
+		case read.Status != datByte(r.Status) || read.Marker != datByte(r.Marker):
+			return fmt.Errorf("record %d reads with status %q and marker %q, %q and %q were written", i, read.Status, read.Marker, datByte(r.Status), datByte(r.Marker))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// readDatSet reads a file set back through LibDAT.DatReader.
+func readDatSet(t *testing.T, floatFileName string) (string, []*LibDAT.DatTagRecord, []*LibDAT.DatFloatRecord) {
+	t.Helper()
+	dr := &LibDAT.DatReader{FloatFileNames: []string{floatFileName}}
+	_, date, err := dr.ReadTagFileHeader(floatFileName)
+	if err != nil {
+		t.Fatalf("reading the tag file header of %s: %v", filepath.Base(floatFileName), err)
+	}
+	tags, err := dr.ReadTagFile(floatFileName)
+	if err != nil {
+		t.Fatalf("reading the tag file of %s: %v", filepath.Base(floatFileName), err)
+	}
+	records, err := dr.ReadFloatFile(floatFileName)
+	if err != nil {
+		t.Fatalf("reading %s: %v", filepath.Base(floatFileName), err)
+	}
+	return *date, tags, records
+}
+
+func TestWriteDatSetRoundTrip(t *testing.T) {
+	date := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	tags := []*LibDAT.DatTagRecord{
+		{Name: `Line1\Temp01`, ID: 0, Type: 1, Dtype: 2},
+		// Names are padded to 255 bytes, not runes.
+		{Name: `Line1\Température`, ID: 7, Type: 0, Dtype: 12},
+		{Name: strings.Repeat("N", 255), ID: maxDatTagID, Type: maxDatTagType, Dtype: maxDatTagDtype},
+	}
+	records := []*LibDAT.DatFloatRecord{
+		{TimeStamp: date, TagID: 0, Val: 21.5, Status: ' ', Marker: 'B'},
+		{TimeStamp: date.Add(999 * time.Millisecond), TagID: 7, Val: -0.000125, Status: 'U', Marker: ' '},
+		// An unset status is written as a space.
+		{TimeStamp: date.Add(12 * time.Hour), TagID: 0, Val: math.Inf(-1), Status: 0, Marker: 0},
+		{TimeStamp: date.Add(23*time.Hour + 59*time.Minute + 59*time.Second + 1*time.Millisecond), TagID: maxDatTagID, Val: math.MaxFloat64, Marker: 'E'},
+	}
+	floatFileName := filepath.Join(t.TempDir(), "out", datSetName(date))
+	if err := writeDatSet(floatFileName, date, tags, records); err != nil {
+		t.Fatal(err)
+	}
+
+	readDate, readTags, readRecords := readDatSet(t, floatFileName)
+	if readDate != "2024-03-09" {
+		t.Errorf("the tag file is dated %s, 2024-03-09 expected", readDate)
+	}
+	if len(readTags) != len(tags) {
+		t.Fatalf("%d tags read, %d written", len(readTags), len(tags))
+	}
+	for i, tag := range tags {
+		if *readTags[i] != *tag {
+			t.Errorf("tag %d reads as %+v, %+v written", i, *readTags[i], *tag)
+		}
+	}
+	if len(readRecords) != len(records) {
+		t.Fatalf("%d records read, %d written", len(readRecords), len(records))
+	}
+	for i, r := range records {
+		read := readRecords[i]
+		if !read.IsValid || !read.TimeStamp.Equal(r.TimeStamp) || read.TagID != r.TagID || math.Float64bits(read.Val) != math.Float64bits(r.Val) {
+			t.Errorf("record %d reads as %+v, %+v written", i, *read, *r)
+		}
+		if read.Status != datByte(r.Status) || read.Marker != datByte(r.Marker) {
+			t.Errorf("record %d reads with status %q and marker %q, %q and %q written", i, read.Status, read.Marker, datByte(r.Status), datByte(r.Marker))
+		}
+	}
+
+	// The layout is the one the health check expects.
+	if report := checkDatSet(nil, floatFileName, true); report.Health != healthOK {
+		t.Errorf("the written set checks as %s: %v", report.Health, report.Issues)
+	}
+	info, err := os.Stat(floatFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := floatHeaderLength + int64(len(records))*floatRecordLength + 1; info.Size() != want {
+		t.Errorf("the float file is %d bytes, %d expected", info.Size(), want)
+	}
+	info, err = os.Stat(tagFileOf(floatFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := tagHeaderLength + int64(len(tags))*tagRecordLength + 1; info.Size() != want {
+		t.Errorf("the tag file is %d bytes, %d expected", info.Size(), want)
+	}
+}
+
+func TestWriteDatSetRejects(t *testing.T) {
+	date := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+	record := []*LibDAT.DatFloatRecord{{TimeStamp: date, TagID: 0, Val: 1}}
+	tests := []struct {
+		name    string
+		tags    []*LibDAT.DatTagRecord
+		records []*LibDAT.DatFloatRecord
+	}{
+		{"long name", []*LibDAT.DatTagRecord{{Name: strings.Repeat("é", 128), ID: 0}}, record},
+		{"tag id", []*LibDAT.DatTagRecord{{Name: "a", ID: maxDatTagID + 1}}, record},
+		{"tag type", []*LibDAT.DatTagRecord{{Name: "a", ID: 0, Type: 10}}, record},
+		{"record tag id", []*LibDAT.DatTagRecord{{Name: "a", ID: 0}}, []*LibDAT.DatFloatRecord{{TimeStamp: date, TagID: -1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			floatFileName := filepath.Join(dir, datSetName(date))
+			if err := writeDatSet(floatFileName, date, test.tags, test.records); err == nil {
+				t.Fatal("the set was written")
+			}
+			// No half written set is left behind.
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("%d files left in the output folder", len(entries))
+			}
+		})
+	}
+
+	t.Run("existing", func(t *testing.T) {
+		floatFileName := filepath.Join(t.TempDir(), datSetName(date))
+		tags := []*LibDAT.DatTagRecord{{Name: "a", ID: 0}}
+		if err := writeDatSet(floatFileName, date, tags, record); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeDatSet(floatFileName, date, tags, record); err == nil {
+			t.Fatal("an existing set was overwritten")
+		}
+	})
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+// tagStats summarises the float records of a single tag in a DAT file.
+type tagStats struct {
+	Name     string
+	ID       int
+	Count    int
+	First    time.Time
+	Last     time.Time
+	Min      float64
+	Max      float64
+	Mean     float64
+	Statuses map[string]int
+	// Resolved is "Yes" or "No" when the tags were looked up on the
+	// historian, or "-" when the point cache is no longer available.
+	Resolved string
+	// Verify is the verification of the tag, empty when the file was not
+	// verified and "-" when the tag was not compared.
+	Verify string
+}
+
+var detailColumns = []table.Column{
+	{Title: "Tag", Width: 40},
+	{Title: "ID", Width: 5},
+	{Title: "Records", Width: 8},
+	{Title: "First", Width: 12},
+	{Title: "Last", Width: 12},
+	{Title: "Min", Width: 12},
+	{Title: "Max", Width: 12},
+	{Title: "Mean", Width: 12},
+	{Title: "Status", Width: 16},
+	{Title: "Resolved", Width: 8},
+	{Title: "Verify", Width: 22},
+}
+
+type FileDetailModel struct {
+	Active   bool
+	Loading  bool
+	FileName string
+	Err      string
+	Stats    []tagStats
+	Records  []*LibDAT.DatFloatRecord
+	// RecordCount is the number of valid records, Records also holds the
+	// entries left nil or invalid by the read.
+	RecordCount int
+	Table       table.Model
+	Search      textinput.Model
+	Searching   bool
+	SortBy      int
+	SortDesc    bool
+	Plot        PlotModel
+	Keys        keyMap
+	// Report is the integrity check of the file, its issues are listed
+	// above the tags.
+	Report IntegrityReport
+	// Verification is the read back of the file after its insert, the
+	// result of each tag is in the Verify column.
+	Verification VerificationReport
+	visible      []tagStats
+}
+
+func initialFileDetailModel(keys keyMap) FileDetailModel {
+	search := textinput.New()
+	search.Prompt = "/"
+	search.Placeholder = "tag name"
+
+	return FileDetailModel{
+		Table: table.New(
+			table.WithColumns(detailColumns),
+			table.WithFocused(true),
+			table.WithHeight(10),
+		),
+		Search: search,
+		Keys:   keys,
+	}
+}
+
+type FileDetailMsg struct {
+	fileName string
+	stats    []tagStats
+	records  []*LibDAT.DatFloatRecord
+	err      string
+}
+
+// LoadFileDetail reads every record of a DAT file and summarises them per
+// tag. The tag file is read when its records have not been loaded yet.
+func LoadFileDetail(m model, fileName string) tea.Cmd {
+	record := m.datFileRecords[fileName]
+	return func() tea.Msg {
+		staged, err := stagedPath(m.pairing, fileName)
+		if err != nil {
+			return FileDetailMsg{fileName: fileName, err: err.Error()}
+		}
+		tags := record.TagRecords
+		if tags == nil {
+			tags, err = readTagRecords(m.dr, staged, record.Integrity)
+			if err != nil {
+				return FileDetailMsg{fileName: fileName, err: err.Error()}
+			}
+		}
+		records, err := readFloatFileRecords(m.dr, staged, record.Integrity)
+		if err != nil {
+			return FileDetailMsg{fileName: fileName, err: err.Error()}
+		}
+		return FileDetailMsg{fileName: fileName, stats: computeTagStats(tags, records, record.PointCache), records: records}
+	}
+}
+
+func computeTagStats(tags []*LibDAT.DatTagRecord, records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) []tagStats {
+	byID := make(map[int]*tagStats, len(tags))
+	stats := make([]*tagStats, 0, len(tags))
+	for _, tag := range tags {
+		resolved := "-"
+		if points != nil {
+			resolved = "No"
+			if point, exists := points.GetPointByDataLogID(tag.ID); exists && point.Process {
+				resolved = "Yes"
+			}
+		}
+		s := &tagStats{Name: tag.Name, ID: tag.ID, Statuses: make(map[string]int), Resolved: resolved}
+		byID[tag.ID] = s
+		stats = append(stats, s)
+	}
+
+	sums := make(map[int]float64, len(tags))
+	// numeric counts the values of each tag that are not NaN, NaN is left
+	// out of the min, max and mean.
+	numeric := make(map[int]int, len(tags))
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		s, exists := byID[record.TagID]
+		if !exists {
+			continue
+		}
+		if s.Count == 0 {
+			s.First, s.Last = record.TimeStamp, record.TimeStamp
+		}
+		if record.TimeStamp.Before(s.First) {
+			s.First = record.TimeStamp
+		}
+		if record.TimeStamp.After(s.Last) {
+			s.Last = record.TimeStamp
+		}
+		s.Count++
+		if !math.IsNaN(record.Val) {
+			if numeric[record.TagID] == 0 {
+				s.Min, s.Max = record.Val, record.Val
+			}
+			s.Min = math.Min(s.Min, record.Val)
+			s.Max = math.Max(s.Max, record.Val)
+			sums[record.TagID] += record.Val
+			numeric[record.TagID]++
+		}
+
+		status := recordStatus(record)
+		if status == "" {
+			status = "Good"
+		}
+		s.Statuses[status]++
+	}
+
+	result := make([]tagStats, 0, len(stats))
+	for _, s := range stats {
+		if n := numeric[s.ID]; n > 0 {
+			s.Mean = sums[s.ID] / float64(n)
+		} else if s.Count > 0 {
+			s.Min, s.Max, s.Mean = math.NaN(), math.NaN(), math.NaN()
+		}
+		result = append(result, *s)
+	}
+	return result
+}
+
+func (s tagStats) statusSummary() string {
+	keys := make([]string, 0, len(s.Statuses))
+	for key := range s.Statuses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s %d", key, s.Statuses[key]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s tagStats) row() table.Row {
+	if s.Count == 0 {
+		return table.Row{s.Name, fmt.Sprintf("%d", s.ID), "0", "", "", "", "", "", "", s.Resolved, s.Verify}
+	}
+	return table.Row{
+		s.Name,
+		fmt.Sprintf("%d", s.ID),
+		fmt.Sprintf("%d", s.Count),
+		s.First.Format("15:04:05.000"),
+		s.Last.Format("15:04:05.000"),
+		fmt.Sprintf("%.4g", s.Min),
+		fmt.Sprintf("%.4g", s.Max),
+		fmt.Sprintf("%.4g", s.Mean),
+		s.statusSummary(),
+		s.Resolved,
+		s.Verify,
+	}
+}
+
+// missingStat reports whether a tag has no value for the given min, max or
+// mean column, as it has no valid records.
+func (s tagStats) missingStat(column int) bool {
+	switch column {
+	case 5:
+		return math.IsNaN(s.Min)
+	case 6:
+		return math.IsNaN(s.Max)
+	case 7:
+		return math.IsNaN(s.Mean)
+	}
+	return false
+}
+
+// lessTagStats orders two tags by the given detail column. Tags missing the
+// value of the column are ordered by refresh.
+func lessTagStats(a, b tagStats, column int) bool {
+	switch column {
+	case 1:
+		return a.ID < b.ID
+	case 2:
+		return a.Count < b.Count
+	case 3:
+		return a.First.Before(b.First)
+	case 4:
+		return a.Last.Before(b.Last)
+	case 5:
+		return a.Min < b.Min
+	case 6:
+		return a.Max < b.Max
+	case 7:
+		return a.Mean < b.Mean
+	case 8:
+		return a.statusSummary() < b.statusSummary()
+	case 9:
+		return a.Resolved < b.Resolved
+	case 10:
+		return a.Verify < b.Verify
+	}
+	return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+}
+
+// Open shows the detail view for fileName while its records are loaded.
+func (m FileDetailModel) Open(fileName string, report IntegrityReport, verification VerificationReport) FileDetailModel {
+	m.Active = true
+	m.Loading = true
+	m.FileName = fileName
+	m.Report = report
+	m.Verification = verification
+	m.Err = ""
+	m.Stats = nil
+	m.Records = nil
+	m.RecordCount = 0
+	m.Search.SetValue("")
+	m.refresh()
+	return m
+}
+
+func (m FileDetailModel) Close() FileDetailModel {
+	m.Active = false
+	m.Plot = PlotModel{}
+	m.Searching = false
+	m.Search.Blur()
+	// Release the records, a month of data can be large.
+	m.Stats = nil
+	m.Records = nil
+	return m
+}
+
+func (m FileDetailModel) Loaded(msg FileDetailMsg) FileDetailModel {
+	if !m.Active || msg.fileName != m.FileName {
+		return m
+	}
+	m.Loading = false
+	m.Err = msg.err
+	m.Stats = msg.stats
+	m.Records = msg.records
+	m.RecordCount = 0
+	for _, record := range msg.records {
+		if record != nil && record.IsValid {
+			m.RecordCount++
+		}
+	}
+	m.annotateVerification()
+	m.refresh()
+	return m
+}
+
+// Verified shows the verification of a file that finished while its detail
+// view is open.
+func (m FileDetailModel) Verified(fileName string, verification VerificationReport) FileDetailModel {
+	if !m.Active || fileName != m.FileName {
+		return m
+	}
+	m.Verification = verification
+	m.annotateVerification()
+	m.refresh()
+	return m
+}
+
+func (m *FileDetailModel) annotateVerification() {
+	if m.Verification.Result == "" {
+		return
+	}
+	for i, s := range m.Stats {
+		m.Stats[i].Verify = "-"
+		if tag, ok := m.Verification.Tags[s.ID]; ok {
+			m.Stats[i].Verify = tag.summary()
+		}
+	}
+}
+
+// SelectedTag returns the stats of the tag under the cursor.
+func (m FileDetailModel) SelectedTag() (tagStats, bool) {
+	cursor := m.Table.Cursor()
+	if cursor < 0 || cursor >= len(m.visible) {
+		return tagStats{}, false
+	}
+	return m.visible[cursor], true
+}
+
+// refresh applies the search and sort order to the table rows.
+func (m *FileDetailModel) refresh() {
+	query := strings.ToLower(m.Search.Value())
+	m.visible = make([]tagStats, 0, len(m.Stats))
+	for _, s := range m.Stats {
+		if query == "" || strings.Contains(strings.ToLower(s.Name), query) {
+			m.visible = append(m.visible, s)
+		}
+	}
+	sort.SliceStable(m.visible, func(i, j int) bool {
+		a, b := m.visible[i], m.visible[j]
+		// NaN compares false with everything, tags without a value go last
+		// in either direction.
+		if aMissing, bMissing := a.missingStat(m.SortBy), b.missingStat(m.SortBy); aMissing || bMissing {
+			return !aMissing && bMissing
+		}
+		if m.SortDesc {
+			return lessTagStats(b, a, m.SortBy)
+		}
+		return lessTagStats(a, b, m.SortBy)
+	})
+
+	rows := make([]table.Row, 0, len(m.visible))
+	for _, s := range m.visible {
+		rows = append(rows, s.row())
+	}
+	m.Table.SetRows(rows)
+	if m.Table.Cursor() >= len(rows) {
+		m.Table.SetCursor(max(len(rows)-1, 0))
+	}
+}
+
+func (m FileDetailModel) Update(msg tea.KeyMsg) (FileDetailModel, tea.Cmd) {
+	if m.Plot.Active {
+		m.Plot = m.Plot.Update(msg)
+		return m, nil
+	}
+	if m.Searching {
+		switch msg.String() {
+		case "enter", "esc":
+			m.Searching = false
+			m.Search.Blur()
+			if msg.String() == "esc" {
+				m.Search.SetValue("")
+			}
+			m.refresh()
+			return m, nil
+		}
+		var cmd tea.Cmd
+		m.Search, cmd = m.Search.Update(msg)
+		m.refresh()
+		return m, cmd
+	}
+
+	switch {
+	case key.Matches(msg, m.Keys.Down):
+		m.Table.MoveDown(1)
+		return m, nil
+	case key.Matches(msg, m.Keys.Up):
+		m.Table.MoveUp(1)
+		return m, nil
+	case key.Matches(msg, m.Keys.PageDown):
+		m.Table.MoveDown(m.Table.Height())
+		return m, nil
+	case key.Matches(msg, m.Keys.PageUp):
+		m.Table.MoveUp(m.Table.Height())
+		return m, nil
+	}
+
+	switch {
+	case key.Matches(msg, m.Keys.Back):
+		if m.Search.Value() != "" {
+			m.Search.SetValue("")
+			m.refresh()
+			return m, nil
+		}
+		return m.Close(), nil
+	case key.Matches(msg, m.Keys.Search):
+		m.Searching = true
+		return m, m.Search.Focus()
+	case key.Matches(msg, m.Keys.Details):
+		if tag, ok := m.SelectedTag(); ok && !m.Loading {
+			m.Plot = OpenPlot(m.Keys, tag, m.Records)
+		}
+	case key.Matches(msg, m.Keys.TagSort):
+		m.SortBy = (m.SortBy + 1) % len(detailColumns)
+		m.refresh()
+	case key.Matches(msg, m.Keys.TagSortBack):
+		m.SortBy = (m.SortBy + len(detailColumns) - 1) % len(detailColumns)
+		m.refresh()
+	case key.Matches(msg, m.Keys.TagReverse):
+		m.SortDesc = !m.SortDesc
+		m.refresh()
+	}
+	return m, nil
+}
+
+func (m FileDetailModel) View(width, height int) string {
+	if m.Plot.Active {
+		return m.Plot.View(width, height)
+	}
+
+	s := fmt.Sprintf("File detail: %s\n", lipgloss.NewStyle().Bold(true).Render(filepath.Base(m.FileName)))
+
+	switch {
+	case m.Loading:
+		s += "Loading records...\n"
+	case m.Err != "":
+		s += lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render("Failed to load records: "+m.Err) + "\n"
+	default:
+		s += fmt.Sprintf("%d tags, %d records\n", len(m.Stats), m.RecordCount)
+	}
+	report := m.reportView(height) + m.verificationView(height)
+	s += report
+
+	// The tag column takes whatever width the other columns leave over.
+	columns := make([]table.Column, len(detailColumns))
+	copy(columns, detailColumns)
+	arrow := " ▲"
+	if m.SortDesc {
+		arrow = " ▼"
+	}
+	columns[m.SortBy].Title += arrow
+	if m.SortBy > 0 {
+		columns[m.SortBy].Width += 2
+	}
+	used := 0
+	for _, column := range columns[1:] {
+		used += column.Width + 2
+	}
+	columns[0].Width = max(width-used-2, 20)
+	m.Table.SetColumns(columns)
+
+	// Leave room for the two header lines, the report, the search line and
+	// the key menu.
+	m.Table.SetHeight(max(height-4-strings.Count(report, "\n"), 1))
+	s += m.Table.View() + "\n"
+	if m.Searching || m.Search.Value() != "" {
+		s += m.Search.View() + "\n"
+	} else {
+		s += "\n"
+	}
+	k := m.Keys
+	s += strings.Join([]string{keyHint(k.Back, "Back"), keyHint(k.Details, "Plot"), keyHint(k.Search, "Search"), keyHint(k.TagSort, "Sort column"), keyHint(k.TagSortBack, "Sort back"), keyHint(k.TagReverse, "Reverse sort")}, "  ")
+	return s
+}
+
+// verificationView shows the result of the read back and the first value
+// of each tag that differs, using at most a third of the height.
+func (m FileDetailModel) verificationView(height int) string {
+	switch m.Verification.Result {
+	case "":
+		return ""
+	case verifyVerified:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("2")).Render("Verification: "+m.Verification.Summary()) + "\n"
+	}
+	s := lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render(fmt.Sprintf("Verification: %s, %s", m.Verification.Result, m.Verification.Summary())) + "\n"
+	var lines []string
+	for _, tag := range m.Verification.sortedTags() {
+		if !tag.ok() {
+			lines = append(lines, fmt.Sprintf("  %s: %d of %d values %s, first %s", tag.Name, tag.Missing+tag.Different, tag.Expected, tag.summary(), tag.First))
+		}
+	}
+	limit := max(height/3-1, 1)
+	for i, line := range lines {
+		if i == limit && len(lines) > limit+1 {
+			s += fmt.Sprintf("  and %d more tags, see the Verify column\n", len(lines)-limit)
+			break
+		}
+		s += line + "\n"
+	}
+	return s
+}
+
+// reportView lists the issues the integrity check found, using at most a
+// third of the height.
+func (m FileDetailModel) reportView(height int) string {
+	if len(m.Report.Issues) == 0 {
+		return ""
+	}
+	color := lipgloss.Color("3")
+	if m.Report.Health != healthWarn {
+		color = lipgloss.Color("1")
+	}
+	s := lipgloss.NewStyle().Foreground(color).Render("Health: "+m.Report.Health) + "\n"
+	limit := max(height/3-1, 1)
+	for i, issue := range m.Report.Issues {
+		if i == limit && len(m.Report.Issues) > limit+1 {
+			s += fmt.Sprintf("  and %d more issues, see the log\n", len(m.Report.Issues)-limit)
+			break
+		}
+		s += "  " + issue + "\n"
+	}
+	return s
+}
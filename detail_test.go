@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+func TestComputeTagStatsSkipsNaN(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tags := []*LibDAT.DatTagRecord{{Name: "Temp", ID: 0}, {Name: "Broken", ID: 1}}
+	records := []*LibDAT.DatFloatRecord{
+		{TimeStamp: start, TagID: 0, Val: math.NaN(), IsValid: true},
+		{TimeStamp: start, TagID: 1, Val: math.NaN(), IsValid: true},
+		{TimeStamp: start.Add(time.Second), TagID: 0, Val: 2, IsValid: true},
+		nil,
+		{TimeStamp: start.Add(2 * time.Second), TagID: 0, Val: 4, IsValid: true},
+		{TimeStamp: start.Add(3 * time.Second), TagID: 0, Val: 100},
+	}
+
+	stats := computeTagStats(tags, records, nil)
+	if s := stats[0]; s.Count != 3 || s.Min != 2 || s.Max != 4 || s.Mean != 3 {
+		t.Errorf("Temp has %d records, min %g, max %g and mean %g", s.Count, s.Min, s.Max, s.Mean)
+	}
+	if s := stats[1]; s.Count != 1 || !math.IsNaN(s.Min) || !math.IsNaN(s.Mean) {
+		t.Errorf("Broken has %d records, min %g and mean %g", s.Count, s.Min, s.Mean)
+	}
+
+	m := initialFileDetailModel(defaultKeyMap()).Open("2024 01 01 0000 (Float).DAT", IntegrityReport{}, VerificationReport{})
+	m = m.Loaded(FileDetailMsg{fileName: m.FileName, stats: stats, records: records})
+	if m.RecordCount != 4 {
+		t.Errorf("the header counts %d records, 4 expected", m.RecordCount)
+	}
+}
+
+func TestDetailSortsNaNLast(t *testing.T) {
+	stats := []tagStats{
+		{Name: "B", Min: 5, Max: 5, Mean: 5},
+		{Name: "Broken", Min: math.NaN(), Max: math.NaN(), Mean: math.NaN()},
+		{Name: "A", Min: 1, Max: 1, Mean: 1},
+		{Name: "Empty", Min: math.NaN(), Max: math.NaN(), Mean: math.NaN()},
+		{Name: "C", Min: 3, Max: 3, Mean: 3},
+	}
+	m := initialFileDetailModel(defaultKeyMap()).Open("2024 01 01 0000 (Float).DAT", IntegrityReport{}, VerificationReport{})
+	m = m.Loaded(FileDetailMsg{fileName: m.FileName, stats: stats})
+	for _, column := range []int{5, 6, 7} {
+		for _, desc := range []bool{false, true} {
+			m.SortBy, m.SortDesc = column, desc
+			m.refresh()
+			var names []string
+			for _, s := range m.visible {
+				names = append(names, s.Name)
+			}
+			want := "A C B Broken Empty"
+			if desc {
+				want = "B C A Broken Empty"
+			}
+			if got := strings.Join(names, " "); got != want {
+				t.Errorf("column %d, descending %v sorts %s, %s expected", column, desc, got, want)
+			}
+		}
+	}
+}
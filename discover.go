@@ -0,0 +1,331 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// Index of the folder column in the files table.
+const folderColumn = 9
+
+// pathList is a flag that may be given several times.
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *pathList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// datSources are the folders DAT files are loaded from and the globs
+// choosing which of their files are used.
+type datSources struct {
+	Paths     []string
+	Recursive bool
+	Include   []string
+	Exclude   []string
+	// StagingDir is where DAT files inside archives are extracted to, and
+	// the files of remote sources copied to.
+	StagingDir string
+	// StagingLimit is the megabytes of files extracted from archives kept
+	// in StagingDir, 0 for no limit.
+	StagingLimit int
+	// Hosts are the credentials of remote sources by host name.
+	Hosts map[string]HostCredentials
+	// TagFallback reads float files without a tag file with the tag file
+	// of the nearest day in the same folder.
+	TagFallback bool
+}
+
+func registerSourceFlags() *datSources {
+	src := &datSources{}
+	flag.Var((*pathList)(&src.Paths), "path", "Path to a directory containing DAT files, or an sftp://user@host/folder URL, may be given several times (default \".\")")
+	flag.BoolVar(&src.Recursive, "recursive", false, "Also load DAT files from the folders below each -path")
+	flag.Func("include", "Comma separated globs, only float files matching one are loaded", func(value string) error {
+		src.Include = splitGlobs(value)
+		return validateGlobs(src.Include)
+	})
+	flag.StringVar(&src.StagingDir, "stagingDir", defaultStagingDir(), "Folder DAT files inside archives and from remote sources are copied to before they are read")
+	flag.IntVar(&src.StagingLimit, "stagingLimit", 2048, "Megabytes of files extracted from archives kept in -stagingDir, 0 for no limit")
+	flag.BoolVar(&src.TagFallback, "tagFallback", false, "Read float files without a tag file with the tag file of the nearest day in the same folder")
+	flag.Func("exclude", "Comma separated globs of float files and folders that are skipped", func(value string) error {
+		src.Exclude = splitGlobs(value)
+		return validateGlobs(src.Exclude)
+	})
+	return src
+}
+
+func splitGlobs(value string) []string {
+	var globs []string
+	for _, glob := range strings.Split(value, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, filepath.ToSlash(glob))
+		}
+	}
+	return globs
+}
+
+func validateGlobs(globs []string) error {
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %v", glob, err)
+		}
+	}
+	return nil
+}
+
+// roots returns the paths to scan, the working directory when none was given.
+func (s datSources) roots() []string {
+	if len(s.Paths) == 0 {
+		return []string{"."}
+	}
+	roots := make([]string, len(s.Paths))
+	for i, root := range s.Paths {
+		// Paths pasted from Explorer keep their quotes.
+		root = strings.ReplaceAll(root, "\"", "")
+		if !isRemote(root) {
+			root = filepath.Clean(root)
+		}
+		roots[i] = root
+	}
+	return roots
+}
+
+// localRoot returns the folder a root is read from, the mirror of a remote
+// source.
+func (s datSources) localRoot(root string) string {
+	if isRemote(root) {
+		return remoteMirror(s.StagingDir, root)
+	}
+	return root
+}
+
+func (s datSources) String() string {
+	roots := s.roots()
+	for i, root := range roots {
+		roots[i] = redactURL(root)
+	}
+	return strings.Join(roots, ", ")
+}
+
+// WithPath returns the sources for a single folder, keeping the other options.
+func (s datSources) WithPath(dir string) datSources {
+	s.Paths = []string{dir}
+	return s
+}
+
+// matchGlobs reports whether one of globs matches the file or folder at rel,
+// the slash separated path below its root. Globs without a slash only match
+// the last element.
+func matchGlobs(globs []string, rel string) bool {
+	for _, glob := range globs {
+		name := rel
+		if !strings.Contains(glob, "/") {
+			name = path.Base(rel)
+		}
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Discover finds the float files of the sources and returns them with their
+// pairing. Each float file is paired with the tag file in its own folder, see
+// pair. Zip, tar.gz and 7z archives given as
+// a path, or found when scanning recursively, are read like folders. Remote
+// sources are copied to their mirror first, a source that cannot be reached
+// gives the files copied before.
+func (s datSources) Discover() (*LibDAT.DatReader, *datPairing, error) {
+	seen := make(map[string]bool)
+	var candidates []datCandidate
+	var errs []string
+	add := func(found []datCandidate) {
+		for _, candidate := range found {
+			abs, err := filepath.Abs(candidate.fileName)
+			if err != nil {
+				abs = candidate.fileName
+			}
+			if !seen[abs] {
+				seen[abs] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	for _, root := range s.roots() {
+		if isRemote(root) {
+			mirror, err := s.syncRemote(root)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			if _, statErr := os.Stat(mirror); statErr != nil {
+				continue
+			}
+			root = mirror
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if !info.IsDir() {
+			if archiveKind(root) == "" {
+				errs = append(errs, fmt.Sprintf("%s is not a directory or archive", root))
+				continue
+			}
+			found, err := s.discoverArchive(root, filepath.Base(root))
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			add(found)
+			continue
+		}
+
+		err = filepath.WalkDir(root, func(fileName string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Skipping %s: %v", fileName, err))
+				if entry != nil && entry.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(root, fileName)
+			rel = filepath.ToSlash(rel)
+			if entry.IsDir() {
+				if fileName == root {
+					return nil
+				}
+				if !s.Recursive || matchGlobs(s.Exclude, rel) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if s.Recursive && archiveKind(entry.Name()) != "" && !matchGlobs(s.Exclude, rel) {
+				found, err := s.discoverArchive(fileName, rel)
+				if err != nil {
+					slog.Warn(fmt.Sprintf("Skipping %s: %v", fileName, err))
+				}
+				add(found)
+				return nil
+			}
+			if isDatFile(entry.Name()) {
+				add([]datCandidate{{fileName: fileName, rel: rel}})
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	floatFileNames, pairing := s.pair(candidates)
+	if len(floatFileNames) == 0 {
+		if len(errs) > 0 {
+			return nil, nil, fmt.Errorf("no input files: %s", strings.Join(errs, "; "))
+		}
+		return nil, nil, fmt.Errorf("no input files")
+	}
+	for _, err := range errs {
+		slog.Warn(err)
+	}
+	sort.Strings(floatFileNames)
+	return &LibDAT.DatReader{FloatFileNames: floatFileNames}, pairing, nil
+}
+
+// discoverArchive returns the DAT files in an archive by their virtual paths,
+// rel is the archive's path below its root. Folders inside the archive are
+// always read.
+func (s datSources) discoverArchive(archive, rel string) ([]datCandidate, error) {
+	entries, err := listArchive(archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", archive, err)
+	}
+	staging.register(s.StagingDir, int64(s.StagingLimit)<<20, entries)
+
+	var files []datCandidate
+	for _, entry := range entries {
+		if s.excludedArchiveFolder(rel, entry.name) {
+			continue
+		}
+		files = append(files, datCandidate{fileName: virtualPath(entry), rel: rel + "/" + entry.name})
+	}
+	return files, nil
+}
+
+// excludedArchiveFolder reports whether a folder the archive entry name is
+// in matches an exclude glob.
+func (s datSources) excludedArchiveFolder(rel, name string) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if matchGlobs(s.Exclude, rel+"/"+dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// useFloatFile reports whether fileName, at rel below its root, is a float
+// file passing the include and exclude globs.
+func (s datSources) useFloatFile(fileName, rel string) bool {
+	if !strings.HasSuffix(fileName, " (Float).DAT") {
+		return false
+	}
+	if len(s.Include) > 0 && !matchGlobs(s.Include, rel) {
+		return false
+	}
+	if matchGlobs(s.Exclude, rel) {
+		return false
+	}
+	// LibDAT finds the tag file by replacing the first " (Float)" in the
+	// whole path, which misses when a folder is named like that.
+	tagFileName := filepath.Join(filepath.Dir(fileName), strings.Replace(filepath.Base(fileName), " (Float)", " (Tagname)", 1))
+	if strings.Replace(fileName, " (Float)", " (Tagname)", 1) != tagFileName {
+		slog.Warn(fmt.Sprintf("Skipping %s, its tag file cannot be found from a folder named like a float file", fileName))
+		return false
+	}
+	return true
+}
+
+// Folder returns the folder column of fileName, its folder below the root it
+// was found in. With several roots the root is included. Files inside an
+// archive show the archive as a folder.
+func (s datSources) Folder(fileName string) string {
+	dir := filepath.Dir(fileName)
+	roots := s.roots()
+	best, bestRoot := "", ""
+	for _, root := range roots {
+		local := s.localRoot(root)
+		if rel, err := filepath.Rel(local, dir); err == nil && !strings.HasPrefix(rel, "..") && len(local) > len(best) {
+			best, bestRoot = local, root
+		}
+	}
+	if best == "" {
+		return dir
+	}
+	rel, _ := filepath.Rel(best, dir)
+	if len(roots) > 1 {
+		if isRemote(bestRoot) {
+			return strings.TrimSuffix(redactURL(bestRoot), "/") + "/" + filepath.ToSlash(rel)
+		}
+		return filepath.Join(best, rel)
+	}
+	// Files of an archive given as the path show the archive name.
+	if archiveKind(best) != "" {
+		if info, err := os.Stat(best); err == nil && !info.IsDir() {
+			return filepath.Join(filepath.Base(best), rel)
+		}
+	}
+	return rel
+}
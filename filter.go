@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Index of the date column, the default sort order of the files table.
+const dateColumn = 3
+
+// FilesViewModel holds the search, filters and sort order applied to the
+// files table. The model's rows stay the full list of files, the table only
+// shows the rows passing the filters.
+type FilesViewModel struct {
+	Search       textinput.Model
+	Searching    bool
+	DateInput    textinput.Model
+	EditingDates bool
+	State        string
+	DateFrom     time.Time
+	DateTo       time.Time
+	SortColumn   int
+	SortDesc     bool
+	Err          string
+}
+
+func initialFilesViewModel() FilesViewModel {
+	search := textinput.New()
+	search.Prompt = "/"
+	search.Placeholder = "file name"
+
+	dates := textinput.New()
+	dates.Prompt = "Dates: "
+	dates.Placeholder = "YYYY-MM-DD..YYYY-MM-DD"
+
+	return FilesViewModel{Search: search, DateInput: dates, SortColumn: dateColumn}
+}
+
+// Editing reports whether a text input has the keyboard.
+func (m FilesViewModel) Editing() bool {
+	return m.Searching || m.EditingDates
+}
+
+// Filtered reports whether any filter is hiding rows.
+func (m FilesViewModel) Filtered() bool {
+	return m.Search.Value() != "" || m.State != "" || !m.DateFrom.IsZero() || !m.DateTo.IsZero()
+}
+
+// Visible reports whether the filter line is shown below the table.
+func (m FilesViewModel) Visible() bool {
+	return m.Editing() || m.Filtered() || m.Err != ""
+}
+
+// Apply returns the rows passing the filters in the selected sort order.
+func (m FilesViewModel) Apply(rows []table.Row) []table.Row {
+	query := strings.ToLower(m.Search.Value())
+	visible := make([]table.Row, 0, len(rows))
+	for _, row := range rows {
+		if query != "" && !strings.Contains(strings.ToLower(row[1]), query) {
+			continue
+		}
+		if m.State != "" && row[2] != m.State {
+			continue
+		}
+		if !m.DateFrom.IsZero() || !m.DateTo.IsZero() {
+			date, err := parseDate(row[3])
+			if err != nil {
+				continue
+			}
+			if !m.DateFrom.IsZero() && date.Before(m.DateFrom) {
+				continue
+			}
+			if !m.DateTo.IsZero() && date.After(m.DateTo) {
+				continue
+			}
+		}
+		visible = append(visible, row)
+	}
+
+	// Rows are kept in date order already, so the default order needs no sort.
+	if m.SortColumn != dateColumn || m.SortDesc {
+		sort.SliceStable(visible, func(i, j int) bool {
+			if m.SortDesc {
+				return lessRowColumn(visible[j], visible[i], m.SortColumn)
+			}
+			return lessRowColumn(visible[i], visible[j], m.SortColumn)
+		})
+	}
+	return visible
+}
+
+// Key identifies the filters and sort order, rows need to be filtered again
+// when it changes.
+func (m FilesViewModel) Key() string {
+	return fmt.Sprintf("%s|%s|%v|%v|%d|%v", m.Search.Value(), m.State, m.DateFrom, m.DateTo, m.SortColumn, m.SortDesc)
+}
+
+// Volatile reports whether the result of Apply depends on columns that change
+// while files are processed, the state filter and sorting on other columns
+// than the date.
+func (m FilesViewModel) Volatile() bool {
+	return m.State != "" || m.SortColumn != dateColumn
+}
+
+// lessRowColumn compares a column of two rows, numerically when both values
+// start with a number so counts and durations sort by size.
+func lessRowColumn(a, b table.Row, column int) bool {
+	if column == dateColumn {
+		return lessRowDate(a, b)
+	}
+	numA, errA := strconv.ParseFloat(strings.Fields(a[column] + " x")[0], 64)
+	numB, errB := strconv.ParseFloat(strings.Fields(b[column] + " x")[0], 64)
+	switch {
+	case errA == nil && errB == nil:
+		return numA < numB
+	case errA == nil:
+		return true
+	case errB == nil:
+		return false
+	}
+	return strings.ToLower(a[column]) < strings.ToLower(b[column])
+}
+
+// nextState cycles the state filter through the states present in rows.
+func (m FilesViewModel) nextState(rows []table.Row) string {
+	var states []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		if !seen[row[2]] {
+			seen[row[2]] = true
+			states = append(states, row[2])
+		}
+	}
+	sort.Strings(states)
+	for i, state := range states {
+		if state == m.State && i+1 < len(states) {
+			return states[i+1]
+		}
+	}
+	if m.State == "" && len(states) > 0 {
+		return states[0]
+	}
+	return ""
+}
+
+// parseDateRange parses "from..to", where either side may be left empty.
+func parseDateRange(value string) (time.Time, time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, time.Time{}, nil
+	}
+	fromStr, toStr, found := strings.Cut(value, "..")
+	if !found {
+		toStr = fromStr
+	}
+	var from, to time.Time
+	var err error
+	if strings.TrimSpace(fromStr) != "" {
+		if from, err = parseDate(strings.TrimSpace(fromStr)); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start date %q", fromStr)
+		}
+	}
+	if strings.TrimSpace(toStr) != "" {
+		if to, err = parseDate(strings.TrimSpace(toStr)); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end date %q", toStr)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end date is before start date")
+	}
+	return from, to, nil
+}
+
+// UpdateInput passes a key to the text input being edited.
+func (m FilesViewModel) UpdateInput(msg tea.KeyMsg) (FilesViewModel, tea.Cmd) {
+	var cmd tea.Cmd
+	if m.Searching {
+		switch msg.String() {
+		case "enter":
+			m.Searching = false
+			m.Search.Blur()
+		case "esc":
+			m.Searching = false
+			m.Search.Blur()
+			m.Search.SetValue("")
+		default:
+			m.Search, cmd = m.Search.Update(msg)
+		}
+		return m, cmd
+	}
+
+	switch msg.String() {
+	case "enter":
+		m.EditingDates = false
+		m.DateInput.Blur()
+		from, to, err := parseDateRange(m.DateInput.Value())
+		m.Err = ""
+		if err != nil {
+			m.Err = err.Error()
+			from, to = time.Time{}, time.Time{}
+		}
+		m.DateFrom, m.DateTo = from, to
+	case "esc":
+		m.EditingDates = false
+		m.DateInput.Blur()
+	default:
+		m.DateInput, cmd = m.DateInput.Update(msg)
+	}
+	return m, cmd
+}
+
+// SortBy sorts on column, reversing the order when it is already sorted on it.
+func (m FilesViewModel) SortBy(column int) FilesViewModel {
+	if column == m.SortColumn {
+		m.SortDesc = !m.SortDesc
+	} else {
+		m.SortColumn = column
+		m.SortDesc = false
+	}
+	return m
+}
+
+// Columns returns the table columns with the sort indicator on the sorted
+// one, widened so the indicator does not truncate its title.
+func (m FilesViewModel) Columns(columns []table.Column) []table.Column {
+	result := make([]table.Column, len(columns))
+	copy(result, columns)
+	for i := range result {
+		if title, found := strings.CutSuffix(result[i].Title, " ▲"); found {
+			result[i].Title, result[i].Width = title, result[i].Width-2
+		} else if title, found := strings.CutSuffix(result[i].Title, " ▼"); found {
+			result[i].Title, result[i].Width = title, result[i].Width-2
+		}
+	}
+	arrow := " ▲"
+	if m.SortDesc {
+		arrow = " ▼"
+	}
+	result[m.SortColumn].Title += arrow
+	result[m.SortColumn].Width += 2
+	return result
+}
+
+// ClearFilters removes the search, state and date filters.
+func (m FilesViewModel) ClearFilters() FilesViewModel {
+	m.Search.SetValue("")
+	m.DateInput.SetValue("")
+	m.State = ""
+	m.DateFrom, m.DateTo = time.Time{}, time.Time{}
+	m.Err = ""
+	return m
+}
+
+func (m FilesViewModel) View(shown, total int) string {
+	if m.Searching {
+		return m.Search.View()
+	}
+	if m.EditingDates {
+		return m.DateInput.View()
+	}
+
+	var parts []string
+	if m.Search.Value() != "" {
+		parts = append(parts, "Search: "+m.Search.Value())
+	}
+	if m.State != "" {
+		parts = append(parts, "State: "+m.State)
+	}
+	if !m.DateFrom.IsZero() || !m.DateTo.IsZero() {
+		parts = append(parts, "Dates: "+m.DateInput.Value())
+	}
+	parts = append(parts, fmt.Sprintf("%d of %d files", shown, total))
+	s := strings.Join(parts, "  ")
+	if m.Err != "" {
+		s += "  " + lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render(m.Err)
+	}
+	return s
+}
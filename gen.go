@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// genConfig are the flags of the gen subcommand.
+type genConfig struct {
+	out        string
+	tags       int
+	rate       time.Duration
+	duration   time.Duration
+	start      time.Time
+	noise      float64
+	statusRate float64
+	corrupt    []genCorruption
+	seed       int64
+}
+
+// genCorruption is a way gen can damage a file set, to reproduce the files
+// the health check reports.
+type genCorruption struct {
+	name        string
+	description string
+}
+
+// Corruptions gen can apply, each to a file set of its own.
+var genCorruptions = []genCorruption{
+	{"truncate", "float file cut off in the middle of a record"},
+	{"count", "float file header counting more records than the file holds"},
+	{"negative", "float file header with a negative record count"},
+	{"garbage", "float records with unreadable timestamps"},
+	{"orphan", "float records of tag ids missing from the tag file"},
+	{"backwards", "float records older than the record before them"},
+	{"tagfile", "tag file cut off in the middle of a record"},
+	{"notag", "float file without its tag file"},
+	{"nofloat", "tag file without its float file"},
+}
+
+func findGenCorruption(name string) (genCorruption, bool) {
+	for _, corruption := range genCorruptions {
+		if corruption.name == name {
+			return corruption, true
+		}
+	}
+	return genCorruption{}, false
+}
+
+// Status codes of bad quality records.
+var genStatusCodes = []byte{'U', 'S', 'E', 'D'}
+
+func parseGenFlags(args []string) (genConfig, error) {
+	cfg := genConfig{}
+	fs := flag.NewFlagSet("gen", flag.ContinueOnError)
+	fs.StringVar(&cfg.out, "out", "", "Folder the DAT files are written to")
+	fs.IntVar(&cfg.tags, "tags", 100, "Number of tags")
+	fs.DurationVar(&cfg.rate, "rate", 10*time.Second, "Time between the samples of each tag")
+	fs.DurationVar(&cfg.duration, "duration", 24*time.Hour, "Time covered by the files, a file set is written per day")
+	start := fs.String("start", "2024-01-01", "Time of the first sample, as 2006-01-02 or 2006-01-02T15:04:05")
+	fs.Float64Var(&cfg.noise, "noise", 0.01, "Standard deviation of the noise added to each sample, relative to the range of its tag")
+	fs.Float64Var(&cfg.statusRate, "status", 0.001, "Fraction of the samples written with a bad status code")
+	var names []string
+	for _, corruption := range genCorruptions {
+		names = append(names, corruption.name)
+	}
+	corrupt := fs.String("corrupt", "", "Comma separated corruptions, applied to the file sets from the last one back: "+strings.Join(names, ", "))
+	fs.Int64Var(&cfg.seed, "seed", 1, "Seed of the random values, the same seed writes the same files")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	var err error
+	switch {
+	case cfg.out == "":
+		return cfg, fmt.Errorf("-out must name the folder the DAT files are written to")
+	case cfg.tags < 1 || cfg.tags > maxDatTagID+1:
+		return cfg, fmt.Errorf("-tags must be between 1 and %d", maxDatTagID+1)
+	case cfg.rate < time.Millisecond:
+		return cfg, fmt.Errorf("-rate must be at least 1ms")
+	case cfg.duration < cfg.rate:
+		return cfg, fmt.Errorf("-duration must be at least -rate")
+	case cfg.statusRate < 0 || cfg.statusRate > 1:
+		return cfg, fmt.Errorf("-status must be between 0 and 1")
+	}
+	if cfg.start, err = time.Parse("2006-01-02T15:04:05", *start); err != nil {
+		if cfg.start, err = time.Parse("2006-01-02", *start); err != nil {
+			return cfg, fmt.Errorf("invalid -start %s", *start)
+		}
+	}
+	for _, name := range strings.Split(*corrupt, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		corruption, ok := findGenCorruption(name)
+		if !ok {
+			return cfg, fmt.Errorf("unknown corruption %s", name)
+		}
+		cfg.corrupt = append(cfg.corrupt, corruption)
+	}
+	if sets := cfg.setCount(); len(cfg.corrupt) > sets {
+		return cfg, fmt.Errorf("-corrupt names %d corruptions for %d file sets, a file set takes one, raise -duration", len(cfg.corrupt), sets)
+	}
+	return cfg, nil
+}
+
+// setCount returns the number of file sets written, one per day from -start
+// to the end of -duration.
+func (cfg genConfig) setCount() int {
+	end := cfg.start.Add(cfg.duration)
+	sets := 0
+	for from := cfg.start; from.Before(end); sets++ {
+		from = time.Date(from.Year(), from.Month(), from.Day()+1, 0, 0, 0, 0, from.Location())
+	}
+	return sets
+}
+
+// genTag is a tag of the generated files and the process it follows.
+type genTag struct {
+	name  string
+	kind  string
+	base  float64
+	span  float64
+	phase float64
+	value float64
+}
+
+// Kinds of generated tags, the shape of their values over a day.
+var genTagKinds = []string{"Temp", "Press", "Flow", "Level", "Valve"}
+
+func newGenTags(count int, rng *rand.Rand) []*genTag {
+	tags := make([]*genTag, count)
+	for i := range tags {
+		kind := genTagKinds[i%len(genTagKinds)]
+		tag := &genTag{
+			name:  fmt.Sprintf(`Line%d\%s%02d`, i/(len(genTagKinds)*10)+1, kind, i/len(genTagKinds)%10+1),
+			kind:  kind,
+			base:  math.Round(rng.Float64()*100) + 10,
+			span:  math.Round(rng.Float64()*50) + 5,
+			phase: rng.Float64(),
+		}
+		tag.value = tag.base
+		if kind == "Valve" {
+			tag.base, tag.span, tag.value = 0, 1, float64(rng.Intn(2))
+		}
+		tags[i] = tag
+	}
+	return tags
+}
+
+// sample returns the value of the tag at t. Temperatures follow the day,
+// pressures a faster cycle, flows wander, levels fill and drain and valves
+// switch now and then.
+func (t *genTag) sample(at time.Time, noise float64, rng *rand.Rand) float64 {
+	midnight := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	day := at.Sub(midnight).Hours() / 24
+	switch t.kind {
+	case "Temp":
+		t.value = t.base + t.span/2*math.Sin(2*math.Pi*(day+t.phase))
+	case "Press":
+		t.value = t.base + t.span/5*math.Sin(2*math.Pi*(4*day+t.phase))
+	case "Flow":
+		t.value = math.Max(t.base-t.span/2, math.Min(t.base+t.span/2, t.value+rng.NormFloat64()*t.span/100))
+	case "Level":
+		t.value = t.base + t.span*(math.Mod(3*day+t.phase, 1)-0.5)
+	case "Valve":
+		if rng.Float64() < 0.001 {
+			t.value = 1 - t.value
+		}
+		return t.value
+	}
+	return t.value + rng.NormFloat64()*noise*t.span
+}
+
+// runGen is the gen subcommand, it writes synthetic float and tag file sets.
+func runGen(args []string) error {
+	cfg, err := parseGenFlags(args)
+	if err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(cfg.seed))
+	tags := newGenTags(cfg.tags, rng)
+	tagRecords := make([]*LibDAT.DatTagRecord, len(tags))
+	for i, tag := range tags {
+		// Every tag is written with the same type and data type.
+		tagRecords[i] = &LibDAT.DatTagRecord{Name: tag.name, ID: i, Type: 1, Dtype: 2}
+	}
+
+	// A file set is started at the first sample and at every midnight after.
+	end := cfg.start.Add(cfg.duration)
+	var floatFileNames []string
+	total := 0
+	for from := cfg.start; from.Before(end); {
+		to := time.Date(from.Year(), from.Month(), from.Day()+1, 0, 0, 0, 0, from.Location())
+		if to.After(end) {
+			to = end
+		}
+		samples := int((to.Sub(from) + cfg.rate - 1) / cfg.rate)
+		if samples*len(tags) > math.MaxInt32 {
+			return fmt.Errorf("a day of %d tags every %s holds more records than a float file can count", len(tags), cfg.rate)
+		}
+		floatFileName := filepath.Join(cfg.out, datSetName(from))
+		for _, fileName := range []string{floatFileName, tagFileOf(floatFileName)} {
+			if _, err := os.Stat(fileName); err == nil {
+				return fmt.Errorf("%s already exists", fileName)
+			}
+		}
+		if err := writeTagFile(tagFileOf(floatFileName), from, tagRecords); err != nil {
+			return err
+		}
+		first, last := from.Equal(cfg.start), !to.Before(end)
+		err := writeFloatRecords(floatFileName, from, samples*len(tags), func(write func(*LibDAT.DatFloatRecord) error) error {
+			record := &LibDAT.DatFloatRecord{}
+			for i := 0; i < samples; i++ {
+				at := from.Add(time.Duration(i) * cfg.rate)
+				for id, tag := range tags {
+					*record = LibDAT.DatFloatRecord{TimeStamp: at, TagID: id, Val: tag.sample(at, cfg.noise, rng), Status: ' ', Marker: ' '}
+					if rng.Float64() < cfg.statusRate {
+						record.Status = genStatusCodes[rng.Intn(len(genStatusCodes))]
+						record.Val = 0
+					}
+					// Logging begins with the first sample and ends with the last.
+					if first && i == 0 {
+						record.Marker = 'B'
+					} else if last && i == samples-1 {
+						record.Marker = 'E'
+					}
+					if err := write(record); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			os.Remove(tagFileOf(floatFileName))
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s, %d records\n", floatFileName, samples*len(tags))
+		floatFileNames = append(floatFileNames, floatFileName)
+		total += samples * len(tags)
+		from = to
+	}
+
+	// Corruptions are applied from the last file set back, one set each.
+	for i, corruption := range cfg.corrupt {
+		floatFileName := floatFileNames[len(floatFileNames)-1-i]
+		if err := corruptDatSet(floatFileName, corruption.name, len(tags), rng); err != nil {
+			return fmt.Errorf("failed to corrupt %s: %v", floatFileName, err)
+		}
+		fmt.Fprintf(os.Stderr, "Corrupted %s: %s\n", filepath.Base(floatFileName), corruption.description)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d file sets, %d tags, %d records\n", len(floatFileNames), len(tags), total)
+	return nil
+}
+
+// corruptDatSet damages a written file set the way name describes.
+func corruptDatSet(floatFileName, name string, tagCount int, rng *rand.Rand) error {
+	switch name {
+	case "notag":
+		return os.Remove(tagFileOf(floatFileName))
+	case "nofloat":
+		return os.Remove(floatFileName)
+	case "tagfile":
+		return os.Truncate(tagFileOf(floatFileName), tagHeaderLength+tagRecordLength*int64(tagCount)/2+tagRecordLength/2)
+	}
+
+	file, err := os.OpenFile(floatFileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	count := (info.Size() - floatHeaderLength) / floatRecordLength
+	// offset returns the offset of a random record, or of the field at
+	// field bytes into it.
+	offset := func(field int64) int64 {
+		return floatHeaderLength + rng.Int63n(max(count-1, 1))*floatRecordLength + field
+	}
+	countField := make([]byte, 4)
+	switch name {
+	case "truncate":
+		return file.Truncate(floatHeaderLength + count*2/3*floatRecordLength + floatRecordLength/2)
+	case "count":
+		binary.LittleEndian.PutUint32(countField, uint32(count+1000))
+		_, err = file.WriteAt(countField, 4)
+	case "negative":
+		binary.LittleEndian.PutUint32(countField, uint32(0xFFFFFFFF))
+		_, err = file.WriteAt(countField, 4)
+	case "garbage":
+		for i := 0; i < 5 && err == nil; i++ {
+			_, err = file.WriteAt([]byte("################"), offset(1))
+		}
+	case "orphan":
+		for i := 0; i < 5 && err == nil; i++ {
+			_, err = file.WriteAt([]byte(fmt.Sprintf("%5d", tagCount+i)), offset(20))
+		}
+	case "backwards":
+		// A record is given the time of one at least a sample later.
+		later := make([]byte, 19)
+		at := offset(1)
+		if _, err = file.ReadAt(later, min(at+int64(tagCount)*floatRecordLength, floatHeaderLength+(count-1)*floatRecordLength+1)); err == nil {
+			_, err = file.WriteAt(later, at)
+		}
+	}
+	return err
+}
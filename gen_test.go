@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseGenFlagsCorruptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-corrupt", "notag"}, true},
+		{[]string{"-corrupt", "notag,nofloat"}, false},
+		{[]string{"-duration", "72h", "-corrupt", "truncate,notag,orphan"}, true},
+		{[]string{"-duration", "72h", "-corrupt", "truncate,notag,orphan,count"}, false},
+		// A run starting at noon crosses midnight and writes two sets.
+		{[]string{"-start", "2024-01-01T12:00:00", "-corrupt", "truncate,notag"}, true},
+	}
+	for _, test := range tests {
+		_, err := parseGenFlags(append([]string{"-out", t.TempDir()}, test.args...))
+		if (err == nil) != test.ok {
+			t.Errorf("%v: error %v", test.args, err)
+		}
+	}
+}
+
+func TestGenKeepsStdout(t *testing.T) {
+	out := captureStdout(t, func() {
+		if err := runGen([]string{"-out", t.TempDir(), "-tags", "2", "-rate", "1h", "-corrupt", "orphan"}); err != nil {
+			t.Error(err)
+		}
+	})
+	if out != "" {
+		t.Errorf("gen wrote to stdout: %q", out)
+	}
+}
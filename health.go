@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Consecutive failed checks after which the connection is considered lost.
+const healthLostAfter = 3
+
+// HealthChecker is implemented by sinks that can check their connection.
+// Ping may try to reconnect before it reports a failure.
+type HealthChecker interface {
+	Ping() error
+}
+
+type healthState int
+
+const (
+	healthConnected healthState = iota
+	healthDegraded
+	healthLost
+)
+
+type healthConfig struct {
+	interval time.Duration
+	slow     time.Duration
+}
+
+func registerHealthFlags() *healthConfig {
+	cfg := &healthConfig{}
+	flag.DurationVar(&cfg.interval, "healthInterval", 10*time.Second, "How often the connection is checked, 0 disables the checks")
+	flag.DurationVar(&cfg.slow, "healthSlow", time.Second, "Check latency above which the connection is shown as degraded")
+	return cfg
+}
+
+// HealthModel tracks the connection of the sink between health checks and
+// inserts.
+type HealthModel struct {
+	cfg      healthConfig
+	State    healthState
+	Latency  time.Duration
+	Checked  bool
+	Failures int
+	Err      string
+	// generation stops the check loop of a replaced sink.
+	generation int
+}
+
+type healthTickMsg struct {
+	generation int
+}
+
+type healthCheckMsg struct {
+	generation int
+	latency    time.Duration
+	err        string
+}
+
+func initialHealthModel(cfg healthConfig) HealthModel {
+	return HealthModel{cfg: cfg}
+}
+
+// Start resets the state after a successful connect and starts a new check
+// loop for sink, ending the loop of any previous sink.
+func (m HealthModel) Start(sink Sink) (HealthModel, tea.Cmd) {
+	m.generation++
+	m.State = healthConnected
+	m.Checked = false
+	m.Failures = 0
+	m.Err = ""
+	if _, ok := sink.(HealthChecker); !ok || m.cfg.interval <= 0 {
+		return m, nil
+	}
+	return m, m.tick()
+}
+
+func (m HealthModel) tick() tea.Cmd {
+	generation := m.generation
+	return tea.Tick(m.cfg.interval, func(time.Time) tea.Msg {
+		return healthTickMsg{generation: generation}
+	})
+}
+
+// Check pings the sink in the background.
+func (m HealthModel) Check(sink Sink) tea.Cmd {
+	checker, ok := sink.(HealthChecker)
+	if !ok {
+		return nil
+	}
+	generation := m.generation
+	return func() tea.Msg {
+		start := time.Now()
+		err := checker.Ping()
+		msg := healthCheckMsg{generation: generation, latency: time.Since(start)}
+		if err != nil {
+			msg.err = err.Error()
+		}
+		return msg
+	}
+}
+
+// Record updates the state with the result of a check or insert and returns
+// the message to show when the state changed.
+func (m HealthModel) Record(latency time.Duration, err string, target string) (HealthModel, statusLevel, string) {
+	previous := m.State
+	if err != "" {
+		m.Failures++
+		m.Err = err
+		m.State = healthDegraded
+		if m.Failures >= healthLostAfter {
+			m.State = healthLost
+		}
+	} else {
+		m.Failures = 0
+		m.Err = ""
+		m.State = healthConnected
+		if latency > 0 {
+			m.Latency = latency
+			m.Checked = true
+			if m.cfg.slow > 0 && latency > m.cfg.slow {
+				m.State = healthDegraded
+			}
+		}
+	}
+
+	if m.State == previous {
+		return m, statusInfo, ""
+	}
+	switch m.State {
+	case healthLost:
+		return m, statusError, fmt.Sprintf("Connection to %s lost, inserts are paused: %s", target, m.Err)
+	case healthDegraded:
+		if m.Err != "" {
+			return m, statusWarn, fmt.Sprintf("Connection to %s degraded: %s", target, m.Err)
+		}
+		return m, statusWarn, fmt.Sprintf("Connection to %s is slow, check took %s", target, formatLatency(m.Latency))
+	}
+	if previous == healthLost {
+		return m, statusInfo, fmt.Sprintf("Connection to %s restored, inserts resumed", target)
+	}
+	return m, statusInfo, fmt.Sprintf("Connection to %s restored", target)
+}
+
+// Lost marks the connection lost straight away, after an insert failed and
+// the sink did not answer a check either.
+func (m HealthModel) Lost(err string, target string) (HealthModel, statusLevel, string) {
+	m.Failures = healthLostAfter - 1
+	return m.Record(0, err, target)
+}
+
+func formatLatency(latency time.Duration) string {
+	if latency < time.Second {
+		return fmt.Sprintf("%d ms", latency.Milliseconds())
+	}
+	return fmt.Sprintf("%.1f s", latency.Seconds())
+}
+
+// inserting reports whether an insert is in flight, checks are skipped then
+// as the insert itself reports on the connection.
+func (m model) inserting() bool {
+	for _, row := range m.rows {
+		if row[2] == "Inserting" {
+			return true
+		}
+	}
+	return false
+}
+
+func updateWithHealthTickMsg(m model, msg healthTickMsg) (model, tea.Cmd) {
+	if msg.generation != m.health.generation {
+		return m, nil
+	}
+	if m.inserting() {
+		return m, m.health.tick()
+	}
+	return m, m.health.Check(m.sink)
+}
+
+func updateWithHealthCheckMsg(m model, msg healthCheckMsg) (model, tea.Cmd) {
+	if msg.generation != m.health.generation {
+		return m, nil
+	}
+	var level statusLevel
+	var message string
+	m.health, level, message = m.health.Record(msg.latency, msg.err, m.sink.Target())
+	cmds := []tea.Cmd{m.health.tick()}
+	if message != "" {
+		cmds = append(cmds, m.notify(level, message))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+// recordInsert updates the connection state after an insert. A failed insert
+// counts against the connection only when the sink failed its check as well,
+// an insert the sink rejected while it answered is an error of the file alone.
+func (m *model) recordInsert(err string, connectionLost bool) tea.Cmd {
+	var level statusLevel
+	var message string
+	if connectionLost {
+		m.health, level, message = m.health.Lost(err, m.sink.Target())
+	} else {
+		m.health, level, message = m.health.Record(0, "", m.sink.Target())
+	}
+	if message == "" {
+		return nil
+	}
+	return m.notify(level, message)
+}
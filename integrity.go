@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// Index of the health column in the files table.
+const healthColumn = 10
+
+// Health column values.
+const (
+	healthOK = "OK"
+	// healthWarn files are read as they are, the issues found are reported.
+	healthWarn = "Warn"
+	// healthSalvaged files cannot be read by LibDAT as they are, their
+	// readable records are read one by one instead.
+	healthSalvaged   = "Salvaged"
+	healthUnreadable = "Unreadable"
+	// healthFallback float files have no tag file and are read with the tag
+	// file of the nearest day, see pair.
+	healthFallback = "Fallback"
+	// healthUnpaired tag files have no float file and are not read.
+	healthUnpaired = "Unpaired"
+)
+
+// floatChunkRecords is the number of float records checked at a time.
+const floatChunkRecords = 10000
+
+// datLayout is the dBase layout LibDAT reads a DAT file with.
+type datLayout struct {
+	name         string
+	headerLength int64
+	recordLength int64
+	// fields are the lengths of the fields LibDAT reads, in order. Fields
+	// after them are not read.
+	fields []int
+}
+
+var (
+	floatFileLayout = datLayout{name: "float", headerLength: floatHeaderLength, recordLength: floatRecordLength, fields: []int{8, 8, 3, 5, 8, 1, 1}}
+	tagFileLayout   = datLayout{name: "tag", headerLength: tagHeaderLength, recordLength: tagRecordLength, fields: []int{255, 5, 1, 2}}
+)
+
+// IntegrityReport is the result of checking a float file and its tag file.
+type IntegrityReport struct {
+	Health string
+	Issues []string
+	// Salvage is set when the files are read record by record rather than
+	// through LibDAT.
+	Salvage bool
+	Date    string
+	// TagCount and FloatCount are the readable records of each file.
+	TagCount   int
+	FloatCount int
+	// Backwards is the number of float records older than the record
+	// before them.
+	Backwards int
+	// Scanned is set when the float records were checked, otherwise they
+	// are checked once they are loaded.
+	Scanned bool
+	// Fallback is the tag file of another day the float file is read with.
+	Fallback string
+}
+
+func (r IntegrityReport) issue(format string, args ...any) IntegrityReport {
+	r.Issues = append(r.Issues, fmt.Sprintf(format, args...))
+	return r
+}
+
+func (r IntegrityReport) unreadable(format string, args ...any) IntegrityReport {
+	r = r.issue(format, args...)
+	r.Health = healthUnreadable
+	return r
+}
+
+// Summary returns the first issue of the report, and how many more there are.
+func (r IntegrityReport) Summary() string {
+	switch len(r.Issues) {
+	case 0:
+		return ""
+	case 1:
+		return r.Issues[0]
+	}
+	return fmt.Sprintf("%s (and %d more)", r.Issues[0], len(r.Issues)-1)
+}
+
+// datHeader is the dBase header of a DAT file.
+type datHeader struct {
+	date         string
+	count        int32
+	headerLength int64
+	recordLength int64
+	fields       []int
+	size         int64
+}
+
+func readDatHeader(fileName string) (datHeader, error) {
+	var h datHeader
+	file, err := os.Open(fileName)
+	if err != nil {
+		return h, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return h, err
+	}
+	h.size = info.Size()
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return h, fmt.Errorf("the file is %d bytes, too short for a header", h.size)
+	}
+	h.date = fmt.Sprintf("%04d-%02d-%02d", int(header[1])+1900, header[2], header[3])
+	h.count = int32(binary.LittleEndian.Uint32(header[4:8]))
+	h.headerLength = int64(binary.LittleEndian.Uint16(header[8:10]))
+	h.recordLength = int64(binary.LittleEndian.Uint16(header[10:12]))
+
+	// The field descriptors follow in 32 byte blocks up to a 0x0D byte.
+	descriptor := make([]byte, 32)
+	for offset := int64(32); offset < h.headerLength && offset < h.size; offset += 32 {
+		if _, err := file.ReadAt(descriptor[:1], offset); err != nil || descriptor[0] == 0x0D {
+			break
+		}
+		if _, err := file.ReadAt(descriptor, offset); err != nil {
+			break
+		}
+		h.fields = append(h.fields, int(descriptor[16]))
+	}
+	return h, nil
+}
+
+// check compares the header with the layout LibDAT reads and with the size
+// of the file. salvage is set when LibDAT would misread the file.
+func (h datHeader) check(layout datLayout, report IntegrityReport) (IntegrityReport, bool) {
+	salvage := false
+	if h.headerLength != layout.headerLength || h.recordLength != layout.recordLength {
+		report = report.issue("%s file has a %d byte header and %d byte records, %d and %d are expected", layout.name, h.headerLength, h.recordLength, layout.headerLength, layout.recordLength)
+		salvage = true
+	}
+	if !sameFields(h.fields, layout.fields) {
+		report = report.issue("%s file fields are %v, %v are expected", layout.name, h.fields, layout.fields)
+		salvage = true
+	}
+
+	headerLength, recordLength := usableLayout(h, layout)
+	records := max(h.size-headerLength, 0) / recordLength
+	// The file may end in a 0x1A end of file marker.
+	if rest := max(h.size-headerLength, 0) % recordLength; rest > 1 {
+		report = report.issue("%s file ends in a partial record of %d bytes", layout.name, rest)
+	}
+	switch {
+	case h.count < 0:
+		report = report.issue("%s file header counts %d records", layout.name, h.count)
+		salvage = true
+	case int64(h.count) > records:
+		report = report.issue("%s file header counts %d records but the file holds %d, it is truncated", layout.name, h.count, records)
+		salvage = true
+	case int64(h.count) < records:
+		report = report.issue("%s file holds %d records but the header counts %d", layout.name, records, h.count)
+		salvage = true
+	}
+	return report, salvage
+}
+
+func sameFields(fields, expected []int) bool {
+	if len(fields) < len(expected) {
+		return false
+	}
+	for i, length := range expected {
+		if fields[i] != length {
+			return false
+		}
+	}
+	return true
+}
+
+// usableLayout returns the header and record length to salvage records
+// with, those of the header when they are plausible.
+func usableLayout(h datHeader, layout datLayout) (int64, int64) {
+	if h.headerLength < 32 || h.recordLength < layout.recordLength {
+		return layout.headerLength, layout.recordLength
+	}
+	return h.headerLength, h.recordLength
+}
+
+// parseTagRecord decodes a tag record the way LibDAT does.
+func parseTagRecord(buffer []byte) (*LibDAT.DatTagRecord, error) {
+	name := strings.TrimSpace(string(buffer[1:256]))
+	id, err := strconv.Atoi(strings.TrimSpace(string(buffer[256:261])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag id %q", buffer[256:261])
+	}
+	typ, err := strconv.Atoi(string(buffer[261:262]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag type %q", buffer[261:262])
+	}
+	dtype, err := strconv.Atoi(strings.TrimSpace(string(buffer[262:264])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid data type %q", buffer[262:264])
+	}
+	return &LibDAT.DatTagRecord{Name: name, ID: id, Type: typ, Dtype: dtype}, nil
+}
+
+// salvageTagRecords reads every readable tag record of the tag file of a
+// float file, whatever its header counts.
+func salvageTagRecords(floatFileName string) ([]*LibDAT.DatTagRecord, int, error) {
+	tagFileName := strings.Replace(floatFileName, " (Float)", " (Tagname)", 1)
+	h, err := readDatHeader(tagFileName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read tag file: %v", err)
+	}
+	data, err := os.ReadFile(tagFileName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read tag file: %v", err)
+	}
+	headerLength, recordLength := usableLayout(h, tagFileLayout)
+	var records []*LibDAT.DatTagRecord
+	skipped := 0
+	for offset := headerLength; offset+recordLength <= int64(len(data)); offset += recordLength {
+		buffer := data[offset : offset+recordLength]
+		if buffer[0] == '*' || buffer[0] == 0x1A {
+			continue
+		}
+		record, err := parseTagRecord(buffer)
+		if err != nil {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, skipped, nil
+}
+
+// floatRecordReader reads the readable records of a float file a chunk at a
+// time, whatever its header counts.
+type floatRecordReader struct {
+	file         *os.File
+	headerLength int64
+	recordLength int64
+	total        int64
+	read         int64
+	// skipped is the number of records read so far that were not readable.
+	skipped int
+}
+
+func openFloatRecords(fileName string) (*floatRecordReader, error) {
+	h, err := readDatHeader(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read float file: %v", err)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open float file: %v", err)
+	}
+	headerLength, recordLength := usableLayout(h, floatFileLayout)
+	return &floatRecordReader{
+		file:         file,
+		headerLength: headerLength,
+		recordLength: recordLength,
+		total:        max(h.size-headerLength, 0) / recordLength,
+	}, nil
+}
+
+// next returns the next chunk of records, or no records at the end of the
+// file.
+func (r *floatRecordReader) next() ([]*LibDAT.DatFloatRecord, error) {
+	for r.read < r.total {
+		count := min(floatChunkRecords, r.total-r.read)
+		records, skipped, err := readFloatRecords(r.file, r.headerLength+r.read*r.recordLength, count, r.recordLength)
+		if err != nil {
+			return nil, err
+		}
+		r.read += count
+		r.skipped += skipped
+		if len(records) > 0 {
+			return records, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *floatRecordReader) Close() error {
+	return r.file.Close()
+}
+
+// scanFloatRecords calls fn with the readable records of a float file, a
+// chunk at a time, and returns the number of records that were not readable.
+func scanFloatRecords(fileName string, fn func([]*LibDAT.DatFloatRecord)) (int, error) {
+	r, err := openFloatRecords(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	for {
+		records, err := r.next()
+		if err != nil {
+			return r.skipped, err
+		}
+		if len(records) == 0 {
+			return r.skipped, nil
+		}
+		fn(records)
+	}
+}
+
+// salvageFloatRecords reads every readable record of a float file, whatever
+// its header counts.
+func salvageFloatRecords(fileName string) ([]*LibDAT.DatFloatRecord, error) {
+	var records []*LibDAT.DatFloatRecord
+	_, err := scanFloatRecords(fileName, func(chunk []*LibDAT.DatFloatRecord) {
+		records = append(records, chunk...)
+	})
+	return records, err
+}
+
+// checkDatFile checks a float file and its tag file: the header record
+// counts against the file sizes, the dBase field layout and the tag records.
+// The float records are only scanned when the float header does not check
+// out, otherwise checkFloatRecords checks them once they are read. pairing
+// gives the tag file the float file is read with.
+func checkDatFile(pairing *datPairing, fileName string) IntegrityReport {
+	return checkDatSet(pairing, fileName, false)
+}
+
+// checkDatSet checks a float file like checkDatFile. With scan set its
+// records are scanned in any case, that timestamps do not go back and that
+// every record belongs to a tag of the tag file.
+func checkDatSet(pairing *datPairing, fileName string, scan bool) IntegrityReport {
+	report := IntegrityReport{Health: healthOK}
+	staged, err := stagedPath(pairing, fileName)
+	if err != nil {
+		return report.unreadable("%v", err)
+	}
+
+	tagHeader, err := readDatHeader(strings.Replace(staged, " (Float)", " (Tagname)", 1))
+	if err != nil {
+		return report.unreadable("tag file: %v", err)
+	}
+	report.Date = tagHeader.date
+	report, salvageTags := tagHeader.check(tagFileLayout, report)
+	tags, skipped, err := salvageTagRecords(staged)
+	if err != nil {
+		return report.unreadable("%v", err)
+	}
+	if skipped > 0 {
+		report = report.issue("tag records not readable: %d", skipped)
+		salvageTags = true
+	}
+	if len(tags) == 0 {
+		return report.unreadable("tag file holds no readable tags")
+	}
+	report.TagCount = len(tags)
+	fallback, isFallback := pairing.Fallback(fileName)
+	if isFallback {
+		report.Fallback = fallback
+		report = report.issue("tag file missing, the tag file %s is used", filepath.Base(fallback))
+	} else if previous, ok := pairing.PreviousTagFile(fileName); ok {
+		report = compareTags(report, tags, previous)
+	}
+
+	floatHeader, err := readDatHeader(staged)
+	if err != nil {
+		return report.unreadable("float file: %v", err)
+	}
+	report, salvageFloats := floatHeader.check(floatFileLayout, report)
+	if isFallback {
+		// The tag file is of another day.
+		report.Date = floatHeader.date
+	}
+
+	// LibDAT reads a float file whose header checks out, its records are
+	// checked as they are loaded rather than read twice.
+	if !scan && !salvageFloats {
+		report.FloatCount = int(floatHeader.count)
+		report.Salvage = salvageTags
+		return report.withHealth(isFallback)
+	}
+
+	check := newFloatRecordCheck(tags)
+	skipped, err = scanFloatRecords(staged, check.add)
+	if err != nil {
+		return report.unreadable("%v", err)
+	}
+	if skipped > 0 {
+		report = report.issue("float records not readable and skipped: %d", skipped)
+		salvageFloats = true
+	}
+	report = check.issues(report)
+	report.FloatCount = check.count
+	report.Scanned = true
+	if report.FloatCount == 0 && floatHeader.count != 0 {
+		return report.unreadable("float file holds no readable records")
+	}
+	report.Salvage = salvageTags || salvageFloats
+	return report.withHealth(isFallback)
+}
+
+// withHealth sets the health from the issues found.
+func (r IntegrityReport) withHealth(isFallback bool) IntegrityReport {
+	switch {
+	case r.Salvage:
+		r.Health = healthSalvaged
+	case isFallback:
+		r.Health = healthFallback
+	case len(r.Issues) > 0:
+		r.Health = healthWarn
+	}
+	return r
+}
+
+// floatRecordCheck counts the float records going back in time and those of
+// tags missing from the tag file.
+type floatRecordCheck struct {
+	ids       map[int]bool
+	orphans   map[int]int
+	backwards int
+	last      time.Time
+	count     int
+}
+
+func newFloatRecordCheck(tags []*LibDAT.DatTagRecord) *floatRecordCheck {
+	ids := make(map[int]bool, len(tags))
+	for _, tag := range tags {
+		ids[tag.ID] = true
+	}
+	return &floatRecordCheck{ids: ids, orphans: make(map[int]int)}
+}
+
+func (c *floatRecordCheck) add(records []*LibDAT.DatFloatRecord) {
+	for _, record := range records {
+		if record.TimeStamp.Before(c.last) {
+			c.backwards++
+		}
+		c.last = record.TimeStamp
+		if !c.ids[record.TagID] {
+			c.orphans[record.TagID]++
+		}
+	}
+	c.count += len(records)
+}
+
+func (c *floatRecordCheck) issues(report IntegrityReport) IntegrityReport {
+	if c.backwards > 0 {
+		report = report.issue("float records older than the record before them: %d", c.backwards)
+		report.Backwards = c.backwards
+	}
+	if len(c.orphans) > 0 {
+		report = report.issue("float records of tag ids missing from the tag file: %d (ids %s)", sumCounts(c.orphans), formatIDs(c.orphans, 5))
+	}
+	return report
+}
+
+// checkFloatRecords checks the records LibDAT read for a file whose records
+// were not scanned by checkDatFile, and returns the report with the issues
+// found added.
+func checkFloatRecords(report IntegrityReport, tags []*LibDAT.DatTagRecord, records []*LibDAT.DatFloatRecord) IntegrityReport {
+	check := newFloatRecordCheck(tags)
+	valid := make([]*LibDAT.DatFloatRecord, 0, len(records))
+	for _, record := range records {
+		if record != nil && record.IsValid {
+			valid = append(valid, record)
+		}
+	}
+	check.add(valid)
+	if skipped := len(records) - len(valid); skipped > 0 {
+		report = report.issue("float records not readable and skipped: %d", skipped)
+	}
+	report = check.issues(report)
+	report.Scanned = true
+	return report.withHealth(report.Fallback != "")
+}
+
+// compareTags reports tags added, removed or renamed since the tag file of
+// the day before. The ids of renamed tags no longer match their history.
+func compareTags(report IntegrityReport, tags []*LibDAT.DatTagRecord, previousFileName string) IntegrityReport {
+	previous, err := readTagFile(previousFileName)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Failed to read %s to compare tags: %v", previousFileName, err))
+		return report
+	}
+	added, removed, renamed := tagChanges(tags, previous)
+	if added+removed+renamed == 0 {
+		return report
+	}
+	return report.issue("tags differ from %s: %d added, %d removed, %d renamed", filepath.Base(previousFileName), added, removed, renamed)
+}
+
+func sumCounts(counts map[int]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+// formatIDs lists up to limit of the ids in counts in order.
+func formatIDs(counts map[int]int, limit int) string {
+	ids := make([]int, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	parts := make([]string, 0, limit+1)
+	for i, id := range ids {
+		if i == limit {
+			parts = append(parts, fmt.Sprintf("and %d more", len(ids)-limit))
+			break
+		}
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readTagRecords reads the tag records of a float file through LibDAT, or
+// salvages them when its check found LibDAT cannot read them.
+func readTagRecords(dr *LibDAT.DatReader, staged string, report IntegrityReport) ([]*LibDAT.DatTagRecord, error) {
+	if report.Salvage {
+		records, _, err := salvageTagRecords(staged)
+		return records, err
+	}
+	return dr.ReadTagFile(staged)
+}
+
+// readFloatFileRecords reads the records of a float file through LibDAT, or
+// salvages them when its check found LibDAT cannot read them.
+func readFloatFileRecords(dr *LibDAT.DatReader, staged string, report IntegrityReport) ([]*LibDAT.DatFloatRecord, error) {
+	if report.Salvage {
+		return salvageFloatRecords(staged)
+	}
+	return dr.ReadFloatFile(staged)
+}
+
+// openDatFile checks a float file for the headless modes, logging the issues
+// found, and reads its tags. It returns the path the file is read from. The
+// float records are scanned too when scan is set.
+func openDatFile(dr *LibDAT.DatReader, pairing *datPairing, fileName string, scan bool) (IntegrityReport, string, []*LibDAT.DatTagRecord, error) {
+	report := checkDatSet(pairing, fileName, scan)
+	for _, issue := range report.Issues {
+		slog.Warn(fmt.Sprintf("%s: %s", fileName, issue))
+	}
+	if report.Health == healthUnreadable {
+		return report, "", nil, fmt.Errorf("%s", report.Summary())
+	}
+	staged, err := stagedPath(pairing, fileName)
+	if err != nil {
+		return report, "", nil, err
+	}
+	tags, err := readTagRecords(dr, staged, report)
+	return report, staged, tags, err
+}
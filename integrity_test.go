@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDatFileLeavesRecordsToTheLoad(t *testing.T) {
+	dir := genSet(t, "-tags", "5", "-rate", "1h", "-duration", "48h", "-corrupt", "backwards,orphan")
+	// The headers of both sets check out, their records are not scanned.
+	backwards := filepath.Join(dir, "2024 01 02 0000 (Float).DAT")
+	report := checkDatFile(nil, backwards)
+	if report.Scanned || report.Health != healthOK || report.FloatCount != 5*24 {
+		t.Fatalf("the header check is %+v", report)
+	}
+	if scanned := checkDatSet(nil, backwards, true); !scanned.Scanned || scanned.Backwards == 0 || scanned.Health != healthWarn {
+		t.Errorf("the scan is %+v", scanned)
+	}
+
+	// The load checks the records it read.
+	sink := newMemorySink()
+	m := newTestModel(t, dir, sink)
+	m = runModel(t, m, m.Init(), loaded(2))
+	next, cmd := m.Update(keyPress("p"))
+	m = runModel(t, asModel(next), cmd, processed)
+	for _, row := range m.rows {
+		report := m.datFileRecords[row[1]].Integrity
+		if row[healthColumn] != healthWarn || !report.Scanned || len(report.Issues) != 1 {
+			t.Errorf("%s is %s after the load: %v", filepath.Base(row[1]), row[healthColumn], report.Issues)
+		}
+	}
+	if m.datFileRecords[backwards].Integrity.Backwards == 0 {
+		t.Error("the records going back are not counted")
+	}
+}
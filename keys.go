@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+)
+
+// keyMap holds the key bindings of the files table, the file detail, the plot,
+// the log pane and the connection dialog. The bindings can be remapped in the config file by the
+// names returned from bindings.
+type keyMap struct {
+	Up          key.Binding
+	Down        key.Binding
+	PageUp      key.Binding
+	PageDown    key.Binding
+	Details     key.Binding
+	Toggle      key.Binding
+	SelectAll   key.Binding
+	DeselectAll key.Binding
+	Invert      key.Binding
+	Range       key.Binding
+	SelectDates key.Binding
+	Search      key.Binding
+	State       key.Binding
+	Dates       key.Binding
+	Sort        key.Binding
+	ReverseSort key.Binding
+	Clear       key.Binding
+	Process     key.Binding
+	Connection  key.Binding
+	Browse      key.Binding
+	Messages    key.Binding
+	Logs        key.Binding
+	Help        key.Binding
+	Quit        key.Binding
+
+	// The file detail, plot and log pane also use the movement, Details,
+	// Search and Logs bindings above.
+	Back        key.Binding
+	TagSort     key.Binding
+	TagSortBack key.Binding
+	TagReverse  key.Binding
+	ZoomIn      key.Binding
+	ZoomOut     key.Binding
+	PanLeft     key.Binding
+	PanRight    key.Binding
+	PanStart    key.Binding
+	PanEnd      key.Binding
+	ResetZoom   key.Binding
+	LogLevel    key.Binding
+	LogFollow   key.Binding
+	LogSave     key.Binding
+	// The connection dialog also uses Back, Details and the movement
+	// bindings.
+	NextField key.Binding
+	PrevField key.Binding
+}
+
+func defaultKeyMap() keyMap {
+	return keyMap{
+		Up:          key.NewBinding(key.WithKeys("k", "up"), key.WithHelp("k/↑", "up")),
+		Down:        key.NewBinding(key.WithKeys("j", "down"), key.WithHelp("j/↓", "down")),
+		PageUp:      key.NewBinding(key.WithKeys("pgup", "b", "ctrl+u"), key.WithHelp("pgup/b", "page up")),
+		PageDown:    key.NewBinding(key.WithKeys("pgdown", "f", "ctrl+d"), key.WithHelp("pgdown/f", "page down")),
+		Details:     key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "details")),
+		Toggle:      key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "toggle select")),
+		SelectAll:   key.NewBinding(key.WithKeys("a"), key.WithHelp("a", "select all")),
+		DeselectAll: key.NewBinding(key.WithKeys("n"), key.WithHelp("n", "deselect all")),
+		Invert:      key.NewBinding(key.WithKeys("i"), key.WithHelp("i", "invert selection")),
+		Range:       key.NewBinding(key.WithKeys("v"), key.WithHelp("v", "mark range")),
+		SelectDates: key.NewBinding(key.WithKeys("D"), key.WithHelp("D", "select dates")),
+		Search:      key.NewBinding(key.WithKeys("/"), key.WithHelp("/", "search")),
+		State:       key.NewBinding(key.WithKeys("s"), key.WithHelp("s", "filter state")),
+		Dates:       key.NewBinding(key.WithKeys("d"), key.WithHelp("d", "filter dates")),
+		Sort:        key.NewBinding(key.WithKeys("o"), key.WithHelp("o", "sort column")),
+		ReverseSort: key.NewBinding(key.WithKeys("O"), key.WithHelp("O", "reverse sort")),
+		Clear:       key.NewBinding(key.WithKeys("esc"), key.WithHelp("esc", "clear filters")),
+		Process:     key.NewBinding(key.WithKeys("p"), key.WithHelp("p", "process selected")),
+		Connection:  key.NewBinding(key.WithKeys("c"), key.WithHelp("c", "connection")),
+		Browse:      key.NewBinding(key.WithKeys("B"), key.WithHelp("B", "browse folders")),
+		Messages:    key.NewBinding(key.WithKeys("m"), key.WithHelp("m", "messages")),
+		Logs:        key.NewBinding(key.WithKeys("L"), key.WithHelp("L", "log pane")),
+		Help:        key.NewBinding(key.WithKeys("?"), key.WithHelp("?", "help")),
+		Quit:        key.NewBinding(key.WithKeys("q"), key.WithHelp("q", "quit")),
+
+		Back:        key.NewBinding(key.WithKeys("esc"), key.WithHelp("esc", "back")),
+		TagSort:     key.NewBinding(key.WithKeys("s", "right"), key.WithHelp("s/→", "sort tags")),
+		TagSortBack: key.NewBinding(key.WithKeys("left"), key.WithHelp("←", "sort tags back")),
+		TagReverse:  key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "reverse tag sort")),
+		ZoomIn:      key.NewBinding(key.WithKeys("+", "="), key.WithHelp("+", "plot zoom in")),
+		ZoomOut:     key.NewBinding(key.WithKeys("-", "_"), key.WithHelp("-", "plot zoom out")),
+		PanLeft:     key.NewBinding(key.WithKeys("h", "left"), key.WithHelp("h/←", "plot pan left")),
+		PanRight:    key.NewBinding(key.WithKeys("l", "right"), key.WithHelp("l/→", "plot pan right")),
+		PanStart:    key.NewBinding(key.WithKeys("H", "home"), key.WithHelp("H/home", "plot start")),
+		PanEnd:      key.NewBinding(key.WithKeys("L", "end"), key.WithHelp("L/end", "plot end")),
+		ResetZoom:   key.NewBinding(key.WithKeys("0"), key.WithHelp("0", "plot reset")),
+		LogLevel:    key.NewBinding(key.WithKeys("e"), key.WithHelp("e", "log level")),
+		LogFollow:   key.NewBinding(key.WithKeys("F"), key.WithHelp("F", "log follow")),
+		LogSave:     key.NewBinding(key.WithKeys("w"), key.WithHelp("w", "save log")),
+		NextField:   key.NewBinding(key.WithKeys("tab"), key.WithHelp("tab", "next field")),
+		PrevField:   key.NewBinding(key.WithKeys("shift+tab"), key.WithHelp("shift+tab", "previous field")),
+	}
+}
+
+// bindings returns the bindings by the name used in the config file.
+func (k *keyMap) bindings() map[string]*key.Binding {
+	return map[string]*key.Binding{
+		"up":          &k.Up,
+		"down":        &k.Down,
+		"pageUp":      &k.PageUp,
+		"pageDown":    &k.PageDown,
+		"details":     &k.Details,
+		"toggle":      &k.Toggle,
+		"selectAll":   &k.SelectAll,
+		"deselectAll": &k.DeselectAll,
+		"invert":      &k.Invert,
+		"range":       &k.Range,
+		"selectDates": &k.SelectDates,
+		"search":      &k.Search,
+		"state":       &k.State,
+		"dates":       &k.Dates,
+		"sort":        &k.Sort,
+		"reverseSort": &k.ReverseSort,
+		"clear":       &k.Clear,
+		"process":     &k.Process,
+		"connection":  &k.Connection,
+		"browse":      &k.Browse,
+		"messages":    &k.Messages,
+		"logs":        &k.Logs,
+		"help":        &k.Help,
+		"quit":        &k.Quit,
+		"back":        &k.Back,
+		"tagSort":     &k.TagSort,
+		"tagSortBack": &k.TagSortBack,
+		"tagReverse":  &k.TagReverse,
+		"zoomIn":      &k.ZoomIn,
+		"zoomOut":     &k.ZoomOut,
+		"panLeft":     &k.PanLeft,
+		"panRight":    &k.PanRight,
+		"panStart":    &k.PanStart,
+		"panEnd":      &k.PanEnd,
+		"resetZoom":   &k.ResetZoom,
+		"logLevel":    &k.LogLevel,
+		"logFollow":   &k.LogFollow,
+		"logSave":     &k.LogSave,
+		"nextField":   &k.NextField,
+		"prevField":   &k.PrevField,
+	}
+}
+
+// remap replaces the keys of the named bindings, keeping their help text.
+func (k *keyMap) remap(keys map[string][]string) error {
+	bindings := k.bindings()
+	for name, keyNames := range keys {
+		binding, exists := bindings[name]
+		if !exists {
+			names := make([]string, 0, len(bindings))
+			for name := range bindings {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown key binding %q, expected one of %s", name, strings.Join(names, ", "))
+		}
+		if len(keyNames) == 0 {
+			return fmt.Errorf("key binding %q has no keys", name)
+		}
+		binding.SetKeys(keyNames...)
+		binding.SetHelp(strings.Join(keyNames, "/"), binding.Help().Desc)
+	}
+	return nil
+}
+
+// ShortHelp returns the bindings shown in the footer.
+func (k keyMap) ShortHelp() []key.Binding {
+	return []key.Binding{k.Help, k.Quit, k.Toggle, k.Details, k.Process, k.Search, k.SelectAll, k.DeselectAll}
+}
+
+// FullHelp returns the bindings shown in the help overlay, one group per column.
+func (k keyMap) FullHelp() [][]key.Binding {
+	return [][]key.Binding{
+		{k.Up, k.Down, k.PageUp, k.PageDown, k.Details},
+		{k.Toggle, k.SelectAll, k.DeselectAll, k.Invert, k.Range, k.SelectDates},
+		{k.Search, k.State, k.Dates, k.Sort, k.ReverseSort, k.Clear},
+		{k.Process, k.Connection, k.Browse, k.Messages, k.Logs, k.Help, k.Quit},
+		{k.Back, k.TagSort, k.TagSortBack, k.TagReverse, k.LogLevel, k.LogFollow, k.LogSave},
+		{k.ZoomIn, k.ZoomOut, k.PanLeft, k.PanRight, k.PanStart, k.PanEnd, k.ResetZoom},
+		{k.NextField, k.PrevField},
+	}
+}
+
+// keyHint renders a binding as it is shown in a key menu, as "[esc] Back".
+func keyHint(binding key.Binding, text string) string {
+	return fmt.Sprintf("[%s] %s", binding.Help().Key, text)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestRemappedPaneKeys(t *testing.T) {
+	keys := defaultKeyMap()
+	if err := keys.remap(map[string][]string{"logs": {"G"}, "zoomIn": {"z"}, "back": {"x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pane := initialLogPaneModel(keys)
+	pane.Active = true
+	if pane, _, _ = pane.Update(keyPress("L")); !pane.Active {
+		t.Error("the log pane closes on L after logs is remapped")
+	}
+	if pane, _, _ = pane.Update(keyPress("G")); pane.Active {
+		t.Error("the log pane does not close on the remapped key")
+	}
+
+	plot := OpenPlot(keys, tagStats{Name: "Temp"}, nil)
+	if plot = plot.Update(keyPress("z")); plot.zoom != 2 {
+		t.Errorf("the remapped zoom key zooms to %gx", plot.zoom)
+	}
+	if plot = plot.Update(tea.KeyMsg{Type: tea.KeyEsc}); !plot.Active {
+		t.Error("the plot closes on esc after back is remapped")
+	}
+	if plot = plot.Update(keyPress("x")); plot.Active {
+		t.Error("the plot does not close on the remapped back key")
+	}
+}
+
+func TestRemappedHistoryKeys(t *testing.T) {
+	keys := defaultKeyMap()
+	if err := keys.remap(map[string][]string{"back": {"x"}, "down": {"J"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var status StatusModel
+	for i := 0; i < 20; i++ {
+		status, _ = status.Push(statusInfo, "message")
+	}
+	status = status.OpenHistory(80, 7, keys)
+	status.Viewport.GotoTop()
+	if status, _ = status.UpdateHistory(keyPress("J")); status.Viewport.YOffset != 1 {
+		t.Errorf("the remapped down key scrolls to line %d", status.Viewport.YOffset)
+	}
+	if status, _ = status.UpdateHistory(tea.KeyMsg{Type: tea.KeyEsc}); !status.ShowHistory {
+		t.Error("the history closes on esc after back is remapped")
+	}
+	if !strings.Contains(status.HistoryView(), "[x] Back") {
+		t.Error("the key menu does not show the remapped back key")
+	}
+	if status, _ = status.UpdateHistory(keyPress("x")); status.ShowHistory {
+		t.Error("the history does not close on the remapped back key")
+	}
+}
+
+func TestRemappedConnectionKeys(t *testing.T) {
+	keys := defaultKeyMap()
+	if err := keys.remap(map[string][]string{"back": {"x"}, "details": {"ctrl+s"}, "nextField": {"ctrl+n"}}); err != nil {
+		t.Fatal(err)
+	}
+	dialog := initialConnectionDialogModel([]RecentServer{{Host: "historian", ProcessName: "test"}}, keys)
+	dialog.Active = true
+	dialog.Editable = true
+	dialog, _ = dialog.focus(connectionFocusHost)
+
+	// A remapped key typed into a field is text.
+	dialog, _, _ = dialog.Update(keyPress("x"))
+	if !dialog.Active || dialog.Host.Value() != "x" {
+		t.Fatalf("typing x into the host field gives %q", dialog.Host.Value())
+	}
+	if dialog, _, _ = dialog.Update(tea.KeyMsg{Type: tea.KeyTab}); dialog.Focus != connectionFocusHost {
+		t.Error("tab moves the focus after next field is remapped")
+	}
+	if dialog, _, _ = dialog.Update(tea.KeyMsg{Type: tea.KeyCtrlN}); dialog.Focus != connectionFocusProcess {
+		t.Error("the remapped next field key does not move the focus")
+	}
+	if _, _, connect := dialog.Update(tea.KeyMsg{Type: tea.KeyEnter}); connect {
+		t.Error("enter connects after details is remapped")
+	}
+	dialog.ProcessName.SetValue("test")
+	if _, _, connect := dialog.Update(tea.KeyMsg{Type: tea.KeyCtrlS}); !connect {
+		t.Error("the remapped details key does not connect")
+	}
+	if dialog, _, _ = dialog.Update(tea.KeyMsg{Type: tea.KeyEsc}); !dialog.Active {
+		t.Error("the dialog closes on esc after back is remapped")
+	}
+	if !strings.Contains(dialog.View(100, 40, false, ""), "[ctrl+s] Connect") {
+		t.Error("the key menu does not show the remapped details key")
+	}
+
+	dialog, _ = dialog.focus(connectionFocusRecent)
+	if dialog, _, _ = dialog.Update(keyPress("x")); dialog.Active {
+		t.Error("the remapped back key does not close the dialog outside the fields")
+	}
+}
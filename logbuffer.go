@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of log records kept for the log pane.
+const logBufferSize = 5000
+
+type logEntry struct {
+	time    time.Time
+	level   slog.Level
+	message string
+}
+
+func (e logEntry) String() string {
+	return fmt.Sprintf("%s %-5s %s", e.time.Format("15:04:05.000"), e.level, e.message)
+}
+
+// logRing keeps the most recent log records in memory.
+type logRing struct {
+	mu      sync.Mutex
+	entries []logEntry
+	next    int
+	// total counts every record ever added so readers can tell when it changed.
+	total int
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]logEntry, 0, size)}
+}
+
+func (r *logRing) add(entry logEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, entry)
+	} else {
+		r.entries[r.next] = entry
+		r.next = (r.next + 1) % len(r.entries)
+	}
+	r.total++
+}
+
+// snapshot returns the buffered records oldest first.
+func (r *logRing) snapshot() ([]logEntry, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]logEntry, 0, len(r.entries))
+	entries = append(entries, r.entries[r.next:]...)
+	entries = append(entries, r.entries[:r.next]...)
+	return entries, r.total
+}
+
+// logBuffer holds the records shown in the log pane.
+var logBuffer = newLogRing(logBufferSize)
+
+// ringHandler is a slog.Handler writing records at or above level to a logRing.
+type ringHandler struct {
+	ring   *logRing
+	level  slog.Level
+	attrs  string
+	groups string
+}
+
+func newRingHandler(ring *logRing, level slog.Level) *ringHandler {
+	return &ringHandler{ring: ring, level: level}
+}
+
+func (h *ringHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *ringHandler) Handle(_ context.Context, record slog.Record) error {
+	var b strings.Builder
+	b.WriteString(record.Message)
+	b.WriteString(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		writeLogAttr(&b, h.groups, attr)
+		return true
+	})
+	h.ring.add(logEntry{time: record.Time, level: record.Level, message: b.String()})
+	return nil
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, attr := range attrs {
+		writeLogAttr(&b, h.groups, attr)
+	}
+	return &ringHandler{ring: h.ring, level: h.level, attrs: b.String(), groups: h.groups}
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &ringHandler{ring: h.ring, level: h.level, attrs: h.attrs, groups: h.groups + name + "."}
+}
+
+func writeLogAttr(b *strings.Builder, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, member := range attr.Value.Group() {
+			writeLogAttr(b, prefix+attr.Key+".", member)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s=%v", prefix, attr.Key, attr.Value)
+}
+
+// teeHandler passes records to every handler enabled for their level.
+type teeHandler struct {
+	handlers []slog.Handler
+}
+
+func newTeeHandler(handlers ...slog.Handler) *teeHandler {
+	return &teeHandler{handlers: handlers}
+}
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, record.Level) {
+			if err := handler.Handle(ctx, record.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return &teeHandler{handlers: handlers}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return &teeHandler{handlers: handlers}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// How often the open log pane picks up new records.
+const logPaneRefresh = 500 * time.Millisecond
+
+// Levels the log pane filter cycles through.
+var logPaneLevels = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// LogPaneModel shows the in-memory log buffer below the files table.
+type LogPaneModel struct {
+	Keys      keyMap
+	Active    bool
+	Level     slog.Level
+	Follow    bool
+	Search    textinput.Model
+	Searching bool
+	Viewport  viewport.Model
+	// total is the buffer count the content was last built from.
+	total int
+}
+
+type logPaneTickMsg struct{}
+
+func initialLogPaneModel(keys keyMap) LogPaneModel {
+	search := textinput.New()
+	search.Prompt = "/"
+	search.Placeholder = "log text"
+	pane := viewport.New(0, 0)
+	pane.KeyMap.Up, pane.KeyMap.Down = keys.Up, keys.Down
+	pane.KeyMap.PageUp, pane.KeyMap.PageDown = keys.PageUp, keys.PageDown
+	return LogPaneModel{Keys: keys, Level: slog.LevelInfo, Follow: true, Search: search, Viewport: pane}
+}
+
+func logPaneTick() tea.Cmd {
+	return tea.Tick(logPaneRefresh, func(time.Time) tea.Msg {
+		return logPaneTickMsg{}
+	})
+}
+
+// Height returns the rows taken by the pane, including its title and key menu.
+func (m LogPaneModel) Height(screenHeight int) int {
+	if !m.Active {
+		return 0
+	}
+	return max(screenHeight*2/5, 5)
+}
+
+func (m LogPaneModel) Open(width, screenHeight int) (LogPaneModel, tea.Cmd) {
+	m.Active = true
+	m = m.Resize(width, screenHeight)
+	m.refresh(true)
+	return m, logPaneTick()
+}
+
+func (m LogPaneModel) Close() LogPaneModel {
+	m.Active = false
+	m.Searching = false
+	m.Search.Blur()
+	m.Viewport.SetContent("")
+	return m
+}
+
+func (m LogPaneModel) Resize(width, screenHeight int) LogPaneModel {
+	m.Viewport.Width = width
+	m.Viewport.Height = max(m.Height(screenHeight)-2, 1)
+	return m
+}
+
+// Tick rebuilds the content when records were added and keeps the tick
+// running while the pane is open.
+func (m LogPaneModel) Tick() (LogPaneModel, tea.Cmd) {
+	if !m.Active {
+		return m, nil
+	}
+	m.refresh(false)
+	return m, logPaneTick()
+}
+
+// refresh rebuilds the content from the buffer, when force is false only
+// if records were added since the last refresh.
+func (m *LogPaneModel) refresh(force bool) {
+	entries, total := logBuffer.snapshot()
+	if !force && total == m.total {
+		return
+	}
+	m.total = total
+
+	query := strings.ToLower(m.Search.Value())
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.level < m.Level {
+			continue
+		}
+		line := entry.String()
+		if query != "" && !strings.Contains(strings.ToLower(line), query) {
+			continue
+		}
+		lines = append(lines, lipgloss.NewStyle().Foreground(logLevelColor(entry.level)).Render(line))
+	}
+	m.Viewport.SetContent(strings.Join(lines, "\n"))
+	if m.Follow {
+		m.Viewport.GotoBottom()
+	}
+}
+
+func logLevelColor(level slog.Level) lipgloss.Color {
+	switch {
+	case level >= slog.LevelError:
+		return lipgloss.Color("1")
+	case level >= slog.LevelWarn:
+		return lipgloss.Color("3")
+	case level >= slog.LevelInfo:
+		return lipgloss.Color("7")
+	}
+	return lipgloss.Color("8")
+}
+
+// save writes the whole buffer, ignoring the filters, to a new file in the
+// working directory.
+func (m LogPaneModel) save() (string, error) {
+	entries, _ := logBuffer.snapshot()
+	fileName := fmt.Sprintf("goDataLogConvertTUI-%s.log", time.Now().Format("20060102-150405"))
+	var b strings.Builder
+	for _, entry := range entries {
+		b.WriteString(entry.String())
+		b.WriteString("\n")
+	}
+	if err := os.WriteFile(fileName, []byte(b.String()), 0644); err != nil {
+		return "", fmt.Errorf("failed to save log: %v", err)
+	}
+	return fileName, nil
+}
+
+// Update handles a key while the pane is open. status reports the result of
+// saving the buffer.
+func (m LogPaneModel) Update(msg tea.KeyMsg) (pane LogPaneModel, cmd tea.Cmd, status *StatusMsg) {
+	if m.Searching {
+		switch msg.String() {
+		case "enter", "esc":
+			m.Searching = false
+			m.Search.Blur()
+			if msg.String() == "esc" {
+				m.Search.SetValue("")
+			}
+		default:
+			m.Search, cmd = m.Search.Update(msg)
+		}
+		m.refresh(true)
+		return m, cmd, nil
+	}
+
+	switch {
+	case key.Matches(msg, m.Keys.Back):
+		if m.Search.Value() != "" {
+			m.Search.SetValue("")
+			m.refresh(true)
+			return m, nil, nil
+		}
+		return m.Close(), nil, nil
+	case key.Matches(msg, m.Keys.Logs):
+		return m.Close(), nil, nil
+	case key.Matches(msg, m.Keys.Search):
+		m.Searching = true
+		return m, m.Search.Focus(), nil
+	case key.Matches(msg, m.Keys.LogLevel):
+		for i, level := range logPaneLevels {
+			if level == m.Level {
+				m.Level = logPaneLevels[(i+1)%len(logPaneLevels)]
+				break
+			}
+		}
+		m.refresh(true)
+	case key.Matches(msg, m.Keys.LogFollow):
+		m.Follow = !m.Follow
+		if m.Follow {
+			m.Viewport.GotoBottom()
+		}
+	case key.Matches(msg, m.Keys.LogSave):
+		fileName, err := m.save()
+		if err != nil {
+			return m, nil, &StatusMsg{level: statusError, message: err.Error()}
+		}
+		return m, nil, &StatusMsg{level: statusInfo, message: fmt.Sprintf("Saved log to %s", fileName)}
+	default:
+		m.Viewport, cmd = m.Viewport.Update(msg)
+		// Scrolling away from the end stops following new records.
+		m.Follow = m.Viewport.AtBottom()
+	}
+	return m, cmd, nil
+}
+
+func (m LogPaneModel) View() string {
+	follow := "off"
+	if m.Follow {
+		follow = "on"
+	}
+	title := lipgloss.NewStyle().Bold(true).Render("Log")
+	s := fmt.Sprintf("%s  level %s+  follow %s", title, m.Level, follow)
+	if m.Searching || m.Search.Value() != "" {
+		s += "  " + m.Search.View()
+	}
+	s += "\n" + m.Viewport.View() + "\n"
+	k := m.Keys
+	s += strings.Join([]string{
+		fmt.Sprintf("[%s/%s] Close", k.Logs.Help().Key, k.Back.Help().Key),
+		fmt.Sprintf("[%s/%s] Scroll", k.Down.Help().Key, k.Up.Help().Key),
+		keyHint(k.LogLevel, "Level"), keyHint(k.LogFollow, "Follow"), keyHint(k.Search, "Search"), keyHint(k.LogSave, "Save"),
+	}, "  ")
+	return s
+}
@@ -5,25 +5,34 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 
+	"github.com/charmbracelet/bubbles/help"
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/table"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/complacentsee/goDatalogConvert/LibDAT"
 )
 
 type model struct {
-	Width, Height    int
-	filesTable       table.Model
-	selected         int
-	rows             []table.Row
-	connected        bool
-	connecting       bool
-	dirPath          string
-	hostname         string
-	processName      string
-	tagMapCSV        string
-	debugLevel       bool
-	dr               *LibDAT.DatReader
+	Width, Height  int
+	filesTable     table.Model
+	selected       int
+	rows           []table.Row
+	rowIndex       map[string]int
+	visibleIndexes []int
+	visibleKey     string
+	connected      bool
+	connecting     bool
+	sources        datSources
+	hostname       string
+	processName    string
+	sink           Sink
+	tagMapCSV      string
+	debugLevel     bool
+	dr             *LibDAT.DatReader
+	// pairing is the pairing of the files of dr, from the same discovery.
+	pairing          *datPairing
 	datFileRecords   map[string]DATRecordStructure
 	tagMaps          map[string]string
 	useTagMap        bool
@@ -32,15 +41,42 @@ type model struct {
 	recsLoadedCount  int
 	sfmpu            ScanningFilesPopupModel
 	novfpu           NoValidFilesPopupModel
+	detail           FileDetailModel
+	filesView        FilesViewModel
+	selection        SelectionModel
+	keys             keyMap
+	help             help.Model
+	showHelp         bool
+	status           StatusModel
+	logPane          LogPaneModel
+	connection       ConnectionDialogModel
+	browser          DirBrowserModel
+	watch            WatchModel
+	connectErr       string
+	revalidate       bool
+	config           Config
+	health           HealthModel
+	verify           verifyConfig
+	configPath       string
 	processingStatus *processingStatus
+	// generation is increased when another directory is loaded, messages of
+	// the loads started before are dropped.
+	generation int
 }
 
-func initialModel(dirPath, host, processName, tagMapCSV string, debugLevel bool) model {
+func initialModel(sources datSources, host, processName, tagMapCSV string, debugLevel bool, sink Sink, keys keyMap, config Config, configPath string, health healthConfig, watchCfg watchConfig, verify verifyConfig) model {
 
 	noValidFiles := false
 
-	dr, err := LibDAT.NewDatReader(dirPath)
-	if err != nil {
+	watch := initialWatchModel(watchCfg)
+	var dr *LibDAT.DatReader
+	var pairing *datPairing
+	var err error
+	if watch.Enabled() {
+		// Files are added by the watch scans once they are closed.
+		watch = watch.Start(sources)
+		dr = &LibDAT.DatReader{}
+	} else if dr, pairing, err = sources.Discover(); err != nil {
 		noValidFiles = true
 	}
 
@@ -55,6 +91,8 @@ func initialModel(dirPath, host, processName, tagMapCSV string, debugLevel bool)
 		{Title: "Records", Width: 7},
 		{Title: "Duration", Width: 8},
 		{Title: "Duration", Width: 8},
+		{Title: "Folder", Width: 6},
+		{Title: "Health", Width: 10},
 	}
 
 	rows := []table.Row{}
@@ -70,19 +108,34 @@ func initialModel(dirPath, host, processName, tagMapCSV string, debugLevel bool)
 		filesTable:     filesTable,
 		rows:           rows,
 		selected:       0,
-		dirPath:        dirPath,
+		sources:        sources,
 		hostname:       host,
 		processName:    processName,
+		sink:           sink,
 		tagMapCSV:      tagMapCSV,
 		debugLevel:     debugLevel,
 		connecting:     true,
 		dr:             dr,
+		pairing:        pairing,
 		datFileRecords: make(map[string]DATRecordStructure),
 		tagMaps:        make(map[string]string),
 		useTagMap:      false,
 		processed:      false,
 		sfmpu:          initialScanningPopupModel(),
 		novfpu:         InitialNoValidFilesPopupModel(noValidFiles),
+		detail:         initialFileDetailModel(keys),
+		filesView:      initialFilesViewModel(),
+		selection:      initialSelectionModel(),
+		keys:           keys,
+		help:           help.New(),
+		logPane:        initialLogPaneModel(keys),
+		connection:     initialConnectionDialogModel(config.RecentServers, keys),
+		browser:        initialDirBrowserModel(),
+		watch:          watch,
+		config:         config,
+		health:         initialHealthModel(health),
+		verify:         verify,
+		configPath:     configPath,
 	}
 }
 
@@ -91,15 +144,20 @@ func (m model) Init() tea.Cmd {
 
 	if m.novfpu.Active {
 		return tea.Batch(
-			SetProcessName(m.processName),
-			PiConnectToServer(m.hostname),
+			PiConnectToServer(m.sink, m.hostname),
+			LoadCSVMapping(m),
+		)
+	}
+	if m.watch.Enabled() {
+		return tea.Batch(
+			PiConnectToServer(m.sink, m.hostname),
 			LoadCSVMapping(m),
+			m.watch.Run(),
 		)
 	}
 
 	return tea.Batch(
-		SetProcessName(m.processName),
-		PiConnectToServer(m.hostname),
+		PiConnectToServer(m.sink, m.hostname),
 		loadDirectory(m),
 		LoadCSVMapping(m),
 	)
@@ -107,44 +165,178 @@ func (m model) Init() tea.Cmd {
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	slog.Debug("Update model called", "Type", fmt.Sprintf("%T", msg), "Tea.Msg", msg)
+	if msg, ok := msg.(loadMsg); ok && msg.directoryGeneration() != m.generation {
+		return m, nil
+	}
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
-		switch msg.String() {
-		case "q", "ctrl+c":
+		if msg.String() == "ctrl+c" {
 			return m, tea.Quit
-		case "j", "down":
+		}
+		if m.status.ShowHistory {
+			var cmd tea.Cmd
+			m.status, cmd = m.status.UpdateHistory(msg)
+			return m, cmd
+		}
+		if m.browser.Active {
+			var cmd tea.Cmd
+			var chosen string
+			m.browser, cmd, chosen = m.browser.Update(msg)
+			if chosen != "" {
+				return m.loadNewDirectory(chosen)
+			}
+			return m, cmd
+		}
+		if m.detail.Active {
+			var cmd tea.Cmd
+			m.detail, cmd = m.detail.Update(msg)
+			return m, cmd
+		}
+		if m.connection.Active {
+			var cmd tea.Cmd
+			var connect bool
+			m.connection, cmd, connect = m.connection.Update(msg)
+			if connect && !m.connecting {
+				return m.reconnect()
+			}
+			return m, cmd
+		}
+		if m.logPane.Active {
+			var cmd tea.Cmd
+			var status *StatusMsg
+			m.logPane, cmd, status = m.logPane.Update(msg)
+			if status != nil {
+				cmd = tea.Batch(cmd, m.notify(status.level, status.message))
+			}
+			m.UpdateViewDimentions()
+			return m, cmd
+		}
+		if m.selection.EditingDates {
+			var cmd tea.Cmd
+			var done bool
+			m.selection, cmd, done = m.selection.UpdateInput(msg)
+			if done {
+				m.selectDates()
+			}
+			return m, cmd
+		}
+		if m.filesView.Editing() {
+			var cmd tea.Cmd
+			m.filesView, cmd = m.filesView.UpdateInput(msg)
+			m.refreshTable()
+			return m, cmd
+		}
+		if m.showHelp {
+			// Any key closes the help overlay
+			m.showHelp = false
+			return m, nil
+		}
+		switch {
+		case key.Matches(msg, m.keys.Help):
+			m.showHelp = true
+		case key.Matches(msg, m.keys.Connection):
+			if m.processed && (m.processingStatus == nil || !m.processingStatus.completed) {
+				return m, m.notify(statusWarn, "The connection cannot be changed while files are processed.")
+			}
+			var cmd tea.Cmd
+			m.connection, cmd = m.connection.Open(m.sink, m.connectErr)
+			return m, cmd
+		case key.Matches(msg, m.keys.Browse):
+			if m.processed && (m.processingStatus == nil || !m.processingStatus.completed) {
+				return m, m.notify(statusWarn, "The folder cannot be changed while files are processed.")
+			}
+			if m.sfmpu.Active {
+				return m, m.notify(statusWarn, "The folder cannot be changed while files are scanned.")
+			}
+			var cmd tea.Cmd
+			m.browser, cmd = m.browser.Open(m.sources.roots()[0], m.Height)
+			return m, cmd
+		case key.Matches(msg, m.keys.Messages):
+			m.status = m.status.OpenHistory(m.Width, m.Height, m.keys)
+		case key.Matches(msg, m.keys.Logs):
+			var cmd tea.Cmd
+			m.logPane, cmd = m.logPane.Open(m.Width, m.Height)
+			m.UpdateViewDimentions()
+			return m, cmd
+		case key.Matches(msg, m.keys.Quit):
+			return m, tea.Quit
+		case key.Matches(msg, m.keys.Down):
 			m.filesTable.MoveDown(1)
-		case "k", "up":
+		case key.Matches(msg, m.keys.Up):
 			m.filesTable.MoveUp(1)
-		case "pgdown", "f", "ctrl+d": // Page Down
+		case key.Matches(msg, m.keys.PageDown):
 			m.filesTable.MoveDown(m.filesTable.Height()) // Move down by the height of the table
-		case "pgup", "b", "ctrl+u": // Page Up
+		case key.Matches(msg, m.keys.PageUp):
 			m.filesTable.MoveUp(m.filesTable.Height()) // Move up by the height of the table
 
-		case " ", "enter":
+		case key.Matches(msg, m.keys.Details):
+			if index := m.selectedRowIndex(); index >= 0 {
+				fileName := m.rows[index][1]
+				if !selectable(m.rows[index]) {
+					return m, m.notify(statusError, fmt.Sprintf("%s has no float file", filepath.Base(fileName)))
+				}
+				m.detail = m.detail.Open(fileName, m.datFileRecords[fileName].Integrity, m.datFileRecords[fileName].Verification)
+				return m, LoadFileDetail(m, fileName)
+			}
+		case key.Matches(msg, m.keys.Toggle):
 			if m.processed {
 				return m, nil
 			}
-			selectedRow := m.filesTable.Cursor()
-			if selectedRow >= 0 && selectedRow < len(m.rows) {
-				if m.rows[selectedRow][0] == "[ ]" {
-					m.rows[selectedRow][0] = "[X]"
+			if index := m.selectedRowIndex(); index >= 0 && selectable(m.rows[index]) {
+				if m.rows[index][0] == "[ ]" {
+					m.rows[index][0] = "[X]"
 				} else {
-					m.rows[selectedRow][0] = "[ ]"
+					m.rows[index][0] = "[ ]"
 				}
 			}
-			m.filesTable.SetRows(m.rows)
-		case "a":
-			for i := 0; i < len(m.rows); i++ {
-				m.rows[i][0] = "[X]"
+			m.refreshTable()
+		case key.Matches(msg, m.keys.SelectAll): // Select all files shown by the current filters
+			for _, i := range m.visibleRowIndexes() {
+				if selectable(m.rows[i]) {
+					m.rows[i][0] = "[X]"
+				}
 			}
-			m.filesTable.SetRows(m.rows)
-		case "n":
-			for i := 0; i < len(m.rows); i++ {
+			m.refreshTable()
+		case key.Matches(msg, m.keys.DeselectAll):
+			for _, i := range m.visibleRowIndexes() {
 				m.rows[i][0] = "[ ]"
 			}
-			m.filesTable.SetRows(m.rows)
-		case "p": // Process selected file
+			m.refreshTable()
+		case key.Matches(msg, m.keys.Search):
+			m.filesView.Searching = true
+			m.refreshTable()
+			return m, m.filesView.Search.Focus()
+		case key.Matches(msg, m.keys.State):
+			m.filesView.State = m.filesView.nextState(m.rows)
+			m.refreshTable()
+		case key.Matches(msg, m.keys.Dates):
+			m.filesView.EditingDates = true
+			m.refreshTable()
+			return m, m.filesView.DateInput.Focus()
+		case key.Matches(msg, m.keys.Sort):
+			m.filesView.SortColumn = (m.filesView.SortColumn + 1) % len(m.filesTable.Columns())
+			m.filesView.SortDesc = false
+			m.refreshTable()
+		case key.Matches(msg, m.keys.ReverseSort):
+			m.filesView.SortDesc = !m.filesView.SortDesc
+			m.refreshTable()
+		case key.Matches(msg, m.keys.Range):
+			m.markRange()
+		case key.Matches(msg, m.keys.SelectDates):
+			m.selection.EditingDates = true
+			m.selection.Err = ""
+			return m, m.selection.DateInput.Focus()
+		case key.Matches(msg, m.keys.Invert):
+			m.invertSelection()
+		case key.Matches(msg, m.keys.Clear):
+			if m.selection.Anchor != "" || m.selection.Err != "" {
+				m.selection.Anchor = ""
+				m.selection.Err = ""
+				return m, nil
+			}
+			m.filesView = m.filesView.ClearFilters()
+			m.refreshTable()
+		case key.Matches(msg, m.keys.Process): // Process selected file
 			if !m.processed {
 				m.processed = true
 				return processNextDatFile(&m, true)
@@ -155,6 +347,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.Width = msg.Width
 		m.Height = msg.Height
 		m.UpdateViewDimentions()
+		m.status = m.status.Resize(m.Width, m.Height)
+		m.logPane = m.logPane.Resize(m.Width, m.Height)
+		m.browser = m.browser.Resize(m.Height)
 
 	case tea.MouseMsg:
 		// Handle mouse scroll
@@ -162,16 +357,48 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.filesTable.MoveUp(1)
 		} else if msg.Type == tea.MouseWheelDown {
 			m.filesTable.MoveDown(1)
+		} else if msg.Action == tea.MouseActionPress && msg.Button == tea.MouseButtonLeft && !m.detail.Active {
+			// Clicking a column header sorts on that column
+			if column := m.headerColumnAt(msg.X, msg.Y); column >= 0 {
+				m.filesView = m.filesView.SortBy(column)
+				m.refreshTable()
+			}
 		}
 
-	case PiServerProcessNameMsg:
-		m.processName = msg.processName
 	case PiServerConnectMsg:
 		m.connected = msg.connected
 		m.hostname = msg.hostname
 		m.connecting = false
+		m.connectErr = msg.err
+		if !msg.connected {
+			m.connection.Err = msg.err
+			return m, m.notify(statusError, fmt.Sprintf("Unable to connect to %s: %s. Press [%s] to change the connection.", m.sink.Target(), msg.err, m.keys.Connection.Help().Key))
+		}
+		m.connection = m.connection.Close()
+		var healthCmd tea.Cmd
+		m.health, healthCmd = m.health.Start(m.sink)
+		cmds := []tea.Cmd{healthCmd, m.notify(statusInfo, fmt.Sprintf("Connected to %s", m.sink.Target()))}
+		if cmd := m.rememberServer(); cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+		if m.revalidate {
+			m.revalidate = false
+			cmds = append(cmds, revalidateTags(&m))
+		} else if cmd := processWatchedFiles(&m); cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+		return m, tea.Batch(cmds...)
 	case DATFileNameMsg:
 		return updateWithDATFileNameMsg(m, msg)
+	case VerifyMsg:
+		return updateWithVerifyMsg(m, msg)
+	case UnpairedTagFileMsg:
+		return updateWithUnpairedTagFileMsg(m, msg), nil
+	case DATIntegrityMsg:
+		return updateWithDATIntegrityMsg(m, msg)
+	case DATFileErrorMsg:
+		m, cmd := updateWithDATFileErrorMsg(m, msg)
+		return m, tea.Batch(cmd, watchFailed(&m, msg.fileName))
 	case DATTagFileHeaderMsg:
 		m = updateWithDATFileHeaderMsg(m, msg)
 		return m, tea.Batch(LoadDATTagRecords(m, msg.fileName, int(msg.recordCound)))
@@ -179,20 +406,27 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m = upsertDatTagFileRecord(m, msg.fileName, msg.records)
 		return m, LookupTagsOnHistorian(m, msg.fileName)
 	case CSVMapping:
-		if msg.err == "" {
-			m.tagMaps = msg.mapping
-			m.useTagMap = true
-		} else {
-			// TODO: POPUP MESSAGE
-			//m.footerStatus = msg.err
+		if msg.err != "" {
+			return m, m.notify(statusError, msg.err)
 		}
+		m.tagMaps = msg.mapping
+		m.useTagMap = true
+		m.UpdateViewDimentions()
+		return m, m.notify(statusInfo, fmt.Sprintf("Loaded %d tag mappings from %s", len(msg.mapping), m.tagMapCSV))
 	case LookupTagsOnHistorianMsg:
 		updateDATFileRecord(&m, msg)
 		return m, LoadDATFloatFile(m, msg.fileName)
 	case DATFloatFileHeaderMsg:
-		return updateWithDATFloatFileHeaderMsg(m, msg)
+		m, cmd := updateWithDATFloatFileHeaderMsg(m, msg)
+		return m, tea.Batch(cmd, processWatchedFiles(&m))
 	case DATTagFloatRecordMsg:
 		m = updateWithDATFloatFileRecordsMsg(m, msg)
+		if msg.err != "" {
+			notifyCmd := m.notify(statusError, fmt.Sprintf("Loading records of %s failed: %s", filepath.Base(msg.fileName), msg.err))
+			watchCmd := watchFailed(&m, msg.fileName)
+			m, cmd := processNextDatFile(&m, false)
+			return m, tea.Batch(cmd, notifyCmd, watchCmd)
+		}
 		if !m.firstDatReturned {
 			m.firstDatReturned = true
 			histCMD := processNextHistorianInsert(&m)
@@ -205,52 +439,142 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m = updateWithUpdateStateToLoadingMsg(m, msg)
 	case HistorianInsertMsg:
 		m = updateWithHistorianInsertMsg(m, msg)
-		return m, processNextHistorianInsert(&m)
+		// Verified files are recorded once they are verified.
+		if _, row, err := findRowByFileName(m, msg.fileName); err == nil && row[2] == "Completed" && m.watch.Enabled() && !m.verify.enabled {
+			m.watch = m.watch.Imported(msg.fileName)
+		}
+		healthCmd := m.recordInsert(msg.err, msg.connectionLost)
+		// The file is marked Verifying before the next insert looks for
+		// pending files.
+		var cmds []tea.Cmd
+		if m.verify.enabled {
+			cmds = append(cmds, startVerification(&m, msg.fileName))
+		}
+		cmds = append(cmds, processNextHistorianInsert(&m))
+		if msg.err != "" && !msg.connectionLost {
+			cmds = append(cmds, m.notify(statusError, fmt.Sprintf("Insert of %s failed: %s", filepath.Base(msg.fileName), msg.err)), watchFailed(&m, msg.fileName))
+		}
+		cmds = append(cmds, healthCmd)
+		return m, tea.Batch(cmds...)
 	case RetriggerDATLoadingMsg:
 		return processNextDatFile(&m, false)
 	case RetriggerHistorianInsertMsg:
 		return m, processNextHistorianInsert(&m)
 	case ResetProcessingFlagMsg:
 		m.processed = false
+	case StatusMsg:
+		return m, m.notify(msg.level, msg.message)
+	case toastExpiredMsg:
+		m.status = m.status.Expire(msg.id)
+	case watchEventMsg:
+		return updateWithWatchEventMsg(m, msg)
+	case watchTickMsg:
+		return updateWithWatchTickMsg(m, msg)
+	case watchScanMsg:
+		return updateWithWatchScanMsg(m, msg)
+	case tailTickMsg:
+		return updateWithTailTickMsg(m, msg)
+	case tailReadyMsg:
+		return updateWithTailReadyMsg(m, msg)
+	case tailBatchMsg:
+		return updateWithTailBatchMsg(m, msg)
+	case healthTickMsg:
+		return updateWithHealthTickMsg(m, msg)
+	case healthCheckMsg:
+		return updateWithHealthCheckMsg(m, msg)
+	case logPaneTickMsg:
+		var cmd tea.Cmd
+		m.logPane, cmd = m.logPane.Tick()
+		return m, cmd
+
+	case FileDetailMsg:
+		m.detail = m.detail.Loaded(msg)
 
 	case FileInititalCountMsg:
 		m.sfmpu.TotalFiles = msg.FileCount
 		m.sfmpu.Active = true
 	case FileScanCompletedMsg:
 		m.sfmpu.Active = false
+	case dirDiscoveredMsg:
+		return updateWithDirDiscoveredMsg(m, msg)
+
+	default:
+		// The file picker reads folders with its own messages.
+		if m.browser.Active {
+			var cmd tea.Cmd
+			m.browser, cmd, _ = m.browser.Update(msg)
+			return m, cmd
+		}
 	}
 
 	return m, nil
 }
 
 func (m model) View() string {
+	if m.status.ShowHistory {
+		return m.status.View(m.Width, m.status.HistoryView())
+	}
+	if m.browser.Active {
+		return m.status.View(m.Width, m.browser.View(m.Width, m.Height))
+	}
+	if m.detail.Active {
+		return m.status.View(m.Width, m.detail.View(m.Width, m.Height))
+	}
+
 	s := ""
 	s += m.ViewMainModel()
 
 	if m.novfpu.Active {
 
 	}
-	s = m.novfpu.View(m.Width, m.Height, m.dirPath, s)
+	s = m.novfpu.View(m.Width, m.Height, m.sources.String(), m.keys.Browse.Help().Key, s)
 	if m.sfmpu.Active {
 		s = m.sfmpu.View(m.Width, m.Height, s)
 	}
+	s = m.connection.View(m.Width, m.Height, m.connecting, s)
+	if m.showHelp {
+		s = m.ViewHelp(s)
+	}
+	s = m.status.View(m.Width, s)
 
 	return s
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		if err := runGen(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "gen failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Define the command-line flags
-	dirPath := flag.String("path", ".", "Path to the directory containing DAT files")
+	sources := registerSourceFlags()
 	host := flag.String("host", "localhost", "Hostname of PI server")
 	processName := flag.String("processName", "dat2fth", "Process name")
 	tagMapCSV := flag.String("tagMapCSV", "", "Path to the CSV file containing the tag map.")
 	debugLevel := flag.Bool("debug", false, "Enable debug logging")
+	sinkName := flag.String("sink", "piapi", "Where records are written: piapi, piwebapi, opcua, mqtt, kafka, ndjson or dat")
+	outPath := flag.String("out", "", "Output file for -sink ndjson, stdout when empty, or output folder for -sink dat")
+	mqttCfg := registerMQTTFlags()
+	kafkaCfg := registerKafkaFlags()
+	piWebAPICfg := registerPIWebAPIFlags()
+	opcuaCfg := registerOPCUAFlags()
+	healthCfg := registerHealthFlags()
+	watchCfg := registerWatchFlags()
+	datCfg := registerDATFlags()
+	verifyCfg := registerVerifyFlags()
+	configPath := flag.String("config", "", "Path to the JSON config file, defaults to the user config directory")
 
 	// Parse the flags
 	flag.Parse()
 
+	// The log pane keeps info and above, and debug records as well with -debug.
+	bufferLevel := slog.LevelInfo
 	var logHandler *slog.TextHandler
 	if debugLevel != nil && *debugLevel {
+		bufferLevel = slog.LevelDebug
 		// Handle debug logging to a text file
 		logFile, err := os.OpenFile("applog.txt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
@@ -264,14 +588,75 @@ func main() {
 	} else {
 		logHandler = slog.NewTextHandler(&nullWriter{}, nil)
 	}
-	logger := slog.New(logHandler)
+	logger := slog.New(newTeeHandler(logHandler, newRingHandler(logBuffer, bufferLevel)))
 	slog.SetDefault(logger)
 
+	explicitConfig := *configPath != ""
+	if !explicitConfig {
+		*configPath = defaultConfigPath()
+	}
+	config, err := loadConfig(*configPath, explicitConfig)
+	if err != nil {
+		fmt.Printf("Invalid config file: %v\n", err)
+		os.Exit(1)
+	}
+	keys := defaultKeyMap()
+	if err := keys.remap(config.Keys); err != nil {
+		fmt.Printf("Invalid config file: %v\n", err)
+		os.Exit(1)
+	}
+	sources.Hosts = config.Hosts
+
+	if *sinkName == "ndjson" {
+		err := runNDJSON(*sources, *tagMapCSV, *outPath)
+		staging.cleanup()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ndjson export failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *sinkName == "dat" {
+		err := runDATRewrite(*sources, *tagMapCSV, *outPath, *datCfg)
+		staging.cleanup()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "DAT rewrite failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	sink, err := newSink(sinkConfig{
+		name:        *sinkName,
+		hostname:    *host,
+		processName: *processName,
+		mqtt:        mqttCfg,
+		kafka:       kafkaCfg,
+		piWebAPI:    piWebAPICfg,
+		opcua:       opcuaCfg,
+	})
+	if err != nil {
+		fmt.Printf("Invalid sink configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if _, ok := sink.(Verifier); verifyCfg.enabled && !ok {
+		fmt.Printf("Invalid sink configuration: -verify reads values back through the sink, the %s sink has no archive read and is not supported, use -sink piwebapi or opcua\n", sink.Name())
+		os.Exit(1)
+	}
+
 	// Initialize the Bubble Tea program with the flags
-	p := tea.NewProgram(initialModel(*dirPath, *host, *processName, *tagMapCSV, *debugLevel), tea.WithAltScreen())
+	p := tea.NewProgram(initialModel(*sources, *host, *processName, *tagMapCSV, *debugLevel, sink, keys, config, *configPath, *healthCfg, *watchCfg, *verifyCfg), tea.WithAltScreen(), tea.WithMouseCellMotion())
 
 	// Run the Bubble Tea program
-	if _, err := p.Run(); err != nil {
+	final, err := p.Run()
+	// The sink may have been replaced from the connection dialog.
+	if final, ok := final.(model); ok {
+		final.sink.Close()
+	} else {
+		sink.Close()
+	}
+	staging.cleanup()
+	if err != nil {
 		fmt.Printf("Alas, there's been an error: %v", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibUtil"
+)
+
+// ndjsonRecord is a single line written by the headless ndjson mode.
+type ndjsonRecord struct {
+	File         string   `json:"file"`
+	Tag          string   `json:"tag"`
+	HistorianTag string   `json:"historianTag"`
+	Timestamp    string   `json:"ts"`
+	Value        *float64 `json:"value"`
+	Status       string   `json:"status"`
+}
+
+// ndjsonFile is a float file being merged, with the records read from it
+// and not written yet.
+type ndjsonFile struct {
+	fileName string
+	// order breaks ties between records of the same time, in file order.
+	order   int
+	tags    map[int]*LibDAT.DatTagRecord
+	records []*LibDAT.DatFloatRecord
+	// reader is nil when the records of the file are all in memory.
+	reader *floatRecordReader
+}
+
+// openNDJSONFile checks a float file and reads its tags. Its records are
+// read a chunk at a time while they are merged, unless they go back in time
+// and are sorted in memory first.
+func openNDJSONFile(dr *LibDAT.DatReader, pairing *datPairing, fileName string, order int) (*ndjsonFile, error) {
+	// The records are scanned first, a file going back in time is sorted.
+	report, staged, tagRecords, err := openDatFile(dr, pairing, fileName, true)
+	if err != nil {
+		return nil, err
+	}
+	file := &ndjsonFile{fileName: fileName, order: order, tags: make(map[int]*LibDAT.DatTagRecord, len(tagRecords))}
+	for _, tag := range tagRecords {
+		file.tags[tag.ID] = tag
+	}
+	if report.Backwards > 0 {
+		records, err := readFloatFileRecords(dr, staged, report)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record != nil && record.IsValid {
+				file.records = append(file.records, record)
+			}
+		}
+		sort.SliceStable(file.records, func(i, j int) bool {
+			return file.records[i].TimeStamp.Before(file.records[j].TimeStamp)
+		})
+		return file, nil
+	}
+	if file.reader, err = openFloatRecords(staged); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// fill reads the next chunk once the records read are written, it returns
+// false when the file has no records left.
+func (f *ndjsonFile) fill() (bool, error) {
+	if len(f.records) > 0 {
+		return true, nil
+	}
+	if f.reader == nil {
+		return false, nil
+	}
+	records, err := f.reader.next()
+	if err != nil {
+		return false, err
+	}
+	f.records = records
+	return len(records) > 0, nil
+}
+
+func (f *ndjsonFile) close() {
+	if f.reader != nil {
+		f.reader.Close()
+	}
+}
+
+// ndjsonMerge is a heap of the files being merged by the time of their next
+// record.
+type ndjsonMerge []*ndjsonFile
+
+func (m ndjsonMerge) Len() int { return len(m) }
+
+func (m ndjsonMerge) Less(i, j int) bool {
+	a, b := m[i].records[0].TimeStamp, m[j].records[0].TimeStamp
+	if a.Equal(b) {
+		return m[i].order < m[j].order
+	}
+	return a.Before(b)
+}
+
+func (m ndjsonMerge) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+
+func (m *ndjsonMerge) Push(x any) { *m = append(*m, x.(*ndjsonFile)) }
+
+func (m *ndjsonMerge) Pop() any {
+	old := *m
+	file := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return file
+}
+
+// writeNDJSON writes every record of the DAT files found by dr, paired as
+// pairing has them, to out as one JSON object per line, in time order across
+// all files. The files are merged as they are read, so only a chunk of each
+// is held in memory. Files that cannot be read are reported on stderr and
+// skipped, the records of the others are written before the skipped files
+// are returned as an error.
+func writeNDJSON(dr *LibDAT.DatReader, pairing *datPairing, tagMaps map[string]string, useTagMap bool, out io.Writer) error {
+	// The files discovery lists without a float file, as the TUI does.
+	for _, tagFileName := range pairing.Unpaired() {
+		fmt.Fprintf(os.Stderr, "Skipping %s, it has no float file\n", tagFileName)
+	}
+
+	merge := &ndjsonMerge{}
+	defer func() {
+		for _, file := range *merge {
+			file.close()
+		}
+	}()
+	fileNames := dr.GetFloatFiles()
+	skipped := 0
+	for i, fileName := range fileNames {
+		file, err := openNDJSONFile(dr, pairing, fileName, i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", fileName, err)
+			skipped++
+			continue
+		}
+		ok, err := file.fill()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", fileName, err)
+			skipped++
+		}
+		if !ok {
+			file.close()
+			continue
+		}
+		heap.Push(merge, file)
+	}
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	for merge.Len() > 0 {
+		file := (*merge)[0]
+		record := file.records[0]
+		file.records = file.records[1:]
+		if err := writeNDJSONRecord(enc, file, record, tagMaps, useTagMap); err != nil {
+			return err
+		}
+
+		ok, err := file.fill()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping the rest of %s: %v\n", file.fileName, err)
+			skipped++
+		}
+		if ok {
+			heap.Fix(merge, 0)
+		} else {
+			heap.Pop(merge)
+			file.close()
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return fmt.Errorf("skipped %d of %d files", skipped, len(fileNames))
+	}
+	return nil
+}
+
+func writeNDJSONRecord(enc *json.Encoder, file *ndjsonFile, record *LibDAT.DatFloatRecord, tagMaps map[string]string, useTagMap bool) error {
+	if record == nil || !record.IsValid {
+		return nil
+	}
+	tag, exists := file.tags[record.TagID]
+	if !exists {
+		return nil
+	}
+	historianTag, exists := historianTagName(tag.Name, tagMaps, useTagMap)
+	if !exists {
+		return nil
+	}
+
+	line := ndjsonRecord{
+		File:         filepath.Base(file.fileName),
+		Tag:          tag.Name,
+		HistorianTag: historianTag,
+		Timestamp:    record.TimeStamp.Format(time.RFC3339Nano),
+		Status:       recordStatus(record),
+	}
+	// JSON has no representation for NaN or infinity, those are written as null.
+	if !math.IsNaN(record.Val) && !math.IsInf(record.Val, 0) {
+		value := record.Val
+		line.Value = &value
+	}
+	return enc.Encode(line)
+}
+
+// runNDJSON is the headless -sink ndjson mode, it writes the DAT files in
+// sources to outPath, or to stdout when no output file is given.
+func runNDJSON(sources datSources, tagMapCSV, outPath string) error {
+	dr, pairing, err := sources.Discover()
+	if err != nil {
+		return fmt.Errorf("directory %s contained no valid files: %v", sources, err)
+	}
+
+	tagMaps := make(map[string]string)
+	useTagMap := false
+	if tagMapCSV != "" {
+		if err := LibUtil.LoadTagMapCSV(tagMapCSV, tagMaps); err != nil {
+			return fmt.Errorf("failed to load tag map CSV: %v", err)
+		}
+		if len(tagMaps) < 1 {
+			return fmt.Errorf("tag mapping file was provided but had no entries")
+		}
+		useTagMap = true
+	}
+
+	var out io.Writer = os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	return writeNDJSON(dr, pairing, tagMaps, useTagMap, out)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// ndjson runs -sink ndjson over the folders and returns the lines written.
+func ndjson(t *testing.T, dirs ...string) []ndjsonRecord {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "out.ndjson")
+	if err := runNDJSON(datSources{Paths: dirs, StagingDir: t.TempDir()}, "", out); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []ndjsonRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line ndjsonRecord
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func checkTimeOrder(t *testing.T, lines []ndjsonRecord) {
+	t.Helper()
+	var last time.Time
+	for i, line := range lines {
+		ts, err := time.Parse(time.RFC3339Nano, line.Timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts.Before(last) {
+			t.Fatalf("line %d at %s is before the line before it", i, line.Timestamp)
+		}
+		last = ts
+	}
+}
+
+func TestNDJSONMergesAcrossDays(t *testing.T) {
+	dir := t.TempDir()
+	day1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	// The file of the first day runs into the second day.
+	sets := []struct {
+		date  time.Time
+		tag   string
+		times []time.Time
+	}{
+		{day1, "A", []time.Time{day1.Add(23 * time.Hour), day2.Add(10 * time.Hour)}},
+		{day2, "B", []time.Time{day2.Add(5 * time.Hour), day2.Add(12 * time.Hour)}},
+	}
+	for _, set := range sets {
+		var records []*LibDAT.DatFloatRecord
+		for i, ts := range set.times {
+			records = append(records, &LibDAT.DatFloatRecord{TimeStamp: ts, TagID: 0, Val: float64(i), Status: ' ', Marker: ' '})
+		}
+		if set.tag == "B" {
+			records[1].Val = math.NaN()
+		}
+		tags := []*LibDAT.DatTagRecord{{Name: set.tag, ID: 0}}
+		if err := writeDatSet(filepath.Join(dir, datSetName(set.date)), set.date, tags, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := ndjson(t, dir)
+	want := []string{"A", "B", "A", "B"}
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines written, %d expected", len(lines), len(want))
+	}
+	for i, line := range lines {
+		if line.Tag != want[i] {
+			t.Errorf("line %d is of %s at %s, %s expected", i, line.Tag, line.Timestamp, want[i])
+		}
+	}
+	checkTimeOrder(t, lines)
+	if lines[3].Value != nil || lines[3].File != "2024 01 02 0000 (Float).DAT" {
+		t.Errorf("the NaN value was written as %+v", lines[3])
+	}
+}
+
+func TestNDJSONMergesFolders(t *testing.T) {
+	first := genSet(t, "-tags", "5", "-rate", "1h", "-duration", "48h")
+	second := genSet(t, "-tags", "3", "-rate", "25m", "-duration", "24h", "-start", "2024-01-02")
+	lines := ndjson(t, first, second)
+	// 58 samples 25 minutes apart fit in a day.
+	if want := 5*48 + 3*58; len(lines) != want {
+		t.Errorf("%d lines written, %d expected", len(lines), want)
+	}
+	checkTimeOrder(t, lines)
+}
+
+func TestNDJSONSortsBackwardsFiles(t *testing.T) {
+	dir := genSet(t, "-tags", "5", "-rate", "1h", "-duration", "48h", "-corrupt", "backwards")
+	lines := ndjson(t, dir)
+	if len(lines) != 5*48 {
+		t.Errorf("%d lines written, %d expected", len(lines), 5*48)
+	}
+	checkTimeOrder(t, lines)
+}
+
+func TestNDJSONFailsOnSkippedFiles(t *testing.T) {
+	dir := genSet(t, "-tags", "5", "-rate", "1h", "-duration", "48h", "-corrupt", "notag")
+	out := filepath.Join(t.TempDir(), "out.ndjson")
+	if err := runNDJSON(datSources{Paths: []string{dir}, StagingDir: t.TempDir()}, "", out); err == nil {
+		t.Error("a skipped file is not reported as an error")
+	}
+	// The records of the readable file are written all the same.
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 5*24 {
+		t.Errorf("%d lines written, %d expected", lines, 5*24)
+	}
+}
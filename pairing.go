@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// datCandidate is a DAT file found by discovery, before float and tag files
+// are paired.
+type datCandidate struct {
+	fileName string
+	// rel is the slash separated path below the root it was found in.
+	rel string
+}
+
+func isFloatFile(name string) bool {
+	return strings.HasSuffix(name, " (Float).DAT")
+}
+
+func isTagFile(name string) bool {
+	return strings.HasSuffix(name, " (Tagname).DAT")
+}
+
+// tagFileOf returns the tag file paired with a float file, in its folder.
+func tagFileOf(floatFileName string) string {
+	return filepath.Join(filepath.Dir(floatFileName), strings.Replace(filepath.Base(floatFileName), " (Float)", " (Tagname)", 1))
+}
+
+// floatFileOf returns the float file paired with a tag file, in its folder.
+func floatFileOf(tagFileName string) string {
+	return filepath.Join(filepath.Dir(tagFileName), strings.Replace(filepath.Base(tagFileName), " (Tagname)", " (Float)", 1))
+}
+
+// datFileTime returns the time in the name of a DAT file,
+// "2024 01 31 0000 (Float).DAT".
+func datFileTime(fileName string) (time.Time, bool) {
+	base := filepath.Base(fileName)
+	if i := strings.Index(base, " ("); i >= 0 {
+		base = base[:i]
+	}
+	t, err := time.Parse("2006 01 02 1504", base)
+	return t, err == nil
+}
+
+// datPairing is the pairing of float and tag files found by a discovery, it
+// is not changed once discovery returns it. Float files without a tag file
+// may be read with the tag file of the nearest day in the same folder. A nil
+// pairing reads every float file with its own tag file.
+type datPairing struct {
+	dir string
+	// tagFiles are the tag files of each folder in name order.
+	tagFiles  map[string][]string
+	fallbacks map[string]string
+	unpaired  []string
+}
+
+// pair chooses the float files to load from the candidates, and returns them
+// with the fallback tag files and the tag files without a float file.
+func (s datSources) pair(candidates []datCandidate) ([]string, *datPairing) {
+	floats := make(map[string]bool)
+	tags := make(map[string]bool)
+	tagFiles := make(map[string][]string)
+	for _, candidate := range candidates {
+		switch {
+		case isFloatFile(candidate.fileName):
+			floats[candidate.fileName] = true
+		case isTagFile(candidate.fileName):
+			tags[candidate.fileName] = true
+			dir := filepath.Dir(candidate.fileName)
+			tagFiles[dir] = append(tagFiles[dir], candidate.fileName)
+		}
+	}
+	for _, files := range tagFiles {
+		sort.Strings(files)
+	}
+
+	var floatFileNames, unpaired []string
+	fallbacks := make(map[string]string)
+	for _, candidate := range candidates {
+		if isTagFile(candidate.fileName) {
+			floatFileName := floatFileOf(candidate.fileName)
+			floatRel := strings.Replace(candidate.rel, " (Tagname)", " (Float)", 1)
+			if !floats[floatFileName] && s.useFloatFile(floatFileName, floatRel) {
+				slog.Warn(fmt.Sprintf("%s has no float file", candidate.fileName))
+				unpaired = append(unpaired, candidate.fileName)
+			}
+			continue
+		}
+		if !s.useFloatFile(candidate.fileName, candidate.rel) {
+			continue
+		}
+		floatFileNames = append(floatFileNames, candidate.fileName)
+		if tags[tagFileOf(candidate.fileName)] {
+			continue
+		}
+		if !s.TagFallback {
+			slog.Warn(fmt.Sprintf("%s has no tag file", candidate.fileName))
+			continue
+		}
+		if tag, ok := nearestTagFile(candidate.fileName, tagFiles[filepath.Dir(candidate.fileName)]); ok {
+			slog.Warn(fmt.Sprintf("%s has no tag file, using %s", candidate.fileName, filepath.Base(tag)))
+			fallbacks[candidate.fileName] = tag
+		} else {
+			slog.Warn(fmt.Sprintf("%s has no tag file and no other day's tag file is in its folder", candidate.fileName))
+		}
+	}
+	sort.Strings(unpaired)
+	return floatFileNames, &datPairing{dir: s.StagingDir, tagFiles: tagFiles, fallbacks: fallbacks, unpaired: unpaired}
+}
+
+// nearestTagFile returns the tag file of the day closest to a float file's,
+// the earlier one when two are as close.
+func nearestTagFile(floatFileName string, tagFiles []string) (string, bool) {
+	floatTime, ok := datFileTime(floatFileName)
+	if !ok {
+		return "", false
+	}
+	best := ""
+	bestDistance := time.Duration(math.MaxInt64)
+	for _, tag := range tagFiles {
+		tagTime, ok := datFileTime(tag)
+		if !ok {
+			continue
+		}
+		distance := tagTime.Sub(floatTime)
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance < bestDistance || (distance == bestDistance && tagTime.Before(floatTime)) {
+			best, bestDistance = tag, distance
+		}
+	}
+	return best, best != ""
+}
+
+// Fallback returns the tag file of another day a float file is read with.
+func (p *datPairing) Fallback(floatFileName string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	tag, ok := p.fallbacks[floatFileName]
+	return tag, ok
+}
+
+// Unpaired returns the tag files without a float file.
+func (p *datPairing) Unpaired() []string {
+	if p == nil {
+		return nil
+	}
+	return append([]string(nil), p.unpaired...)
+}
+
+// PreviousTagFile returns the tag file of the day before a float file's own
+// tag file in the same folder.
+func (p *datPairing) PreviousTagFile(floatFileName string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	own := tagFileOf(floatFileName)
+	files := p.tagFiles[filepath.Dir(floatFileName)]
+	i := sort.SearchStrings(files, own)
+	if i == 0 {
+		return "", false
+	}
+	return files[i-1], true
+}
+
+// stage returns a float file path LibDAT reads the fallback tag file from.
+// LibDAT finds a tag file next to its float file, so both are put in a
+// folder of the staging folder, the float file as a link where possible.
+func (p *datPairing) stage(floatFileName, staged, tag string) (string, error) {
+	base := p.dir
+	if base == "" {
+		base = defaultStagingDir()
+	}
+	stagedTag, err := staging.stage(tag)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(floatFileName + "|" + tag))
+	dir := filepath.Join(base, "pairs", hex.EncodeToString(sum[:6]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.Base(floatFileName))
+	if err := linkOrCopy(staged, target); err != nil {
+		return "", fmt.Errorf("failed to stage %s: %v", floatFileName, err)
+	}
+	if err := linkOrCopy(stagedTag, tagFileOf(target)); err != nil {
+		return "", fmt.Errorf("failed to stage %s: %v", tag, err)
+	}
+	return target, nil
+}
+
+// linkOrCopy makes target a hard link of source, or a copy where links are
+// not possible. An existing copy is kept while it has the source's size.
+func linkOrCopy(source, target string) error {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if targetInfo, err := os.Stat(target); err == nil {
+		if os.SameFile(sourceInfo, targetInfo) || targetInfo.Size() == sourceInfo.Size() {
+			return nil
+		}
+		os.Remove(target)
+	}
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeStagedFile(target, file)
+}
+
+// tagChanges compares the tags of two tag files by id.
+func tagChanges(tags, previous []*LibDAT.DatTagRecord) (added, removed, renamed int) {
+	names := make(map[int]string, len(previous))
+	for _, tag := range previous {
+		names[tag.ID] = tag.Name
+	}
+	for _, tag := range tags {
+		name, ok := names[tag.ID]
+		switch {
+		case !ok:
+			added++
+		case name != tag.Name:
+			renamed++
+		}
+		delete(names, tag.ID)
+	}
+	return added, len(names), renamed
+}
+
+// readTagFile reads the tags of a tag file, salvaging what is readable.
+func readTagFile(tagFileName string) ([]*LibDAT.DatTagRecord, error) {
+	staged, err := staging.stage(tagFileName)
+	if err != nil {
+		return nil, err
+	}
+	tags, _, err := salvageTagRecords(staged)
+	return tags, err
+}
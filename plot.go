@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+)
+
+// An interval this many times longer than the median sample interval is
+// drawn as a gap rather than joined with a line.
+const plotGapFactor = 3
+
+// Width of the value labels left of the chart.
+const plotAxisWidth = 11
+
+const plotMaxZoom = 4096
+
+type plotPoint struct {
+	time  time.Time
+	value float64
+	good  bool
+}
+
+type PlotModel struct {
+	Keys      keyMap
+	Active    bool
+	Tag       string
+	points    []plotPoint
+	spanStart time.Time
+	spanEnd   time.Time
+	gap       time.Duration
+	zoom      float64
+	// center of the visible window as a fraction of the file's time span.
+	center float64
+}
+
+// OpenPlot shows the values of tag over the time span of records, which
+// covers every tag in the file so tags can be compared at the same scale.
+func OpenPlot(keys keyMap, tag tagStats, records []*LibDAT.DatFloatRecord) PlotModel {
+	m := PlotModel{Keys: keys, Active: true, Tag: tag.Name, zoom: 1, center: 0.5}
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		if m.spanStart.IsZero() || record.TimeStamp.Before(m.spanStart) {
+			m.spanStart = record.TimeStamp
+		}
+		if record.TimeStamp.After(m.spanEnd) {
+			m.spanEnd = record.TimeStamp
+		}
+		if record.TagID == tag.ID {
+			m.points = append(m.points, plotPoint{time: record.TimeStamp, value: record.Val, good: recordStatus(record) == ""})
+		}
+	}
+	sort.SliceStable(m.points, func(i, j int) bool {
+		return m.points[i].time.Before(m.points[j].time)
+	})
+	if !m.spanEnd.After(m.spanStart) {
+		m.spanEnd = m.spanStart.Add(time.Second)
+	}
+
+	if len(m.points) > 1 {
+		intervals := make([]time.Duration, 0, len(m.points)-1)
+		for i := 1; i < len(m.points); i++ {
+			intervals = append(intervals, m.points[i].time.Sub(m.points[i-1].time))
+		}
+		sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+		m.gap = intervals[len(intervals)/2] * plotGapFactor
+	}
+	return m
+}
+
+func (m PlotModel) Update(msg tea.KeyMsg) PlotModel {
+	step := 0.25 / m.zoom
+	switch {
+	case key.Matches(msg, m.Keys.Back, m.Keys.Quit):
+		m.Active = false
+	case key.Matches(msg, m.Keys.ZoomIn):
+		m.zoom = math.Min(m.zoom*2, plotMaxZoom)
+	case key.Matches(msg, m.Keys.ZoomOut):
+		m.zoom = math.Max(m.zoom/2, 1)
+	case key.Matches(msg, m.Keys.PanLeft):
+		m.center -= step
+	case key.Matches(msg, m.Keys.PanRight):
+		m.center += step
+	case key.Matches(msg, m.Keys.PanStart):
+		m.center = 0
+	case key.Matches(msg, m.Keys.PanEnd):
+		m.center = 1
+	case key.Matches(msg, m.Keys.ResetZoom):
+		m.zoom = 1
+		m.center = 0.5
+	}
+
+	// Keep the visible window inside the file's time span.
+	half := 0.5 / m.zoom
+	m.center = math.Max(half, math.Min(1-half, m.center))
+	return m
+}
+
+// window returns the visible time range.
+func (m PlotModel) window() (time.Time, time.Time) {
+	span := m.spanEnd.Sub(m.spanStart)
+	width := time.Duration(float64(span) / m.zoom)
+	start := m.spanStart.Add(time.Duration(float64(span)*m.center) - width/2)
+	return start, start.Add(width)
+}
+
+func (m PlotModel) View(width, height int) string {
+	s := fmt.Sprintf("Tag: %s\n", lipgloss.NewStyle().Bold(true).Render(m.Tag))
+	if len(m.points) == 0 {
+		s += "No records for this tag.\n\n" + keyHint(m.Keys.Back, "Back")
+		return s
+	}
+
+	start, end := m.window()
+	s += fmt.Sprintf("%s to %s, zoom %gx\n", start.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"), m.zoom)
+
+	cols := max(width-plotAxisWidth-1, 10)
+	rows := max(height-6, 3)
+	chart, markers, low, high := m.render(start, end, cols, rows)
+
+	axis := lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	for i, line := range chart {
+		label := ""
+		switch i {
+		case 0:
+			label = fmt.Sprintf("%.4g", high)
+		case rows / 2:
+			label = fmt.Sprintf("%.4g", (low+high)/2)
+		case rows - 1:
+			label = fmt.Sprintf("%.4g", low)
+		}
+		s += axis.Render(fmt.Sprintf("%*s┤", plotAxisWidth-1, label)) + line + "\n"
+	}
+	s += strings.Repeat(" ", plotAxisWidth) + markers + "\n"
+
+	startLabel := start.Format("15:04:05")
+	endLabel := end.Format("15:04:05")
+	padding := max(cols-len(startLabel)-len(endLabel), 1)
+	s += strings.Repeat(" ", plotAxisWidth) + axis.Render(startLabel+strings.Repeat(" ", padding)+endLabel) + "\n"
+
+	bad := lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render("✕")
+	gap := lipgloss.NewStyle().Foreground(lipgloss.Color("3")).Render("░")
+	k := m.Keys
+	s += strings.Join([]string{bad + " bad status", gap + " gap", keyHint(k.Back, "Back"), keyHint(k.ZoomIn, "Zoom in"), keyHint(k.ZoomOut, "Zoom out"), keyHint(k.PanLeft, "Pan left"), keyHint(k.PanRight, "Pan right"), keyHint(k.ResetZoom, "Reset")}, "  ")
+	return s
+}
+
+// render draws the points between start and end as braille characters, each
+// character cell holding a 2x4 grid of dots. It also returns the marker line
+// flagging gaps and bad status samples, and the value range of the chart.
+func (m PlotModel) render(start, end time.Time, cols, rows int) ([]string, string, float64, float64) {
+	first := sort.Search(len(m.points), func(i int) bool { return !m.points[i].time.Before(start) })
+	last := sort.Search(len(m.points), func(i int) bool { return m.points[i].time.After(end) })
+	// Include the neighbours outside the window so lines run to the edges.
+	first = max(first-1, 0)
+	last = min(last+1, len(m.points))
+	visible := m.points[first:last]
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, p := range visible {
+		if math.IsNaN(p.value) || math.IsInf(p.value, 0) {
+			continue
+		}
+		low = math.Min(low, p.value)
+		high = math.Max(high, p.value)
+	}
+	if math.IsInf(low, 1) {
+		low, high = 0, 1
+	}
+	if low == high {
+		low, high = low-1, high+1
+	}
+
+	dotsX, dotsY := cols*2, rows*4
+	grid := make([][]bool, dotsY)
+	for i := range grid {
+		grid[i] = make([]bool, dotsX)
+	}
+	markers := make([]rune, cols)
+	for i := range markers {
+		markers[i] = ' '
+	}
+
+	span := float64(end.Sub(start))
+	toX := func(t time.Time) int {
+		return int(math.Round(float64(t.Sub(start)) / span * float64(dotsX-1)))
+	}
+	toY := func(v float64) int {
+		return dotsY - 1 - int(math.Round((v-low)/(high-low)*float64(dotsY-1)))
+	}
+	inside := func(x int) bool { return x >= 0 && x < dotsX }
+
+	for i, p := range visible {
+		if math.IsNaN(p.value) || math.IsInf(p.value, 0) {
+			continue
+		}
+		x, y := toX(p.time), toY(p.value)
+		if inside(x) {
+			grid[y][x] = true
+			if !p.good {
+				markers[x/2] = '✕'
+			}
+		}
+		if i == 0 {
+			continue
+		}
+		prev := visible[i-1]
+		if m.gap > 0 && p.time.Sub(prev.time) > m.gap {
+			for gx := max(toX(prev.time)+1, 0); gx < min(x, dotsX); gx++ {
+				if markers[gx/2] == ' ' {
+					markers[gx/2] = '░'
+				}
+			}
+			continue
+		}
+		if !math.IsNaN(prev.value) && !math.IsInf(prev.value, 0) {
+			drawLine(grid, toX(prev.time), toY(prev.value), x, y)
+		}
+	}
+
+	// Braille dot bits indexed by [row within cell][column within cell].
+	bits := [4][2]rune{{0x01, 0x08}, {0x02, 0x10}, {0x04, 0x20}, {0x40, 0x80}}
+	lines := make([]string, rows)
+	for row := 0; row < rows; row++ {
+		var b strings.Builder
+		for col := 0; col < cols; col++ {
+			char := rune(0x2800)
+			for dy := 0; dy < 4; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					if grid[row*4+dy][col*2+dx] {
+						char |= bits[dy][dx]
+					}
+				}
+			}
+			b.WriteRune(char)
+		}
+		lines[row] = b.String()
+	}
+
+	badStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	gapStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+	var marker strings.Builder
+	for _, r := range markers {
+		switch r {
+		case '✕':
+			marker.WriteString(badStyle.Render(string(r)))
+		case '░':
+			marker.WriteString(gapStyle.Render(string(r)))
+		default:
+			marker.WriteRune(r)
+		}
+	}
+	return lines, marker.String(), low, high
+}
+
+// drawLine sets the dots between two points, clipped to the grid.
+func drawLine(grid [][]bool, x0, y0, x1, y1 int) {
+	dx := abs(x1 - x0)
+	dy := -abs(y1 - y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		if y0 >= 0 && y0 < len(grid) && x0 >= 0 && x0 < len(grid[y0]) {
+			grid[y0][x0] = true
+		}
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -60,6 +60,28 @@ func initialScanningPopupModel() ScanningFilesPopupModel {
 	}
 }
 
+// Skip counts a file that failed to load at stage as done in the stages it
+// did not reach.
+func (m ScanningFilesPopupModel) Skip(stage int) ScanningFilesPopupModel {
+	if stage <= stageTagHeader {
+		m.InitalizedFiles++
+	}
+	if stage <= stageTagRecords {
+		m.DATTagsLoadedFiles++
+	}
+	if stage <= stageLookup {
+		m.HistorianTagsLoadedFiles++
+	}
+	m.RecordLoadedFiles++
+	if m.TotalFiles > 0 {
+		m.InitPercentage = float64(m.InitalizedFiles) / float64(m.TotalFiles)
+		m.DatTagsLoadedPercentage = float64(m.DATTagsLoadedFiles) / float64(m.TotalFiles)
+		m.HistorianTagsLoadedPercentage = float64(m.HistorianTagsLoadedFiles) / float64(m.TotalFiles)
+		m.RecordsLoadedPercentage = float64(m.RecordLoadedFiles) / float64(m.TotalFiles)
+	}
+	return m
+}
+
 type FileInititalCountMsg struct {
 	FileCount int
 }
@@ -138,7 +160,7 @@ func InitialNoValidFilesPopupModel(active bool) NoValidFilesPopupModel {
 	return NoValidFilesPopupModel{Active: active}
 }
 
-func (m NoValidFilesPopupModel) View(width int, height int, directory string, background string) string {
+func (m NoValidFilesPopupModel) View(width int, height int, directory string, browseKey string, background string) string {
 	if !m.Active {
 		return background
 	}
@@ -155,7 +177,7 @@ func (m NoValidFilesPopupModel) View(width int, height int, directory string, ba
 	content := lipgloss.JoinVertical(
 		lipgloss.Center,
 		fmt.Sprintf("Directory %s contained no valid files.", directory),
-		"Press q to quit.",
+		fmt.Sprintf("Press %s to browse for a folder or q to quit.", browseKey),
 	)
 
 	forground := lipgloss.Place(
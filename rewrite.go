@@ -0,0 +1,284 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibUtil"
+)
+
+type datRewriteConfig struct {
+	merge   bool
+	subsets []tagSubset
+}
+
+// tagSubset is a set of tags written to a folder of their own.
+type tagSubset struct {
+	name  string
+	globs []string
+}
+
+func registerDATFlags() *datRewriteConfig {
+	cfg := &datRewriteConfig{}
+	flag.BoolVar(&cfg.merge, "datMerge", false, "For -sink dat, merge all days into one float and tag file set")
+	flag.Func("datSplit", "For -sink dat, write the tags matching comma separated globs to a folder of their own, as name=glob,glob. May be given several times", func(value string) error {
+		name, globs, ok := strings.Cut(value, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || globs == "" || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("expected name=glob,glob")
+		}
+		subset := tagSubset{name: name}
+		for _, glob := range strings.Split(globs, ",") {
+			glob = tagGlob(strings.TrimSpace(glob))
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("invalid glob %s: %v", glob, err)
+			}
+			subset.globs = append(subset.globs, glob)
+		}
+		cfg.subsets = append(cfg.subsets, subset)
+		return nil
+	})
+	return cfg
+}
+
+// tagGlob escapes the backslashes of a glob, so they match the backslashes
+// of tag names rather than escaping the next character. * matches across
+// them.
+func tagGlob(s string) string {
+	return strings.ReplaceAll(s, `\`, `\\`)
+}
+
+func (s tagSubset) matches(tagName string) bool {
+	for _, glob := range s.globs {
+		if ok, _ := path.Match(glob, tagName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// datOutput collects the tags and records of a file set being rewritten.
+// Tags are identified by name, the ids of the input files are replaced by
+// ids numbered in the order the tags are first seen.
+type datOutput struct {
+	dir     string
+	name    time.Time
+	tags    []*LibDAT.DatTagRecord
+	ids     map[string]int
+	records []*LibDAT.DatFloatRecord
+}
+
+func newDatOutput(dir string) *datOutput {
+	return &datOutput{dir: dir, ids: make(map[string]int)}
+}
+
+// add adds a record of tag, the record is copied with the output tag id.
+func (o *datOutput) add(tag *LibDAT.DatTagRecord, record *LibDAT.DatFloatRecord) {
+	id, ok := o.ids[tag.Name]
+	if !ok {
+		id = len(o.tags)
+		o.ids[tag.Name] = id
+		o.tags = append(o.tags, &LibDAT.DatTagRecord{Name: tag.Name, ID: id, Type: tag.Type, Dtype: tag.Dtype})
+	}
+	copied := *record
+	copied.TagID = id
+	o.records = append(o.records, &copied)
+}
+
+// flush writes the file set in time order and starts a new one.
+func (o *datOutput) flush() (string, error) {
+	if len(o.records) == 0 {
+		return "", nil
+	}
+	sort.SliceStable(o.records, func(i, j int) bool {
+		return o.records[i].TimeStamp.Before(o.records[j].TimeStamp)
+	})
+	floatFileName := filepath.Join(o.dir, datSetName(o.name))
+	err := writeDatSet(floatFileName, o.name, o.tags, o.records)
+	o.tags, o.ids, o.records = nil, make(map[string]int), nil
+	return floatFileName, err
+}
+
+// datRewrite is the state of the -sink dat mode.
+type datRewrite struct {
+	cfg     datRewriteConfig
+	pairing *datPairing
+	tagMaps map[string]string
+	outputs []*datOutput
+	// subsets are the subsets of each output, nil when not split.
+	subsets []*tagSubset
+	written []string
+	// Counts reported once the rewrite is done.
+	dropped, unmapped map[string]bool
+	orphans           int
+}
+
+// runDATRewrite is the headless -sink dat mode. It writes the records of the
+// DAT files in sources to new DAT files in outDir, renaming tags through the
+// tag map and splitting or merging them as configured.
+func runDATRewrite(sources datSources, tagMapCSV, outDir string, cfg datRewriteConfig) error {
+	if outDir == "" {
+		return fmt.Errorf("-out must name the folder the DAT files are written to")
+	}
+	dr, pairing, err := sources.Discover()
+	if err != nil {
+		return fmt.Errorf("directory %s contained no valid files: %v", sources, err)
+	}
+
+	r := &datRewrite{cfg: cfg, pairing: pairing, dropped: make(map[string]bool), unmapped: make(map[string]bool)}
+	if tagMapCSV != "" {
+		r.tagMaps = make(map[string]string)
+		if err := LibUtil.LoadTagMapCSV(tagMapCSV, r.tagMaps); err != nil {
+			return fmt.Errorf("failed to load tag map CSV: %v", err)
+		}
+		if len(r.tagMaps) < 1 {
+			return fmt.Errorf("tag mapping file was provided but had no entries")
+		}
+	}
+	if len(cfg.subsets) == 0 {
+		r.outputs = []*datOutput{newDatOutput(outDir)}
+		r.subsets = []*tagSubset{nil}
+	}
+	for i := range cfg.subsets {
+		r.outputs = append(r.outputs, newDatOutput(filepath.Join(outDir, cfg.subsets[i].name)))
+		r.subsets = append(r.subsets, &cfg.subsets[i])
+	}
+
+	// Files of the same day, from several folders, are written together.
+	days := make(map[string][]string)
+	var dayNames []string
+	for _, fileName := range dr.GetFloatFiles() {
+		day := filepath.Base(fileName)
+		if _, ok := days[day]; !ok {
+			dayNames = append(dayNames, day)
+		}
+		days[day] = append(days[day], fileName)
+	}
+	sort.Strings(dayNames)
+
+	for _, day := range dayNames {
+		name, ok := datFileTime(day)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Skipping %s, its name has no date\n", day)
+			continue
+		}
+		if r.outputs[0].name.IsZero() || !cfg.merge {
+			for _, output := range r.outputs {
+				output.name = name
+			}
+		}
+		for _, fileName := range days[day] {
+			if err := r.read(dr, fileName); err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", fileName, err)
+			}
+		}
+		if !cfg.merge {
+			if err := r.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	r.report()
+	if len(r.written) == 0 {
+		return fmt.Errorf("no records were written")
+	}
+	return nil
+}
+
+// read adds the records of a float file to the outputs of their tags.
+func (r *datRewrite) read(dr *LibDAT.DatReader, fileName string) error {
+	report, staged, tagRecords, err := openDatFile(dr, r.pairing, fileName, false)
+	if err != nil {
+		return err
+	}
+	records, err := readFloatFileRecords(dr, staged, report)
+	if err != nil {
+		return err
+	}
+	if !report.Scanned {
+		checked := checkFloatRecords(report, tagRecords, records)
+		for _, issue := range checked.Issues[len(report.Issues):] {
+			slog.Warn(fmt.Sprintf("%s: %s", fileName, issue))
+		}
+	}
+
+	// The outputs each tag id is written to, under its new name.
+	tags := make(map[int]*LibDAT.DatTagRecord, len(tagRecords))
+	outputs := make(map[int][]*datOutput, len(tagRecords))
+	for _, tag := range tagRecords {
+		renamed := *tag
+		if r.tagMaps != nil {
+			// LibUtil keys the tag map by upper case name.
+			if name, ok := r.tagMaps[strings.ToUpper(tag.Name)]; ok {
+				renamed.Name = strings.TrimSpace(name)
+			} else {
+				r.unmapped[tag.Name] = true
+			}
+		}
+		tags[tag.ID] = &renamed
+		for i, subset := range r.subsets {
+			if subset == nil || subset.matches(tag.Name) {
+				outputs[tag.ID] = append(outputs[tag.ID], r.outputs[i])
+			}
+		}
+		if len(outputs[tag.ID]) == 0 {
+			r.dropped[tag.Name] = true
+		}
+	}
+
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		tag, ok := tags[record.TagID]
+		if !ok {
+			r.orphans++
+			continue
+		}
+		for _, output := range outputs[record.TagID] {
+			output.add(tag, record)
+		}
+	}
+	return nil
+}
+
+func (r *datRewrite) flush() error {
+	for _, output := range r.outputs {
+		floatFileName, err := output.flush()
+		if err != nil {
+			return err
+		}
+		if floatFileName != "" {
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", floatFileName)
+			r.written = append(r.written, floatFileName)
+		}
+	}
+	return nil
+}
+
+// report prints what was left out of the rewrite to stderr, stdout is kept
+// for data as in the other headless modes.
+func (r *datRewrite) report() {
+	if len(r.unmapped) > 0 {
+		fmt.Fprintf(os.Stderr, "%d tags are not in the tag map and keep their name\n", len(r.unmapped))
+	}
+	if len(r.dropped) > 0 {
+		fmt.Fprintf(os.Stderr, "%d tags match no -datSplit subset and are left out\n", len(r.dropped))
+	}
+	if r.orphans > 0 {
+		fmt.Fprintf(os.Stderr, "%d records of tag ids missing from their tag file are left out\n", r.orphans)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d DAT file sets, each read back through LibDAT as written\n", len(r.written))
+}
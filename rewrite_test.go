@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rewrite runs -sink dat over the folders into a new output folder.
+func rewrite(t *testing.T, cfg datRewriteConfig, tagMapCSV string, dirs ...string) string {
+	t.Helper()
+	out := t.TempDir()
+	sources := datSources{Paths: dirs, StagingDir: t.TempDir()}
+	if err := runDATRewrite(sources, tagMapCSV, out, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func tagNames(t *testing.T, floatFileName string) []string {
+	t.Helper()
+	_, tags, _ := readDatSet(t, floatFileName)
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		if tag.ID != i {
+			t.Errorf("tag %s has id %d, %d expected", tag.Name, tag.ID, i)
+		}
+		names[i] = tag.Name
+	}
+	return names
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRewriteUnchanged(t *testing.T) {
+	in := genSet(t, "-tags", "10", "-rate", "1h", "-duration", "48h")
+	out := rewrite(t, datRewriteConfig{}, "", in)
+
+	for _, name := range []string{"2024 01 01 0000 (Float).DAT", "2024 01 01 0000 (Tagname).DAT", "2024 01 02 0000 (Float).DAT", "2024 01 02 0000 (Tagname).DAT"} {
+		want, err := os.ReadFile(filepath.Join(in, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from its input", name)
+		}
+	}
+}
+
+func TestRewriteMerge(t *testing.T) {
+	first := genSet(t, "-tags", "10", "-rate", "1h", "-duration", "48h")
+	// A second folder adds a day with two more tags.
+	second := genSet(t, "-tags", "12", "-rate", "1h", "-duration", "24h", "-start", "2024-01-03")
+	out := rewrite(t, datRewriteConfig{merge: true}, "", first, second)
+
+	entries, err := os.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d files written, one set expected", len(entries))
+	}
+	floatFileName := filepath.Join(out, "2024 01 01 0000 (Float).DAT")
+	date, tags, records := readDatSet(t, floatFileName)
+	if date != "2024-01-01" {
+		t.Errorf("the merged set is dated %s, 2024-01-01 expected", date)
+	}
+	if len(tags) != 12 || tags[10].Name != `Line1\Temp03` || tags[11].Name != `Line1\Press03` {
+		t.Errorf("the merged set has tags %v", tagNames(t, floatFileName))
+	}
+	if len(records) != 2*24*10+24*12 {
+		t.Fatalf("%d records merged, %d expected", len(records), 2*24*10+24*12)
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].TimeStamp.Before(records[i-1].TimeStamp) {
+			t.Fatalf("record %d at %s is before the record before it", i, records[i].TimeStamp)
+		}
+	}
+	if last := records[len(records)-1].TimeStamp; !last.Equal(time.Date(2024, 1, 3, 23, 0, 0, 0, time.UTC)) {
+		t.Errorf("the last record is at %s", last)
+	}
+}
+
+func TestRewriteSplit(t *testing.T) {
+	in := genSet(t, "-tags", "10", "-rate", "1h", "-duration", "48h")
+	cfg := datRewriteConfig{subsets: []tagSubset{
+		{name: "flow", globs: []string{tagGlob("*Flow*")}},
+		{name: "temp", globs: []string{tagGlob(`Line1\Temp01`), tagGlob(`Line1\Temp02`)}},
+	}}
+	out := rewrite(t, cfg, "", in)
+
+	for _, day := range []string{"2024 01 01 0000 (Float).DAT", "2024 01 02 0000 (Float).DAT"} {
+		flow := filepath.Join(out, "flow", day)
+		if names := tagNames(t, flow); !equalNames(names, []string{`Line1\Flow01`, `Line1\Flow02`}) {
+			t.Errorf("%s has tags %v", flow, names)
+		}
+		temp := filepath.Join(out, "temp", day)
+		if names := tagNames(t, temp); !equalNames(names, []string{`Line1\Temp01`, `Line1\Temp02`}) {
+			t.Errorf("%s has tags %v", temp, names)
+		}
+		_, _, records := readDatSet(t, temp)
+		if len(records) != 48 {
+			t.Errorf("%s has %d records, 48 expected", temp, len(records))
+		}
+		for _, record := range records {
+			if record.TagID != 0 && record.TagID != 1 {
+				t.Fatalf("%s has a record of tag id %d", temp, record.TagID)
+			}
+		}
+	}
+	// Tags matching no subset are left out, there is no set of all tags.
+	if _, err := os.Stat(filepath.Join(out, "2024 01 01 0000 (Float).DAT")); !os.IsNotExist(err) {
+		t.Errorf("a set of all tags was written")
+	}
+}
+
+func TestRewriteTagMap(t *testing.T) {
+	in := genSet(t, "-tags", "5", "-rate", "1h", "-duration", "24h")
+	tagMapCSV := filepath.Join(t.TempDir(), "map.csv")
+	// The tag map is matched without case.
+	if err := os.WriteFile(tagMapCSV, []byte("Line1\\Temp01,Plant\\T1\nline1\\flow01, Plant\\F1 \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := rewrite(t, datRewriteConfig{}, tagMapCSV, in)
+
+	names := tagNames(t, filepath.Join(out, "2024 01 01 0000 (Float).DAT"))
+	want := []string{`Plant\T1`, `Line1\Press01`, `Plant\F1`, `Line1\Level01`, `Line1\Valve01`}
+	if !equalNames(names, want) {
+		t.Errorf("the renamed tags are %v, %v expected", names, want)
+	}
+}
+
+// captureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	read := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		read <- b
+	}()
+	fn()
+	w.Close()
+	return string(<-read)
+}
+
+func TestRewriteKeepsStdout(t *testing.T) {
+	in := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "24h")
+	if out := captureStdout(t, func() { rewrite(t, datRewriteConfig{}, "", in) }); out != "" {
+		t.Errorf("the rewrite wrote to stdout: %q", out)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// SelectionModel holds the state of the range and date based bulk selection
+// of the files table. Like the other bulk actions these only touch the rows
+// shown by the current filters.
+type SelectionModel struct {
+	// Anchor is the file a range was started on, empty when no range is open.
+	Anchor       string
+	DateInput    textinput.Model
+	EditingDates bool
+	Err          string
+}
+
+func initialSelectionModel() SelectionModel {
+	dates := textinput.New()
+	dates.Prompt = "Select dates: "
+	dates.Placeholder = "YYYY-MM-DD..YYYY-MM-DD"
+	return SelectionModel{DateInput: dates}
+}
+
+// UpdateInput passes a key to the date range input, done is set once the
+// range is confirmed.
+func (m SelectionModel) UpdateInput(msg tea.KeyMsg) (sel SelectionModel, cmd tea.Cmd, done bool) {
+	switch msg.String() {
+	case "enter":
+		m.EditingDates = false
+		m.DateInput.Blur()
+		return m, nil, true
+	case "esc":
+		m.EditingDates = false
+		m.DateInput.Blur()
+		return m, nil, false
+	}
+	m.DateInput, cmd = m.DateInput.Update(msg)
+	return m, cmd, false
+}
+
+// markRange starts a range on the row under the cursor, or when a range is
+// already open selects every shown row between its start and the cursor.
+func (m *model) markRange() {
+	m.selection.Err = ""
+	index := m.selectedRowIndex()
+	if m.processed || index < 0 {
+		return
+	}
+	fileName := m.rows[index][1]
+	if m.selection.Anchor == "" {
+		m.selection.Anchor = fileName
+		return
+	}
+
+	start := -1
+	for i, row := range m.filesTable.Rows() {
+		if row[1] == m.selection.Anchor {
+			start = i
+		}
+	}
+	m.selection.Anchor = ""
+	if start < 0 {
+		m.selection.Err = "The range start is hidden by the filters."
+		return
+	}
+	end := m.filesTable.Cursor()
+	if end < start {
+		start, end = end, start
+	}
+	indexes := m.visibleRowIndexes()
+	for _, i := range indexes[start : end+1] {
+		if selectable(m.rows[i]) {
+			m.rows[i][0] = "[X]"
+		}
+	}
+	m.refreshTable()
+}
+
+// selectDates selects the shown rows dated within the range typed in the
+// selection input and deselects the others.
+func (m *model) selectDates() {
+	m.selection.Err = ""
+	if m.processed {
+		return
+	}
+	from, to, err := parseDateRange(m.selection.DateInput.Value())
+	if err != nil {
+		m.selection.Err = err.Error()
+		return
+	}
+	for _, i := range m.visibleRowIndexes() {
+		m.rows[i][0] = "[ ]"
+		date, err := parseDate(m.rows[i][3])
+		if err != nil {
+			continue
+		}
+		if selectable(m.rows[i]) && (from.IsZero() || !date.Before(from)) && (to.IsZero() || !date.After(to)) {
+			m.rows[i][0] = "[X]"
+		}
+	}
+	m.refreshTable()
+}
+
+// invertSelection toggles the selection of every shown row.
+func (m *model) invertSelection() {
+	if m.processed {
+		return
+	}
+	for _, i := range m.visibleRowIndexes() {
+		if m.rows[i][0] == "[X]" {
+			m.rows[i][0] = "[ ]"
+		} else if selectable(m.rows[i]) {
+			m.rows[i][0] = "[X]"
+		}
+	}
+	m.refreshTable()
+}
+
+// selectionSummary counts the selected files, their records and the distinct
+// tags across them. Records and tags are only known once the headers are read.
+func (m model) selectionSummary() (files, records, tags int) {
+	names := make(map[string]bool)
+	for _, row := range m.rows {
+		if row[0] != "[X]" {
+			continue
+		}
+		files++
+		record, exists := m.datFileRecords[row[1]]
+		if !exists {
+			continue
+		}
+		records += record.recordCount
+		for _, tag := range record.TagRecords {
+			names[tag.Name] = true
+		}
+	}
+	return files, records, len(names)
+}
+
+func (m model) ViewSelection() string {
+	if m.selection.EditingDates {
+		return m.selection.DateInput.View()
+	}
+	files, records, tags := m.selectionSummary()
+	s := fmt.Sprintf("Selected %d of %d files, %d records, %d tags", files, len(m.rows), records, tags)
+	if m.selection.Anchor != "" {
+		s += fmt.Sprintf("  Range from %s, move and press [v] to select", filepath.Base(m.selection.Anchor))
+	}
+	if m.selection.Err != "" {
+		s += "  " + lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Render(m.selection.Err)
+	}
+	return s
+}
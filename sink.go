@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibFTH"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+// Sink is a destination for DAT float records. The default piapi sink writes
+// straight into the historian through piapi.dll, the others publish the same
+// records to external systems.
+type Sink interface {
+	// Name returns the value used to select the sink with -sink.
+	Name() string
+	// Target describes where the sink writes to, shown in the status bar.
+	Target() string
+	Connect() error
+	// ResolvePoint maps a datalog tag onto the sink. Points returned with
+	// Process set to false are not counted as valid and are never inserted.
+	ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache
+	Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error
+	Close() error
+}
+
+type sinkConfig struct {
+	name        string
+	hostname    string
+	processName string
+	mqtt        *mqttConfig
+	kafka       *kafkaConfig
+	piWebAPI    *piWebAPIConfig
+	opcua       *opcuaConfig
+}
+
+func newSink(cfg sinkConfig) (Sink, error) {
+	switch strings.ToLower(cfg.name) {
+	case "", "piapi":
+		return &piapiSink{hostname: cfg.hostname, processName: cfg.processName}, nil
+	case "mqtt":
+		return newMQTTSink(*cfg.mqtt)
+	case "kafka":
+		return newKafkaSink(*cfg.kafka)
+	case "piwebapi":
+		return newPIWebAPISink(*cfg.piWebAPI, cfg.hostname)
+	case "opcua":
+		return newOPCUASink(*cfg.opcua)
+	}
+	return nil, fmt.Errorf("unknown sink %q", cfg.name)
+}
+
+// piapiSink writes snapshots to the historian through piapi.dll.
+type piapiSink struct {
+	hostname    string
+	processName string
+}
+
+func (s *piapiSink) Name() string { return "piapi" }
+
+func (s *piapiSink) Target() string {
+	return fmt.Sprintf("Server: %s, with process name: %s", s.hostname, s.processName)
+}
+
+func (s *piapiSink) Connect() error {
+	LibFTH.SetProcessName(s.processName)
+	return LibFTH.Connect(s.hostname)
+}
+
+func (s *piapiSink) ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	return LibFTH.AddToPIPointCache(tag.Name, tag.ID, 0, historianTag)
+}
+
+func (s *piapiSink) Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	return LibFTH.ConvertDatFloatRecordsToPutSnapshots(records, points)
+}
+
+func (s *piapiSink) Close() error {
+	return LibFTH.Disconnect()
+}
+
+// Ping sets the server node again. piut_setservernode contacts the server and
+// reconnects when the connection was lost, which is how piapi.dll recovers
+// from a lost server. LibFTH holds the piapi.dll lock for the call, so a check
+// never runs while an insert is in piapi.dll.
+func (s *piapiSink) Ping() error {
+	if err := LibFTH.Connect(s.hostname); err != nil {
+		return fmt.Errorf("reconnecting to %s failed: %v", s.hostname, err)
+	}
+	return nil
+}
+
+// externalPoint builds the point cache entry used by sinks that do not need a
+// historian point id, they only need the historian tag name to publish under.
+func externalPoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	return &LibPI.PointCache{
+		DatalogName: tag.Name,
+		DataLogID:   tag.ID,
+		DataLogType: tag.Dtype,
+		Process:     true,
+		PIName:      historianTag,
+	}
+}
+
+// jsonRecord is the JSON shape of a single float record shared by the sinks
+// that publish JSON.
+type jsonRecord struct {
+	Tag        string `json:"tag"`
+	DatalogTag string `json:"datalogTag"`
+	Timestamp  string `json:"timestamp"`
+	// Value is nil for values that are not finite, JSON has no
+	// representation for them.
+	Value  *float64 `json:"value"`
+	Status string   `json:"status,omitempty"`
+}
+
+func newJSONRecord(record *LibDAT.DatFloatRecord, point *LibPI.PointCache) jsonRecord {
+	rec := jsonRecord{
+		Tag:        point.PIName,
+		DatalogTag: point.DatalogName,
+		Timestamp:  record.TimeStamp.Format(time.RFC3339Nano),
+		Status:     recordStatus(record),
+	}
+	if !math.IsNaN(record.Val) && !math.IsInf(record.Val, 0) {
+		value := record.Val
+		rec.Value = &value
+	}
+	return rec
+}
+
+// recordStatus returns the datalog status character of a float record,
+// records logged without a status are reported as good.
+func recordStatus(record *LibDAT.DatFloatRecord) string {
+	if record.Status == 0 || record.Status == ' ' {
+		return ""
+	}
+	return string(rune(record.Status))
+}
+
+// rateLimiter spaces calls to Wait so no more than perSecond calls pass each
+// second. A zero or negative rate disables limiting.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (r *rateLimiter) Wait() {
+	if r.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if r.next.After(now) {
+		time.Sleep(r.next.Sub(now))
+		now = r.next
+	}
+	r.next = now.Add(r.interval)
+}
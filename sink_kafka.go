@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+	"github.com/segmentio/kafka-go"
+)
+
+// Number of messages handed to the writer per call, the writer splits them
+// further into batches using the configured size and linger limits.
+const kafkaWriteChunk = 10000
+
+type kafkaConfig struct {
+	brokers    string
+	topic      string
+	encoding   string
+	acks       string
+	batchSize  int
+	batchBytes int64
+	linger     time.Duration
+	schemaID   int
+}
+
+func registerKafkaFlags() *kafkaConfig {
+	cfg := &kafkaConfig{}
+	flag.StringVar(&cfg.brokers, "kafkaBrokers", "localhost:9092", "Comma separated Kafka bootstrap brokers used by the kafka sink")
+	flag.StringVar(&cfg.topic, "kafkaTopic", "datalog", "Kafka topic records are produced to")
+	flag.StringVar(&cfg.encoding, "kafkaEncoding", "json", "Kafka message encoding: json or avro")
+	flag.StringVar(&cfg.acks, "kafkaAcks", "all", "Broker acknowledgements to wait for: all, one or none")
+	flag.IntVar(&cfg.batchSize, "kafkaBatchSize", 1000, "Maximum messages per Kafka batch")
+	flag.Int64Var(&cfg.batchBytes, "kafkaBatchBytes", 1048576, "Maximum bytes per Kafka batch")
+	flag.DurationVar(&cfg.linger, "kafkaLinger", 50*time.Millisecond, "Time to wait for a Kafka batch to fill before sending it")
+	flag.IntVar(&cfg.schemaID, "kafkaSchemaID", 0, "Schema registry id to prefix avro messages with, 0 to send plain avro")
+	return cfg
+}
+
+// kafkaWriter is the part of kafka.Writer the sink uses.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaSink produces one message per record keyed by historian tag name, so
+// every value of a tag lands on the same partition in time order.
+type kafkaSink struct {
+	cfg    kafkaConfig
+	acks   kafka.RequiredAcks
+	writer kafkaWriter
+}
+
+func newKafkaSink(cfg kafkaConfig) (*kafkaSink, error) {
+	if cfg.encoding != "json" && cfg.encoding != "avro" {
+		return nil, fmt.Errorf("unknown Kafka encoding %q", cfg.encoding)
+	}
+
+	var acks kafka.RequiredAcks
+	switch cfg.acks {
+	case "all":
+		acks = kafka.RequireAll
+	case "one":
+		acks = kafka.RequireOne
+	case "none":
+		acks = kafka.RequireNone
+	default:
+		return nil, fmt.Errorf("unknown Kafka acks setting %q", cfg.acks)
+	}
+	return &kafkaSink{cfg: cfg, acks: acks}, nil
+}
+
+func (s *kafkaSink) Name() string { return "kafka" }
+
+func (s *kafkaSink) Target() string {
+	return fmt.Sprintf("Kafka topic: %s on %s, with %s encoding", s.cfg.topic, s.cfg.brokers, s.cfg.encoding)
+}
+
+func (s *kafkaSink) Connect() error {
+	brokers := strings.Split(s.cfg.brokers, ",")
+
+	// Dial the first broker and check the topic exists so a bad address or
+	// topic is reported up front rather than on the first insert.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := kafka.DialContext(ctx, "tcp", brokers[0])
+	if err != nil {
+		return fmt.Errorf("failed to connect to Kafka broker %s: %v", brokers[0], err)
+	}
+	defer conn.Close()
+	if _, err := conn.ReadPartitions(s.cfg.topic); err != nil {
+		return fmt.Errorf("failed to read partitions of Kafka topic %s: %v", s.cfg.topic, err)
+	}
+
+	if s.cfg.encoding == "avro" {
+		slog.Info("Producing avro encoded records", "schema", avroRecordSchema)
+	}
+
+	s.writer = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        s.cfg.topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    s.cfg.batchSize,
+		BatchBytes:   s.cfg.batchBytes,
+		BatchTimeout: s.cfg.linger,
+		RequiredAcks: s.acks,
+	}
+	return nil
+}
+
+func (s *kafkaSink) ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	return externalPoint(tag, historianTag)
+}
+
+// Insert blocks until the brokers acknowledged every message, so the insert
+// duration shown in the table includes the time spent waiting on acks.
+func (s *kafkaSink) Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	if s.writer == nil {
+		return fmt.Errorf("not connected to Kafka")
+	}
+
+	start := time.Now()
+	messages := make([]kafka.Message, 0, kafkaWriteChunk)
+	count := 0
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		point, exists := points.GetPointByDataLogID(record.TagID)
+		if !exists || !point.Process {
+			continue
+		}
+
+		value, err := s.encode(record, point)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{Key: []byte(point.PIName), Value: value, Time: record.TimeStamp})
+		count++
+		if len(messages) == kafkaWriteChunk {
+			if err := s.writer.WriteMessages(context.Background(), messages...); err != nil {
+				return fmt.Errorf("failed to produce to Kafka: %v", err)
+			}
+			messages = messages[:0]
+		}
+	}
+	if len(messages) > 0 {
+		if err := s.writer.WriteMessages(context.Background(), messages...); err != nil {
+			return fmt.Errorf("failed to produce to Kafka: %v", err)
+		}
+	}
+	if count < 1 {
+		return fmt.Errorf("no valid entries to produce")
+	}
+
+	slog.Info(fmt.Sprintf("Produced %d records to Kafka topic %s, acknowledged in %.2f seconds", count, s.cfg.topic, time.Since(start).Seconds()))
+	return nil
+}
+
+func (s *kafkaSink) encode(record *LibDAT.DatFloatRecord, point *LibPI.PointCache) ([]byte, error) {
+	rec := newJSONRecord(record, point)
+	if s.cfg.encoding == "avro" {
+		return encodeAvroRecord(rec, record.TimeStamp.UnixMicro(), s.cfg.schemaID), nil
+	}
+	return json.Marshal(rec)
+}
+
+func (s *kafkaSink) Close() error {
+	if s.writer != nil {
+		return s.writer.Close()
+	}
+	return nil
+}
+
+// Ping dials the first broker and reads the partitions of the topic.
+func (s *kafkaSink) Ping() error {
+	broker := strings.Split(s.cfg.brokers, ",")[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := kafka.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Kafka broker %s: %v", broker, err)
+	}
+	defer conn.Close()
+	if _, err := conn.ReadPartitions(s.cfg.topic); err != nil {
+		return fmt.Errorf("failed to read partitions of Kafka topic %s: %v", s.cfg.topic, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/segmentio/kafka-go"
+)
+
+// stubKafkaWriter keeps the messages written to it.
+type stubKafkaWriter struct {
+	messages []kafka.Message
+	err      error
+}
+
+func (w *stubKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *stubKafkaWriter) Close() error { return nil }
+
+func newStubKafkaSink(t *testing.T, encoding string, schemaID int) (*kafkaSink, *stubKafkaWriter) {
+	t.Helper()
+	sink, err := newKafkaSink(kafkaConfig{topic: "datalog", encoding: encoding, acks: "all", schemaID: schemaID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &stubKafkaWriter{}
+	sink.writer = writer
+	return sink, writer
+}
+
+func TestKafkaInsertJSON(t *testing.T) {
+	sink, writer := newStubKafkaSink(t, "json", 0)
+	points := testPoints(sink, "TEMP", "FLOW")
+	records := testRecords(0, 1, 0)
+	records[2].Val = math.NaN()
+	// Invalid records and records of unknown tags are not produced.
+	records = append(records, &LibDAT.DatFloatRecord{TagID: 0}, &LibDAT.DatFloatRecord{TagID: 9, IsValid: true}, nil)
+
+	if err := sink.Insert(records, points); err != nil {
+		t.Fatal(err)
+	}
+	if len(writer.messages) != 3 {
+		t.Fatalf("%d messages produced, 3 expected", len(writer.messages))
+	}
+	for i, key := range []string{"TEMP", "FLOW", "TEMP"} {
+		message := writer.messages[i]
+		if string(message.Key) != key || !message.Time.Equal(records[i].TimeStamp) {
+			t.Errorf("message %d is keyed %s at %s", i, message.Key, message.Time)
+		}
+	}
+	var second, third jsonRecord
+	if err := json.Unmarshal(writer.messages[1].Value, &second); err != nil {
+		t.Fatal(err)
+	}
+	if second.Tag != "FLOW" || second.Timestamp != "2024-01-01T00:00:01.5Z" || second.Value == nil || *second.Value != 1 {
+		t.Errorf("the second record was produced as %s", writer.messages[1].Value)
+	}
+	if err := json.Unmarshal(writer.messages[2].Value, &third); err != nil {
+		t.Fatal(err)
+	}
+	if third.Value != nil {
+		t.Errorf("a NaN value was produced as %s", writer.messages[2].Value)
+	}
+}
+
+func TestKafkaInsertAvro(t *testing.T) {
+	sink, writer := newStubKafkaSink(t, "avro", 42)
+	points := testPoints(sink, "TEMP", "FLOW")
+	records := testRecords(0, 1)
+
+	if err := sink.Insert(records, points); err != nil {
+		t.Fatal(err)
+	}
+	if len(writer.messages) != 2 {
+		t.Fatalf("%d messages produced, 2 expected", len(writer.messages))
+	}
+	for i, record := range records {
+		point, _ := points.GetPointByDataLogID(record.TagID)
+		want := encodeAvroRecord(newJSONRecord(record, point), record.TimeStamp.UnixMicro(), 42)
+		message := writer.messages[i]
+		if string(message.Key) != point.PIName || !bytes.Equal(message.Value, want) {
+			t.Errorf("message %d is keyed %s with % x", i, message.Key, message.Value)
+		}
+	}
+}
+
+func TestKafkaInsertErrors(t *testing.T) {
+	sink, writer := newStubKafkaSink(t, "json", 0)
+	points := testPoints(sink, "TEMP")
+
+	if err := sink.Insert([]*LibDAT.DatFloatRecord{{TagID: 9, IsValid: true}}, points); err == nil {
+		t.Error("a file without records to produce is not reported")
+	}
+	writer.err = kafka.LeaderNotAvailable
+	if err := sink.Insert(testRecords(0), points); err == nil {
+		t.Error("a failed write is not reported")
+	}
+
+	sink.writer = nil
+	if err := sink.Insert(testRecords(0), points); err == nil {
+		t.Error("an insert before connecting is not reported")
+	}
+}
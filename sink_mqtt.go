@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Number of publishes left in flight before waiting on their acknowledgements.
+const mqttMaxInFlight = 1000
+
+type mqttConfig struct {
+	broker          string
+	clientID        string
+	username        string
+	password        string
+	topic           string
+	payload         string
+	qos             int
+	rate            int
+	sparkplugGroup  string
+	sparkplugNode   string
+	sparkplugDevice string
+	sparkplugBatch  int
+}
+
+func registerMQTTFlags() *mqttConfig {
+	cfg := &mqttConfig{}
+	flag.StringVar(&cfg.broker, "mqttBroker", "tcp://localhost:1883", "MQTT broker URL used by the mqtt sink")
+	flag.StringVar(&cfg.clientID, "mqttClientID", "dat2fth", "MQTT client id")
+	flag.StringVar(&cfg.username, "mqttUser", "", "MQTT username")
+	flag.StringVar(&cfg.password, "mqttPassword", "", "MQTT password")
+	flag.StringVar(&cfg.topic, "mqttTopic", "datalog/{tag}", "Topic template for json payloads, {tag} is replaced by the historian tag name")
+	flag.StringVar(&cfg.payload, "mqttPayload", "json", "MQTT payload format: json or sparkplug")
+	flag.IntVar(&cfg.qos, "mqttQoS", 1, "MQTT QoS level (0, 1 or 2)")
+	flag.IntVar(&cfg.rate, "mqttRate", 0, "Maximum MQTT messages per second, 0 for no limit")
+	flag.StringVar(&cfg.sparkplugGroup, "sparkplugGroup", "datalog", "Sparkplug B group id")
+	flag.StringVar(&cfg.sparkplugNode, "sparkplugNode", "dat2fth", "Sparkplug B edge node id")
+	flag.StringVar(&cfg.sparkplugDevice, "sparkplugDevice", "backfill", "Sparkplug B device id")
+	flag.IntVar(&cfg.sparkplugBatch, "sparkplugBatch", 500, "Metrics per Sparkplug B DDATA message")
+	return cfg
+}
+
+// mqttSink publishes records to an MQTT broker, either as one JSON message
+// per record or as Sparkplug B DDATA messages flagged as historical.
+type mqttSink struct {
+	cfg     mqttConfig
+	client  mqtt.Client
+	limiter *rateLimiter
+	seq     uint64
+
+	// Sparkplug B session. nodeBorn is cleared when the client reconnects or
+	// a host application asks for a rebirth, the next insert then publishes
+	// NBIRTH and DBIRTH again before its DDATA.
+	nodeBorn   atomic.Bool
+	deviceBorn bool
+	metrics    []string
+	metricSet  map[string]bool
+	// willMu guards bdSeq, which the reconnect handler changes together
+	// with the NDEATH will.
+	willMu sync.Mutex
+	bdSeq  uint64
+}
+
+func newMQTTSink(cfg mqttConfig) (*mqttSink, error) {
+	if cfg.qos < 0 || cfg.qos > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d", cfg.qos)
+	}
+	switch cfg.payload {
+	case "json":
+		if !strings.Contains(cfg.topic, "{tag}") {
+			return nil, fmt.Errorf("MQTT topic template %q must contain {tag}", cfg.topic)
+		}
+	case "sparkplug":
+		if cfg.sparkplugBatch < 1 {
+			cfg.sparkplugBatch = 1
+		}
+	default:
+		return nil, fmt.Errorf("unknown MQTT payload format %q", cfg.payload)
+	}
+	return &mqttSink{cfg: cfg, limiter: newRateLimiter(cfg.rate), metricSet: make(map[string]bool)}, nil
+}
+
+func (s *mqttSink) Name() string { return "mqtt" }
+
+func (s *mqttSink) Target() string {
+	return fmt.Sprintf("MQTT broker: %s, with %s payloads", s.cfg.broker, s.cfg.payload)
+}
+
+func (s *mqttSink) Connect() error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.cfg.broker).
+		SetClientID(s.cfg.clientID).
+		SetUsername(s.cfg.username).
+		SetPassword(s.cfg.password).
+		SetConnectTimeout(10 * time.Second).
+		SetAutoReconnect(true)
+	if s.cfg.payload == "sparkplug" {
+		s.sparkplugSession(opts)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker %s: %v", s.cfg.broker, err)
+	}
+	s.client = client
+	return nil
+}
+
+func (s *mqttSink) ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	return externalPoint(tag, historianTag)
+}
+
+func (s *mqttSink) Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	if s.client == nil {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	if s.cfg.payload == "sparkplug" {
+		return s.insertSparkplug(records, points)
+	}
+	return s.insertJSON(records, points)
+}
+
+func (s *mqttSink) insertJSON(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	tokens := make([]mqtt.Token, 0, mqttMaxInFlight)
+	count := 0
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		point, exists := points.GetPointByDataLogID(record.TagID)
+		if !exists || !point.Process {
+			continue
+		}
+
+		payload, err := json.Marshal(newJSONRecord(record, point))
+		if err != nil {
+			return err
+		}
+
+		s.limiter.Wait()
+		tokens = append(tokens, s.client.Publish(s.topicFor(point.PIName), byte(s.cfg.qos), false, payload))
+		count++
+		if len(tokens) == mqttMaxInFlight {
+			if err := waitTokens(tokens); err != nil {
+				return err
+			}
+			tokens = tokens[:0]
+		}
+	}
+	if err := waitTokens(tokens); err != nil {
+		return err
+	}
+	if count < 1 {
+		return fmt.Errorf("no valid entries to publish")
+	}
+	slog.Info(fmt.Sprintf("Published %d records to %s", count, s.cfg.broker))
+	return nil
+}
+
+// sparkplugSession sets the NDEATH will of the edge node and the handlers
+// that keep its bdSeq and births in step with the connection.
+func (s *mqttSink) sparkplugSession(opts *mqtt.ClientOptions) {
+	s.willMu.Lock()
+	// A new connection of the same sink, after the connection dialog closed
+	// it, is a new session.
+	if s.client != nil {
+		s.bdSeq = (s.bdSeq + 1) % 256
+	}
+	opts.SetBinaryWill(s.sparkplugTopic("NDEATH"), encodeSparkplugNodeDeath(s.bdSeq), 1, false)
+	s.willMu.Unlock()
+	s.nodeBorn.Store(false)
+
+	opts.SetReconnectingHandler(func(_ mqtt.Client, opts *mqtt.ClientOptions) {
+		s.willMu.Lock()
+		s.bdSeq = (s.bdSeq + 1) % 256
+		opts.SetBinaryWill(s.sparkplugTopic("NDEATH"), encodeSparkplugNodeDeath(s.bdSeq), 1, false)
+		s.willMu.Unlock()
+		s.nodeBorn.Store(false)
+	})
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		token := client.Subscribe(s.sparkplugTopic("NCMD"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+			if sparkplugRebirthRequested(msg.Payload()) {
+				slog.Info("Sparkplug B rebirth requested")
+				s.nodeBorn.Store(false)
+			}
+		})
+		if token.Wait(); token.Error() != nil {
+			slog.Warn(fmt.Sprintf("Subscribing to Sparkplug B node commands failed: %v", token.Error()))
+		}
+	})
+}
+
+// sparkplugTopic is the topic of a node message, or of a device message
+// when messageType starts with D.
+func (s *mqttSink) sparkplugTopic(messageType string) string {
+	topic := fmt.Sprintf("spBv1.0/%s/%s/%s", s.cfg.sparkplugGroup, messageType, s.cfg.sparkplugNode)
+	if strings.HasPrefix(messageType, "D") {
+		topic += "/" + s.cfg.sparkplugDevice
+	}
+	return topic
+}
+
+// publishSparkplug publishes a message carrying the next sequence number.
+func (s *mqttSink) publishSparkplug(messageType string, payload func(seq uint64) []byte) mqtt.Token {
+	s.limiter.Wait()
+	token := s.client.Publish(s.sparkplugTopic(messageType), byte(s.cfg.qos), false, payload(s.seq))
+	// Sparkplug sequence numbers wrap at 256.
+	s.seq = (s.seq + 1) % 256
+	return token
+}
+
+// sparkplugBirth publishes NBIRTH when the node is not born on this
+// connection, and DBIRTH when the device is not born or names contains
+// metrics its last DBIRTH did not define. A device is declared dead before
+// it is born again with the new metrics.
+func (s *mqttSink) sparkplugBirth(names []string) error {
+	var tokens []mqtt.Token
+	if s.nodeBorn.CompareAndSwap(false, true) {
+		s.willMu.Lock()
+		bdSeq := s.bdSeq
+		s.willMu.Unlock()
+		s.seq = 0
+		tokens = append(tokens, s.publishSparkplug("NBIRTH", func(seq uint64) []byte {
+			return encodeSparkplugNodeBirth(seq, bdSeq)
+		}))
+		s.deviceBorn = false
+	}
+
+	added := false
+	for _, name := range names {
+		if !s.metricSet[name] {
+			s.metricSet[name] = true
+			s.metrics = append(s.metrics, name)
+			added = true
+		}
+	}
+	if added || !s.deviceBorn {
+		if s.deviceBorn {
+			tokens = append(tokens, s.publishSparkplug("DDEATH", encodeSparkplugDeviceDeath))
+		}
+		tokens = append(tokens, s.publishSparkplug("DBIRTH", func(seq uint64) []byte {
+			return encodeSparkplugDeviceBirth(seq, s.metrics)
+		}))
+		s.deviceBorn = true
+	}
+	return waitTokens(tokens)
+}
+
+func (s *mqttSink) insertSparkplug(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	// The births define every metric of the file before its first DDATA.
+	var names []string
+	seen := make(map[int]bool)
+	for _, record := range records {
+		if record == nil || !record.IsValid || seen[record.TagID] {
+			continue
+		}
+		seen[record.TagID] = true
+		if point, exists := points.GetPointByDataLogID(record.TagID); exists && point.Process {
+			names = append(names, point.PIName)
+		}
+	}
+	if err := s.sparkplugBirth(names); err != nil {
+		return err
+	}
+
+	topic := s.sparkplugTopic("DDATA")
+	tokens := make([]mqtt.Token, 0, mqttMaxInFlight)
+	metrics := make([]sparkplugMetric, 0, s.cfg.sparkplugBatch)
+	count := 0
+
+	publish := func() error {
+		if len(metrics) == 0 {
+			return nil
+		}
+		tokens = append(tokens, s.publishSparkplug("DDATA", func(seq uint64) []byte {
+			return encodeSparkplugPayload(seq, metrics)
+		}))
+		metrics = metrics[:0]
+		if len(tokens) == mqttMaxInFlight {
+			if err := waitTokens(tokens); err != nil {
+				return err
+			}
+			tokens = tokens[:0]
+		}
+		return nil
+	}
+
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		point, exists := points.GetPointByDataLogID(record.TagID)
+		if !exists || !point.Process {
+			continue
+		}
+		metrics = append(metrics, sparkplugMetric{
+			name:      point.PIName,
+			timestamp: record.TimeStamp,
+			value:     record.Val,
+			good:      recordStatus(record) == "",
+		})
+		count++
+		if len(metrics) == s.cfg.sparkplugBatch {
+			if err := publish(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := publish(); err != nil {
+		return err
+	}
+	if err := waitTokens(tokens); err != nil {
+		return err
+	}
+	if count < 1 {
+		return fmt.Errorf("no valid entries to publish")
+	}
+	slog.Info(fmt.Sprintf("Published %d Sparkplug B metrics to %s", count, topic))
+	return nil
+}
+
+func (s *mqttSink) topicFor(tag string) string {
+	// Wildcard characters are not allowed in a publish topic.
+	tag = strings.NewReplacer("+", "_", "#", "_").Replace(tag)
+	return strings.ReplaceAll(s.cfg.topic, "{tag}", tag)
+}
+
+func (s *mqttSink) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	// The broker only sends the will when the connection is lost, a node
+	// that disconnects declares its own death.
+	if s.cfg.payload == "sparkplug" && s.client.IsConnectionOpen() {
+		s.willMu.Lock()
+		payload := encodeSparkplugNodeDeath(s.bdSeq)
+		s.willMu.Unlock()
+		token := s.client.Publish(s.sparkplugTopic("NDEATH"), 1, false, payload)
+		if !token.WaitTimeout(5 * time.Second) {
+			slog.Warn("Publishing the Sparkplug B NDEATH timed out")
+		}
+	}
+	s.client.Disconnect(250)
+	return nil
+}
+
+// Ping reports whether the client is connected, the client reconnects to the
+// broker by itself.
+func (s *mqttSink) Ping() error {
+	if s.client == nil {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	if !s.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to MQTT broker %s", s.cfg.broker)
+	}
+	return nil
+}
+
+func waitTokens(tokens []mqtt.Token) error {
+	for _, token := range tokens {
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("MQTT publish failed: %v", err)
+		}
+	}
+	return nil
+}
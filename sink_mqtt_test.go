@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type brokerMessage struct {
+	topic   string
+	payload []byte
+}
+
+// testBroker is a minimal MQTT 3.1.1 broker. It records every publish and
+// the will of each connection, publishes the will when a connection is lost
+// and forwards its own publishes to the subscribed clients.
+type testBroker struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []brokerMessage
+	wills    []brokerMessage
+	conns    map[net.Conn]*sync.Mutex
+	subs     map[net.Conn][]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: listener, conns: make(map[net.Conn]*sync.Mutex), subs: make(map[net.Conn][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		b.drop()
+	})
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	writeMu := &sync.Mutex{}
+	write := func(packet packets.ControlPacket) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		packet.Write(conn)
+	}
+	var will *brokerMessage
+	defer func() {
+		conn.Close()
+		b.mu.Lock()
+		delete(b.conns, conn)
+		delete(b.subs, conn)
+		if will != nil {
+			b.messages = append(b.messages, *will)
+		}
+		b.mu.Unlock()
+	}()
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.conns[conn] = writeMu
+			if p.WillFlag {
+				will = &brokerMessage{topic: p.WillTopic, payload: p.WillMessage}
+				b.wills = append(b.wills, *will)
+			}
+			b.mu.Unlock()
+			write(packets.NewControlPacket(packets.Connack))
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.messages = append(b.messages, brokerMessage{topic: p.TopicName, payload: p.Payload})
+			b.mu.Unlock()
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				write(ack)
+			}
+		case *packets.SubscribePacket:
+			b.mu.Lock()
+			b.subs[conn] = append(b.subs[conn], p.Topics...)
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			write(ack)
+		case *packets.PingreqPacket:
+			write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			// A clean disconnect discards the will.
+			will = nil
+			return
+		}
+	}
+}
+
+// publish sends a message to the clients subscribed to topic.
+func (b *testBroker) publish(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn, topics := range b.subs {
+		for _, sub := range topics {
+			if sub == topic {
+				packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				packet.TopicName = topic
+				packet.Payload = payload
+				b.conns[conn].Lock()
+				packet.Write(conn)
+				b.conns[conn].Unlock()
+			}
+		}
+	}
+}
+
+// drop closes every connection without a DISCONNECT.
+func (b *testBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// waitMessages waits until n messages have been published and returns them,
+// clearing the broker's record.
+func (b *testBroker) waitMessages(t *testing.T, n int) []brokerMessage {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b.mu.Lock()
+		if len(b.messages) >= n {
+			messages := b.messages
+			b.messages = nil
+			b.mu.Unlock()
+			return messages
+		}
+		got := len(b.messages)
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages published, %d expected", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *testBroker) waitWills(t *testing.T, n int) []brokerMessage {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b.mu.Lock()
+		wills := append([]brokerMessage(nil), b.wills...)
+		b.mu.Unlock()
+		if len(wills) >= n {
+			return wills
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections with a will, %d expected", len(wills), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newSparkplugSink(t *testing.T, broker *testBroker) *mqttSink {
+	t.Helper()
+	cfg := mqttConfig{broker: broker.url(), clientID: "test", payload: "sparkplug", qos: 1, sparkplugGroup: "plant", sparkplugNode: "node", sparkplugDevice: "backfill", sparkplugBatch: 2}
+	sink, err := newMQTTSink(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return sink
+}
+
+// checkSparkplug checks the topic and sequence number of a message and
+// returns its metrics.
+func checkSparkplug(t *testing.T, message brokerMessage, topic string, seq int) []sparkplugValue {
+	t.Helper()
+	if message.topic != topic {
+		t.Fatalf("published to %s, %s expected", message.topic, topic)
+	}
+	gotSeq, values, err := decodeSparkplugPayload(message.payload)
+	if err != nil {
+		t.Fatalf("%s: %v", topic, err)
+	}
+	switch {
+	case seq < 0 && gotSeq != nil:
+		t.Errorf("%s has the sequence number %d", topic, *gotSeq)
+	case seq >= 0 && (gotSeq == nil || *gotSeq != uint64(seq)):
+		t.Errorf("%s has the sequence number %v, %d expected", topic, gotSeq, seq)
+	}
+	return values
+}
+
+func checkBdSeq(t *testing.T, values []sparkplugValue, bdSeq uint64) {
+	t.Helper()
+	for _, value := range values {
+		if value.name == spBdSeq {
+			if value.datatype != spDataTypeInt64 || value.intValue != bdSeq {
+				t.Errorf("bdSeq is %d of type %d, %d expected", value.intValue, value.datatype, bdSeq)
+			}
+			return
+		}
+	}
+	t.Errorf("no bdSeq metric in %v", values)
+}
+
+func checkDefinitions(t *testing.T, values []sparkplugValue, names ...string) {
+	t.Helper()
+	if len(values) != len(names) {
+		t.Fatalf("DBIRTH defines %d metrics, %d expected", len(values), len(names))
+	}
+	for i, value := range values {
+		if value.name != names[i] || value.datatype != spDataTypeDouble || !value.null || value.historical {
+			t.Errorf("DBIRTH metric %d is %+v", i, value)
+		}
+	}
+}
+
+func TestSparkplugSession(t *testing.T) {
+	broker := newTestBroker(t)
+	sink := newSparkplugSink(t, broker)
+
+	will := broker.waitWills(t, 1)[0]
+	checkBdSeq(t, checkSparkplug(t, will, "spBv1.0/plant/NDEATH/node", -1), 0)
+
+	points := testPoints(sink, "TEMP", "FLOW", "LEVEL")
+	if err := sink.Insert(testRecords(0, 1, 0), points); err != nil {
+		t.Fatal(err)
+	}
+	messages := broker.waitMessages(t, 4)
+	birth := checkSparkplug(t, messages[0], "spBv1.0/plant/NBIRTH/node", 0)
+	checkBdSeq(t, birth, 0)
+	if len(birth) != 2 || birth[1].name != spNodeRebirth || birth[1].datatype != spDataTypeBoolean || birth[1].intValue != 0 {
+		t.Errorf("NBIRTH metrics are %+v", birth)
+	}
+	checkDefinitions(t, checkSparkplug(t, messages[1], "spBv1.0/plant/DBIRTH/node/backfill", 1), "TEMP", "FLOW")
+	data := checkSparkplug(t, messages[2], "spBv1.0/plant/DDATA/node/backfill", 2)
+	if len(data) != 2 || data[0].name != "TEMP" || data[1].name != "FLOW" || !data[0].historical || data[1].doubleValue != 1 {
+		t.Errorf("DDATA metrics are %+v", data)
+	}
+	checkSparkplug(t, messages[3], "spBv1.0/plant/DDATA/node/backfill", 3)
+
+	// A file with a new tag is published after the device is born again
+	// with it.
+	if err := sink.Insert(testRecords(2, 0), points); err != nil {
+		t.Fatal(err)
+	}
+	messages = broker.waitMessages(t, 3)
+	checkSparkplug(t, messages[0], "spBv1.0/plant/DDEATH/node/backfill", 4)
+	checkDefinitions(t, checkSparkplug(t, messages[1], "spBv1.0/plant/DBIRTH/node/backfill", 5), "TEMP", "FLOW", "LEVEL")
+	checkSparkplug(t, messages[2], "spBv1.0/plant/DDATA/node/backfill", 6)
+
+	// Known tags are only published as data.
+	if err := sink.Insert(testRecords(1), points); err != nil {
+		t.Fatal(err)
+	}
+	checkSparkplug(t, broker.waitMessages(t, 1)[0], "spBv1.0/plant/DDATA/node/backfill", 7)
+
+	sink.Close()
+	death := broker.waitMessages(t, 1)
+	checkBdSeq(t, checkSparkplug(t, death[0], "spBv1.0/plant/NDEATH/node", -1), 0)
+}
+
+func TestSparkplugRebirth(t *testing.T) {
+	broker := newTestBroker(t)
+	sink := newSparkplugSink(t, broker)
+	points := testPoints(sink, "TEMP")
+	if err := sink.Insert(testRecords(0), points); err != nil {
+		t.Fatal(err)
+	}
+	broker.waitMessages(t, 3)
+
+	// A host application asks for a rebirth.
+	var metric []byte
+	metric = protowire.AppendTag(metric, spMetricName, protowire.BytesType)
+	metric = protowire.AppendString(metric, spNodeRebirth)
+	metric = protowire.AppendTag(metric, spMetricBooleanValue, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, protowire.EncodeBool(true))
+	deadline := time.Now().Add(10 * time.Second)
+	for sink.nodeBorn.Load() {
+		broker.publish("spBv1.0/plant/NCMD/node", sparkplugPayload([][]byte{metric}, nil))
+		if time.Now().After(deadline) {
+			t.Fatal("the rebirth command was not received")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := sink.Insert(testRecords(0), points); err != nil {
+		t.Fatal(err)
+	}
+	messages := broker.waitMessages(t, 3)
+	checkBdSeq(t, checkSparkplug(t, messages[0], "spBv1.0/plant/NBIRTH/node", 0), 0)
+	checkDefinitions(t, checkSparkplug(t, messages[1], "spBv1.0/plant/DBIRTH/node/backfill", 1), "TEMP")
+	checkSparkplug(t, messages[2], "spBv1.0/plant/DDATA/node/backfill", 2)
+}
+
+func TestSparkplugReconnect(t *testing.T) {
+	broker := newTestBroker(t)
+	sink := newSparkplugSink(t, broker)
+	points := testPoints(sink, "TEMP")
+	if err := sink.Insert(testRecords(0), points); err != nil {
+		t.Fatal(err)
+	}
+	broker.waitMessages(t, 3)
+
+	// The broker publishes the will of the lost connection, the client
+	// reconnects with the next bdSeq and is born again with it.
+	broker.drop()
+	death := broker.waitMessages(t, 1)
+	checkBdSeq(t, checkSparkplug(t, death[0], "spBv1.0/plant/NDEATH/node", -1), 0)
+	checkBdSeq(t, checkSparkplug(t, broker.waitWills(t, 2)[1], "spBv1.0/plant/NDEATH/node", -1), 1)
+
+	if err := sink.Insert(testRecords(0), points); err != nil {
+		t.Fatal(err)
+	}
+	messages := broker.waitMessages(t, 3)
+	checkBdSeq(t, checkSparkplug(t, messages[0], "spBv1.0/plant/NBIRTH/node", 0), 1)
+	checkSparkplug(t, messages[1], "spBv1.0/plant/DBIRTH/node/backfill", 1)
+	checkSparkplug(t, messages[2], "spBv1.0/plant/DDATA/node/backfill", 2)
+}
+
+func TestMQTTInsertJSON(t *testing.T) {
+	broker := newTestBroker(t)
+	sink, err := newMQTTSink(mqttConfig{broker: broker.url(), clientID: "test", topic: "datalog/{tag}", payload: "json", qos: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Ping(); err == nil {
+		t.Error("a check before connecting did not fail")
+	}
+	if err := sink.Insert(testRecords(0), nil); err == nil {
+		t.Error("an insert before connecting is not reported")
+	}
+	if err := sink.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	if err := sink.Ping(); err != nil {
+		t.Errorf("a connected sink failed its check: %v", err)
+	}
+
+	points := testPoints(sink, "TEMP", "FLOW#2")
+	records := testRecords(0, 1, 0)
+	records[2].Val = math.NaN()
+	// Invalid records and records of unknown tags are not published.
+	records = append(records, &LibDAT.DatFloatRecord{TagID: 0}, &LibDAT.DatFloatRecord{TagID: 9, IsValid: true}, nil)
+	if err := sink.Insert(records, points); err != nil {
+		t.Fatal(err)
+	}
+	messages := broker.waitMessages(t, 3)
+	if len(messages) != 3 {
+		t.Fatalf("%d messages published, 3 expected", len(messages))
+	}
+	// Wildcard characters in a tag name are replaced in the topic.
+	for i, topic := range []string{"datalog/TEMP", "datalog/FLOW_2", "datalog/TEMP"} {
+		if messages[i].topic != topic {
+			t.Errorf("message %d is published to %s, %s expected", i, messages[i].topic, topic)
+		}
+	}
+	var second, third jsonRecord
+	if err := json.Unmarshal(messages[1].payload, &second); err != nil {
+		t.Fatal(err)
+	}
+	if second.Tag != "FLOW#2" || second.Timestamp != "2024-01-01T00:00:01.5Z" || second.Value == nil || *second.Value != 1 {
+		t.Errorf("the second record was published as %s", messages[1].payload)
+	}
+	if err := json.Unmarshal(messages[2].payload, &third); err != nil {
+		t.Fatal(err)
+	}
+	if third.Value != nil {
+		t.Errorf("a NaN value was published as %s", messages[2].payload)
+	}
+
+	if err := sink.Insert([]*LibDAT.DatFloatRecord{{TagID: 9, IsValid: true}}, points); err == nil {
+		t.Error("a file without records to publish is not reported")
+	}
+}
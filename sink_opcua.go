@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+const opcuaTimeout = 30 * time.Second
+
+type opcuaConfig struct {
+	endpoint       string
+	username       string
+	password       string
+	securityPolicy string
+	securityMode   string
+	certFile       string
+	keyFile        string
+	nodeTemplate   string
+	updateMode     string
+	batchSize      int
+}
+
+func registerOPCUAFlags() *opcuaConfig {
+	cfg := &opcuaConfig{}
+	flag.StringVar(&cfg.endpoint, "opcuaEndpoint", "opc.tcp://localhost:4840", "OPC UA endpoint used by the opcua sink")
+	flag.StringVar(&cfg.username, "opcuaUser", "", "OPC UA username, anonymous when empty")
+	flag.StringVar(&cfg.password, "opcuaPassword", "", "OPC UA password")
+	flag.StringVar(&cfg.securityPolicy, "opcuaSecurityPolicy", "None", "OPC UA security policy, for example None or Basic256Sha256")
+	flag.StringVar(&cfg.securityMode, "opcuaSecurityMode", "None", "OPC UA message security mode: None, Sign or SignAndEncrypt")
+	flag.StringVar(&cfg.certFile, "opcuaCert", "", "Client certificate file for signed or encrypted OPC UA connections")
+	flag.StringVar(&cfg.keyFile, "opcuaKey", "", "Client private key file for signed or encrypted OPC UA connections")
+	flag.StringVar(&cfg.nodeTemplate, "opcuaNodeTemplate", "ns=2;s={tag}", "NodeId template, {tag} is replaced by the historian tag name unless it already is a NodeId")
+	flag.StringVar(&cfg.updateMode, "opcuaUpdateMode", "insert", "HistoryUpdate mode: insert, replace or update")
+	flag.IntVar(&cfg.batchSize, "opcuaBatch", 1000, "Values per HistoryUpdate request")
+	return cfg
+}
+
+// opcuaSink writes values into an OPC UA historian with HistoryUpdate
+// requests carrying UpdateDataDetails.
+type opcuaSink struct {
+	cfg        opcuaConfig
+	updateType ua.PerformUpdateType
+	client     *opcua.Client
+
+	mu      sync.RWMutex
+	nodeIDs map[string]*ua.NodeID
+}
+
+func newOPCUASink(cfg opcuaConfig) (*opcuaSink, error) {
+	var updateType ua.PerformUpdateType
+	switch cfg.updateMode {
+	case "insert":
+		updateType = ua.PerformUpdateTypeInsert
+	case "replace":
+		updateType = ua.PerformUpdateTypeReplace
+	case "update":
+		updateType = ua.PerformUpdateTypeUpdate
+	default:
+		return nil, fmt.Errorf("unknown OPC UA update mode %q", cfg.updateMode)
+	}
+	if ua.MessageSecurityModeFromString(cfg.securityMode) == ua.MessageSecurityModeInvalid {
+		return nil, fmt.Errorf("unknown OPC UA security mode %q", cfg.securityMode)
+	}
+	if cfg.batchSize < 1 {
+		cfg.batchSize = 1
+	}
+	return &opcuaSink{cfg: cfg, updateType: updateType, nodeIDs: make(map[string]*ua.NodeID)}, nil
+}
+
+func (s *opcuaSink) Name() string { return "opcua" }
+
+func (s *opcuaSink) Target() string {
+	auth := "anonymous"
+	if s.cfg.username != "" {
+		auth = "user " + s.cfg.username
+	}
+	return fmt.Sprintf("OPC UA endpoint: %s, as %s", s.cfg.endpoint, auth)
+}
+
+func (s *opcuaSink) Connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), opcuaTimeout)
+	defer cancel()
+
+	endpoints, err := opcua.GetEndpoints(ctx, s.cfg.endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to get OPC UA endpoints from %s: %v", s.cfg.endpoint, err)
+	}
+	ep := opcua.SelectEndpoint(endpoints, s.cfg.securityPolicy, ua.MessageSecurityModeFromString(s.cfg.securityMode))
+	if ep == nil {
+		return fmt.Errorf("no OPC UA endpoint with security policy %s and mode %s", s.cfg.securityPolicy, s.cfg.securityMode)
+	}
+
+	// The authentication option has to come before SecurityFromEndpoint so
+	// the matching user token policy is picked from the endpoint.
+	opts := []opcua.Option{opcua.AuthAnonymous()}
+	authType := ua.UserTokenTypeAnonymous
+	if s.cfg.username != "" {
+		opts = []opcua.Option{opcua.AuthUsername(s.cfg.username, s.cfg.password)}
+		authType = ua.UserTokenTypeUserName
+	}
+	if s.cfg.certFile != "" {
+		opts = append(opts, opcua.CertificateFile(s.cfg.certFile), opcua.PrivateKeyFile(s.cfg.keyFile))
+	}
+	opts = append(opts, opcua.SecurityFromEndpoint(ep, authType))
+
+	client, err := opcua.NewClient(ep.EndpointURL, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create OPC UA client: %v", err)
+	}
+	if err := client.Connect(ctx); err != nil {
+		return fmt.Errorf("failed to connect to OPC UA endpoint %s: %v", s.cfg.endpoint, err)
+	}
+	s.client = client
+	return nil
+}
+
+func (s *opcuaSink) ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	point := externalPoint(tag, historianTag)
+	if _, err := s.lookupNodeID(historianTag); err != nil {
+		slog.Debug(fmt.Sprintf("OPC UA node lookup failed: %v", err))
+		point.Process = false
+	}
+	return point
+}
+
+// lookupNodeID maps a historian tag onto a NodeId and checks the node exists
+// on the server, caching the result for the life of the sink.
+func (s *opcuaSink) lookupNodeID(tag string) (*ua.NodeID, error) {
+	s.mu.RLock()
+	nodeID, exists := s.nodeIDs[tag]
+	s.mu.RUnlock()
+	if exists {
+		return nodeID, nil
+	}
+	if s.client == nil {
+		return nil, fmt.Errorf("not connected to OPC UA endpoint")
+	}
+
+	nodeID, err := ua.ParseNodeID(opcuaNodeIDString(s.cfg.nodeTemplate, tag))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NodeId for tag %s: %v", tag, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opcuaTimeout)
+	defer cancel()
+	if _, err := s.client.Node(nodeID).NodeClass(ctx); err != nil {
+		return nil, fmt.Errorf("error finding node %s: %v", nodeID, err)
+	}
+
+	s.mu.Lock()
+	s.nodeIDs[tag] = nodeID
+	s.mu.Unlock()
+	return nodeID, nil
+}
+
+// opcuaNodeIDString returns tag unchanged when the tag map already holds a
+// full NodeId, otherwise the tag is placed into the template.
+func opcuaNodeIDString(template, tag string) string {
+	for _, prefix := range []string{"ns=", "nsu=", "i=", "s=", "g=", "b="} {
+		if strings.HasPrefix(tag, prefix) {
+			return tag
+		}
+	}
+	return strings.ReplaceAll(template, "{tag}", tag)
+}
+
+func (s *opcuaSink) Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	if s.client == nil {
+		return fmt.Errorf("not connected to OPC UA endpoint")
+	}
+
+	values := make(map[string][]*ua.DataValue)
+	nodes := make(map[string]*ua.NodeID)
+	batched := 0
+	count := 0
+	// Values the server kept its own entry for, and records of nodes that
+	// cannot be found, are not written.
+	existing := 0
+	failed := 0
+	var lookupErr error
+
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		rejected, err := s.historyUpdate(s.updateDetails(nodes, values))
+		if err != nil {
+			return err
+		}
+		existing += rejected
+		values = make(map[string][]*ua.DataValue)
+		batched = 0
+		return nil
+	}
+
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		point, exists := points.GetPointByDataLogID(record.TagID)
+		if !exists || !point.Process {
+			continue
+		}
+		nodeID, err := s.lookupNodeID(point.PIName)
+		if err != nil {
+			failed++
+			lookupErr = err
+			continue
+		}
+
+		key := nodeID.String()
+		nodes[key] = nodeID
+		values[key] = append(values[key], opcuaDataValue(record))
+		batched++
+		count++
+		if batched == s.cfg.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if count > existing {
+		slog.Info(fmt.Sprintf("Wrote %d records with OPC UA HistoryUpdate", count-existing))
+	}
+	if existing > 0 {
+		return fmt.Errorf("%d of %d values already exist in the history and were not written, -opcuaUpdateMode update replaces them", existing, count)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records were not written, %v", failed, lookupErr)
+	}
+	if count < 1 {
+		return fmt.Errorf("no valid entries to push to historian")
+	}
+	return nil
+}
+
+// opcuaDataValue is the history value of a record, records with a datalog
+// status are written as bad.
+func opcuaDataValue(record *LibDAT.DatFloatRecord) *ua.DataValue {
+	status := ua.StatusGood
+	if recordStatus(record) != "" {
+		status = ua.StatusBad
+	}
+	return &ua.DataValue{
+		EncodingMask:    ua.DataValueValue | ua.DataValueStatusCode | ua.DataValueSourceTimestamp,
+		Value:           ua.MustVariant(record.Val),
+		Status:          status,
+		SourceTimestamp: record.TimeStamp,
+	}
+}
+
+// updateDetails builds the UpdateDataDetails of the values of each node.
+func (s *opcuaSink) updateDetails(nodes map[string]*ua.NodeID, values map[string][]*ua.DataValue) []*ua.ExtensionObject {
+	details := make([]*ua.ExtensionObject, 0, len(values))
+	for key, dataValues := range values {
+		details = append(details, &ua.ExtensionObject{
+			TypeID:       ua.NewFourByteExpandedNodeID(0, id.UpdateDataDetails_Encoding_DefaultBinary),
+			EncodingMask: ua.ExtensionObjectBinary,
+			Value: &ua.UpdateDataDetails{
+				NodeID:               nodes[key],
+				PerformInsertReplace: s.updateType,
+				UpdateValues:         dataValues,
+			},
+		})
+	}
+	return details
+}
+
+// historyUpdate sends the details and returns the number of values that were
+// not written because the history already holds an entry at their time.
+func (s *opcuaSink) historyUpdate(details []*ua.ExtensionObject) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opcuaTimeout)
+	defer cancel()
+
+	var res *ua.HistoryUpdateResponse
+	err := s.client.Send(ctx, &ua.HistoryUpdateRequest{HistoryUpdateDetails: details}, func(v interface{}) error {
+		r, ok := v.(*ua.HistoryUpdateResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", v)
+		}
+		res = r
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("HistoryUpdate failed: %v", err)
+	}
+	return historyUpdateResults(details, res)
+}
+
+// historyUpdateResults checks the result of each value of a HistoryUpdate.
+// Values that already exist are reported per value rather than as a failure
+// of the request, they are counted.
+func historyUpdateResults(details []*ua.ExtensionObject, res *ua.HistoryUpdateResponse) (int, error) {
+	if len(res.Results) != len(details) {
+		return 0, fmt.Errorf("HistoryUpdate returned %d results for %d nodes", len(res.Results), len(details))
+	}
+	existing := 0
+	for i, result := range res.Results {
+		nodeID := details[i].Value.(*ua.UpdateDataDetails).NodeID
+		if result.StatusCode != ua.StatusOK {
+			return 0, fmt.Errorf("HistoryUpdate of %s returned %v", nodeID, result.StatusCode)
+		}
+		for _, op := range result.OperationResults {
+			switch op {
+			case ua.StatusOK, ua.StatusGoodEntryInserted, ua.StatusGoodEntryReplaced:
+			case ua.StatusBadEntryExists:
+				existing++
+			default:
+				return 0, fmt.Errorf("HistoryUpdate of %s returned %v", nodeID, op)
+			}
+		}
+	}
+	return existing, nil
+}
+
+// ReadBack reads the raw history of the point's node, following
+// continuation points in pages of -opcuaBatch values.
+func (s *opcuaSink) ReadBack(point *LibPI.PointCache, start, end time.Time) ([]storedValue, error) {
+	if s.client == nil {
+		return nil, fmt.Errorf("not connected to OPC UA endpoint")
+	}
+	nodeID, err := s.lookupNodeID(point.PIName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The end time of a raw read is not included.
+	details := &ua.ReadRawModifiedDetails{
+		StartTime:        start,
+		EndTime:          end.Add(time.Millisecond),
+		NumValuesPerNode: uint32(s.cfg.batchSize),
+	}
+	node := &ua.HistoryReadValueID{NodeID: nodeID, DataEncoding: &ua.QualifiedName{}}
+	var values []storedValue
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), opcuaTimeout)
+		res, err := s.client.HistoryReadRawModified(ctx, []*ua.HistoryReadValueID{node}, details)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("HistoryRead failed: %v", err)
+		}
+		if len(res.Results) != 1 {
+			return nil, fmt.Errorf("HistoryRead of %s returned %d results", nodeID, len(res.Results))
+		}
+		result := res.Results[0]
+		if result.StatusCode != ua.StatusOK && result.StatusCode != ua.StatusGoodNoData && result.StatusCode != ua.StatusGoodMoreData {
+			return nil, fmt.Errorf("HistoryRead of %s returned %v", nodeID, result.StatusCode)
+		}
+		if result.HistoryData != nil {
+			if data, ok := result.HistoryData.Value.(*ua.HistoryData); ok {
+				for _, dv := range data.DataValues {
+					value, ok := opcuaFloat(dv.Value)
+					values = append(values, storedValue{
+						Time:  dv.SourceTimestamp,
+						Value: value,
+						Good:  ok && dv.Status == ua.StatusOK,
+					})
+				}
+			}
+		}
+		if len(result.ContinuationPoint) == 0 {
+			return values, nil
+		}
+		node.ContinuationPoint = result.ContinuationPoint
+	}
+}
+
+// opcuaFloat converts a numeric variant, other values are NaN.
+func opcuaFloat(v *ua.Variant) (float64, bool) {
+	if v == nil {
+		return math.NaN(), false
+	}
+	switch value := v.Value().(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int8:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint8:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return math.NaN(), false
+}
+
+func (s *opcuaSink) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	client := s.client
+	s.client = nil
+	return client.Close(context.Background())
+}
+
+// Ping reads the server's current time.
+func (s *opcuaSink) Ping() error {
+	if s.client == nil {
+		return fmt.Errorf("not connected to OPC UA endpoint")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opcuaTimeout)
+	defer cancel()
+	_, err := s.client.Node(ua.NewNumericNodeID(0, id.Server_ServerStatus_CurrentTime)).Value(ctx)
+	return err
+}
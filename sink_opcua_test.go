@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestOPCUANodeIDString(t *testing.T) {
+	tests := []struct{ tag, want string }{
+		{`Line1\Temp01`, `ns=2;s=Line1\Temp01`},
+		{"ns=3;s=Line1.Temp", "ns=3;s=Line1.Temp"},
+		{"i=2258", "i=2258"},
+	}
+	for _, test := range tests {
+		if got := opcuaNodeIDString("ns=2;s={tag}", test.tag); got != test.want {
+			t.Errorf("%s maps onto %s, %s expected", test.tag, got, test.want)
+		}
+	}
+}
+
+func TestOPCUAHistoryUpdateEncoding(t *testing.T) {
+	sink, err := newOPCUASink(opcuaConfig{securityMode: "None", updateMode: "update", batchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := testRecords(0, 0)
+	records[1].Status = 'U'
+	nodeID := ua.NewStringNodeID(2, `Line1\Temp01`)
+	values := map[string][]*ua.DataValue{nodeID.String(): {opcuaDataValue(records[0]), opcuaDataValue(records[1])}}
+	req := &ua.HistoryUpdateRequest{
+		// The header is the one the secure channel sets before sending.
+		RequestHeader:        &ua.RequestHeader{AuthenticationToken: ua.NewTwoByteNodeID(0), AdditionalHeader: ua.NewExtensionObject(nil)},
+		HistoryUpdateDetails: sink.updateDetails(map[string]*ua.NodeID{nodeID.String(): nodeID}, values),
+	}
+
+	b, err := ua.Encode(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(ua.HistoryUpdateRequest)
+	if _, err := ua.Decode(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.HistoryUpdateDetails) != 1 {
+		t.Fatalf("%d details decoded, 1 expected", len(decoded.HistoryUpdateDetails))
+	}
+	detail := decoded.HistoryUpdateDetails[0]
+	if detail.TypeID.NodeID.IntID() != id.UpdateDataDetails_Encoding_DefaultBinary {
+		t.Errorf("the details are encoded as %v", detail.TypeID)
+	}
+	details, ok := detail.Value.(*ua.UpdateDataDetails)
+	if !ok {
+		t.Fatalf("the details decode as %T", detail.Value)
+	}
+	if details.NodeID.String() != nodeID.String() || details.PerformInsertReplace != ua.PerformUpdateTypeUpdate {
+		t.Errorf("the details are for %s with mode %v", details.NodeID, details.PerformInsertReplace)
+	}
+	if len(details.UpdateValues) != 2 {
+		t.Fatalf("%d values decoded, 2 expected", len(details.UpdateValues))
+	}
+	for i, value := range details.UpdateValues {
+		if !value.SourceTimestamp.Equal(records[i].TimeStamp) {
+			t.Errorf("value %d is at %s, %s expected", i, value.SourceTimestamp, records[i].TimeStamp)
+		}
+		if got, ok := value.Value.Value().(float64); !ok || got != records[i].Val {
+			t.Errorf("value %d decodes as %v", i, value.Value.Value())
+		}
+	}
+	if details.UpdateValues[0].Status != ua.StatusGood || details.UpdateValues[1].Status != ua.StatusBad {
+		t.Errorf("the values have status %v and %v", details.UpdateValues[0].Status, details.UpdateValues[1].Status)
+	}
+}
+
+func TestOPCUAHistoryUpdateResults(t *testing.T) {
+	details := []*ua.ExtensionObject{
+		{Value: &ua.UpdateDataDetails{NodeID: ua.NewStringNodeID(2, "A")}},
+		{Value: &ua.UpdateDataDetails{NodeID: ua.NewStringNodeID(2, "B")}},
+	}
+	result := func(status ua.StatusCode, ops ...ua.StatusCode) *ua.HistoryUpdateResult {
+		return &ua.HistoryUpdateResult{StatusCode: status, OperationResults: ops}
+	}
+	tests := []struct {
+		name     string
+		results  []*ua.HistoryUpdateResult
+		existing int
+		err      string
+	}{
+		{"written", []*ua.HistoryUpdateResult{result(ua.StatusOK, ua.StatusOK, ua.StatusGoodEntryInserted), result(ua.StatusOK, ua.StatusGoodEntryReplaced)}, 0, ""},
+		{"existing", []*ua.HistoryUpdateResult{result(ua.StatusOK, ua.StatusBadEntryExists, ua.StatusOK), result(ua.StatusOK, ua.StatusBadEntryExists)}, 2, ""},
+		{"value rejected", []*ua.HistoryUpdateResult{result(ua.StatusOK, ua.StatusOK), result(ua.StatusOK, ua.StatusBadTypeMismatch)}, 0, "ns=2;s=B"},
+		{"node rejected", []*ua.HistoryUpdateResult{result(ua.StatusBadNodeIDUnknown), result(ua.StatusOK)}, 0, "ns=2;s=A"},
+		{"missing results", []*ua.HistoryUpdateResult{result(ua.StatusOK)}, 0, "1 results for 2 nodes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			existing, err := historyUpdateResults(details, &ua.HistoryUpdateResponse{Results: test.results})
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("returned %v, an error about %s expected", err, test.err)
+			}
+			if existing != test.existing {
+				t.Errorf("%d values counted as existing, %d expected", existing, test.existing)
+			}
+		})
+	}
+}
+
+func TestOPCUAInsertNotConnected(t *testing.T) {
+	sink, err := newOPCUASink(opcuaConfig{securityMode: "None", updateMode: "insert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Insert([]*LibDAT.DatFloatRecord{}, nil); err == nil {
+		t.Error("inserting without a session did not fail")
+	}
+	if err := sink.Ping(); err == nil {
+		t.Error("a check without a session did not fail")
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("closing without a session failed: %v", err)
+	}
+}
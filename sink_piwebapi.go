@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+type piWebAPIConfig struct {
+	url          string
+	dataServer   string
+	username     string
+	password     string
+	insecure     bool
+	batchSize    int
+	updateOption string
+}
+
+func registerPIWebAPIFlags() *piWebAPIConfig {
+	cfg := &piWebAPIConfig{}
+	flag.StringVar(&cfg.url, "piwebapiURL", "https://localhost/piwebapi", "Base URL of the PI Web API used by the piwebapi sink")
+	flag.StringVar(&cfg.dataServer, "piwebapiDataServer", "", "Data archive name used in point paths, defaults to -host")
+	flag.StringVar(&cfg.username, "piwebapiUser", "", "PI Web API basic auth username, anonymous when empty")
+	flag.StringVar(&cfg.password, "piwebapiPassword", "", "PI Web API basic auth password")
+	flag.BoolVar(&cfg.insecure, "piwebapiInsecure", false, "Skip TLS certificate verification for the PI Web API")
+	flag.IntVar(&cfg.batchSize, "piwebapiBatch", 10000, "Values per streamsets/recorded request")
+	flag.StringVar(&cfg.updateOption, "piwebapiUpdateOption", "Replace", "PI Web API updateOption: Replace, Insert, NoReplace, ReplaceOnly or InsertNoCompression")
+	return cfg
+}
+
+// piWebAPISink writes recorded values through the PI Web API REST interface,
+// avoiding piapi.dll and the trust setup it needs on the server.
+type piWebAPISink struct {
+	cfg    piWebAPIConfig
+	client *http.Client
+
+	mu     sync.RWMutex
+	webIDs map[string]string
+}
+
+type piWebAPIValue struct {
+	Timestamp string  `json:"Timestamp"`
+	Value     float64 `json:"Value"`
+	Good      bool    `json:"Good"`
+}
+
+type piWebAPIStream struct {
+	WebId string          `json:"WebId"`
+	Items []piWebAPIValue `json:"Items"`
+}
+
+func newPIWebAPISink(cfg piWebAPIConfig, hostname string) (*piWebAPISink, error) {
+	if _, err := url.Parse(cfg.url); err != nil {
+		return nil, fmt.Errorf("invalid PI Web API URL %q: %v", cfg.url, err)
+	}
+	if cfg.dataServer == "" {
+		cfg.dataServer = hostname
+	}
+	if cfg.batchSize < 1 {
+		cfg.batchSize = 1
+	}
+	cfg.url = strings.TrimSuffix(cfg.url, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &piWebAPISink{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: 60 * time.Second},
+		webIDs: make(map[string]string),
+	}, nil
+}
+
+func (s *piWebAPISink) Name() string { return "piwebapi" }
+
+func (s *piWebAPISink) Target() string {
+	return fmt.Sprintf("PI Web API: %s, with data server: %s", s.cfg.url, s.cfg.dataServer)
+}
+
+func (s *piWebAPISink) Connect() error {
+	resp, err := s.do(http.MethodGet, "/", nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PI Web API %s: %v", s.cfg.url, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *piWebAPISink) ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	point := externalPoint(tag, historianTag)
+	if _, err := s.lookupWebID(historianTag); err != nil {
+		slog.Debug(fmt.Sprintf("PI Web API point lookup failed: %v", err))
+		point.Process = false
+	}
+	return point
+}
+
+// lookupWebID resolves a point path to its WebID, caching the result for
+// the life of the sink the same way historian point ids are cached.
+func (s *piWebAPISink) lookupWebID(tag string) (string, error) {
+	s.mu.RLock()
+	webID, exists := s.webIDs[tag]
+	s.mu.RUnlock()
+	if exists {
+		return webID, nil
+	}
+
+	path := fmt.Sprintf(`\\%s\%s`, s.cfg.dataServer, tag)
+	resp, err := s.do(http.MethodGet, "/points?selectedFields=WebId&path="+url.QueryEscape(path), nil)
+	if err != nil {
+		return "", fmt.Errorf("error finding point %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var point struct {
+		WebId string `json:"WebId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&point); err != nil {
+		return "", fmt.Errorf("error decoding point %s: %v", path, err)
+	}
+	if point.WebId == "" {
+		return "", fmt.Errorf("point %s has no WebId", path)
+	}
+
+	s.mu.Lock()
+	s.webIDs[tag] = point.WebId
+	s.mu.Unlock()
+	return point.WebId, nil
+}
+
+func (s *piWebAPISink) Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	streams := make(map[string]*piWebAPIStream)
+	batched := 0
+	count := 0
+	// Records of points whose WebID cannot be found are not written.
+	failed := 0
+	var lookupErr error
+
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		body := make([]*piWebAPIStream, 0, len(streams))
+		for _, stream := range streams {
+			body = append(body, stream)
+		}
+		if err := s.writeRecorded(body); err != nil {
+			return err
+		}
+		streams = make(map[string]*piWebAPIStream)
+		batched = 0
+		return nil
+	}
+
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		point, exists := points.GetPointByDataLogID(record.TagID)
+		if !exists || !point.Process {
+			continue
+		}
+		webID, err := s.lookupWebID(point.PIName)
+		if err != nil {
+			failed++
+			lookupErr = err
+			continue
+		}
+
+		stream, exists := streams[webID]
+		if !exists {
+			stream = &piWebAPIStream{WebId: webID}
+			streams[webID] = stream
+		}
+		stream.Items = append(stream.Items, piWebAPIValue{
+			Timestamp: record.TimeStamp.Format(time.RFC3339Nano),
+			Value:     record.Val,
+			Good:      recordStatus(record) == "",
+		})
+		batched++
+		count++
+		if batched == s.cfg.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if count > 0 {
+		slog.Info(fmt.Sprintf("Wrote %d records through PI Web API", count))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records were not written, %v", failed, lookupErr)
+	}
+	if count < 1 {
+		return fmt.Errorf("no valid entries to push to historian")
+	}
+	return nil
+}
+
+func (s *piWebAPISink) writeRecorded(streams []*piWebAPIStream) error {
+	body, err := json.Marshal(streams)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, "/streamsets/recorded?updateOption="+url.QueryEscape(s.cfg.updateOption), body)
+	if err != nil {
+		return fmt.Errorf("streamsets/recorded failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// A partial failure is reported as 207 with the errors in the body.
+	if resp.StatusCode == http.StatusMultiStatus {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("streamsets/recorded partially failed: %s", detail)
+	}
+	return nil
+}
+
+// ReadBack reads the recorded values of a point, in pages of -piwebapiBatch
+// values. Digital states and other values that are not numbers are returned
+// as bad NaN values.
+func (s *piWebAPISink) ReadBack(point *LibPI.PointCache, start, end time.Time) ([]storedValue, error) {
+	webID, err := s.lookupWebID(point.PIName)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []storedValue
+	for {
+		query := url.Values{}
+		query.Set("startTime", start.UTC().Format(time.RFC3339Nano))
+		query.Set("endTime", end.UTC().Format(time.RFC3339Nano))
+		query.Set("boundaryType", "Inside")
+		query.Set("maxCount", fmt.Sprintf("%d", s.cfg.batchSize))
+		query.Set("selectedFields", "Items.Timestamp;Items.Value;Items.Good")
+		resp, err := s.do(http.MethodGet, "/streams/"+url.PathEscape(webID)+"/recorded?"+query.Encode(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("streams/recorded failed: %v", err)
+		}
+		var page struct {
+			Items []struct {
+				Timestamp time.Time       `json:"Timestamp"`
+				Value     json.RawMessage `json:"Value"`
+				Good      bool            `json:"Good"`
+			} `json:"Items"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding recorded values of %s: %v", point.PIName, err)
+		}
+
+		// The next page starts at the last value read, values read before are
+		// skipped.
+		added := 0
+		for _, item := range page.Items {
+			if len(values) > 0 && !item.Timestamp.After(values[len(values)-1].Time) {
+				continue
+			}
+			value := storedValue{Time: item.Timestamp, Value: math.NaN()}
+			if err := json.Unmarshal(item.Value, &value.Value); err == nil {
+				value.Good = item.Good
+			} else {
+				value.Value = math.NaN()
+			}
+			values = append(values, value)
+			added++
+		}
+		if len(page.Items) < s.cfg.batchSize || added == 0 {
+			return values, nil
+		}
+		start = values[len(values)-1].Time
+	}
+}
+
+// do sends a request to the PI Web API and returns an error for any non 2xx
+// response.
+func (s *piWebAPISink) do(method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.cfg.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Required by the PI Web API CSRF defence for requests other than GET.
+	req.Header.Set("X-Requested-With", "goDataLogConvertTUI")
+	if s.cfg.username != "" {
+		req.SetBasicAuth(s.cfg.username, s.cfg.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return resp, nil
+}
+
+func (s *piWebAPISink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Ping requests the PI Web API system information.
+func (s *piWebAPISink) Ping() error {
+	resp, err := s.do("GET", "/system", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+// piWebAPIStandIn is a local HTTP stand-in for the PI Web API. Points are
+// found by path, the WebID of a point is its tag name.
+type piWebAPIStandIn struct {
+	mu      sync.Mutex
+	points  map[string]string
+	lookups map[string]int
+	posts   [][]piWebAPIStream
+	queries []string
+	// status is returned by streamsets/recorded when set.
+	status int
+}
+
+func newPIWebAPIStandIn(t *testing.T, tags ...string) (*piWebAPIStandIn, *piWebAPISink) {
+	t.Helper()
+	standIn := &piWebAPIStandIn{points: make(map[string]string), lookups: make(map[string]int)}
+	for _, tag := range tags {
+		standIn.points[`\\historian\`+tag] = tag
+	}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	cfg := piWebAPIConfig{url: server.URL + "/piwebapi/", username: "user", password: "secret", batchSize: 3, updateOption: "Replace"}
+	sink, err := newPIWebAPISink(cfg, "historian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return standIn, sink
+}
+
+func (s *piWebAPIStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/piwebapi/points":
+		path := r.URL.Query().Get("path")
+		s.lookups[path]++
+		webID, ok := s.points[path]
+		if !ok {
+			http.Error(w, `{"Errors":["point not found"]}`, http.StatusNotFound)
+			return
+		}
+		if webID == "" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"WebId": webID})
+	case r.URL.Path == "/piwebapi/streamsets/recorded" && r.Method == http.MethodPost:
+		if r.Header.Get("X-Requested-With") == "" {
+			http.Error(w, "missing X-Requested-With", http.StatusBadRequest)
+			return
+		}
+		s.queries = append(s.queries, r.URL.RawQuery)
+		var streams []piWebAPIStream
+		if err := json.NewDecoder(r.Body).Decode(&streams); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.posts = append(s.posts, streams)
+		if s.status != 0 {
+			w.WriteHeader(s.status)
+			w.Write([]byte(`{"Errors":["rejected"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testPoints(sink Sink, tags ...string) *LibPI.PointLookup {
+	points := LibPI.NewPointLookup()
+	for i, tag := range tags {
+		points.AddPoint(sink.ResolvePoint(&LibDAT.DatTagRecord{Name: tag, ID: i}, tag))
+	}
+	return points
+}
+
+func testRecords(tagIDs ...int) []*LibDAT.DatFloatRecord {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := make([]*LibDAT.DatFloatRecord, len(tagIDs))
+	for i, id := range tagIDs {
+		records[i] = &LibDAT.DatFloatRecord{TimeStamp: start.Add(time.Duration(i) * 1500 * time.Millisecond), TagID: id, Val: float64(i), Status: ' ', IsValid: true}
+	}
+	return records
+}
+
+func TestPIWebAPILookupWebID(t *testing.T) {
+	standIn, sink := newPIWebAPIStandIn(t, "TEMP")
+	standIn.points[`\\historian\EMPTY`] = ""
+
+	for i := 0; i < 3; i++ {
+		if point := sink.ResolvePoint(&LibDAT.DatTagRecord{Name: "temp"}, "TEMP"); !point.Process {
+			t.Fatalf("TEMP was not resolved")
+		}
+	}
+	if got := standIn.lookups[`\\historian\TEMP`]; got != 1 {
+		t.Errorf("TEMP was looked up %d times, its WebID should be cached", got)
+	}
+
+	for _, tag := range []string{"MISSING", "EMPTY"} {
+		if point := sink.ResolvePoint(&LibDAT.DatTagRecord{Name: tag}, tag); point.Process {
+			t.Errorf("%s was resolved", tag)
+		}
+		if _, err := sink.lookupWebID(tag); err == nil {
+			t.Errorf("looking %s up again did not fail", tag)
+		}
+		// Failed lookups are not cached.
+		if got := standIn.lookups[`\\historian\`+tag]; got != 2 {
+			t.Errorf("%s was looked up %d times, 2 expected", tag, got)
+		}
+	}
+}
+
+func TestPIWebAPIInsertBatches(t *testing.T) {
+	standIn, sink := newPIWebAPIStandIn(t, "TEMP", "FLOW")
+	points := testPoints(sink, "TEMP", "FLOW")
+	records := testRecords(0, 1, 0, 1, 0, 1, 0)
+	records[2].Status = 'U'
+	// Invalid records and records of unknown tags are not written.
+	records = append(records, &LibDAT.DatFloatRecord{TagID: 0}, &LibDAT.DatFloatRecord{TagID: 9, IsValid: true}, nil)
+
+	if err := sink.Insert(records, points); err != nil {
+		t.Fatal(err)
+	}
+	if len(standIn.posts) != 3 {
+		t.Fatalf("%d requests sent, 3 batches of at most 3 values expected", len(standIn.posts))
+	}
+	values := make(map[string][]piWebAPIValue)
+	for i, streams := range standIn.posts {
+		count := 0
+		for _, stream := range streams {
+			values[stream.WebId] = append(values[stream.WebId], stream.Items...)
+			count += len(stream.Items)
+		}
+		if count > 3 {
+			t.Errorf("request %d holds %d values", i, count)
+		}
+		if standIn.queries[i] != "updateOption=Replace" {
+			t.Errorf("request %d has the query %s", i, standIn.queries[i])
+		}
+	}
+	if len(values["TEMP"]) != 4 || len(values["FLOW"]) != 3 {
+		t.Fatalf("values written by WebID: %v", values)
+	}
+	third := values["TEMP"][1]
+	if third.Timestamp != "2024-01-01T00:00:03Z" || third.Value != 2 || third.Good {
+		t.Errorf("the bad status value was written as %+v", third)
+	}
+	if second := values["FLOW"][0]; second.Timestamp != "2024-01-01T00:00:01.5Z" || !second.Good {
+		t.Errorf("the second value was written as %+v", second)
+	}
+}
+
+func TestPIWebAPIInsertErrors(t *testing.T) {
+	t.Run("partial failure", func(t *testing.T) {
+		standIn, sink := newPIWebAPIStandIn(t, "TEMP")
+		standIn.status = http.StatusMultiStatus
+		err := sink.Insert(testRecords(0), testPoints(sink, "TEMP"))
+		if err == nil || !strings.Contains(err.Error(), "partially failed") {
+			t.Errorf("a 207 response returned %v", err)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		standIn, sink := newPIWebAPIStandIn(t, "TEMP")
+		standIn.status = http.StatusInternalServerError
+		err := sink.Insert(testRecords(0, 0, 0, 0), testPoints(sink, "TEMP"))
+		if err == nil || !strings.Contains(err.Error(), "500") {
+			t.Errorf("a 500 response returned %v", err)
+		}
+		if len(standIn.posts) != 1 {
+			t.Errorf("%d requests sent after the first failed", len(standIn.posts))
+		}
+	})
+
+	t.Run("lookup failure", func(t *testing.T) {
+		standIn, sink := newPIWebAPIStandIn(t, "TEMP", "FLOW")
+		points := testPoints(sink, "TEMP", "FLOW")
+		// FLOW is deleted on the server before its WebID is cached.
+		delete(standIn.points, `\\historian\FLOW`)
+		sink.webIDs = make(map[string]string)
+		err := sink.Insert(testRecords(0, 1, 0, 1), points)
+		if err == nil || !strings.Contains(err.Error(), "2 records were not written") {
+			t.Errorf("records of a point that cannot be found returned %v", err)
+		}
+		if len(standIn.posts) != 1 || len(standIn.posts[0]) != 1 || standIn.posts[0][0].WebId != "TEMP" {
+			t.Errorf("the records of TEMP were not written: %v", standIn.posts)
+		}
+	})
+
+	t.Run("nothing to write", func(t *testing.T) {
+		_, sink := newPIWebAPIStandIn(t)
+		if err := sink.Insert(testRecords(0), LibPI.NewPointLookup()); err == nil {
+			t.Error("inserting no values did not fail")
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, sink := newPIWebAPIStandIn(t)
+		sink.cfg.password = "wrong"
+		if err := sink.Connect(); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("connecting with a wrong password returned %v", err)
+		}
+	})
+}
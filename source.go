@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source is a folder of DAT files on another machine. Its files are copied
+// to a local mirror in the staging folder before discovery reads them like
+// any other folder.
+type Source interface {
+	// List returns the files below the source's folder. Folders for which
+	// skip returns true are not listed, only the top folder is listed unless
+	// recursive is set.
+	List(recursive bool, skip func(rel string) bool) ([]remoteFile, error)
+	// Stat returns the file at rel, the slash separated path below the folder.
+	Stat(rel string) (remoteFile, error)
+	Open(rel string) (io.ReadCloser, error)
+	Close() error
+}
+
+// remoteHasher is implemented by sources that can hash a file on the remote
+// machine, so a copy is compared with the file it was copied from.
+type remoteHasher interface {
+	// RemoteSHA256 returns errNoRemoteHash when the remote machine has no
+	// way to hash files.
+	RemoteSHA256(rel string) (string, error)
+}
+
+var errNoRemoteHash = errors.New("the remote host cannot hash files")
+
+// remoteFile is a file of a Source.
+type remoteFile struct {
+	Rel     string
+	Size    int64
+	ModTime time.Time
+}
+
+// HostCredentials are the login details of a remote source host, read from
+// the hosts section of the config file.
+type HostCredentials struct {
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	// KeyFile is a private key used instead of, or before, the password.
+	KeyFile       string `json:"keyFile,omitempty"`
+	KeyPassphrase string `json:"keyPassphrase,omitempty"`
+	// KnownHosts defaults to ~/.ssh/known_hosts.
+	KnownHosts string `json:"knownHosts,omitempty"`
+	// InsecureIgnoreHostKey accepts any host key, for test setups only.
+	InsecureIgnoreHostKey bool `json:"insecureIgnoreHostKey,omitempty"`
+}
+
+// isRemote reports whether root is the URL of a remote source rather than a
+// local path.
+func isRemote(root string) bool {
+	return strings.HasPrefix(strings.ToLower(root), "sftp://")
+}
+
+func newSource(root string, hosts map[string]HostCredentials) (Source, error) {
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %s: %v", root, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "sftp":
+		return newSFTPSource(u, hosts[u.Hostname()])
+	}
+	return nil, fmt.Errorf("unknown source %s", root)
+}
+
+// redactURL removes a password from a source URL before it is shown.
+func redactURL(root string) string {
+	u, err := url.Parse(root)
+	if err != nil || u.User == nil {
+		return root
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// remoteMirror returns the local folder the files of a remote source are
+// copied to.
+func remoteMirror(stagingDir, root string) string {
+	u, err := url.Parse(root)
+	host := "remote"
+	if err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+		// The user and password do not change which files are mirrored.
+		u.User = nil
+		root = u.String()
+	}
+	sum := sha1.Sum([]byte(root))
+	return filepath.Join(stagingDir, "remote", fmt.Sprintf("%s-%s", host, hex.EncodeToString(sum[:6])))
+}
+
+const mirrorManifestName = ".manifest.json"
+
+// mirroredFile is a file of the mirror manifest, the remote size and time
+// it was copied at and the checksum of the copy.
+type mirroredFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+func loadMirrorManifest(mirror string) map[string]mirroredFile {
+	manifest := make(map[string]mirroredFile)
+	data, err := os.ReadFile(filepath.Join(mirror, mirrorManifestName))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn(fmt.Sprintf("Failed to read the manifest of %s: %v", mirror, err))
+		}
+		return manifest
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to parse the manifest of %s, all files are copied again: %v", mirror, err))
+		return make(map[string]mirroredFile)
+	}
+	return manifest
+}
+
+func saveMirrorManifest(mirror string, manifest map[string]mirroredFile) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStagedFile(filepath.Join(mirror, mirrorManifestName), strings.NewReader(string(data)+"\n"))
+}
+
+// syncRemote copies the DAT files of a remote source that pass the globs to
+// its mirror and returns the mirror folder. Files already copied are only
+// copied again when their remote size or time changed, or the size of the
+// copy no longer matches.
+func (s datSources) syncRemote(root string) (string, error) {
+	mirror := remoteMirror(s.StagingDir, root)
+	src, err := newSource(root, s.Hosts)
+	if err != nil {
+		return mirror, err
+	}
+	defer src.Close()
+
+	files, err := src.List(s.Recursive, func(rel string) bool {
+		return matchGlobs(s.Exclude, rel)
+	})
+	if err != nil {
+		return mirror, fmt.Errorf("failed to list %s: %v", redactURL(root), err)
+	}
+	// Tag files are copied when their float file passes the globs, whether
+	// it exists or not, so they are paired like local files.
+	var wanted []remoteFile
+	for _, file := range files {
+		floatRel := path.Join(path.Dir(file.Rel), strings.Replace(path.Base(file.Rel), " (Tagname)", " (Float)", 1))
+		if s.useFloatFile(filepath.Join(mirror, filepath.FromSlash(floatRel)), floatRel) {
+			wanted = append(wanted, file)
+		}
+	}
+
+	manifest := loadMirrorManifest(mirror)
+	copied := 0
+	for _, file := range wanted {
+		target := filepath.Join(mirror, filepath.FromSlash(file.Rel))
+		if mirrored, ok := manifest[file.Rel]; ok && mirrored.Size == file.Size && mirrored.ModTime.Equal(file.ModTime) {
+			if info, err := os.Stat(target); err == nil && info.Size() == file.Size {
+				continue
+			}
+		}
+		sum, err := fetchRemoteFile(src, file, target)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Failed to copy %s from %s: %v", file.Rel, redactURL(root), err))
+			continue
+		}
+		manifest[file.Rel] = mirroredFile{Size: file.Size, ModTime: file.ModTime, SHA256: sum}
+		copied++
+	}
+	if copied > 0 {
+		slog.Info(fmt.Sprintf("Copied %d DAT files from %s", copied, redactURL(root)))
+		if err := saveMirrorManifest(mirror, manifest); err != nil {
+			slog.Warn(fmt.Sprintf("Failed to save the manifest of %s: %v", mirror, err))
+		}
+	}
+	return mirror, nil
+}
+
+// fetchRemoteFile copies file to target and returns the SHA-256 of the copy.
+// The copy is rejected when its size differs from the listing, when the
+// remote file changed while it was read, or when the source hashes the
+// remote file to something else.
+func fetchRemoteFile(src Source, file remoteFile, target string) (string, error) {
+	r, err := src.Open(file.Rel)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".staging-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	after, err := src.Stat(file.Rel)
+	if err != nil {
+		return "", err
+	}
+	if size != file.Size || after.Size != file.Size || !after.ModTime.Equal(file.ModTime) {
+		return "", fmt.Errorf("file changed while it was copied, %d bytes read of %d", size, after.Size)
+	}
+	sum, err := hashFile(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	if hasher, ok := src.(remoteHasher); ok {
+		remote, err := hasher.RemoteSHA256(file.Rel)
+		switch {
+		case errors.Is(err, errNoRemoteHash):
+			// Only the size and time are checked.
+		case err != nil:
+			return "", fmt.Errorf("failed to hash the remote file: %v", err)
+		case !strings.EqualFold(remote, sum):
+			return "", fmt.Errorf("checksum mismatch, the remote file hashes to %s but the copy to %s", remote, sum)
+		}
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", err
+	}
+	// The mirror keeps the remote time so the watch sees files settle.
+	os.Chtimes(target, file.ModTime, file.ModTime)
+	return sum, nil
+}
+
+func hashFile(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
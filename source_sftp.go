@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource reads DAT files over SFTP, the OpenSSH server of Windows HMI
+// PCs included. Its URL is sftp://[user@]host[:port]/folder.
+type sftpSource struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	dir    string
+	// noHash is set once the host turned out to have no hash command.
+	noHash bool
+}
+
+func newSFTPSource(u *url.URL, creds HostCredentials) (*sftpSource, error) {
+	config, err := sftpClientConfig(u, creds)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", host, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp on %s: %v", host, err)
+	}
+	dir := "."
+	if u.Path != "" {
+		dir = path.Clean(u.Path)
+	}
+	return &sftpSource{conn: conn, client: client, dir: dir}, nil
+}
+
+// sftpClientConfig builds the ssh login from the config file credentials of
+// the host. A user or password in the URL takes precedence.
+func sftpClientConfig(u *url.URL, creds HostCredentials) (*ssh.ClientConfig, error) {
+	user := creds.User
+	password := creds.Password
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if user == "" {
+		return nil, fmt.Errorf("no user for %s, add it to the URL or the hosts section of the config file", u.Hostname())
+	}
+
+	var auth []ssh.AuthMethod
+	if creds.KeyFile != "" {
+		key, err := os.ReadFile(creds.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		var signer ssh.Signer
+		if creds.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(creds.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file %s: %v", creds.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no password or key file for %s", u.Hostname())
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !creds.InsecureIgnoreHostKey {
+		knownHostsFile := creds.KnownHosts
+		if knownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		var err error
+		if hostKey, err = knownhosts.New(knownHostsFile); err != nil {
+			return nil, fmt.Errorf("failed to read known hosts: %v", err)
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+func (s *sftpSource) List(recursive bool, skip func(rel string) bool) ([]remoteFile, error) {
+	var files []remoteFile
+	walker := s.client.Walk(s.dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == s.dir {
+				return nil, err
+			}
+			continue
+		}
+		rel := relPath(s.dir, walker.Path())
+		info := walker.Stat()
+		if info.IsDir() {
+			if rel != "" && (!recursive || skip(rel)) {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if info.Mode().IsRegular() && isDatFile(rel) && validEntryName(rel) {
+			files = append(files, remoteFile{Rel: rel, Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	return files, nil
+}
+
+// relPath returns the slash separated path p below dir, or an empty string
+// for dir itself.
+func relPath(dir, p string) string {
+	p = path.Clean(p)
+	switch {
+	case p == dir:
+		return ""
+	case dir == ".":
+		return p
+	case dir == "/":
+		return strings.TrimPrefix(p, "/")
+	}
+	return strings.TrimPrefix(p, dir+"/")
+}
+
+func (s *sftpSource) Stat(rel string) (remoteFile, error) {
+	info, err := s.client.Stat(path.Join(s.dir, rel))
+	if err != nil {
+		return remoteFile{}, err
+	}
+	return remoteFile{Rel: rel, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *sftpSource) Open(rel string) (io.ReadCloser, error) {
+	return s.client.Open(path.Join(s.dir, rel))
+}
+
+// RemoteSHA256 hashes a file on the host with sha256sum, or with certutil on
+// Windows hosts whose ssh shell is cmd.exe.
+func (s *sftpSource) RemoteSHA256(rel string) (string, error) {
+	if s.noHash {
+		return "", errNoRemoteHash
+	}
+	p := path.Join(s.dir, rel)
+	commands := []string{"sha256sum -- " + shellQuote(p)}
+	if !strings.Contains(p, `"`) {
+		commands = append(commands, `certutil -hashfile "`+windowsPath(p)+`" SHA256`)
+	}
+	for _, command := range commands {
+		session, err := s.conn.NewSession()
+		if err != nil {
+			return "", err
+		}
+		out, err := session.Output(command)
+		session.Close()
+		if err != nil {
+			continue
+		}
+		if sum, ok := parseSHA256(out); ok {
+			return sum, nil
+		}
+	}
+	slog.Warn(fmt.Sprintf("%s has neither sha256sum nor certutil, copies are only checked by their size and time", s.conn.RemoteAddr()))
+	s.noHash = true
+	return "", errNoRemoteHash
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// windowsPath turns an sftp path such as /C:/Datalog/x.DAT into C:\Datalog\x.DAT.
+func windowsPath(p string) string {
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return strings.ReplaceAll(p, "/", `\`)
+}
+
+// parseSHA256 finds the hex digest in the output of sha256sum, which starts
+// its line, or of certutil, which has a line of its own that older versions
+// split into bytes with spaces.
+func parseSHA256(out []byte) (string, bool) {
+	for _, line := range strings.Split(string(out), "\n") {
+		candidates := []string{strings.ReplaceAll(strings.TrimSpace(line), " ", "")}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			// sha256sum escapes names with backslashes and marks the line.
+			candidates = append(candidates, strings.TrimPrefix(fields[0], `\`))
+		}
+		for _, candidate := range candidates {
+			if len(candidate) != 64 {
+				continue
+			}
+			if _, err := hex.DecodeString(candidate); err == nil {
+				return strings.ToLower(candidate), true
+			}
+		}
+	}
+	return "", false
+}
+
+func (s *sftpSource) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
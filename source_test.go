@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memorySource is a Source of files held in memory. hash is what the remote
+// host hashes a file to, a nil func for hosts without a hash command.
+type memorySource struct {
+	files map[string][]byte
+	hash  func(data []byte) string
+	// changed is applied to a file after it was opened.
+	changed func(data []byte) []byte
+}
+
+func (s *memorySource) List(bool, func(string) bool) ([]remoteFile, error) {
+	var files []remoteFile
+	for rel := range s.files {
+		files = append(files, s.stat(rel))
+	}
+	return files, nil
+}
+
+func (s *memorySource) stat(rel string) remoteFile {
+	return remoteFile{Rel: rel, Size: int64(len(s.files[rel])), ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (s *memorySource) Stat(rel string) (remoteFile, error) {
+	if _, ok := s.files[rel]; !ok {
+		return remoteFile{}, os.ErrNotExist
+	}
+	return s.stat(rel), nil
+}
+
+func (s *memorySource) Open(rel string) (io.ReadCloser, error) {
+	data := s.files[rel]
+	if s.changed != nil {
+		s.files[rel] = s.changed(data)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memorySource) RemoteSHA256(rel string) (string, error) {
+	if s.hash == nil {
+		return "", errNoRemoteHash
+	}
+	return s.hash(s.files[rel]), nil
+}
+
+func (s *memorySource) Close() error { return nil }
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFetchRemoteFile(t *testing.T) {
+	data := []byte("2024 01 01 0000 (Float).DAT contents")
+	tests := []struct {
+		name    string
+		hash    func([]byte) string
+		changed func([]byte) []byte
+		err     string
+	}{
+		{"matching hash", func(b []byte) string { return strings.ToUpper(sha256Hex(b)) }, nil, ""},
+		{"no remote hash", nil, nil, ""},
+		{"different hash", func(b []byte) string { return sha256Hex(append(b, 0)) }, nil, "checksum mismatch"},
+		{"changed", sha256Hex, func(b []byte) []byte { return append(b, 'x') }, "changed while it was copied"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := &memorySource{files: map[string][]byte{"line1/a (Float).DAT": data}, hash: test.hash, changed: test.changed}
+			file := src.stat("line1/a (Float).DAT")
+			target := filepath.Join(t.TempDir(), "line1", "a (Float).DAT")
+			sum, err := fetchRemoteFile(src, file, target)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("returned %v, an error about %s expected", err, test.err)
+				}
+				if _, err := os.Stat(target); !os.IsNotExist(err) {
+					t.Error("a rejected copy was kept")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != sha256Hex(data) {
+				t.Errorf("the copy hashes to %s", sum)
+			}
+			if copied, err := os.ReadFile(target); err != nil || !bytes.Equal(copied, data) {
+				t.Errorf("the copy holds %q, %v", copied, err)
+			}
+		})
+	}
+}
+
+func TestRelPath(t *testing.T) {
+	tests := []struct{ dir, p, want string }{
+		{".", ".", ""},
+		{".", ".hidden (Float).DAT", ".hidden (Float).DAT"},
+		{".", "line1/a (Float).DAT", "line1/a (Float).DAT"},
+		{"/C:/Datalog", "/C:/Datalog", ""},
+		{"/C:/Datalog", "/C:/Datalog/line1/a (Float).DAT", "line1/a (Float).DAT"},
+		{"/", "/a (Float).DAT", "a (Float).DAT"},
+	}
+	for _, test := range tests {
+		if got := relPath(test.dir, test.p); got != test.want {
+			t.Errorf("relPath(%q, %q) = %q, %q expected", test.dir, test.p, got, test.want)
+		}
+	}
+}
+
+func TestParseSHA256(t *testing.T) {
+	sum := sha256Hex([]byte("x"))
+	spaced := ""
+	for i := 0; i < len(sum); i += 2 {
+		spaced += sum[i:i+2] + " "
+	}
+	tests := []struct{ name, out string }{
+		{"sha256sum", sum + "  /home/hmi/Datalog/a (Float).DAT\n"},
+		{"sha256sum escaped", `\` + sum + `  /home/hmi/Datalog/a\\b (Float).DAT` + "\n"},
+		{"certutil", "SHA256 hash of C:\\Datalog\\a (Float).DAT:\r\n" + strings.ToUpper(sum) + "\r\nCertUtil: -hashfile command completed successfully.\r\n"},
+		{"certutil spaced", "SHA256 hash of file C:\\Datalog\\a (Float).DAT:\r\n" + spaced + "\r\nCertUtil: -hashfile command completed successfully.\r\n"},
+	}
+	for _, test := range tests {
+		if got, ok := parseSHA256([]byte(test.out)); !ok || got != sum {
+			t.Errorf("%s output parsed as %q, %v", test.name, got, ok)
+		}
+	}
+	if _, ok := parseSHA256([]byte("sha256sum: a (Float).DAT: No such file or directory\n")); ok {
+		t.Error("an error message parsed as a hash")
+	}
+}
+
+func TestWindowsPath(t *testing.T) {
+	if got := windowsPath("/C:/Datalog/line1/a (Float).DAT"); got != `C:\Datalog\line1\a (Float).DAT` {
+		t.Errorf("the path is %s", got)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers and data types from the Eclipse Tahu sparkplug_b.proto
+// definition. Only the parts needed for the births, deaths and historical
+// DDATA of one edge node and device are encoded.
+const (
+	spPayloadTimestamp = 1
+	spPayloadMetrics   = 2
+	spPayloadSeq       = 3
+
+	spMetricName         = 1
+	spMetricTimestamp    = 3
+	spMetricDatatype     = 4
+	spMetricIsHistorical = 5
+	spMetricIsNull       = 7
+	spMetricProperties   = 9
+	spMetricLongValue    = 11
+	spMetricDoubleValue  = 13
+	spMetricBooleanValue = 14
+
+	spPropertySetKeys   = 1
+	spPropertySetValues = 2
+
+	spPropertyValueType     = 1
+	spPropertyValueIntValue = 3
+
+	spDataTypeInt32   = 3
+	spDataTypeInt64   = 4
+	spDataTypeDouble  = 10
+	spDataTypeBoolean = 11
+
+	// Metrics every NBIRTH defines.
+	spBdSeq       = "bdSeq"
+	spNodeRebirth = "Node Control/Rebirth"
+
+	// OPC style quality codes used by the Sparkplug "Quality" property.
+	spQualityGood = 192
+	spQualityBad  = 0
+)
+
+type sparkplugMetric struct {
+	name      string
+	timestamp time.Time
+	value     float64
+	good      bool
+}
+
+// encodeSparkplugPayload encodes metrics as a Sparkplug B payload with every
+// metric flagged as historical.
+func encodeSparkplugPayload(seq uint64, metrics []sparkplugMetric) []byte {
+	encoded := make([][]byte, len(metrics))
+	for i, metric := range metrics {
+		encoded[i] = encodeSparkplugMetric(metric)
+	}
+	return sparkplugPayload(encoded, &seq)
+}
+
+// encodeSparkplugNodeBirth encodes the NBIRTH of the edge node, it defines
+// the bdSeq of the connection and the rebirth command.
+func encodeSparkplugNodeBirth(seq, bdSeq uint64) []byte {
+	now := time.Now()
+	return sparkplugPayload([][]byte{
+		sparkplugBdSeq(bdSeq, now),
+		sparkplugControl(spNodeRebirth, now),
+	}, &seq)
+}
+
+// encodeSparkplugNodeDeath encodes the NDEATH of the edge node, it carries
+// the bdSeq of the connection and no sequence number.
+func encodeSparkplugNodeDeath(bdSeq uint64) []byte {
+	return sparkplugPayload([][]byte{sparkplugBdSeq(bdSeq, time.Now())}, nil)
+}
+
+// encodeSparkplugDeviceBirth encodes the DBIRTH of the device, defining
+// every metric its DDATA carries. The metrics have no current value.
+func encodeSparkplugDeviceBirth(seq uint64, names []string) []byte {
+	now := time.Now()
+	metrics := make([][]byte, len(names))
+	for i, name := range names {
+		var b []byte
+		b = appendSparkplugHeader(b, name, now, spDataTypeDouble)
+		b = protowire.AppendTag(b, spMetricIsNull, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+		metrics[i] = b
+	}
+	return sparkplugPayload(metrics, &seq)
+}
+
+func encodeSparkplugDeviceDeath(seq uint64) []byte {
+	return sparkplugPayload(nil, &seq)
+}
+
+// sparkplugPayload encodes a payload of encoded metrics, deaths of the node
+// have no sequence number.
+func sparkplugPayload(metrics [][]byte, seq *uint64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, spPayloadTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(time.Now().UnixMilli()))
+	for _, metric := range metrics {
+		b = protowire.AppendTag(b, spPayloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, metric)
+	}
+	if seq != nil {
+		b = protowire.AppendTag(b, spPayloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, *seq)
+	}
+	return b
+}
+
+func appendSparkplugHeader(b []byte, name string, timestamp time.Time, datatype uint64) []byte {
+	b = protowire.AppendTag(b, spMetricName, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, spMetricTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(timestamp.UnixMilli()))
+	b = protowire.AppendTag(b, spMetricDatatype, protowire.VarintType)
+	return protowire.AppendVarint(b, datatype)
+}
+
+func sparkplugBdSeq(bdSeq uint64, timestamp time.Time) []byte {
+	b := appendSparkplugHeader(nil, spBdSeq, timestamp, spDataTypeInt64)
+	b = protowire.AppendTag(b, spMetricLongValue, protowire.VarintType)
+	return protowire.AppendVarint(b, bdSeq)
+}
+
+func sparkplugControl(name string, timestamp time.Time) []byte {
+	b := appendSparkplugHeader(nil, name, timestamp, spDataTypeBoolean)
+	b = protowire.AppendTag(b, spMetricBooleanValue, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(false))
+}
+
+func encodeSparkplugMetric(metric sparkplugMetric) []byte {
+	b := appendSparkplugHeader(nil, metric.name, metric.timestamp, spDataTypeDouble)
+	b = protowire.AppendTag(b, spMetricIsHistorical, protowire.VarintType)
+	b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+
+	quality := uint64(spQualityGood)
+	if !metric.good {
+		quality = spQualityBad
+	}
+	b = protowire.AppendTag(b, spMetricProperties, protowire.BytesType)
+	b = protowire.AppendBytes(b, encodeSparkplugQuality(quality))
+
+	b = protowire.AppendTag(b, spMetricDoubleValue, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(metric.value))
+	return b
+}
+
+func encodeSparkplugQuality(quality uint64) []byte {
+	var value []byte
+	value = protowire.AppendTag(value, spPropertyValueType, protowire.VarintType)
+	value = protowire.AppendVarint(value, spDataTypeInt32)
+	value = protowire.AppendTag(value, spPropertyValueIntValue, protowire.VarintType)
+	value = protowire.AppendVarint(value, quality)
+
+	var b []byte
+	b = protowire.AppendTag(b, spPropertySetKeys, protowire.BytesType)
+	b = protowire.AppendString(b, "Quality")
+	b = protowire.AppendTag(b, spPropertySetValues, protowire.BytesType)
+	b = protowire.AppendBytes(b, value)
+	return b
+}
+
+// sparkplugValue is a metric of a received payload.
+type sparkplugValue struct {
+	name       string
+	timestamp  uint64
+	datatype   uint64
+	historical bool
+	null       bool
+	// intValue holds the int, long and boolean values.
+	intValue    uint64
+	doubleValue float64
+}
+
+// decodeSparkplugPayload decodes the sequence number and metrics of a
+// payload, seq is nil when the payload has none.
+func decodeSparkplugPayload(b []byte) (*uint64, []sparkplugValue, error) {
+	var seq *uint64
+	var values []sparkplugValue
+	err := rangeProtoFields(b, func(num protowire.Number, v uint64, field []byte) error {
+		switch num {
+		case spPayloadSeq:
+			seq = &v
+		case spPayloadMetrics:
+			value, err := decodeSparkplugMetric(field)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		return nil
+	})
+	return seq, values, err
+}
+
+func decodeSparkplugMetric(b []byte) (sparkplugValue, error) {
+	var value sparkplugValue
+	err := rangeProtoFields(b, func(num protowire.Number, v uint64, field []byte) error {
+		switch num {
+		case spMetricName:
+			value.name = string(field)
+		case spMetricTimestamp:
+			value.timestamp = v
+		case spMetricDatatype:
+			value.datatype = v
+		case spMetricIsHistorical:
+			value.historical = protowire.DecodeBool(v)
+		case spMetricIsNull:
+			value.null = protowire.DecodeBool(v)
+		case spMetricLongValue, spMetricBooleanValue:
+			value.intValue = v
+		case spMetricDoubleValue:
+			value.doubleValue = math.Float64frombits(v)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// rangeProtoFields calls fn with the number and the varint, fixed or bytes
+// value of each field of a protobuf message.
+func rangeProtoFields(b []byte, fn func(num protowire.Number, v uint64, field []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var field []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.BytesType:
+			field, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, v, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sparkplugRebirthRequested reports whether an NCMD payload sets the
+// rebirth command.
+func sparkplugRebirthRequested(payload []byte) bool {
+	_, values, err := decodeSparkplugPayload(payload)
+	if err != nil {
+		return false
+	}
+	for _, value := range values {
+		if value.name == spNodeRebirth && value.intValue != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/complacentsee/goDataLogConvertTUI/helpers"
+)
+
+// How long a toast stays on screen.
+const toastDuration = 5 * time.Second
+
+// Number of messages kept in the message history.
+const statusHistoryLimit = 500
+
+type statusLevel int
+
+const (
+	statusInfo statusLevel = iota
+	statusWarn
+	statusError
+)
+
+func (l statusLevel) String() string {
+	switch l {
+	case statusWarn:
+		return "WARN"
+	case statusError:
+		return "ERROR"
+	}
+	return "INFO"
+}
+
+func (l statusLevel) color() lipgloss.Color {
+	switch l {
+	case statusWarn:
+		return lipgloss.Color("3")
+	case statusError:
+		return lipgloss.Color("1")
+	}
+	return lipgloss.Color("82")
+}
+
+type statusEntry struct {
+	id      int
+	time    time.Time
+	level   statusLevel
+	message string
+}
+
+// StatusModel shows status messages as timed toasts and keeps them in a
+// message history.
+type StatusModel struct {
+	History     []statusEntry
+	Toasts      []statusEntry
+	ShowHistory bool
+	Viewport    viewport.Model
+	// Keys are the bindings of the message history.
+	Keys   keyMap
+	nextID int
+}
+
+type toastExpiredMsg struct {
+	id int
+}
+
+// Push adds a message to the history and shows it as a toast until the
+// returned command expires it.
+func (m StatusModel) Push(level statusLevel, message string) (StatusModel, tea.Cmd) {
+	switch level {
+	case statusError:
+		slog.Error(message)
+	case statusWarn:
+		slog.Warn(message)
+	default:
+		slog.Info(message)
+	}
+
+	m.nextID++
+	entry := statusEntry{id: m.nextID, time: time.Now(), level: level, message: message}
+	m.History = append(m.History, entry)
+	if len(m.History) > statusHistoryLimit {
+		m.History = m.History[len(m.History)-statusHistoryLimit:]
+	}
+	m.Toasts = append(m.Toasts, entry)
+	if m.ShowHistory {
+		m.Viewport.SetContent(m.historyContent())
+		m.Viewport.GotoBottom()
+	}
+
+	id := entry.id
+	return m, tea.Tick(toastDuration, func(time.Time) tea.Msg {
+		return toastExpiredMsg{id: id}
+	})
+}
+
+func (m StatusModel) Expire(id int) StatusModel {
+	toasts := m.Toasts[:0:0]
+	for _, toast := range m.Toasts {
+		if toast.id != id {
+			toasts = append(toasts, toast)
+		}
+	}
+	m.Toasts = toasts
+	return m
+}
+
+func (m StatusModel) OpenHistory(width, height int, keys keyMap) StatusModel {
+	m.ShowHistory = true
+	m.Keys = keys
+	m.Viewport = viewport.New(width, max(height-2, 1))
+	m.Viewport.KeyMap.Up, m.Viewport.KeyMap.Down = keys.Up, keys.Down
+	m.Viewport.KeyMap.PageUp, m.Viewport.KeyMap.PageDown = keys.PageUp, keys.PageDown
+	m.Viewport.SetContent(m.historyContent())
+	m.Viewport.GotoBottom()
+	return m
+}
+
+func (m StatusModel) Resize(width, height int) StatusModel {
+	m.Viewport.Width = width
+	m.Viewport.Height = max(height-2, 1)
+	return m
+}
+
+func (m StatusModel) UpdateHistory(msg tea.KeyMsg) (StatusModel, tea.Cmd) {
+	if key.Matches(msg, m.Keys.Back, m.Keys.Quit) {
+		m.ShowHistory = false
+		return m, nil
+	}
+	var cmd tea.Cmd
+	m.Viewport, cmd = m.Viewport.Update(msg)
+	return m, cmd
+}
+
+func (m StatusModel) historyContent() string {
+	if len(m.History) == 0 {
+		return "No messages yet."
+	}
+	lines := make([]string, 0, len(m.History))
+	for _, entry := range m.History {
+		level := lipgloss.NewStyle().Foreground(entry.level.color()).Render(fmt.Sprintf("%-5s", entry.level))
+		lines = append(lines, fmt.Sprintf("%s %s %s", entry.time.Format("15:04:05"), level, entry.message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m StatusModel) HistoryView() string {
+	s := lipgloss.NewStyle().Bold(true).Render("Messages") + "\n"
+	s += m.Viewport.View() + "\n"
+	s += keyHint(m.Keys.Back, "Back") + "  " + fmt.Sprintf("[%s/%s] Scroll", m.Keys.Down.Help().Key, m.Keys.Up.Help().Key)
+	return s
+}
+
+// View draws the toasts stacked in the top right corner of background.
+func (m StatusModel) View(width int, background string) string {
+	y := 1
+	for _, toast := range m.Toasts {
+		style := lipgloss.NewStyle().
+			Border(lipgloss.RoundedBorder(), true).
+			BorderForeground(toast.level.color()).
+			Padding(0, 1).
+			MaxWidth(max(width/2, 20))
+		box := style.Render(lipgloss.NewStyle().Width(min(lipgloss.Width(toast.message), max(width/2-4, 16))).Render(toast.message))
+		x := max(width-lipgloss.Width(box)-1, 0)
+		background = helpers.PlaceOverlay(x, y, box, background, false)
+		y += lipgloss.Height(box)
+	}
+	return background
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+// Layouts LibDAT assumes for float and tag files, used when the header does
+// not give a usable one.
+const (
+	floatHeaderLength = 0x121
+	floatRecordLength = 39
+	tagHeaderLength   = 0xA1
+	tagRecordLength   = 264
+)
+
+// tailFile is a float file still being written that is forwarded as records
+// are appended.
+type tailFile struct {
+	fileName string
+	offset   int64
+	sent     int
+	tags     map[int]*LibDAT.DatTagRecord
+	points   *LibPI.PointLookup
+	// tagRecords is the record count of the tag file when its tags were
+	// resolved, deleted records included.
+	tagRecords int
+	ready      bool
+	busy       bool
+	// closed is set once the watch considers the file closed, the tail ends
+	// when it has read the file to the end.
+	closed bool
+}
+
+type tailTickMsg struct {
+	generation int
+}
+
+type tailReadyMsg struct {
+	generation int
+	fileName   string
+	date       string
+	tags       map[int]*LibDAT.DatTagRecord
+	points     *LibPI.PointLookup
+	validTags  int
+	tagRecords int
+	err        string
+}
+
+type tailBatchMsg struct {
+	generation int
+	fileName   string
+	offset     int64
+	records    int
+	eof        bool
+	duration   time.Duration
+	err        string
+	// inserted is set when records were sent to the sink, successfully or not.
+	inserted       bool
+	connectionLost bool
+}
+
+func (m WatchModel) tailTick() tea.Cmd {
+	generation := m.generation
+	return tea.Tick(m.cfg.tailInterval, func(time.Time) tea.Msg {
+		return tailTickMsg{generation: generation}
+	})
+}
+
+// readDatLayout returns the header and record length of a DAT file. DAT
+// files are dBase tables, the lengths are at bytes 8 and 10 of the header.
+// The given lengths are returned when the header is not usable.
+func readDatLayout(r io.ReaderAt, headerLength, recordLength int64) (int64, int64) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return headerLength, recordLength
+	}
+	fileHeaderLength := int64(binary.LittleEndian.Uint16(header[8:10]))
+	fileRecordLength := int64(binary.LittleEndian.Uint16(header[10:12]))
+	if fileHeaderLength < 32 || fileRecordLength < recordLength {
+		return headerLength, recordLength
+	}
+	return fileHeaderLength, fileRecordLength
+}
+
+// parseFloatRecord decodes a float record the way LibDAT does. The first
+// byte is the dBase deletion flag.
+func parseFloatRecord(buffer []byte) (*LibDAT.DatFloatRecord, error) {
+	timeStamp, err := time.Parse("2006010215:04:05", string(buffer[1:17]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q: %v", buffer[1:17], err)
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(string(buffer[17:20])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid milliseconds %q: %v", buffer[17:20], err)
+	}
+	tagID, err := strconv.Atoi(strings.TrimSpace(string(buffer[20:25])))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag id %q: %v", buffer[20:25], err)
+	}
+	return &LibDAT.DatFloatRecord{
+		TimeStamp: timeStamp.Add(time.Duration(milli) * time.Millisecond),
+		TagID:     tagID,
+		Val:       math.Float64frombits(binary.LittleEndian.Uint64(buffer[25:33])),
+		Status:    buffer[33],
+		Marker:    buffer[34],
+		IsValid:   true,
+	}, nil
+}
+
+// readFloatTail reads up to limit complete records from offset, 0 meaning
+// the first record. It returns the offset of the next record and whether the
+// end of the file was reached, a record still being written is left for the
+// next read.
+func readFloatTail(fileName string, offset int64, limit int) ([]*LibDAT.DatFloatRecord, int64, bool, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, offset, false, fmt.Errorf("failed to open float file: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, false, err
+	}
+
+	headerLength, recordLength := readDatLayout(file, floatHeaderLength, floatRecordLength)
+	if offset < headerLength {
+		offset = headerLength
+	}
+	count := (info.Size() - offset) / recordLength
+	if count <= 0 {
+		return nil, offset, true, nil
+	}
+	if count > int64(limit) {
+		count = int64(limit)
+	}
+
+	records, skipped, err := readFloatRecords(file, offset, count, recordLength)
+	if err != nil {
+		return nil, offset, false, err
+	}
+	if skipped > 0 {
+		slog.Warn(fmt.Sprintf("Skipped %d unreadable records of %s", skipped, filepath.Base(fileName)))
+	}
+	offset += count * recordLength
+	return records, offset, info.Size()-offset < recordLength, nil
+}
+
+// readFloatRecords parses count records of a float file from offset. Deleted
+// records and the end of file marker are skipped, records that cannot be
+// parsed are logged and counted as skipped.
+func readFloatRecords(file *os.File, offset, count, recordLength int64) ([]*LibDAT.DatFloatRecord, int, error) {
+	buffer := make([]byte, count*recordLength)
+	if _, err := file.ReadAt(buffer, offset); err != nil {
+		return nil, 0, fmt.Errorf("failed to read float records: %v", err)
+	}
+	records := make([]*LibDAT.DatFloatRecord, 0, count)
+	skipped := 0
+	for i := int64(0); i < count; i++ {
+		record := buffer[i*recordLength : (i+1)*recordLength]
+		if record[0] == '*' || record[0] == 0x1A {
+			continue
+		}
+		parsed, err := parseFloatRecord(record)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Skipping record at byte %d of %s: %v", offset+i*recordLength, filepath.Base(file.Name()), err))
+			skipped++
+			continue
+		}
+		records = append(records, parsed)
+	}
+	return records, skipped, nil
+}
+
+// startTail adds a row for a float file that is still open and resolves its
+// tags, it is forwarded once they are.
+func startTail(m *model, fileName string, closed bool) tea.Cmd {
+	tail := &tailFile{fileName: fileName, offset: m.watch.State.Tailing[fileName], closed: closed, busy: true}
+	m.watch.tails[fileName] = tail
+	m.dr.FloatFileNames = append(m.dr.FloatFileNames, fileName)
+	m.setRows(append(m.rows, table.Row{"[X]", fileName, "Tailing", "", "", "", "0", "", "", m.sources.Folder(fileName), ""}))
+	m.refreshTable()
+	return resolveTailTags(*m, tail)
+}
+
+// resolveTailTags reads the tag file of a tailed file and resolves its tags,
+// again when records of tags it did not know yet are appended.
+func resolveTailTags(m model, tail *tailFile) tea.Cmd {
+	fileName := tail.fileName
+	points := tail.points
+	generation := m.watch.generation
+	return func() tea.Msg {
+		msg := tailReadyMsg{generation: generation, fileName: fileName}
+		// Counted before the tags are read, records appended in between are
+		// resolved on the next tick.
+		msg.tagRecords, _ = tagRecordCount(fileName)
+		// A float file without a tag file is paired with a fallback.
+		staged, err := stagedPath(m.pairing, fileName)
+		if err != nil {
+			msg.err = err.Error()
+			return msg
+		}
+		_, date, err := m.dr.ReadTagFileHeader(staged)
+		if err != nil {
+			msg.err = err.Error()
+			return msg
+		}
+		tagRecords, err := m.dr.ReadTagFile(staged)
+		if err != nil {
+			msg.err = err.Error()
+			return msg
+		}
+		if points == nil {
+			points = LibPI.NewPointLookup()
+		}
+		msg.date = *date
+		msg.tags = make(map[int]*LibDAT.DatTagRecord, len(tagRecords))
+		for _, tag := range tagRecords {
+			msg.tags[tag.ID] = tag
+			tagName, exists := historianTagName(tag.Name, m.tagMaps, m.useTagMap)
+			if !exists {
+				continue
+			}
+			if _, exists := points.GetPointByDataLogName(tag.Name); exists {
+				msg.validTags++
+				continue
+			}
+			point := m.sink.ResolvePoint(tag, tagName)
+			if !point.Process {
+				continue
+			}
+			msg.validTags++
+			points.AddPoint(point)
+		}
+		msg.points = points
+		return msg
+	}
+}
+
+// forwardTail reads the records appended since the last batch and inserts
+// them.
+func forwardTail(m model, tail *tailFile) tea.Cmd {
+	fileName := tail.fileName
+	offset := tail.offset
+	points := tail.points
+	limit := m.watch.cfg.tailBatch
+	generation := m.watch.generation
+	return func() tea.Msg {
+		start := time.Now()
+		msg := tailBatchMsg{generation: generation, fileName: fileName, offset: offset}
+		records, next, eof, err := readFloatTail(fileName, offset, limit)
+		if err != nil {
+			msg.err = err.Error()
+			return msg
+		}
+		if len(records) > 0 {
+			msg.inserted = true
+			if err := m.sink.Insert(records, points); err != nil {
+				msg.err = err.Error()
+				if checker, ok := m.sink.(HealthChecker); ok {
+					if pingErr := checker.Ping(); pingErr != nil {
+						msg.connectionLost = true
+						msg.err = pingErr.Error()
+					}
+				}
+				return msg
+			}
+		}
+		msg.offset = next
+		msg.records = len(records)
+		msg.eof = eof
+		msg.duration = time.Since(start)
+		return msg
+	}
+}
+
+func updateWithTailReadyMsg(m model, msg tailReadyMsg) (model, tea.Cmd) {
+	tail, ok := m.watch.tails[msg.fileName]
+	if msg.generation != m.watch.generation || !ok {
+		return m, nil
+	}
+	tail.busy = false
+	index, row, err := findRowByFileName(m, msg.fileName)
+	if err != nil {
+		return m, nil
+	}
+	if msg.err != "" {
+		// The tag file may not be written yet, it is read again on the next tick.
+		slog.Warn(fmt.Sprintf("Tags of %s not readable yet: %s", filepath.Base(msg.fileName), msg.err))
+		return m, nil
+	}
+	tail.tags = msg.tags
+	tail.points = msg.points
+	tail.tagRecords = msg.tagRecords
+	tail.ready = true
+	m, _ = updateRow(m, index, table.Row{row[0], row[1], row[2], msg.date, fmt.Sprintf("%d", len(msg.tags)), fmt.Sprintf("%d", msg.validTags), row[6], row[7], row[8], row[9], row[10]})
+	return m, nil
+}
+
+func updateWithTailTickMsg(m model, msg tailTickMsg) (model, tea.Cmd) {
+	if msg.generation != m.watch.generation {
+		return m, nil
+	}
+	cmds := []tea.Cmd{m.watch.tailTick()}
+	if !m.connected || m.health.State == healthLost {
+		return m, tea.Batch(cmds...)
+	}
+	for _, tail := range m.watch.tails {
+		if tail.busy {
+			continue
+		}
+		// Tags added to the tag file are resolved before their records are read.
+		if !tail.ready || unknownTags(tail) {
+			tail.busy = true
+			cmds = append(cmds, resolveTailTags(m, tail))
+			continue
+		}
+		if _, row, err := findRowByFileName(m, tail.fileName); err != nil || row[0] != "[X]" {
+			continue
+		}
+		tail.busy = true
+		cmds = append(cmds, forwardTail(m, tail))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+func updateWithTailBatchMsg(m model, msg tailBatchMsg) (model, tea.Cmd) {
+	tail, ok := m.watch.tails[msg.fileName]
+	if msg.generation != m.watch.generation || !ok {
+		return m, nil
+	}
+	tail.busy = false
+
+	var cmds []tea.Cmd
+	if msg.inserted {
+		cmds = append(cmds, m.recordInsert(msg.err, msg.connectionLost))
+	}
+	if msg.err != "" {
+		if !msg.connectionLost {
+			cmds = append(cmds, m.notify(statusError, fmt.Sprintf("Forwarding %s failed: %s", filepath.Base(msg.fileName), msg.err)))
+		}
+		return m, tea.Batch(cmds...)
+	}
+
+	tail.offset = msg.offset
+	tail.sent += msg.records
+	m.watch = m.watch.Tailed(msg.fileName, msg.offset)
+	index, row, err := findRowByFileName(m, msg.fileName)
+	if err != nil {
+		return m, tea.Batch(cmds...)
+	}
+	state := row[2]
+	if msg.eof && tail.closed {
+		state = "Completed"
+		delete(m.watch.tails, msg.fileName)
+		m.watch = m.watch.Imported(msg.fileName)
+	}
+	m, _ = updateRow(m, index, table.Row{row[0], row[1], state, row[3], row[4], row[5], fmt.Sprintf("%d", tail.sent), fmt.Sprintf("%.2f sec", msg.duration.Seconds()), row[8], row[9], row[10]})
+	// A backlog is read without waiting for the next tick.
+	if !msg.eof && state == "Tailing" && !unknownTags(tail) {
+		tail.busy = true
+		cmds = append(cmds, forwardTail(m, tail))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+// unknownTags reports whether tags were added to the tag file of tail since
+// its tags were resolved.
+func unknownTags(tail *tailFile) bool {
+	count, err := tagRecordCount(tail.fileName)
+	if err != nil {
+		return false
+	}
+	return count > tail.tagRecords
+}
+
+// tagRecordCount returns the number of records in the tag file of the float
+// file fileName, deleted and unparsable records included.
+func tagRecordCount(fileName string) (int, error) {
+	file, err := os.Open(strings.Replace(fileName, " (Float)", " (Tagname)", 1))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	headerLength, recordLength := readDatLayout(file, tagHeaderLength, tagRecordLength)
+	return int((info.Size() - headerLength) / recordLength), nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/bubbles/progress"
@@ -30,16 +33,85 @@ func updateWithDATFileNameMsg(m model, msg DATFileNameMsg) (model, tea.Cmd) {
 		m.filesTable.SetColumns(columns)
 	}
 
-	// Add new row
-	row := table.Row{"[X]", msg.fileName, "Pending", "", "", "", "", "", ""}
-	m.rows = append(m.rows, row)
-	m.filesTable.SetRows(m.rows)
+	folder := m.sources.Folder(msg.fileName)
+	if columns[folderColumn].Width < len(folder)+1 {
+		columns[folderColumn].Width = len(folder) + 1
+		m.filesTable.SetColumns(columns)
+	}
+
+	// Add new row, a watched file imported again after it failed reuses its row.
+	row := table.Row{"[X]", msg.fileName, "Pending", "", "", "", "", "", "", folder, ""}
+	if index, _, err := findRowByFileName(m, msg.fileName); err == nil {
+		delete(m.datFileRecords, msg.fileName)
+		m, _ = updateRow(m, index, row)
+	} else {
+		m.setRows(append(m.rows, row))
+		m.refreshTable()
+	}
+
+	return m, CheckDATFile(m, msg.fileName)
+}
+
+// updateWithUnpairedTagFileMsg lists a tag file without a float file. Its
+// row cannot be selected, there are no records to load.
+func updateWithUnpairedTagFileMsg(m model, msg UnpairedTagFileMsg) model {
+	date := ""
+	if t, ok := datFileTime(msg.fileName); ok {
+		date = t.Format("2006-01-02")
+	}
+	row := table.Row{"[ ]", msg.fileName, "No Float File", date, "", "", "", "", "", m.sources.Folder(msg.fileName), healthUnpaired}
+	m.setRows(sortRowsByDate(append(m.rows, row)))
+	m.refreshTable()
+	return m
+}
+
+// selectable reports whether a row can be selected for processing.
+func selectable(row table.Row) bool {
+	return row[healthColumn] != healthUnpaired
+}
+
+func updateWithDATIntegrityMsg(m model, msg DATIntegrityMsg) (model, tea.Cmd) {
+	record := m.datFileRecords[msg.fileName]
+	record.Integrity = msg.report
+	m.datFileRecords[msg.fileName] = record
+	for _, issue := range msg.report.Issues {
+		slog.Warn(fmt.Sprintf("%s: %s", filepath.Base(msg.fileName), issue))
+	}
 
+	index, row, err := findRowByFileName(m, msg.fileName)
+	if err != nil {
+		return m, nil
+	}
+	row[healthColumn] = msg.report.Health
+	m, _ = updateRow(m, index, row)
+	if msg.report.Health == healthUnreadable {
+		return updateWithDATFileErrorMsg(m, DATFileErrorMsg{fileName: msg.fileName, stage: stageTagHeader, err: msg.report.Summary()})
+	}
 	return m, LoadDATTagFile(m, msg.fileName)
 }
 
+// updateWithDATFileErrorMsg marks a file that failed to load as unreadable
+// and counts it as scanned, so the scan still completes.
+func updateWithDATFileErrorMsg(m model, msg DATFileErrorMsg) (model, tea.Cmd) {
+	slog.Error(fmt.Sprintf("Failed to load %s: %s", msg.fileName, msg.err))
+	if index, row, err := findRowByFileName(m, msg.fileName); err == nil {
+		row[2] = "Unreadable"
+		row[healthColumn] = healthUnreadable
+		m, _ = updateRow(m, index, row)
+	}
+	m.sfmpu = m.sfmpu.Skip(msg.stage)
+	cmds := []tea.Cmd{m.notify(statusError, fmt.Sprintf("%s is unreadable: %s", filepath.Base(msg.fileName), msg.err))}
+	if m.sfmpu.RecordLoadedFiles == m.sfmpu.TotalFiles {
+		cmds = append(cmds, FileScanCompleted())
+	}
+	return m, tea.Batch(cmds...)
+}
+
 // findRowByFileName searches for a row with the given file name.
 func findRowByFileName(m model, fileName string) (int, table.Row, error) {
+	if i, ok := m.rowIndex[fileName]; ok && i < len(m.rows) && m.rows[i][1] == fileName {
+		return i, m.rows[i], nil
+	}
 	for i, row := range m.rows {
 		if len(row) > 0 && row[1] == fileName {
 			return i, row, nil
@@ -48,13 +120,21 @@ func findRowByFileName(m model, fileName string) (int, table.Row, error) {
 	return -1, nil, fmt.Errorf("row with file name %s not found", fileName)
 }
 
+// setRows replaces the rows after rows are added or reordered, the file name
+// index and the filtered rows are rebuilt by the next refreshTable.
+func (m *model) setRows(rows []table.Row) {
+	m.rows = rows
+	m.rowIndex = nil
+	m.visibleIndexes = nil
+}
+
 // updateRow updates the row at the specified index.
 func updateRow(m model, index int, updatedRow table.Row) (model, error) {
 	if index < 0 || index >= len(m.rows) {
 		return m, fmt.Errorf("index out of bounds")
 	}
 	m.rows[index] = updatedRow
-	m.filesTable.SetRows(m.rows)
+	m.refreshTable()
 	return m, nil
 }
 
@@ -63,15 +143,15 @@ func updateWithDATFileHeaderMsg(m model, msg DATTagFileHeaderMsg) model {
 	if err != nil {
 		return m
 	}
-	updatedRow := table.Row{row[0], row[1], "Tags Loaded", msg.date, fmt.Sprintf("%d", msg.recordCound), row[5], row[6], row[7], row[8]}
+	updatedRow := table.Row{row[0], row[1], "Tags Loaded", msg.date, fmt.Sprintf("%d", msg.recordCound), row[5], row[6], row[7], row[8], row[9], row[10]}
 	m, err = updateRow(m, index, updatedRow)
 	if err != nil {
 		fmt.Println("Error updating row:", err)
 		return m
 	}
 	// Sort the rows by date after updating
-	m.rows = sortRowsByDate(m.rows)
-	m.filesTable.SetRows(m.rows)
+	m.setRows(sortRowsByDate(m.rows))
+	m.refreshTable()
 
 	// update progress bar popup model
 	m.sfmpu.InitalizedFiles++
@@ -89,26 +169,93 @@ func parseDate(dateStr string) (time.Time, error) {
 // sortRowsByDate sorts the rows by date, pushing any without a date to the bottom.
 func sortRowsByDate(rows []table.Row) []table.Row {
 	sort.SliceStable(rows, func(i, j int) bool {
-		dateI, errI := parseDate(rows[i][3])
-		dateJ, errJ := parseDate(rows[j][3])
-		if errI != nil && errJ != nil {
-			return false // Both dates are invalid; keep their relative order
-		}
-		if errI != nil {
-			return false // i has no valid date, so it should be after j
-		}
-		if errJ != nil {
-			return true // j has no valid date, so i should come before j
-		}
-		return dateI.Before(dateJ)
+		return lessRowDate(rows[i], rows[j])
 	})
 	return rows
 }
 
+// lessRowDate orders rows by date, rows without a valid date sort last.
+func lessRowDate(a, b table.Row) bool {
+	dateA, errA := parseDate(a[3])
+	dateB, errB := parseDate(b[3])
+	if errA != nil && errB != nil {
+		return false // Both dates are invalid; keep their relative order
+	}
+	if errA != nil {
+		return false // a has no valid date, so it should be after b
+	}
+	if errB != nil {
+		return true // b has no valid date, so a should come before b
+	}
+	return dateA.Before(dateB)
+}
+
+// refreshTable shows the rows passing the files view filters in the table.
+// The rows are filtered again only when the row set or the filters changed, or
+// when the filters depend on the state of the rows.
+func (m *model) refreshTable() {
+	if m.rowIndex == nil {
+		m.rowIndex = make(map[string]int, len(m.rows))
+		for i, row := range m.rows {
+			if _, ok := m.rowIndex[row[1]]; !ok {
+				m.rowIndex[row[1]] = i
+			}
+		}
+		m.visibleIndexes = nil
+	}
+	if key := m.filesView.Key(); m.visibleIndexes == nil || key != m.visibleKey || m.filesView.Volatile() {
+		filtered := m.filesView.Apply(m.rows)
+		m.visibleIndexes = make([]int, 0, len(filtered))
+		for _, row := range filtered {
+			m.visibleIndexes = append(m.visibleIndexes, m.rowIndex[row[1]])
+		}
+		m.visibleKey = key
+	}
+
+	visible := make([]table.Row, len(m.visibleIndexes))
+	for i, index := range m.visibleIndexes {
+		visible[i] = m.rows[index]
+	}
+	m.filesTable.SetColumns(m.filesView.Columns(m.filesTable.Columns()))
+	m.filesTable.SetRows(visible)
+	if m.filesTable.Cursor() >= len(visible) {
+		m.filesTable.SetCursor(max(len(visible)-1, 0))
+	}
+	m.UpdateViewDimentions()
+}
+
+// selectedRowIndex returns the index in m.rows of the row under the cursor,
+// or -1 when the table is empty.
+func (m model) selectedRowIndex() int {
+	cursor := m.filesTable.Cursor()
+	if cursor < 0 || cursor >= len(m.visibleIndexes) {
+		return -1
+	}
+	return m.visibleIndexes[cursor]
+}
+
+// visibleRowIndexes returns the indexes in m.rows of the rows shown in the table.
+func (m model) visibleRowIndexes() []int {
+	return append([]int(nil), m.visibleIndexes...)
+}
+
+// historianTagName returns the historian tag a datalog tag is written to. With
+// a tag map only mapped tags are written, otherwise the upper cased datalog
+// name is used.
+func historianTagName(datalogName string, tagMaps map[string]string, useTagMap bool) (string, bool) {
+	if useTagMap {
+		tagName, exists := tagMaps[datalogName]
+		return tagName, exists
+	}
+	return strings.ToUpper(datalogName), true
+}
+
 type DATRecordStructure struct {
 	TagRecords   []*LibDAT.DatTagRecord
 	FloatRecords *[]*LibDAT.DatFloatRecord
 	PointCache   *LibPI.PointLookup
+	Integrity    IntegrityReport
+	Verification VerificationReport
 	recordCount  int
 }
 
@@ -153,7 +300,7 @@ func updateDATFileRecord(m *model, msg LookupTagsOnHistorianMsg) error {
 	updatedRow[5] = fmt.Sprintf("%d", msg.validTags)
 	updatedRow[2] = "Tags Valid"
 	m.rows[index] = updatedRow
-	m.filesTable.SetRows(m.rows)
+	m.refreshTable()
 
 	// update progress bar popup model
 	m.sfmpu.HistorianTagsLoadedFiles++
@@ -169,15 +316,15 @@ func updateWithDATFloatFileHeaderMsg(m model, msg DATFloatFileHeaderMsg) (model,
 	if err != nil {
 		return m, nil
 	}
-	updatedRow := table.Row{row[0], row[1], row[2], row[3], row[4], row[5], fmt.Sprintf("%d", msg.recordCound), row[7], row[8]}
+	updatedRow := table.Row{row[0], row[1], row[2], row[3], row[4], row[5], fmt.Sprintf("%d", msg.recordCound), row[7], row[8], row[9], row[10]}
 	m, err = updateRow(m, index, updatedRow)
 	if err != nil {
 		fmt.Println("Error updating row:", err)
 		return m, nil
 	}
 	// Sort the rows by date after updating
-	m.rows = sortRowsByDate(m.rows)
-	m.filesTable.SetRows(m.rows)
+	m.setRows(sortRowsByDate(m.rows))
+	m.refreshTable()
 
 	record := m.datFileRecords[msg.fileName]
 	record.recordCount = int(msg.recordCound)
@@ -206,11 +353,25 @@ func updateWithDATFloatFileRecordsMsg(m model, msg DATTagFloatRecordMsg) model {
 		return m
 	}
 
+	if msg.err != "" {
+		m.recsLoadedCount--
+		updatedRow := table.Row{row[0], row[1], "Error Loading", row[3], row[4], row[5], row[6], fmt.Sprintf("%.2f sec", msg.duration.Seconds()), row[8], row[9], row[10]}
+		m, _ = updateRow(m, index, updatedRow)
+		return m
+	}
+
 	record := m.datFileRecords[msg.fileName]
 	record.FloatRecords = msg.records
+	if msg.report != nil {
+		for _, issue := range msg.report.Issues[min(len(record.Integrity.Issues), len(msg.report.Issues)):] {
+			slog.Warn(fmt.Sprintf("%s: %s", filepath.Base(msg.fileName), issue))
+		}
+		record.Integrity = *msg.report
+		row[healthColumn] = msg.report.Health
+	}
 	m.datFileRecords[msg.fileName] = record
 
-	updatedRow := table.Row{row[0], row[1], "Recs loaded", row[3], row[4], row[5], row[6], fmt.Sprintf("%.2f sec", msg.duration.Seconds()), row[8]}
+	updatedRow := table.Row{row[0], row[1], "Recs loaded", row[3], row[4], row[5], row[6], fmt.Sprintf("%.2f sec", msg.duration.Seconds()), row[8], row[9], row[10]}
 	m, err = updateRow(m, index, updatedRow)
 	if err != nil {
 		fmt.Println("Error updating row:", err)
@@ -222,11 +383,12 @@ func updateWithDATFloatFileRecordsMsg(m model, msg DATTagFloatRecordMsg) model {
 
 func updateWithUpdateStateToLoadingMsg(m model, msg UpdateStateToLoadingMsg) model {
 	index, row, err := findRowByFileName(m, msg.fileName)
-	if err != nil {
+	// The records may already be loaded when this message arrives.
+	if err != nil || row[2] != "Processing" {
 		return m
 	}
 
-	updatedRow := table.Row{row[0], row[1], "Loading", row[3], row[4], row[5], row[6], row[7], row[8]}
+	updatedRow := table.Row{row[0], row[1], "Loading", row[3], row[4], row[5], row[6], row[7], row[8], row[9], row[10]}
 	m, err = updateRow(m, index, updatedRow)
 	if err != nil {
 		fmt.Println("Error updating row:", err)
@@ -239,7 +401,8 @@ func updateWithUpdateStateToLoadingMsg(m model, msg UpdateStateToLoadingMsg) mod
 // Helper function to process the next file
 func processNextDatFile(m *model, first bool) (tea.Model, tea.Cmd) {
 	if !m.connected {
-		return m, SendStatus("Must be connected to server to process.")
+		return m, tea.Batch(SendStatus(statusWarn, "Must be connected to server to process."),
+			ResetProcessingFlag())
 	}
 
 	if first {
@@ -257,11 +420,11 @@ func processNextDatFile(m *model, first bool) (tea.Model, tea.Cmd) {
 			if m.recsLoadedCount < 3 {
 				name := m.rows[i][1]
 				m.rows[i][2] = "Processing"
-				m.filesTable.SetRows(m.rows)
+				m.refreshTable()
 				m.recsLoadedCount++
 				return m, tea.Batch(
 					LoadDATFloatRecords(m, name, m.datFileRecords[name].recordCount),
-					UpdateStateToLoading(name),
+					UpdateStateToLoading(m, name),
 				)
 			} else {
 				return m, tea.Batch(
@@ -271,14 +434,18 @@ func processNextDatFile(m *model, first bool) (tea.Model, tea.Cmd) {
 		}
 	}
 	if m.processed && !first {
-		return m, SendStatus("Processing all DAT files completed successfully!")
+		// Completion is reported once the inserts have finished.
+		return m, nil
 	}
 
-	return m, tea.Batch(SendStatus("No files in state ready for processing. Files should be Selected and marked \"Tags Valid\""),
+	return m, tea.Batch(SendStatus(statusWarn, "No files in state ready for processing. Files should be Selected and marked \"Tags Valid\""),
 		ResetProcessingFlag())
 }
 
 func processNextHistorianInsert(m *model) tea.Cmd {
+	if m.health.State == healthLost {
+		return RetriggerHistorianInsert()
+	}
 	for i := 0; i < len(m.rows); i++ {
 		if m.rows[i][0] == "[X]" && m.rows[i][2] == "Recs loaded" {
 			name := m.rows[i][1]
@@ -286,12 +453,57 @@ func processNextHistorianInsert(m *model) tea.Cmd {
 			return InsertHistorianRecords(m, name)
 		}
 	}
-	// TODO: Add completion logic here.
+	if m.processingStatus != nil && !m.processingStatus.completed && !processingPending(m) {
+		m.processingStatus.completed = true
+		if failed := processingFailures(m); failed > 0 {
+			return SendStatus(statusError, fmt.Sprintf("Processing completed, %d DAT files failed to load or insert.", failed))
+		}
+		if failed := verificationFailures(m); failed > 0 {
+			return SendStatus(statusError, fmt.Sprintf("Processing completed, %d DAT files did not verify.", failed))
+		}
+		return SendStatus(statusInfo, "Processing all DAT files completed successfully!")
+	}
+	if m.processingStatus != nil && m.processingStatus.completed {
+		return nil
+	}
 	return RetriggerHistorianInsert()
 }
 
+// processingPending reports whether any selected file is still waiting to be
+// loaded or inserted.
+func processingPending(m *model) bool {
+	for _, row := range m.rows {
+		if row[0] != "[X]" {
+			continue
+		}
+		switch row[2] {
+		case "Tags Valid", "Processing", "Loading", "Recs loaded", "Inserting", verifyRunning:
+			return true
+		}
+	}
+	return false
+}
+
+func processingFailures(m *model) int {
+	failed := 0
+	for _, row := range m.rows {
+		if row[0] == "[X]" && (row[2] == "Error Loading" || row[2] == "Error Inserting") {
+			failed++
+		}
+	}
+	return failed
+}
+
 func updateWithHistorianInsertMsg(m model, msg HistorianInsertMsg) model {
 	// update progress bar
+	if msg.connectionLost {
+		// Keep the records, the insert is retried once the connection is back.
+		if index, row, err := findRowByFileName(m, msg.fileName); err == nil {
+			m, _ = updateRow(m, index, table.Row{row[0], row[1], "Recs loaded", row[3], row[4], row[5], row[6], row[7], row[8], row[9], row[10]})
+		}
+		return m
+	}
+
 	m.processingStatus.historianInserted++
 	if m.processingStatus.processingCount > 0 {
 		m.processingStatus.historianInsertedProcessedPBPercent = float64(m.processingStatus.historianInserted) / float64(m.processingStatus.processingCount)
@@ -299,26 +511,38 @@ func updateWithHistorianInsertMsg(m model, msg HistorianInsertMsg) model {
 
 	index, row, err := findRowByFileName(m, msg.fileName)
 	if err != nil {
-		updatedRow := table.Row{row[0], row[1], "Error Inserting", row[3], row[4], row[5], row[6], row[7], fmt.Sprintf("%.2f sec", msg.duration.Seconds())}
-		m, _ = updateRow(m, index, updatedRow)
 		return m
 	}
 
-	delete(m.datFileRecords, msg.fileName)
+	// Release the float records, the tag records are small and kept for the
+	// selection summary and detail view.
+	record := m.datFileRecords[msg.fileName]
+	record.FloatRecords = nil
+	m.datFileRecords[msg.fileName] = record
 	m.recsLoadedCount--
 
-	updatedRow := table.Row{row[0], row[1], "Completed", row[3], row[4], row[5], row[6], row[7], fmt.Sprintf("%.2f sec", msg.duration.Seconds())}
+	if msg.err != "" {
+		updatedRow := table.Row{row[0], row[1], "Error Inserting", row[3], row[4], row[5], row[6], row[7], fmt.Sprintf("%.2f sec", msg.duration.Seconds()), row[9], row[10]}
+		m, _ = updateRow(m, index, updatedRow)
+		return m
+	}
+
+	updatedRow := table.Row{row[0], row[1], "Completed", row[3], row[4], row[5], row[6], row[7], fmt.Sprintf("%.2f sec", msg.duration.Seconds()), row[9], row[10]}
 	m, _ = updateRow(m, index, updatedRow)
 
 	return m
 }
 
+// retriggerDelay is how long loading and inserting wait before they look for
+// ready files again.
+var retriggerDelay = 2 * time.Second
+
 type RetriggerDATLoadingMsg struct {
 }
 
 func RetriggerDATLoading() tea.Cmd {
 	return func() tea.Msg {
-		time.Sleep(2 * time.Second)
+		time.Sleep(retriggerDelay)
 		return RetriggerDATLoadingMsg{}
 	}
 }
@@ -328,21 +552,29 @@ type RetriggerHistorianInsertMsg struct {
 
 func RetriggerHistorianInsert() tea.Cmd {
 	return func() tea.Msg {
-		time.Sleep(2 * time.Second)
+		time.Sleep(retriggerDelay)
 		return RetriggerHistorianInsertMsg{}
 	}
 }
 
 type StatusMsg struct {
+	level   statusLevel
 	message string
 }
 
-func SendStatus(message string) tea.Cmd {
+func SendStatus(level statusLevel, message string) tea.Cmd {
 	return func() tea.Msg {
-		return StatusMsg{message: message}
+		return StatusMsg{level: level, message: message}
 	}
 }
 
+// notify shows a message as a toast and records it in the message history.
+func (m *model) notify(level statusLevel, message string) tea.Cmd {
+	var cmd tea.Cmd
+	m.status, cmd = m.status.Push(level, message)
+	return cmd
+}
+
 type ResetProcessingFlagMsg struct {
 }
 
@@ -357,16 +589,17 @@ func (m *model) UpdateViewDimentions() {
 	if newHeight < 1 {
 		m.filesTable.SetHeight(1)
 	} else {
-		newHeight = newHeight - 2 //Remove top header for server status & bottom key menu
-		if m.useTagMap {
-			newHeight--
-		}
+		newHeight = newHeight - 2 - m.statusBarHeight() //Remove top header for server status, selection summary & bottom key menu
 		if m.processingStatus != nil {
 			newHeight = newHeight - 2
 		}
 		if m.novfpu.Active {
 			newHeight--
 		}
+		if m.filesView.Visible() {
+			newHeight--
+		}
+		newHeight -= m.logPane.Height(m.Height)
 		m.filesTable.SetHeight(newHeight)
 	}
 
@@ -385,6 +618,7 @@ type processingStatus struct {
 	datFilesProcessedPBPercent          float64
 	historianInsertedProcessedPB        progress.Model
 	historianInsertedProcessedPBPercent float64
+	completed                           bool
 }
 
 func (m *model) InitializeProgressBars(totalProcessCount int) {
@@ -406,3 +640,59 @@ func (m *model) InitializeProgressBars(totalProcessCount int) {
 
 	m.UpdateViewDimentions()
 }
+
+// reconnect replaces the sink with the host and process name from the
+// connection dialog and connects it. Files not processed yet are validated
+// again once connected, their tags may not exist on the new server.
+func (m model) reconnect() (tea.Model, tea.Cmd) {
+	old := m.sink
+	if m.connection.Editable {
+		m.hostname = m.connection.Host.Value()
+		m.processName = m.connection.ProcessName.Value()
+		m.sink = &piapiSink{hostname: m.hostname, processName: m.processName}
+	}
+	m.connecting = true
+	m.connected = false
+	m.revalidate = true
+	m.connection.Err = ""
+	return m, Reconnect(old, m.sink, m.hostname)
+}
+
+// rememberServer adds the connected piapi server to the recent servers in
+// the config file.
+func (m *model) rememberServer() tea.Cmd {
+	piapi, ok := m.sink.(*piapiSink)
+	if !ok {
+		return nil
+	}
+	server := RecentServer{Host: piapi.hostname, ProcessName: piapi.processName}
+	if len(m.config.RecentServers) > 0 && m.config.RecentServers[0] == server {
+		return nil
+	}
+	m.config.RecentServers = addRecentServer(m.config.RecentServers, server)
+	m.connection.Recent = m.config.RecentServers
+	if err := saveConfig(m.configPath, m.config); err != nil {
+		return m.notify(statusWarn, fmt.Sprintf("Unable to save recent servers: %v", err))
+	}
+	return nil
+}
+
+// revalidateTags looks the tags of the files not processed yet up again.
+func revalidateTags(m *model) tea.Cmd {
+	var cmds []tea.Cmd
+	for i, row := range m.rows {
+		if row[2] != "Tags Valid" {
+			continue
+		}
+		record, exists := m.datFileRecords[row[1]]
+		if !exists || record.TagRecords == nil {
+			continue
+		}
+		record.PointCache = LibPI.NewPointLookup()
+		m.datFileRecords[row[1]] = record
+		m.rows[i][2] = "Validating"
+		cmds = append(cmds, LookupTagsOnHistorian(*m, row[1]))
+	}
+	m.refreshTable()
+	return tea.Batch(cmds...)
+}
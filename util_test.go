@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	retriggerDelay = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// memorySink keeps count of the records inserted into it.
+type memorySink struct {
+	mu      sync.Mutex
+	records map[string]int
+	err     error
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{records: make(map[string]int)}
+}
+
+func (s *memorySink) Name() string   { return "memory" }
+func (s *memorySink) Target() string { return "memory" }
+func (s *memorySink) Connect() error { return nil }
+func (s *memorySink) Close() error   { return nil }
+
+func (s *memorySink) ResolvePoint(tag *LibDAT.DatTagRecord, historianTag string) *LibPI.PointCache {
+	return externalPoint(tag, historianTag)
+}
+
+func (s *memorySink) Insert(records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		if point, exists := points.GetPointByDataLogID(record.TagID); exists && point.Process {
+			s.records[point.PIName]++
+		}
+	}
+	return nil
+}
+
+func (s *memorySink) total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, count := range s.records {
+		total += count
+	}
+	return total
+}
+
+// genSet writes a synthetic DAT file set with the gen subcommand and returns
+// its folder.
+func genSet(tb testing.TB, args ...string) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	if err := runGen(append([]string{"-out", dir}, args...)); err != nil {
+		tb.Fatalf("gen failed: %v", err)
+	}
+	return dir
+}
+
+func newTestModel(tb testing.TB, dir string, sink Sink) model {
+	tb.Helper()
+	sources := datSources{Paths: []string{dir}, StagingDir: tb.TempDir()}
+	m := initialModel(sources, "localhost", "test", "", false, sink, defaultKeyMap(), Config{}, "", healthConfig{}, watchConfig{}, verifyConfig{})
+	m.Width, m.Height = 200, 50
+	return m
+}
+
+// runModel runs commands and feeds their messages to the model the way
+// tea.Program does, until done reports true.
+func runModel(t *testing.T, m model, cmd tea.Cmd, done func(model) bool) model {
+	t.Helper()
+	msgs := make(chan tea.Msg, 1024)
+	stop := make(chan struct{})
+	defer close(stop)
+	start := func(cmd tea.Cmd) {
+		if cmd == nil {
+			return
+		}
+		go func() {
+			select {
+			case msgs <- cmd():
+			case <-stop:
+			}
+		}()
+	}
+	start(cmd)
+
+	timeout := time.After(30 * time.Second)
+	for !done(m) {
+		select {
+		case msg := <-msgs:
+			switch msg := msg.(type) {
+			case nil:
+			case tea.BatchMsg:
+				for _, cmd := range msg {
+					start(cmd)
+				}
+			default:
+				next, cmd := m.Update(msg)
+				m = asModel(next)
+				start(cmd)
+			}
+		case <-timeout:
+			t.Fatalf("timed out, rows: %v", m.rows)
+		}
+	}
+	return m
+}
+
+// loaded reports whether every file has been read up to its float header.
+func loaded(files int) func(model) bool {
+	return func(m model) bool {
+		if len(m.rows) != files {
+			return false
+		}
+		for _, row := range m.rows {
+			switch row[2] {
+			case "Tags Valid":
+				if row[6] == "" {
+					return false
+				}
+			case "Unreadable", "No Float File":
+			default:
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// asModel returns the model behind Update's result, some updates return a
+// pointer to it.
+func asModel(next tea.Model) model {
+	if m, ok := next.(*model); ok {
+		return *m
+	}
+	return next.(model)
+}
+
+func processed(m model) bool {
+	return m.processingStatus != nil && m.processingStatus.completed
+}
+
+func keyPress(k string) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(k)}
+}
+
+func TestLoadGeneratedSet(t *testing.T) {
+	dir := genSet(t, "-tags", "10", "-rate", "5m", "-duration", "72h")
+	m := newTestModel(t, dir, newMemorySink())
+	m = runModel(t, m, m.Init(), loaded(3))
+
+	for i, row := range m.rows {
+		date := fmt.Sprintf("2024-01-0%d", i+1)
+		if row[3] != date {
+			t.Errorf("row %d has date %s, %s expected", i, row[3], date)
+		}
+		if row[0] != "[X]" || row[2] != "Tags Valid" || row[healthColumn] != healthOK {
+			t.Errorf("row %d is %v, a selected valid file is expected", i, row)
+		}
+		if row[4] != "10" || row[5] != "10" || row[6] != "2880" {
+			t.Errorf("row %d counts %s tags, %s historian tags and %s records, 10, 10 and 2880 expected", i, row[4], row[5], row[6])
+		}
+	}
+	if got := len(m.filesTable.Rows()); got != 3 {
+		t.Errorf("table shows %d rows, 3 expected", got)
+	}
+}
+
+func TestUpdateWithDATFileNameMsg(t *testing.T) {
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "24h")
+	m := newTestModel(t, dir, newMemorySink())
+	fileName := filepath.Join(dir, "2024 01 01 0000 (Float).DAT")
+
+	m, cmd := updateWithDATFileNameMsg(m, DATFileNameMsg{fileName: fileName})
+	if len(m.rows) != 1 || m.rows[0][1] != fileName || m.rows[0][2] != "Pending" {
+		t.Fatalf("rows are %v, a pending row for %s expected", m.rows, fileName)
+	}
+	msg, ok := cmd().(DATIntegrityMsg)
+	if !ok || msg.fileName != fileName || msg.report.Health != healthOK {
+		t.Fatalf("the file check returned %+v, a healthy report expected", msg)
+	}
+}
+
+func TestProcessGeneratedSet(t *testing.T) {
+	dir := genSet(t, "-tags", "10", "-rate", "5m", "-duration", "72h")
+	sink := newMemorySink()
+	m := newTestModel(t, dir, sink)
+	m = runModel(t, m, m.Init(), loaded(3))
+
+	next, cmd := m.Update(keyPress("p"))
+	m = runModel(t, asModel(next), cmd, processed)
+
+	for _, row := range m.rows {
+		if row[2] != "Completed" {
+			t.Errorf("%s is %s, Completed expected", filepath.Base(row[1]), row[2])
+		}
+		if records := m.datFileRecords[row[1]].FloatRecords; records != nil {
+			t.Errorf("the records of %s are kept after the insert", filepath.Base(row[1]))
+		}
+	}
+	if got := sink.total(); got != 3*2880 {
+		t.Errorf("%d records inserted, %d expected", got, 3*2880)
+	}
+	if got := len(sink.records); got != 10 {
+		t.Errorf("records of %d tags inserted, 10 expected", got)
+	}
+	if processingFailures(&m) != 0 || processingPending(&m) {
+		t.Errorf("processing left failed or pending files: %v", m.rows)
+	}
+}
+
+func TestProcessGeneratedSetInsertFailure(t *testing.T) {
+	dir := genSet(t, "-tags", "5", "-rate", "10m", "-duration", "48h")
+	sink := newMemorySink()
+	sink.err = fmt.Errorf("historian unavailable")
+	m := newTestModel(t, dir, sink)
+	m = runModel(t, m, m.Init(), loaded(2))
+
+	next, cmd := m.Update(keyPress("p"))
+	m = runModel(t, asModel(next), cmd, processed)
+	for _, row := range m.rows {
+		if row[2] != "Error Inserting" {
+			t.Errorf("%s is %s, Error Inserting expected", filepath.Base(row[1]), row[2])
+		}
+	}
+	if got := processingFailures(&m); got != 2 {
+		t.Errorf("%d failures counted, 2 expected", got)
+	}
+}
+
+// pingableSink is a memorySink that answers health checks.
+type pingableSink struct {
+	*memorySink
+}
+
+func (s pingableSink) Ping() error { return nil }
+
+func TestProcessGeneratedSetRejectedInserts(t *testing.T) {
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "120h")
+	sink := newMemorySink()
+	sink.err = fmt.Errorf("point rejected")
+	m := newTestModel(t, dir, pingableSink{sink})
+	m = runModel(t, m, m.Init(), loaded(5))
+
+	// The sink answers its check, so rejected inserts do not pause the rest.
+	next, cmd := m.Update(keyPress("p"))
+	m = runModel(t, asModel(next), cmd, processed)
+	for _, row := range m.rows {
+		if row[2] != "Error Inserting" {
+			t.Errorf("%s is %s, Error Inserting expected", filepath.Base(row[1]), row[2])
+		}
+	}
+	if m.health.State != healthConnected {
+		t.Errorf("the connection state is %d after rejected inserts", m.health.State)
+	}
+}
+
+func TestProcessGeneratedSetCorrupted(t *testing.T) {
+	dir := genSet(t, "-tags", "5", "-rate", "10m", "-duration", "72h", "-corrupt", "truncate,notag")
+	sink := newMemorySink()
+	m := newTestModel(t, dir, sink)
+	m = runModel(t, m, m.Init(), loaded(3))
+
+	health := make(map[string]string)
+	for _, row := range m.rows {
+		health[row[3]] = row[healthColumn]
+	}
+	// Corruptions are applied from the last day back.
+	if health["2024-01-03"] != healthSalvaged || health["2024-01-01"] != healthOK {
+		t.Fatalf("health by date is %v", health)
+	}
+	if _, row, err := findRowByFileName(m, filepath.Join(dir, "2024 01 02 0000 (Float).DAT")); err != nil || row[2] != "Unreadable" {
+		t.Fatalf("the float file without a tag file is %v, Unreadable expected", row)
+	}
+
+	next, cmd := m.Update(keyPress("p"))
+	m = runModel(t, asModel(next), cmd, processed)
+	if got := sink.total(); got <= 720 || got >= 2*720 {
+		t.Errorf("%d records inserted, the first day and part of the last expected", got)
+	}
+}
+
+func TestUpdateWithHistorianInsertMsg(t *testing.T) {
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "24h")
+	m := newTestModel(t, dir, newMemorySink())
+	m = runModel(t, m, m.Init(), loaded(1))
+	fileName := m.rows[0][1]
+	records := []*LibDAT.DatFloatRecord{}
+	record := m.datFileRecords[fileName]
+	record.FloatRecords = &records
+	m.datFileRecords[fileName] = record
+	m.InitializeProgressBars(1)
+	m.rows[0][2] = "Inserting"
+	m.recsLoadedCount = 1
+
+	// A lost connection keeps the records for a retry.
+	m = updateWithHistorianInsertMsg(m, HistorianInsertMsg{fileName: fileName, err: "lost", connectionLost: true})
+	if m.rows[0][2] != "Recs loaded" || m.datFileRecords[fileName].FloatRecords == nil {
+		t.Fatalf("after a lost connection the row is %v", m.rows[0])
+	}
+	if cmd := processNextHistorianInsert(&m); cmd == nil || m.rows[0][2] != "Inserting" {
+		t.Fatalf("the file is not inserted again, its row is %v", m.rows[0])
+	}
+
+	m = updateWithHistorianInsertMsg(m, HistorianInsertMsg{fileName: fileName, duration: 1500 * time.Millisecond})
+	if m.rows[0][2] != "Completed" || m.rows[0][8] != "1.50 sec" {
+		t.Errorf("after the insert the row is %v", m.rows[0])
+	}
+	if m.datFileRecords[fileName].FloatRecords != nil || m.recsLoadedCount != 0 {
+		t.Errorf("the records are kept after the insert")
+	}
+	if m.processingStatus.historianInserted != 1 {
+		t.Errorf("%d inserts counted, 1 expected", m.processingStatus.historianInserted)
+	}
+
+	// Nothing is left, the processing completes.
+	msg := processNextHistorianInsert(&m)()
+	if status, ok := msg.(StatusMsg); !ok || status.level != statusInfo || !m.processingStatus.completed {
+		t.Errorf("processing did not complete, the last message is %+v", msg)
+	}
+}
+
+func TestRefreshTable(t *testing.T) {
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "120h")
+	m := newTestModel(t, dir, newMemorySink())
+	m = runModel(t, m, m.Init(), loaded(5))
+	m.rows[1][2] = "Completed"
+	m.rows[3][2] = "Completed"
+
+	m.filesView.State = "Completed"
+	m.refreshTable()
+	visible := m.filesTable.Rows()
+	if len(visible) != 2 || visible[0][3] != "2024-01-02" || visible[1][3] != "2024-01-04" {
+		t.Fatalf("the state filter shows %v", visible)
+	}
+	if indexes := m.visibleRowIndexes(); len(indexes) != 2 || indexes[0] != 1 || indexes[1] != 3 {
+		t.Errorf("visible rows are at %v, 1 and 3 expected", indexes)
+	}
+	m.filesTable.SetCursor(1)
+	if index := m.selectedRowIndex(); index != 3 {
+		t.Errorf("the cursor is on row %d, 3 expected", index)
+	}
+
+	m.filesView = m.filesView.ClearFilters()
+	m.filesView.SortDesc = true
+	m.refreshTable()
+	visible = m.filesTable.Rows()
+	if len(visible) != 5 || visible[0][3] != "2024-01-05" || visible[4][3] != "2024-01-01" {
+		t.Fatalf("the reversed sort shows %v", visible)
+	}
+	m.filesTable.SetCursor(0)
+	if index := m.selectedRowIndex(); index != 4 {
+		t.Errorf("the cursor is on row %d, 4 expected", index)
+	}
+
+	// The cursor stays on the table when rows are filtered out.
+	m.filesTable.SetCursor(4)
+	m.filesView.Search.SetValue("2024 01 01")
+	m.refreshTable()
+	if len(m.filesTable.Rows()) != 1 || m.filesTable.Cursor() != 0 {
+		t.Errorf("the search shows %d rows with the cursor on %d", len(m.filesTable.Rows()), m.filesTable.Cursor())
+	}
+}
+
+func TestRefreshTableRowChanges(t *testing.T) {
+	dir := genSet(t, "-tags", "2", "-rate", "1h", "-duration", "120h")
+	m := newTestModel(t, dir, newMemorySink())
+	m = runModel(t, m, m.Init(), loaded(5))
+	for i, row := range m.rows {
+		if index, _, err := findRowByFileName(m, row[1]); err != nil || index != i {
+			t.Fatalf("%s is found at %d, %d expected", row[1], index, i)
+		}
+	}
+
+	// A row replaced by updateRow is shown without filtering again.
+	updated := append(table.Row(nil), m.rows[2]...)
+	updated[2] = "Completed"
+	m, _ = updateRow(m, 2, updated)
+	if visible := m.filesTable.Rows(); visible[2][2] != "Completed" {
+		t.Errorf("the updated row shows %v", visible[2])
+	}
+
+	// The state filter follows state changes.
+	m.filesView.State = "Completed"
+	m.refreshTable()
+	m.rows[0][2] = "Completed"
+	m.refreshTable()
+	if indexes := m.visibleRowIndexes(); len(indexes) != 2 || indexes[0] != 0 || indexes[1] != 2 {
+		t.Errorf("visible rows are at %v, 0 and 2 expected", indexes)
+	}
+
+	// Rows added out of date order are indexed after the sort.
+	m.filesView = m.filesView.ClearFilters()
+	m = updateWithUnpairedTagFileMsg(m, UnpairedTagFileMsg{fileName: filepath.Join(dir, "2023 12 31 0000 (Tagname).DAT")})
+	if index, _, err := findRowByFileName(m, filepath.Join(dir, "2023 12 31 0000 (Tagname).DAT")); err != nil || index != 0 {
+		t.Errorf("the added row is at %d, 0 expected", index)
+	}
+	if len(m.filesTable.Rows()) != 6 || m.selectedRowIndex() != m.visibleIndexes[m.filesTable.Cursor()] {
+		t.Errorf("the table shows %d rows, 6 expected", len(m.filesTable.Rows()))
+	}
+}
+
+func TestHeaderColumnAt(t *testing.T) {
+	m := newTestModel(t, t.TempDir(), newMemorySink())
+	m.Width = 80
+	if column := m.headerColumnAt(2, 1); column != 0 {
+		t.Errorf("the header is not below the status line, column %d", column)
+	}
+	m.useTagMap = true
+	m.tagMapCSV = "tags.csv"
+	if m.headerColumnAt(2, 1) != -1 || m.headerColumnAt(2, 2) != 0 {
+		t.Error("the header is not below the tag map line")
+	}
+
+	// A tag map line wider than the screen wraps and moves the header down.
+	m.tagMapCSV = strings.Repeat("x", 60) + ".csv"
+	if m.headerColumnAt(2, 2) != -1 || m.headerColumnAt(2, 3) != 0 {
+		t.Errorf("the header is not at line 3, the status bar takes %d lines", m.statusBarHeight())
+	}
+	if column := m.headerColumnAt(m.filesTable.Columns()[0].Width+3, 3); column != 1 {
+		t.Errorf("the second header is column %d", column)
+	}
+}
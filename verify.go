@@ -0,0 +1,293 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/complacentsee/goDatalogConvert/LibDAT"
+	"github.com/complacentsee/goDatalogConvert/LibPI"
+)
+
+// Verifier is implemented by sinks that can read the values they inserted
+// back, files are verified with it after their insert when -verify is set.
+type Verifier interface {
+	// ReadBack returns the values stored for a point from start to end, both
+	// included, in time order.
+	ReadBack(point *LibPI.PointCache, start, end time.Time) ([]storedValue, error)
+}
+
+// storedValue is a value read back from a sink.
+type storedValue struct {
+	Time  time.Time
+	Value float64
+	Good  bool
+}
+
+type verifyConfig struct {
+	enabled   bool
+	tags      int
+	tolerance float64
+}
+
+func registerVerifyFlags() *verifyConfig {
+	cfg := &verifyConfig{}
+	flag.BoolVar(&cfg.enabled, "verify", false, "Read the values of each file back from the sink after its insert and compare them, needs -sink piwebapi or opcua")
+	flag.IntVar(&cfg.tags, "verifyTags", 0, "Tags compared per file, spread over its tags, 0 compares every tag")
+	flag.Float64Var(&cfg.tolerance, "verifyTolerance", 1e-4, "Largest difference between a stored and an inserted value counted as equal, relative to values above 1")
+	return cfg
+}
+
+// Row states of verified files.
+const (
+	verifyRunning  = "Verifying"
+	verifyVerified = "Verified"
+	verifyMismatch = "Mismatch"
+	verifyFailed   = "Verify Failed"
+)
+
+// VerificationReport is the result of reading the values of a file back.
+type VerificationReport struct {
+	Result string
+	Err    string
+	// Tags are the compared tags by datalog tag id.
+	Tags map[int]tagVerification
+	// TagCount is the number of tags of the file that were inserted.
+	TagCount int
+}
+
+// tagVerification compares the inserted and stored values of a tag.
+type tagVerification struct {
+	Name string
+	// Expected values were inserted, Stored values were read back from the
+	// time range of the inserted values, values of other sources included.
+	Expected  int
+	Stored    int
+	Missing   int
+	Different int
+	// First describes the first missing or different value.
+	First string
+}
+
+func (v tagVerification) ok() bool {
+	return v.Missing == 0 && v.Different == 0
+}
+
+func (v tagVerification) summary() string {
+	if v.ok() {
+		return "OK"
+	}
+	return fmt.Sprintf("%d missing, %d differ", v.Missing, v.Different)
+}
+
+// Summary describes the result in a line.
+func (r VerificationReport) Summary() string {
+	if r.Result == verifyFailed {
+		return r.Err
+	}
+	differ := 0
+	for _, tag := range r.Tags {
+		if !tag.ok() {
+			differ++
+		}
+	}
+	return fmt.Sprintf("%d of %d tags compared, %d differ", len(r.Tags), r.TagCount, differ)
+}
+
+// sortedTags returns the compared tags in name order.
+func (r VerificationReport) sortedTags() []tagVerification {
+	tags := make([]tagVerification, 0, len(r.Tags))
+	for _, tag := range r.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags
+}
+
+// withinTolerance compares a stored value, historians often keep 32 bit
+// floats, with the inserted one.
+func withinTolerance(stored, inserted, tolerance float64) bool {
+	if math.IsNaN(stored) || math.IsNaN(inserted) {
+		return math.IsNaN(stored) == math.IsNaN(inserted)
+	}
+	return math.Abs(stored-inserted) <= tolerance*math.Max(math.Abs(inserted), 1)
+}
+
+// verifyRecords reads the values of the inserted records back through the
+// sink and compares them by timestamp. Values of bad status records are only
+// checked to exist.
+func verifyRecords(verifier Verifier, records []*LibDAT.DatFloatRecord, points *LibPI.PointLookup, cfg verifyConfig) VerificationReport {
+	report := VerificationReport{Tags: make(map[int]tagVerification)}
+	if points == nil {
+		report.Result, report.Err = verifyFailed, "the tags of the file are no longer resolved"
+		return report
+	}
+
+	// The records the sink was given, the last one per timestamp.
+	byTag := make(map[int]map[int64]*LibDAT.DatFloatRecord)
+	for _, record := range records {
+		if record == nil || !record.IsValid {
+			continue
+		}
+		if point, exists := points.GetPointByDataLogID(record.TagID); !exists || !point.Process {
+			continue
+		}
+		if byTag[record.TagID] == nil {
+			byTag[record.TagID] = make(map[int64]*LibDAT.DatFloatRecord)
+		}
+		byTag[record.TagID][record.TimeStamp.Round(time.Millisecond).UnixMilli()] = record
+	}
+	ids := make([]int, 0, len(byTag))
+	for id := range byTag {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	report.TagCount = len(ids)
+
+	// A sample is spread evenly over the tags.
+	if cfg.tags > 0 && cfg.tags < len(ids) {
+		sample := make([]int, cfg.tags)
+		for i := range sample {
+			sample[i] = ids[i*len(ids)/cfg.tags]
+		}
+		ids = sample
+	}
+
+	for _, id := range ids {
+		point, _ := points.GetPointByDataLogID(id)
+		expected := byTag[id]
+		times := make([]int64, 0, len(expected))
+		for ms := range expected {
+			times = append(times, ms)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		stored, err := verifier.ReadBack(point, time.UnixMilli(times[0]).UTC(), time.UnixMilli(times[len(times)-1]).UTC())
+		if err != nil {
+			report.Result, report.Err = verifyFailed, fmt.Sprintf("reading %s back failed: %v", point.PIName, err)
+			return report
+		}
+		storedBy := make(map[int64]storedValue, len(stored))
+		for _, value := range stored {
+			storedBy[value.Time.Round(time.Millisecond).UnixMilli()] = value
+		}
+
+		tag := tagVerification{Name: point.PIName, Expected: len(expected), Stored: len(stored)}
+		for _, ms := range times {
+			record := expected[ms]
+			at := record.TimeStamp.Format("2006-01-02 15:04:05.000")
+			value, ok := storedBy[ms]
+			good := recordStatus(record) == ""
+			switch {
+			case !ok:
+				tag.Missing++
+				if tag.First == "" {
+					tag.First = fmt.Sprintf("no value at %s", at)
+				}
+			case value.Good != good:
+				tag.Different++
+				if tag.First == "" {
+					tag.First = fmt.Sprintf("%s stored with good %t, inserted with status %q", at, value.Good, recordStatus(record))
+				}
+			case good && !withinTolerance(value.Value, record.Val, cfg.tolerance):
+				tag.Different++
+				if tag.First == "" {
+					tag.First = fmt.Sprintf("%s stored as %v, inserted as %v", at, value.Value, record.Val)
+				}
+			}
+		}
+		report.Tags[id] = tag
+	}
+
+	report.Result = verifyVerified
+	for _, tag := range report.Tags {
+		if !tag.ok() {
+			report.Result = verifyMismatch
+		}
+	}
+	return report
+}
+
+type VerifyMsg struct {
+	loadGeneration
+	fileName string
+	report   VerificationReport
+}
+
+// VerifyFile reads the records of an inserted file again and compares them
+// with the values read back from the sink.
+func VerifyFile(m *model, fileName string) tea.Cmd {
+	verifier := m.sink.(Verifier)
+	record := m.datFileRecords[fileName]
+	cfg := m.verify
+	dr := m.dr
+	pairing := m.pairing
+	load := m.load()
+	return func() tea.Msg {
+		staged, err := stagedPath(pairing, fileName)
+		if err != nil {
+			return VerifyMsg{loadGeneration: load, fileName: fileName, report: VerificationReport{Result: verifyFailed, Err: err.Error()}}
+		}
+		records, err := readFloatFileRecords(dr, staged, record.Integrity)
+		if err != nil {
+			return VerifyMsg{loadGeneration: load, fileName: fileName, report: VerificationReport{Result: verifyFailed, Err: err.Error()}}
+		}
+		return VerifyMsg{loadGeneration: load, fileName: fileName, report: verifyRecords(verifier, records, record.PointCache, cfg)}
+	}
+}
+
+// startVerification marks a completed file as being verified.
+func startVerification(m *model, fileName string) tea.Cmd {
+	index, row, err := findRowByFileName(*m, fileName)
+	if err != nil || row[2] != "Completed" {
+		return nil
+	}
+	row[2] = verifyRunning
+	*m, _ = updateRow(*m, index, row)
+	return VerifyFile(m, fileName)
+}
+
+func updateWithVerifyMsg(m model, msg VerifyMsg) (model, tea.Cmd) {
+	record := m.datFileRecords[msg.fileName]
+	record.Verification = msg.report
+	m.datFileRecords[msg.fileName] = record
+	m.detail = m.detail.Verified(msg.fileName, msg.report)
+
+	if index, row, err := findRowByFileName(m, msg.fileName); err == nil {
+		row[2] = msg.report.Result
+		m, _ = updateRow(m, index, row)
+	}
+	name := filepath.Base(msg.fileName)
+	switch msg.report.Result {
+	case verifyVerified:
+		slog.Info(fmt.Sprintf("%s verified, %s", name, msg.report.Summary()))
+		if m.watch.Enabled() {
+			m.watch = m.watch.Imported(msg.fileName)
+		}
+		return m, nil
+	case verifyMismatch:
+		for _, tag := range msg.report.sortedTags() {
+			if !tag.ok() {
+				slog.Warn(fmt.Sprintf("%s: %s %s, first %s", name, tag.Name, tag.summary(), tag.First))
+			}
+		}
+	}
+	slog.Warn(fmt.Sprintf("%s did not verify: %s", name, msg.report.Summary()))
+	notifyCmd := m.notify(statusError, fmt.Sprintf("%s did not verify: %s", name, msg.report.Summary()))
+	return m, tea.Batch(notifyCmd, watchFailed(&m, msg.fileName))
+}
+
+func verificationFailures(m *model) int {
+	failed := 0
+	for _, row := range m.rows {
+		if row[0] == "[X]" && (row[2] == verifyMismatch || row[2] == verifyFailed) {
+			failed++
+		}
+	}
+	return failed
+}
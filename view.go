@@ -2,45 +2,126 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/charmbracelet/lipgloss"
+	"github.com/complacentsee/goDataLogConvertTUI/helpers"
 )
 
-func (m model) ViewMainModel() string {
+// statusBar renders the server status line above the files table, followed
+// by the tag map line when a tag map is used.
+func (m model) statusBar() string {
 	var statusColor lipgloss.Color
 	statusMessage := ""
 
 	if m.connecting {
 		statusColor = lipgloss.Color("3")
-		statusMessage = fmt.Sprintf("Connecting to Server: %s, with process name: %s", m.hostname, m.processName)
+		statusMessage = fmt.Sprintf("Connecting to %s", m.sink.Target())
 	} else {
 		if m.connected {
-			statusColor = lipgloss.Color("82")
-			statusMessage = fmt.Sprintf("Connected to Server: %s, with process name: %s", m.hostname, m.processName)
+			switch m.health.State {
+			case healthLost:
+				statusColor = lipgloss.Color("1")
+				statusMessage = fmt.Sprintf("Connection lost to %s, inserts paused: %s", m.sink.Target(), m.health.Err)
+			case healthDegraded:
+				statusColor = lipgloss.Color("3")
+				statusMessage = fmt.Sprintf("Degraded connection to %s", m.sink.Target())
+				if m.health.Err != "" {
+					statusMessage += ": " + m.health.Err
+				}
+			default:
+				statusColor = lipgloss.Color("82")
+				statusMessage = fmt.Sprintf("Connected to %s", m.sink.Target())
+			}
+			if m.health.Checked && m.health.State != healthLost {
+				statusMessage += fmt.Sprintf(" (%s)", formatLatency(m.health.Latency))
+			}
 		} else {
 			statusColor = lipgloss.Color("1")
-			statusMessage = fmt.Sprintf("Unable to connect to server: %s, with process name: %s", m.hostname, m.processName)
+			statusMessage = fmt.Sprintf("Unable to connect to %s", m.sink.Target())
 		}
 	}
 
 	statusStyle := lipgloss.NewStyle().Foreground(statusColor).Render
 
 	// Status bar
-	s := fmt.Sprintf("Server status: %s\n", statusStyle(statusMessage))
+	s := fmt.Sprintf("Server status: %s", statusStyle(statusMessage))
+	if m.watch.Enabled() {
+		s += fmt.Sprintf("  Watching %s", m.sources)
+		if !m.watch.LastScan.IsZero() {
+			s += fmt.Sprintf(", last scan %s", m.watch.LastScan.Format("15:04:05"))
+		}
+	}
+	s += "\n"
 	if m.useTagMap {
 		s += fmt.Sprintf("Using tag map file: %s\n", m.tagMapCSV)
 	}
+	return s
+}
+
+// statusBarHeight returns the number of screen lines of the status bar, long
+// lines wrap at the terminal width.
+func (m model) statusBarHeight() int {
+	return screenLines(m.statusBar(), m.Width)
+}
+
+// screenLines returns the number of lines s takes on a screen width columns
+// wide.
+func screenLines(s string, width int) int {
+	lines := 0
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		if w := lipgloss.Width(line); width > 0 && w > width {
+			lines += (w + width - 1) / width
+		} else {
+			lines++
+		}
+	}
+	return lines
+}
+
+func (m model) ViewMainModel() string {
+	s := m.statusBar()
 
 	// Render the table
 	s += m.filesTable.View()
 	s += "\n"
+	if m.filesView.Visible() {
+		s += m.filesView.View(len(m.filesTable.Rows()), len(m.rows)) + "\n"
+	}
 	if m.processed && m.processingStatus != nil {
 		s += m.ViewProcessingProgressBar()
 	}
-	s += "[q] Quit  [j] Down  [k] Up  [Space/Enter] Toggle Select [a] Select All  [n] Deselect All  [p] Process All"
+	if m.logPane.Active {
+		s += m.logPane.View() + "\n"
+	}
+	s += m.ViewSelection() + "\n"
+	m.help.Width = m.Width
+	s += m.help.ShortHelpView(m.keys.ShortHelp())
 	return s
 }
 
+// ViewHelp draws every key binding in a popup over background.
+func (m model) ViewHelp(background string) string {
+	m.help.ShowAll = true
+	borderStyle := lipgloss.NewStyle().
+		Border(lipgloss.NormalBorder(), true).
+		Padding(1, 2).
+		BorderForeground(lipgloss.Color("205"))
+	content := lipgloss.JoinVertical(
+		lipgloss.Left,
+		lipgloss.NewStyle().Bold(true).Render("Keys"),
+		"",
+		m.help.FullHelpView(m.keys.FullHelp()),
+		"",
+		"Press any key to close.",
+	)
+	foreground := borderStyle.Render(content)
+
+	x := max((m.Width-lipgloss.Width(foreground))/2, 0)
+	y := max((m.Height-lipgloss.Height(foreground))/2, 0)
+	return helpers.PlaceOverlay(x, y, foreground, background, false)
+}
+
 func (m model) ViewProcessingProgressBar() string {
 	if m.processingStatus != nil {
 
@@ -69,3 +150,20 @@ func (m model) ViewProcessingProgressBar() string {
 
 	return ""
 }
+
+// headerColumnAt returns the files table column whose header is at x, y on
+// screen, or -1 when the position is not on the header row.
+func (m model) headerColumnAt(x, y int) int {
+	if y != m.statusBarHeight() {
+		return -1
+	}
+	offset := 0
+	for i, column := range m.filesTable.Columns() {
+		// Every cell is padded by one space on each side.
+		offset += column.Width + 2
+		if x < offset {
+			return i
+		}
+	}
+	return -1
+}
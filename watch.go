@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Delay between a file system event and the scan it triggers, so a burst of
+// writes gives a single scan.
+const watchDebounce = 2 * time.Second
+
+type watchConfig struct {
+	enabled      bool
+	poll         time.Duration
+	settle       time.Duration
+	statePath    string
+	tail         bool
+	tailInterval time.Duration
+	tailBatch    int
+}
+
+func registerWatchFlags() *watchConfig {
+	cfg := &watchConfig{}
+	flag.BoolVar(&cfg.enabled, "watch", false, "Keep watching the paths and import DAT files as soon as they are closed")
+	flag.DurationVar(&cfg.poll, "watchPoll", 30*time.Second, "How often the watched paths are scanned, also when no file system events arrive")
+	flag.DurationVar(&cfg.settle, "watchSettle", 15*time.Minute, "Time a DAT file set must keep its size to be considered closed when no newer file exists")
+	flag.StringVar(&cfg.statePath, "watchState", defaultWatchStatePath(), "File remembering the DAT files imported in watch mode")
+	flag.BoolVar(&cfg.tail, "tail", false, "With -watch, also forward the records appended to DAT files that are still open")
+	flag.DurationVar(&cfg.tailInterval, "tailInterval", 5*time.Second, "How often open DAT files are read for appended records")
+	flag.IntVar(&cfg.tailBatch, "tailBatch", 500, "Maximum records forwarded per insert while tailing")
+	return cfg
+}
+
+func defaultWatchStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "goDataLogConvertTUI", "watch.json")
+}
+
+// importedFile is a DAT file inserted in watch mode.
+type importedFile struct {
+	Size     int64     `json:"size"`
+	Imported time.Time `json:"imported"`
+}
+
+// watchState is the watch state file, it keeps files from being imported
+// again after a restart.
+type watchState struct {
+	Imported map[string]importedFile `json:"imported"`
+	// Tailing is the byte offset of the next record of each tailed file.
+	Tailing map[string]int64 `json:"tailing,omitempty"`
+}
+
+func loadWatchState(path string) (watchState, error) {
+	state := watchState{Imported: make(map[string]importedFile), Tailing: make(map[string]int64)}
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if state.Imported == nil {
+		state.Imported = make(map[string]importedFile)
+	}
+	if state.Tailing == nil {
+		state.Tailing = make(map[string]int64)
+	}
+	return state, nil
+}
+
+func saveWatchState(path string, state watchState) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// fileStamp is the size of a float file and its tag file at a scan, since is
+// when that size was first seen.
+type fileStamp struct {
+	size  int64
+	since time.Time
+}
+
+// WatchModel scans the sources for DAT file sets that were closed since the
+// last scan.
+type WatchModel struct {
+	cfg      watchConfig
+	Sources  datSources
+	State    watchState
+	watcher  *fsnotify.Watcher
+	stamps   map[string]fileStamp
+	queued   map[string]bool
+	failures map[string]int
+	tails    map[string]*tailFile
+	scanning bool
+	// pending is set while a scan triggered by an event is scheduled.
+	pending    bool
+	LastScan   time.Time
+	Err        string
+	generation int
+}
+
+type watchEventMsg struct {
+	generation int
+	err        string
+}
+
+type watchTickMsg struct {
+	generation int
+}
+
+type watchScanMsg struct {
+	generation int
+	files      []string
+	sizes      map[string]int64
+	pairing    *datPairing
+	err        string
+}
+
+func initialWatchModel(cfg watchConfig) WatchModel {
+	return WatchModel{cfg: cfg, stamps: make(map[string]fileStamp), queued: make(map[string]bool), failures: make(map[string]int), tails: make(map[string]*tailFile)}
+}
+
+func (m WatchModel) Enabled() bool {
+	return m.cfg.enabled
+}
+
+// Start watches sources, ending the watch of any previous sources. Run
+// starts the scans.
+func (m WatchModel) Start(sources datSources) WatchModel {
+	m.Stop()
+	m.generation++
+	m.Sources = sources
+	m.stamps = make(map[string]fileStamp)
+	m.queued = make(map[string]bool)
+	m.failures = make(map[string]int)
+	m.tails = make(map[string]*tailFile)
+	m.scanning = true
+	m.pending = false
+	m.Err = ""
+
+	state, err := loadWatchState(m.cfg.statePath)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Failed to load watch state: %v", err))
+	}
+	m.State = state
+
+	m.watcher = nil
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("File system events are not available, scanning every %s: %v", m.cfg.poll, err))
+		return m
+	}
+	m.watcher = watcher
+	return m
+}
+
+// Run starts the first scan and waits for file system events.
+func (m WatchModel) Run() tea.Cmd {
+	cmds := []tea.Cmd{m.scan()}
+	if m.watcher != nil {
+		cmds = append(cmds, m.waitForEvent())
+	}
+	if m.cfg.tail {
+		cmds = append(cmds, m.tailTick())
+	}
+	return tea.Batch(cmds...)
+}
+
+// Stop closes the file system watcher.
+func (m WatchModel) Stop() {
+	if m.watcher != nil {
+		m.watcher.Close()
+	}
+}
+
+func (m WatchModel) waitForEvent() tea.Cmd {
+	watcher := m.watcher
+	generation := m.generation
+	return func() tea.Msg {
+		select {
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			return watchEventMsg{generation: generation}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return watchEventMsg{generation: generation, err: err.Error()}
+		}
+	}
+}
+
+func (m WatchModel) tick(delay time.Duration) tea.Cmd {
+	generation := m.generation
+	return tea.Tick(delay, func(time.Time) tea.Msg {
+		return watchTickMsg{generation: generation}
+	})
+}
+
+// scan discovers the DAT files in the background, adding the folders found
+// to the file system watcher.
+func (m WatchModel) scan() tea.Cmd {
+	sources := m.Sources
+	watcher := m.watcher
+	generation := m.generation
+	return func() tea.Msg {
+		msg := watchScanMsg{generation: generation, sizes: make(map[string]int64)}
+		if watcher != nil {
+			watchFolders(watcher, sources)
+		}
+		dr, pairing, err := sources.Discover()
+		if err != nil {
+			// An empty folder is fine, files may still arrive.
+			if err.Error() != "no input files" {
+				msg.err = err.Error()
+			}
+			return msg
+		}
+		msg.files = dr.GetFloatFiles()
+		msg.pairing = pairing
+		for _, fileName := range msg.files {
+			msg.sizes[fileName] = datSetSize(fileName)
+		}
+		return msg
+	}
+}
+
+// watchFolders adds the roots, and the folders below them when scanning
+// recursively, to watcher.
+func watchFolders(watcher *fsnotify.Watcher, sources datSources) {
+	for _, root := range sources.roots() {
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if !sources.Recursive {
+			watcher.Add(root)
+			continue
+		}
+		filepath.WalkDir(root, func(dir string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+			if err := watcher.Add(dir); err != nil {
+				slog.Debug(fmt.Sprintf("Unable to watch %s: %v", dir, err))
+			}
+			return nil
+		})
+	}
+}
+
+// datSetSize returns the size of a float file and its tag file, or -1 for
+// files inside archives which do not change.
+func datSetSize(fileName string) int64 {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return -1
+	}
+	size := info.Size()
+	if tag, err := os.Stat(strings.Replace(fileName, " (Float)", " (Tagname)", 1)); err == nil {
+		size += tag.Size()
+	}
+	return size
+}
+
+// Scanned records the result of a scan and returns the float files closed
+// since the previous one. A file set is closed once a newer float file is in
+// the same folder, or its size has not changed for the settle time. With
+// -tail it also returns the files to start tailing, open files and files
+// tailed before a restart, with whether they are closed.
+func (m WatchModel) Scanned(msg watchScanMsg, now time.Time) (WatchModel, []string, map[string]bool) {
+	m.scanning = false
+	m.LastScan = now
+	m.Err = msg.err
+
+	newest := make(map[string]string)
+	for _, fileName := range msg.files {
+		dir := filepath.Dir(fileName)
+		if filepath.Base(fileName) > newest[dir] {
+			newest[dir] = filepath.Base(fileName)
+		}
+	}
+
+	var closed []string
+	tail := make(map[string]bool)
+	for _, fileName := range msg.files {
+		size := msg.sizes[fileName]
+		stamp, seen := m.stamps[fileName]
+		if !seen || stamp.size != size {
+			stamp = fileStamp{size: size, since: now}
+			m.stamps[fileName] = stamp
+		}
+		isClosed := size < 0 || filepath.Base(fileName) < newest[filepath.Dir(fileName)] || now.Sub(stamp.since) >= m.cfg.settle
+		if t, ok := m.tails[fileName]; ok {
+			t.closed = isClosed
+			continue
+		}
+		if m.queued[fileName] {
+			continue
+		}
+		if imported, ok := m.State.Imported[fileName]; ok && imported.Size == size {
+			continue
+		}
+		_, tailed := m.State.Tailing[fileName]
+		switch {
+		case m.cfg.tail && (tailed || !isClosed):
+			m.queued[fileName] = true
+			tail[fileName] = isClosed
+		case isClosed:
+			m.queued[fileName] = true
+			closed = append(closed, fileName)
+		}
+	}
+	return m, closed, tail
+}
+
+// Tailed saves the offset a tailed file was forwarded up to.
+func (m WatchModel) Tailed(fileName string, offset int64) WatchModel {
+	if m.State.Tailing[fileName] == offset {
+		return m
+	}
+	m.State.Tailing[fileName] = offset
+	if err := saveWatchState(m.cfg.statePath, m.State); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to save watch state: %v", err))
+	}
+	return m
+}
+
+// Imported remembers that fileName was inserted and saves the state file.
+func (m WatchModel) Imported(fileName string) WatchModel {
+	size := datSetSize(fileName)
+	if stamp, ok := m.stamps[fileName]; ok {
+		size = stamp.size
+	}
+	m.State.Imported[fileName] = importedFile{Size: size, Imported: time.Now()}
+	delete(m.State.Tailing, fileName)
+	if err := saveWatchState(m.cfg.statePath, m.State); err != nil {
+		slog.Warn(fmt.Sprintf("Failed to save watch state: %v", err))
+	}
+	return m
+}
+
+// watchRetries is how often a watched file that failed to load or insert is
+// imported again before it is left failed.
+const watchRetries = 3
+
+// Failed un-queues a file that failed to load, insert or verify, the next scan
+// imports it again. It reports true when the file failed watchRetries times
+// more and is left failed for the rest of the session.
+func (m WatchModel) Failed(fileName string) (WatchModel, bool) {
+	m.failures[fileName]++
+	if m.failures[fileName] > watchRetries {
+		return m, m.failures[fileName] == watchRetries+1
+	}
+	delete(m.queued, fileName)
+	return m, false
+}
+
+// watchFailed un-queues a watched file that failed so it is retried, and
+// reports when it is given up on.
+func watchFailed(m *model, fileName string) tea.Cmd {
+	if !m.watch.Enabled() {
+		return nil
+	}
+	var gaveUp bool
+	m.watch, gaveUp = m.watch.Failed(fileName)
+	if !gaveUp {
+		return nil
+	}
+	slog.Error(fmt.Sprintf("%s failed %d times, it is not imported again until a restart", fileName, watchRetries+1))
+	return m.notify(statusError, fmt.Sprintf("%s failed %d times, it is not imported again", filepath.Base(fileName), watchRetries+1))
+}
+
+// watchRetryable reports whether a row is left failed, a watch scan imports
+// its file again.
+func watchRetryable(row table.Row) bool {
+	switch row[2] {
+	case "Unreadable", "Error Loading", "Error Inserting", verifyMismatch, verifyFailed:
+		return true
+	}
+	return false
+}
+
+func updateWithWatchEventMsg(m model, msg watchEventMsg) (model, tea.Cmd) {
+	if msg.generation != m.watch.generation {
+		return m, nil
+	}
+	if msg.err != "" {
+		slog.Warn(fmt.Sprintf("File system watch error: %s", msg.err))
+	}
+	cmds := []tea.Cmd{m.watch.waitForEvent()}
+	if !m.watch.pending {
+		m.watch.pending = true
+		cmds = append(cmds, m.watch.tick(watchDebounce))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+func updateWithWatchTickMsg(m model, msg watchTickMsg) (model, tea.Cmd) {
+	if msg.generation != m.watch.generation || m.watch.scanning {
+		return m, nil
+	}
+	m.watch.scanning = true
+	m.watch.pending = false
+	return m, m.watch.scan()
+}
+
+// updateWithWatchScanMsg adds the closed files to the table, they are
+// processed once their tags are validated.
+func updateWithWatchScanMsg(m model, msg watchScanMsg) (model, tea.Cmd) {
+	if msg.generation != m.watch.generation {
+		return m, nil
+	}
+	// The files found are loaded with the pairing of the scan that found
+	// them.
+	if msg.pairing != nil {
+		m.pairing = msg.pairing
+	}
+	first := m.watch.LastScan.IsZero()
+	var closed []string
+	var tail map[string]bool
+	m.watch, closed, tail = m.watch.Scanned(msg, time.Now())
+	cmds := []tea.Cmd{m.watch.tick(m.watch.cfg.poll)}
+	for fileName, isClosed := range tail {
+		cmds = append(cmds, startTail(&m, fileName, isClosed))
+	}
+	if first {
+		skipped := 0
+		for _, fileName := range msg.files {
+			if imported, ok := m.watch.State.Imported[fileName]; ok && imported.Size == msg.sizes[fileName] {
+				skipped++
+			}
+		}
+		if skipped > 0 {
+			cmds = append(cmds, m.notify(statusInfo, fmt.Sprintf("Skipping %d DAT files imported before", skipped)))
+		}
+	}
+	if msg.err != "" {
+		slog.Warn(fmt.Sprintf("Watch scan failed: %s", msg.err))
+	}
+	if len(closed) == 0 {
+		return m, tea.Batch(cmds...)
+	}
+
+	imported, retried := 0, 0
+	load := m.load()
+	for _, fileName := range closed {
+		index := slices.Index(m.dr.FloatFileNames, fileName)
+		if _, row, err := findRowByFileName(m, fileName); err == nil {
+			// A file still being processed by hand stays queued.
+			if !watchRetryable(row) {
+				continue
+			}
+			retried++
+		}
+		if index < 0 {
+			m.dr.FloatFileNames = append(m.dr.FloatFileNames, fileName)
+			index = len(m.dr.FloatFileNames) - 1
+		}
+		imported++
+		m.sfmpu.TotalFiles++
+		cmds = append(cmds, func(index int, fileName string) tea.Cmd {
+			return func() tea.Msg {
+				return DATFileNameMsg{loadGeneration: load, index: index, fileName: fileName}
+			}
+		}(index, fileName))
+	}
+	switch {
+	case retried > 0:
+		cmds = append(cmds, m.notify(statusInfo, fmt.Sprintf("Importing %d closed DAT files, %d of them again after they failed", imported, retried)))
+	case imported > 0:
+		cmds = append(cmds, m.notify(statusInfo, fmt.Sprintf("Importing %d closed DAT files", imported)))
+	}
+	return m, tea.Batch(cmds...)
+}
+
+// processWatchedFiles starts processing the files validated in watch mode,
+// or adds them to the processing already running.
+func processWatchedFiles(m *model) tea.Cmd {
+	if !m.watch.Enabled() || !m.connected {
+		return nil
+	}
+	ready := 0
+	for _, row := range m.rows {
+		if row[0] == "[X]" && row[2] == "Tags Valid" && m.datFileRecords[row[1]].recordCount > 0 {
+			ready++
+		}
+	}
+	if ready == 0 {
+		return nil
+	}
+	var cmd tea.Cmd
+	if !m.processed || m.processingStatus == nil || m.processingStatus.completed {
+		m.processed = true
+		// The first loaded file starts the inserts again.
+		m.firstDatReturned = false
+		_, cmd = processNextDatFile(m, true)
+		return cmd
+	}
+	loading := 0
+	for _, row := range m.rows {
+		if row[0] == "[X]" && (row[2] == "Processing" || row[2] == "Loading") {
+			loading++
+		}
+	}
+	m.processingStatus.processingCount = m.processingStatus.datFilesProcessed + loading + ready
+	_, cmd = processNextDatFile(m, false)
+	return cmd
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+)
+
+func TestWatchRetriesFailedFiles(t *testing.T) {
+	m := initialWatchModel(watchConfig{enabled: true, settle: time.Minute})
+	m.State = watchState{Imported: make(map[string]importedFile), Tailing: make(map[string]int64)}
+	files := []string{"2024 01 01 0000 (Float).DAT", "2024 01 02 0000 (Float).DAT"}
+	scan := watchScanMsg{files: files, sizes: map[string]int64{files[0]: 100, files[1]: 100}}
+	now := time.Now()
+
+	m, closed, _ := m.Scanned(scan, now)
+	if len(closed) != 1 || closed[0] != files[0] {
+		t.Fatalf("closed files are %v, only the older one expected", closed)
+	}
+	if m, closed, _ = m.Scanned(scan, now); len(closed) != 0 {
+		t.Fatalf("queued files are returned again: %v", closed)
+	}
+
+	// A failed file is returned by the next scan until it failed too often.
+	for i := 0; i < watchRetries; i++ {
+		var gaveUp bool
+		if m, gaveUp = m.Failed(files[0]); gaveUp {
+			t.Fatalf("gave up after %d failures", i+1)
+		}
+		if m, closed, _ = m.Scanned(scan, now); len(closed) != 1 || closed[0] != files[0] {
+			t.Fatalf("after %d failures the scan returns %v", i+1, closed)
+		}
+	}
+	m, gaveUp := m.Failed(files[0])
+	if !gaveUp {
+		t.Error("did not give up after the last retry")
+	}
+	if m, closed, _ = m.Scanned(scan, now); len(closed) != 0 {
+		t.Errorf("a file given up on is returned: %v", closed)
+	}
+	if _, gaveUp = m.Failed(files[0]); gaveUp {
+		t.Error("gave up on the file twice")
+	}
+}
+
+func TestWatchImportsVerifiedFiles(t *testing.T) {
+	m := newTestModel(t, t.TempDir(), newMemorySink())
+	m.verify.enabled = true
+	m.watch = initialWatchModel(watchConfig{enabled: true, statePath: filepath.Join(t.TempDir(), "watch.json")})
+	m.watch.State = watchState{Imported: make(map[string]importedFile), Tailing: make(map[string]int64)}
+	fileName := "2024 01 01 0000 (Float).DAT"
+	m.watch.queued[fileName] = true
+	m.setRows([]table.Row{{"[X]", fileName, verifyRunning, "2024-01-01", "", "", "", "", "", "", ""}})
+	m.refreshTable()
+
+	m, _ = updateWithVerifyMsg(m, VerifyMsg{fileName: fileName, report: VerificationReport{Result: verifyMismatch}})
+	if _, ok := m.watch.State.Imported[fileName]; ok || m.watch.queued[fileName] {
+		t.Fatal("a mismatched file is recorded as imported or stays queued")
+	}
+
+	m.watch.queued[fileName] = true
+	m, _ = updateWithVerifyMsg(m, VerifyMsg{fileName: fileName, report: VerificationReport{Result: verifyVerified}})
+	if _, ok := m.watch.State.Imported[fileName]; !ok {
+		t.Error("a verified file is not recorded as imported")
+	}
+}
+
+func TestTailIgnoresDeletedTagRecords(t *testing.T) {
+	dir := genSet(t, "-tags", "3", "-rate", "1h", "-duration", "24h")
+	floats, err := filepath.Glob(filepath.Join(dir, "*(Float).DAT"))
+	if err != nil || len(floats) != 1 {
+		t.Fatalf("float files are %v: %v", floats, err)
+	}
+	fileName := floats[0]
+
+	// A renamed tag leaves its old record deleted under the same id, the
+	// second record becomes the deleted one of the third.
+	tagFile, err := os.OpenFile(strings.Replace(fileName, " (Float)", " (Tagname)", 1), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLength, recordLength := readDatLayout(tagFile, tagHeaderLength, tagRecordLength)
+	id := make([]byte, 5)
+	if _, err := tagFile.ReadAt(id, headerLength+2*recordLength+256); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tagFile.WriteAt([]byte("*"), headerLength+recordLength); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tagFile.WriteAt(id, headerLength+recordLength+256); err != nil {
+		t.Fatal(err)
+	}
+	tagFile.Close()
+
+	m := newTestModel(t, dir, newMemorySink())
+	m.watch = initialWatchModel(watchConfig{enabled: true})
+	m.watch.State = watchState{Imported: make(map[string]importedFile), Tailing: make(map[string]int64)}
+	msg := startTail(&m, fileName, false)()
+	m, _ = updateWithTailReadyMsg(m, msg.(tailReadyMsg))
+	tail := m.watch.tails[fileName]
+	if !tail.ready || len(tail.tags) != 2 {
+		t.Fatalf("the tail resolved %d tags, 2 expected", len(tail.tags))
+	}
+	if unknownTags(tail) {
+		t.Error("a deleted tag record is taken for an unknown tag")
+	}
+}
@@ -3,36 +3,23 @@ package main
 import (
 	"fmt"
 	"log/slog"
-	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/complacentsee/goDatalogConvert/LibDAT"
-	"github.com/complacentsee/goDatalogConvert/LibFTH"
 	"github.com/complacentsee/goDatalogConvert/LibPI"
 	"github.com/complacentsee/goDatalogConvert/LibUtil"
 )
 
-type PiServerProcessNameMsg struct {
-	processName string
-}
-
-func SetProcessName(processName string) tea.Cmd {
-	return func() tea.Msg {
-		LibFTH.SetProcessName(processName)
-		return PiServerProcessNameMsg{processName: processName}
-	}
-}
-
 type PiServerConnectMsg struct {
 	connected bool
 	hostname  string
 	err       string
 }
 
-func PiConnectToServer(hostname string) tea.Cmd {
+func PiConnectToServer(sink Sink, hostname string) tea.Cmd {
 	return func() tea.Msg {
-		err := LibFTH.Connect(hostname)
+		err := sink.Connect()
 		if err != nil {
 			slog.Error(err.Error())
 			return PiServerConnectMsg{connected: false, hostname: hostname, err: err.Error()}
@@ -42,13 +29,36 @@ func PiConnectToServer(hostname string) tea.Cmd {
 	}
 }
 
+// loadGeneration tags the messages of loading a file with the directory
+// generation the load was started for. Messages of a directory that was
+// replaced since are dropped.
+type loadGeneration struct {
+	generation int
+}
+
+func (g loadGeneration) directoryGeneration() int {
+	return g.generation
+}
+
+// loadMsg is a message of loading a file.
+type loadMsg interface {
+	directoryGeneration() int
+}
+
+// load returns the tag of the loads started for the current directory.
+func (m model) load() loadGeneration {
+	return loadGeneration{m.generation}
+}
+
 type DATFileNameMsg struct {
+	loadGeneration
 	index    int
 	fileName string
 }
 
 func loadDirectory(m model) tea.Cmd {
 	var cmds []tea.Cmd
+	load := m.load()
 
 	// Iterate through the files and create a command for each
 	filecount := 0
@@ -56,12 +66,21 @@ func loadDirectory(m model) tea.Cmd {
 		// Append the command to the list
 		cmds = append(cmds, func(index int, fileName string) tea.Cmd {
 			return func() tea.Msg {
-				return DATFileNameMsg{index: index, fileName: fileName}
+				return DATFileNameMsg{loadGeneration: load, index: index, fileName: fileName}
 			}
 		}(i, floatfileName))
 		filecount++
 	}
 
+	// Tag files without a float file are listed but never loaded.
+	for _, tagFileName := range m.pairing.Unpaired() {
+		cmds = append(cmds, func(fileName string) tea.Cmd {
+			return func() tea.Msg {
+				return UnpairedTagFileMsg{loadGeneration: load, fileName: fileName}
+			}
+		}(tagFileName))
+	}
+
 	// Initialize the popup.
 	cmds = append(cmds, FileInititalCount(filecount))
 
@@ -69,37 +88,99 @@ func loadDirectory(m model) tea.Cmd {
 	return tea.Batch(cmds...)
 }
 
+// UnpairedTagFileMsg is a tag file found without its float file.
+type UnpairedTagFileMsg struct {
+	loadGeneration
+	fileName string
+}
+
+// Stages of loading a DAT file, a DATFileErrorMsg gives the stage that
+// failed.
+const (
+	stageTagHeader = iota
+	stageTagRecords
+	stageLookup
+	stageFloatHeader
+)
+
+// DATFileErrorMsg reports a DAT file that could not be loaded, rather than
+// leaving its row waiting for a message that never comes.
+type DATFileErrorMsg struct {
+	loadGeneration
+	fileName string
+	stage    int
+	err      string
+}
+
+type DATIntegrityMsg struct {
+	loadGeneration
+	fileName string
+	report   IntegrityReport
+}
+
+// CheckDATFile checks a DAT file before it is loaded.
+func CheckDATFile(m model, file string) tea.Cmd {
+	load := m.load()
+	return func() tea.Msg {
+		return DATIntegrityMsg{loadGeneration: load, fileName: file, report: checkDatFile(m.pairing, file)}
+	}
+}
+
 type DATTagFileHeaderMsg struct {
+	loadGeneration
 	fileName    string
 	recordCound int32
 	date        string
 }
 
 func LoadDATTagFile(m model, file string) tea.Cmd {
-	var cmds []tea.Cmd
-	cmds = append(cmds, func() tea.Msg {
-		records, date, err := m.dr.ReadTagFileHeader(file)
+	load := m.load()
+	report := m.datFileRecords[file].Integrity
+	return func() tea.Msg {
+		// The header of a salvaged file is not trusted, the check counted
+		// the readable tags.
+		if report.Salvage {
+			return DATTagFileHeaderMsg{loadGeneration: load, fileName: file, recordCound: int32(report.TagCount), date: report.Date}
+		}
+		staged, err := stagedPath(m.pairing, file)
 		if err != nil {
-			return nil
+			return DATFileErrorMsg{loadGeneration: load, fileName: file, stage: stageTagHeader, err: err.Error()}
 		}
-		return DATTagFileHeaderMsg{fileName: file, recordCound: *records, date: *date}
-	})
-
-	return tea.Batch(cmds...)
+		records, date, err := m.dr.ReadTagFileHeader(staged)
+		if err != nil {
+			return DATFileErrorMsg{loadGeneration: load, fileName: file, stage: stageTagHeader, err: err.Error()}
+		}
+		if report.Fallback != "" {
+			*date = report.Date
+		}
+		return DATTagFileHeaderMsg{loadGeneration: load, fileName: file, recordCound: *records, date: *date}
+	}
 }
 
 type DATTagRecordMsg struct {
+	loadGeneration
 	fileName string
 	records  []*LibDAT.DatTagRecord
 }
 
 func LoadDATTagRecords(m model, file string, count int) tea.Cmd {
+	load := m.load()
+	report := m.datFileRecords[file].Integrity
 	return func() tea.Msg {
-		records, err := m.dr.ReadTagRecordsFile(file, count)
+		staged, err := stagedPath(m.pairing, file)
 		if err != nil {
-			return nil
+			return DATFileErrorMsg{loadGeneration: load, fileName: file, stage: stageTagRecords, err: err.Error()}
 		}
-		return DATTagRecordMsg{fileName: file, records: records}
+		var records []*LibDAT.DatTagRecord
+		if report.Salvage {
+			records, _, err = salvageTagRecords(staged)
+		} else {
+			records, err = m.dr.ReadTagRecordsFile(staged, count)
+		}
+		if err != nil {
+			return DATFileErrorMsg{loadGeneration: load, fileName: file, stage: stageTagRecords, err: err.Error()}
+		}
+		return DATTagRecordMsg{loadGeneration: load, fileName: file, records: records}
 	}
 }
 
@@ -116,7 +197,6 @@ func LoadCSVMapping(m model) tea.Cmd {
 
 		err := LibUtil.LoadTagMapCSV(m.tagMapCSV, m.tagMaps)
 		if err != nil {
-			slog.Error(fmt.Sprintf("Failed to load tag map CSV: %v", err))
 			return CSVMapping{mapping: m.tagMaps, err: fmt.Sprintf("Failed to load tag map CSV: %v", err)}
 		}
 		if len(m.tagMaps) < 1 {
@@ -127,103 +207,146 @@ func LoadCSVMapping(m model) tea.Cmd {
 }
 
 type LookupTagsOnHistorianMsg struct {
+	loadGeneration
 	fileName   string
 	pointCache *LibPI.PointLookup
 	validTags  int
 }
 
 func LookupTagsOnHistorian(m model, filename string) tea.Cmd {
+	load := m.load()
 	return func() tea.Msg {
 		if tagRecords, exists := m.datFileRecords[filename]; exists {
 			count := 0
 			for _, tag := range tagRecords.TagRecords {
-				tagName := strings.ToUpper(tag.Name)
-				if m.useTagMap {
-					var exists bool
-					tagName, exists = m.tagMaps[tag.Name]
-					if !exists {
-						continue
-					}
+				tagName, exists := historianTagName(tag.Name, m.tagMaps, m.useTagMap)
+				if !exists {
+					continue
 				}
 
 				LibDAT.PrintTagRecord(tag)
-				_, exists := tagRecords.PointCache.GetPointByDataLogName(tag.Name)
-				if exists {
+				if _, exists := tagRecords.PointCache.GetPointByDataLogName(tag.Name); exists {
 					continue
 				}
-				pointC := LibFTH.AddToPIPointCache(tag.Name, tag.ID, 0, tagName)
+				pointC := m.sink.ResolvePoint(tag, tagName)
 				if !pointC.Process {
 					continue
 				}
 				count++
 				tagRecords.PointCache.AddPoint(pointC)
 			}
-			return LookupTagsOnHistorianMsg{fileName: filename, validTags: count, pointCache: tagRecords.PointCache}
+			return LookupTagsOnHistorianMsg{loadGeneration: load, fileName: filename, validTags: count, pointCache: tagRecords.PointCache}
 		}
-		return nil
+		return DATFileErrorMsg{loadGeneration: load, fileName: filename, stage: stageLookup, err: "tag records not loaded"}
 	}
 }
 
 type DATFloatFileHeaderMsg struct {
+	loadGeneration
 	fileName    string
 	recordCound int32
 }
 
 func LoadDATFloatFile(m model, file string) tea.Cmd {
+	load := m.load()
+	report := m.datFileRecords[file].Integrity
 	return func() tea.Msg {
-		records, err := m.dr.ReadFloatFileHeader(file)
+		if report.Salvage {
+			return DATFloatFileHeaderMsg{loadGeneration: load, fileName: file, recordCound: int32(report.FloatCount)}
+		}
+		staged, err := stagedPath(m.pairing, file)
 		if err != nil {
-			return nil
+			return DATFileErrorMsg{loadGeneration: load, fileName: file, stage: stageFloatHeader, err: err.Error()}
+		}
+		records, err := m.dr.ReadFloatFileHeader(staged)
+		if err != nil {
+			return DATFileErrorMsg{loadGeneration: load, fileName: file, stage: stageFloatHeader, err: err.Error()}
 		}
-		return DATFloatFileHeaderMsg{fileName: file, recordCound: *records}
+		return DATFloatFileHeaderMsg{loadGeneration: load, fileName: file, recordCound: *records}
 	}
 }
 
 type DATTagFloatRecordMsg struct {
+	loadGeneration
 	fileName string
 	err      string
 	duration time.Duration
 	records  *[]*LibDAT.DatFloatRecord
+	// report is the integrity check with the records checked, set when the
+	// check left them to the load.
+	report *IntegrityReport
 }
 
 func LoadDATFloatRecords(m *model, fileName string, recordCount int) tea.Cmd {
+	load := m.load()
+	pairing := m.pairing
+	report := m.datFileRecords[fileName].Integrity
+	tags := m.datFileRecords[fileName].TagRecords
 	return func() tea.Msg {
 		start := time.Now()
-		records, err := m.dr.ReadFloatFileRecords(fileName, int32(recordCount))
+		staged, err := stagedPath(pairing, fileName)
+		if err != nil {
+			return DATTagFloatRecordMsg{loadGeneration: load, fileName: fileName, err: err.Error()}
+		}
+		var records []*LibDAT.DatFloatRecord
+		if report.Salvage {
+			records, err = salvageFloatRecords(staged)
+		} else {
+			records, err = m.dr.ReadFloatFileRecords(staged, int32(recordCount))
+		}
 		if err != nil {
-			return DATTagFloatRecordMsg{fileName: fileName, err: err.Error()}
+			return DATTagFloatRecordMsg{loadGeneration: load, fileName: fileName, err: err.Error()}
 		}
 
 		duration := time.Since(start)
-		return DATTagFloatRecordMsg{fileName: fileName, records: &records, duration: duration, err: ""}
+		msg := DATTagFloatRecordMsg{loadGeneration: load, fileName: fileName, records: &records, duration: duration, err: ""}
+		if !report.Scanned {
+			checked := checkFloatRecords(report, tags, records)
+			msg.report = &checked
+		}
+		return msg
 	}
 }
 
 type UpdateStateToLoadingMsg struct {
+	loadGeneration
 	fileName string
 }
 
-func UpdateStateToLoading(fileName string) tea.Cmd {
-	return func() tea.Msg { return UpdateStateToLoadingMsg{fileName: fileName} }
+func UpdateStateToLoading(m *model, fileName string) tea.Cmd {
+	load := m.load()
+	return func() tea.Msg { return UpdateStateToLoadingMsg{loadGeneration: load, fileName: fileName} }
 }
 
 type HistorianInsertMsg struct {
+	loadGeneration
 	fileName string
 	err      string
 	duration time.Duration
+	// connectionLost is set when the sink failed its health check after
+	// the insert failed, the insert is retried later.
+	connectionLost bool
 }
 
 func InsertHistorianRecords(m *model, fileName string) tea.Cmd {
+	load := m.load()
 	return func() tea.Msg {
 		start := time.Now()
 		errStr := ""
 		records := m.datFileRecords[fileName].FloatRecords
 		pointCache := m.datFileRecords[fileName].PointCache
-		err := LibFTH.ConvertDatFloatRecordsToPutSnapshots(*records, pointCache)
+		err := m.sink.Insert(*records, pointCache)
+		connectionLost := false
 		if err != nil {
 			errStr = err.Error()
+			if checker, ok := m.sink.(HealthChecker); ok {
+				if pingErr := checker.Ping(); pingErr != nil {
+					connectionLost = true
+					errStr = pingErr.Error()
+				}
+			}
 		}
 		duration := time.Since(start)
-		return HistorianInsertMsg{fileName: fileName, err: errStr, duration: duration}
+		return HistorianInsertMsg{loadGeneration: load, fileName: fileName, err: errStr, duration: duration, connectionLost: connectionLost}
 	}
 }